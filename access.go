@@ -0,0 +1,86 @@
+package mirror
+
+import (
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTrackAccessInterval is the track_access interval if none is given
+const defaultTrackAccessInterval = 10 * time.Minute
+
+// accessTracker throttles recording when mirrored files were last requested
+type accessTracker struct {
+	interval time.Duration
+	mu       sync.Mutex
+	// recorded is when access was last recorded for each file
+	recorded map[string]time.Time
+	pruned   time.Time
+}
+
+func newAccessTracker(interval time.Duration) *accessTracker {
+	return &accessTracker{
+		interval: interval,
+		recorded: make(map[string]time.Time),
+		pruned:   time.Now(),
+	}
+}
+
+// due reports whether access to filename at now should be recorded, which is
+// the case at most once per interval
+func (at *accessTracker) due(filename string, now time.Time) bool {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if last, ok := at.recorded[filename]; ok && now.Sub(last) < at.interval {
+		return false
+	}
+	at.recorded[filename] = now
+	if now.Sub(at.pruned) >= at.interval {
+		for name, last := range at.recorded {
+			if now.Sub(last) >= at.interval {
+				delete(at.recorded, name)
+			}
+		}
+		at.pruned = now
+	}
+	return true
+}
+
+// trackAccess records now as the last access time of the mirrored file
+// filename, if it exists and access hasn't been recorded recently
+func (mir *Mirror) trackAccess(filename string, now time.Time, logger *zap.Logger) {
+	if mir.access == nil || !mir.access.due(filename, now) {
+		return
+	}
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		return
+	}
+	value := now.UTC().Format(time.RFC3339)
+	if mir.UseXattr {
+		err = updateImmutable(filename, func() error {
+			return xattr.Set(filename, xattrAccessed, []byte(value))
+		})
+	} else {
+		err = mir.updateMetadata(filename, xattrAccessed, value)
+	}
+	if err != nil {
+		logger.Error("failed to record last access time", zap.Error(err))
+	}
+}
+
+// lastAccess returns when the mirrored file filename was last requested, as
+// recorded by track_access. As filesystem atime is unreliable, it falls back
+// to the time the file was mirrored, and then to its modification time.
+func (mir *Mirror) lastAccess(filename string, stat fs.FileInfo) time.Time {
+	meta := mir.readMetadata(filename)
+	for _, name := range []string{xattrAccessed, xattrDownloaded} {
+		if t, err := time.Parse(time.RFC3339, meta[name]); err == nil {
+			return t
+		}
+	}
+	return stat.ModTime()
+}
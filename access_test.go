@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessTrackerDue(t *testing.T) {
+	at := newAccessTracker(10 * time.Minute)
+	now := time.Now()
+	testCases := []struct {
+		filename string
+		after    time.Duration
+		expected bool
+	}{
+		{filename: "a", after: 0, expected: true},
+		{filename: "a", after: time.Minute, expected: false},
+		{filename: "b", after: time.Minute, expected: true},
+		{filename: "a", after: 10 * time.Minute, expected: true},
+		{filename: "b", after: 10 * time.Minute, expected: false},
+		{filename: "b", after: 30 * time.Minute, expected: true},
+	}
+	for i, test := range testCases {
+		actual := at.due(test.filename, now.Add(test.after))
+		if actual != test.expected {
+			t.Errorf("Test %d (%s after %v) - expected %v, got %v", i, test.filename, test.after, test.expected, actual)
+		}
+	}
+	if len(at.recorded) != 1 {
+		t.Errorf("expected expired entries to be pruned, got %v", at.recorded)
+	}
+}
+
+func TestTrackAccess(t *testing.T) {
+	root := t.TempDir()
+	filename := filepath.Join(root, "file.txt")
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", TrackAccess: caddy.Duration(time.Hour)})
+	stat := func() os.FileInfo {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat
+	}
+
+	// The first request mirrors the file, so there is nothing to record yet
+	respond := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	}
+	if _, err := serveMirror(mir, "/file.txt", respond); err != nil {
+		t.Fatal(err)
+	}
+	if meta := mir.readMetadata(filename); meta[xattrAccessed] != "" {
+		t.Errorf("unexpected access time recorded for new file: %v", meta)
+	}
+	downloaded, _ := time.Parse(time.RFC3339, mir.readMetadata(filename)[xattrDownloaded])
+	if lastAccess := mir.lastAccess(filename, stat()); !lastAccess.Equal(downloaded) {
+		t.Errorf("expected last access to fall back to download time %v, got %v", downloaded, lastAccess)
+	}
+
+	accessed := time.Now().Add(2 * time.Hour)
+	mir.trackAccess(filename, accessed, mir.logger)
+	if lastAccess := mir.lastAccess(filename, stat()); lastAccess.Unix() != accessed.Unix() {
+		t.Errorf("expected last access %v, got %v", accessed, lastAccess)
+	}
+	if meta := mir.readMetadata(filename); meta[xattrDownloaded] == "" {
+		t.Errorf("other metadata lost when recording access: %v", meta)
+	}
+
+	// Throttled
+	mir.trackAccess(filename, accessed.Add(time.Minute), mir.logger)
+	if lastAccess := mir.lastAccess(filename, stat()); lastAccess.Unix() != accessed.Unix() {
+		t.Errorf("expected last access to remain %v, got %v", accessed, lastAccess)
+	}
+}
@@ -0,0 +1,204 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Actions taken for responses by their status code, as configured with
+// status_actions
+const (
+	actionStore       = "store"
+	actionIgnore      = "ignore"
+	actionDeleteLocal = "delete_local"
+	actionTombstone   = "tombstone"
+	actionRefresh     = "refresh"
+)
+
+// TombstoneSuffix is appended to the path of a file to name its tombstone,
+// recording that upstream answered with a status mapped to the tombstone
+// action. Tombstones are removed when the file is mirrored again.
+const TombstoneSuffix = ".tombstone"
+
+// statusKey matches the keys of status_actions, a status code or a class
+// such as 4xx
+var statusKey = regexp.MustCompile(`^[1-5](xx|[0-9]{2})$`)
+
+// tombstone is the content of tombstone files
+type tombstone struct {
+	Status int       `json:"status"`
+	URL    string    `json:"url"`
+	Time   time.Time `json:"time"`
+}
+
+// statusAction returns the action for responses with statusCode: the one
+// configured for the code, else for its class, else storing 200 responses
+// and ignoring others
+func (mir *Mirror) statusAction(statusCode int) string {
+	if action, ok := mir.StatusActions[strconv.Itoa(statusCode)]; ok {
+		return action
+	}
+	if action, ok := mir.StatusActions[fmt.Sprintf("%dxx", statusCode/100)]; ok {
+		return action
+	}
+	if statusCode == http.StatusOK {
+		return actionStore
+	}
+	return actionIgnore
+}
+
+// tombstones reports whether any status is mapped to the tombstone action
+func (mir *Mirror) tombstones() bool {
+	for _, action := range mir.StatusActions {
+		if action == actionTombstone {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStatusActions checks the status_actions config
+func (mir *Mirror) validateStatusActions() error {
+	for key, action := range mir.StatusActions {
+		if !statusKey.MatchString(key) {
+			return fmt.Errorf("invalid status_actions status %q, must be a status code or a class such as 4xx", key)
+		}
+		switch action {
+		case actionStore:
+			if key != "200" && key != "2xx" {
+				return fmt.Errorf("status_actions %s: only 200 responses can be stored", key)
+			}
+		case actionIgnore, actionDeleteLocal, actionTombstone:
+		case actionRefresh:
+			if !mir.UseXattr && mir.MetadataFileSuffix == "" {
+				return fmt.Errorf("status_actions %s: refresh requires xattr or metadata_file_suffix", key)
+			}
+		default:
+			return fmt.Errorf("unknown status_actions action %q for %s", action, key)
+		}
+	}
+	return nil
+}
+
+// applyStatusAction takes the action for a response with statusCode, other
+// than storing it, on the local copy of the file
+func (rww *responseWriterWrapper) applyStatusAction(statusCode int) {
+	action := rww.config.statusAction(statusCode)
+	if action == actionStore || action == actionIgnore || rww.config.isReadOnly() {
+		return
+	}
+	filename := pathInsideRoot(rww.root, rww.path)
+	if err := rww.config.checkContained(rww.root, filename); err != nil {
+		rww.logger.Error("not applying status action outside of the root",
+			zap.String("path", filename),
+			zap.String("action", action),
+			zap.Error(err))
+		return
+	}
+	// The local copy may be suffixed for a path conflict, or staged
+	filename = rww.config.locate(rww.root, filename)
+	var err error
+	switch action {
+	case actionDeleteLocal:
+		err = rww.deleteLocal(filename)
+	case actionTombstone:
+		err = rww.tombstone(filename, statusCode)
+	case actionRefresh:
+		err = rww.refreshMetadata(filename)
+	}
+	if err != nil {
+		rww.logger.Error("failed to apply status action",
+			zap.String("path", filename),
+			zap.Int("status_code", statusCode),
+			zap.String("action", action),
+			zap.Error(err))
+	}
+}
+
+// deleteLocal removes the local copy filename, with its sidecar files
+func (rww *responseWriterWrapper) deleteLocal(filename string) error {
+	stat, err := os.Lstat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+	if err := rww.config.removeEntry(filename); err != nil {
+		return err
+	}
+	rww.logger.Info("deleted local copy",
+		zap.String("path", filename),
+		zap.String("url", rww.url))
+	return nil
+}
+
+// tombstone records that upstream answered with statusCode for filename.
+// New tombstones count toward max_files like mirrored files, so that
+// requests for made up paths can't create them without bound.
+func (rww *responseWriterWrapper) tombstone(filename string, statusCode int) error {
+	var newFile bool
+	if rww.config.MaxFiles > 0 {
+		var ok bool
+		newFile, ok = rww.config.admitFile(rww.root, filename+TombstoneSuffix)
+		if !ok {
+			rww.logger.Debug("skip recording tombstone, max_files reached",
+				zap.String("path", filename))
+			return nil
+		}
+	}
+	data, err := json.Marshal(tombstone{Status: statusCode, URL: rww.url, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	file, err := rww.config.createTempFile(rww.root, filename+TombstoneSuffix)
+	if err != nil {
+		return err
+	}
+	defer file.Cleanup()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := file.CloseAtomicallyReplace(); err != nil {
+		return err
+	}
+	if newFile {
+		rww.config.fileAdded(rww.root)
+	}
+	rww.config.trace(rww.logger, "recorded tombstone", zap.String("path", filename))
+	return nil
+}
+
+// refreshMetadata updates the freshness metadata of the local copy
+// filename from the response header, without replacing its content
+func (rww *responseWriterWrapper) refreshMetadata(filename string) error {
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+	values := make(map[string]string)
+	if expires, ok := freshUntil(rww.Header(), time.Now(), rww.config.HeuristicFreshness); ok {
+		values[xattrExpires] = expires.UTC().Format(time.RFC3339)
+	}
+	if lastModified, err := http.ParseTime(rww.Header().Get("Last-Modified")); err == nil {
+		values[xattrLastModified] = lastModified.UTC().Format(http.TimeFormat)
+	}
+	for name, value := range values {
+		if rww.config.UseXattr {
+			err = updateImmutable(filename, func() error {
+				return xattr.Set(filename, name, []byte(value))
+			})
+		} else {
+			err = rww.config.updateMetadata(filename, name, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	rww.config.trace(rww.logger, "refreshed metadata", zap.String("path", filename))
+	return nil
+}
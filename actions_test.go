@@ -0,0 +1,205 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStatusAction(t *testing.T) {
+	mir := &Mirror{StatusActions: map[string]string{"404": actionTombstone, "4xx": actionDeleteLocal, "200": actionIgnore}}
+	for status, expected := range map[int]string{
+		http.StatusOK:          actionIgnore,
+		http.StatusNotFound:    actionTombstone,
+		http.StatusGone:        actionDeleteLocal,
+		http.StatusNotModified: actionIgnore,
+		http.StatusBadGateway:  actionIgnore,
+	} {
+		if action := mir.statusAction(status); action != expected {
+			t.Errorf("expected %s for %d, got %s", expected, status, action)
+		}
+	}
+	if action := (&Mirror{}).statusAction(http.StatusOK); action != actionStore {
+		t.Errorf("expected 200 responses stored by default, got %s", action)
+	}
+
+	for actions, valid := range map[string]bool{
+		`{"404": "tombstone", "5xx": "ignore"}`: true,
+		`{"200": "store"}`:                      true,
+		`{"404": "store"}`:                      false,
+		`{"4x": "ignore"}`:                      false,
+		`{"404": "remove"}`:                     false,
+		`{"304": "refresh"}`:                    false,
+	} {
+		mir := Mirror{}
+		if err := json.Unmarshal([]byte(actions), &mir.StatusActions); err != nil {
+			t.Fatal(err)
+		}
+		if err := mir.Validate(); (err == nil) != valid {
+			t.Errorf("expected %s valid %v, got error: %v", actions, valid, err)
+		}
+	}
+}
+
+func TestStatusActions(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	testCases := []struct {
+		name   string
+		action string
+		status int
+		header http.Header
+		check  func(t *testing.T, mir *Mirror, filename string)
+	}{
+		{name: "ignore", action: actionIgnore, status: http.StatusOK, check: func(t *testing.T, mir *Mirror, filename string) {
+			if content, err := os.ReadFile(filename); err != nil || string(content) != "old" {
+				t.Errorf("expected local copy untouched, got %q, error: %v", content, err)
+			}
+		}},
+		{name: "delete local", action: actionDeleteLocal, status: http.StatusGone, check: func(t *testing.T, mir *Mirror, filename string) {
+			for _, name := range []string{filename, filename + ".etag"} {
+				if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected %s deleted, stat error: %v", name, err)
+				}
+			}
+		}},
+		{name: "tombstone", action: actionTombstone, status: http.StatusNotFound, check: func(t *testing.T, mir *Mirror, filename string) {
+			data, err := os.ReadFile(filename + TombstoneSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ts tombstone
+			if err := json.Unmarshal(data, &ts); err != nil || ts.Status != http.StatusNotFound || ts.URL != "http://example.com/file.txt" {
+				t.Errorf("unexpected tombstone %s, error: %v", data, err)
+			}
+			// Mirroring the file again removes its tombstone
+			serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("new"))
+				return nil
+			})
+			if _, err := os.Stat(filename + TombstoneSuffix); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected tombstone removed, stat error: %v", err)
+			}
+		}},
+		{name: "refresh", action: actionRefresh, status: http.StatusNotModified, header: http.Header{"Expires": {expires.Format(http.TimeFormat)}}, check: func(t *testing.T, mir *Mirror, filename string) {
+			if content, err := os.ReadFile(filename); err != nil || string(content) != "old" {
+				t.Errorf("expected content untouched, got %q, error: %v", content, err)
+			}
+			if value := mir.readMetadata(filename)[xattrExpires]; value != expires.Format(time.RFC3339) {
+				t.Errorf("expected expires refreshed to %s, got %q", expires.Format(time.RFC3339), value)
+			}
+		}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			filename := filepath.Join(root, "file.txt")
+			for name, content := range map[string]string{filename: "old", filename + ".etag": `"v1"`} {
+				if err := os.WriteFile(name, []byte(content), filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mir := provisionTestMirror(t, &Mirror{
+				Root:               root,
+				EtagFileSuffix:     ".etag",
+				MetadataFileSuffix: ".meta",
+				StatusActions:      map[string]string{strconv.Itoa(test.status): test.action},
+			})
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				for name, values := range test.header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte("body"))
+				return nil
+			})
+			if err != nil || rec.Code != test.status {
+				t.Fatalf("expected response passed through with %d, got %d, error: %v", test.status, rec.Code, err)
+			}
+			test.check(t, mir, filename)
+		})
+	}
+}
+
+func TestStatusActionsPathConflicts(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), mkdirPerms); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(root, "dir"+conflictSuffix)
+	if err := os.WriteFile(filename, []byte("old"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{
+		Root:          root,
+		PathConflicts: pathConflictsSuffix,
+		StatusActions: map[string]string{"410": actionDeleteLocal},
+	})
+	serveMirror(mir, "/dir", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusGone)
+		return nil
+	})
+	if _, err := os.Stat(filename); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the suffixed local copy deleted, stat error: %v", err)
+	}
+	if stat, err := os.Stat(filepath.Join(root, "dir")); err != nil || !stat.IsDir() {
+		t.Errorf("expected the conflicting directory kept, error: %v", err)
+	}
+}
+
+func TestTombstonesMaxFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("old"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{
+		Root:          root,
+		MaxFiles:      3,
+		StatusActions: map[string]string{"404": actionTombstone},
+	})
+	rf := filesIn(root)
+	mir.countFiles(root, rf)
+	rf.counting = true
+	notFound := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	serveMirror(mir, "/missing.txt", notFound)
+	// Recording the same tombstone again doesn't count it twice
+	serveMirror(mir, "/missing.txt", notFound)
+	rf.mu.Lock()
+	count := rf.count
+	// As if eviction were running, with the root at the limit
+	rf.evicting = true
+	rf.count = mir.MaxFiles
+	rf.mu.Unlock()
+	if count != 2 {
+		t.Errorf("expected the tombstone counted as a file, got %d files", count)
+	}
+
+	for i := 0; i < 10; i++ {
+		serveMirror(mir, fmt.Sprintf("/random%d.txt", i), notFound)
+	}
+	matches, _ := filepath.Glob(filepath.Join(root, "*"+TombstoneSuffix))
+	if len(matches) != 1 {
+		t.Errorf("expected no tombstones recorded beyond max_files, got %v", matches)
+	}
+	rf.mu.Lock()
+	rf.evicting = false
+	rf.mu.Unlock()
+
+	// Tombstones are counted, and evicted, like mirrored files
+	rf.counted = false
+	mir.countFiles(root, rf)
+	if rf.count != 2 {
+		t.Errorf("expected the tombstone counted when walking the root, got %d files", rf.count)
+	}
+}
@@ -0,0 +1,246 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+var (
+	handlersMu sync.RWMutex
+	// handlers are the provisioned mirror handlers, for the admin API
+	handlers = make(map[*Mirror]struct{})
+)
+
+func registerHandler(mir *Mirror) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[mir] = struct{}{}
+}
+
+func unregisterHandler(mir *Mirror) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	delete(handlers, mir)
+}
+
+// adminAPI is a module that serves mirror endpoints on the admin API
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.mirror",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the mirror handlers.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/mirror/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/mirror/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/mirror/inflight",
+			Handler: caddy.AdminHandlerFunc(a.handleInflight),
+		},
+		{
+			Pattern: "/mirror/inflight/",
+			Handler: caddy.AdminHandlerFunc(a.handleInflight),
+		},
+		{
+			Pattern: "/mirror/etag-files/convert",
+			Handler: caddy.AdminHandlerFunc(a.handleConvertEtagFiles),
+		},
+		{
+			Pattern: "/mirror/export",
+			Handler: caddy.AdminHandlerFunc(a.handleExport),
+		},
+		{
+			Pattern: "/mirror/metadata/export",
+			Handler: caddy.AdminHandlerFunc(a.handleMetadataExport),
+		},
+		{
+			Pattern: "/mirror/metadata/import",
+			Handler: caddy.AdminHandlerFunc(a.handleMetadataImport),
+		},
+	}
+}
+
+type handlerHealth struct {
+	Name  string       `json:"name"`
+	Roots []rootHealth `json:"roots"`
+	// XattrDegraded are the roots metadata xattrs are no longer set on,
+	// after setting them kept failing
+	XattrDegraded []xattrRoot `json:"xattr_degraded,omitempty"`
+}
+
+// handleHealth reports the health of the roots of all mirror handlers with
+// health checks enabled, and of those with roots degraded to not setting
+// metadata xattrs. The status is 503 if any root is unhealthy, degraded
+// roots are still mirrored to.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	status := http.StatusOK
+	response := []handlerHealth{}
+	handlersMu.RLock()
+	for mir := range handlers {
+		var degraded []xattrRoot
+		if mir.xattrHealth != nil {
+			degraded = mir.xattrHealth.degraded()
+		}
+		if mir.health == nil && len(degraded) == 0 {
+			continue
+		}
+		roots := []rootHealth{}
+		if mir.health != nil {
+			roots = mir.health.status()
+		}
+		for _, root := range roots {
+			if !root.Healthy {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		response = append(response, handlerHealth{Name: mir.Name, Roots: roots, XattrDegraded: degraded})
+	}
+	handlersMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(response)
+}
+
+type handlerHits struct {
+	Name string `json:"name"`
+	// Hits by what let the local copy be served: being fresh, being stale
+	// with stale_while_revalidate, upstream confirming it is still valid,
+	// or upstream failing
+	FreshHits       int64 `json:"fresh_hits"`
+	StaleHits       int64 `json:"stale_hits"`
+	RevalidatedHits int64 `json:"revalidated_hits"`
+	FallbackHits    int64 `json:"fallback_hits"`
+	Misses          int64 `json:"misses"`
+	StaleRefreshes  int64 `json:"stale_refreshes"`
+	// BytesServedLocally and BytesFetched are the bytes of the bodies of
+	// hits and misses
+	BytesServedLocally int64 `json:"bytes_served_locally"`
+	BytesFetched       int64 `json:"bytes_fetched"`
+	// HitRatio is the ratio of hits among the Requests of the last
+	// HitRatioWindow, null without any
+	HitRatio       *float64 `json:"hit_ratio"`
+	Requests       int64    `json:"requests"`
+	HitRatioWindow string   `json:"hit_ratio_window"`
+}
+
+// handleStats reports the hits and misses of the mirror handlers, with their
+// rolling hit ratio. Handlers sharing a name share their stats, and are
+// reported once.
+func (adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	seen := make(map[*stats]bool)
+	response := []handlerHits{}
+	now := time.Now()
+	handlersMu.RLock()
+	for mir := range handlers {
+		s := mir.stats
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		hits := handlerHits{
+			Name:               s.name,
+			FreshHits:          s.readThroughHits.Value(),
+			StaleHits:          s.staleHits.Value(),
+			RevalidatedHits:    s.notModified.Value(),
+			FallbackHits:       s.fallbackHits.Value(),
+			Misses:             s.misses.Value(),
+			StaleRefreshes:     s.staleRefreshes.Value(),
+			BytesServedLocally: s.bytesServedLocally.Value(),
+			BytesFetched:       s.bytesFetched.Value(),
+			HitRatioWindow:     hitRatioWindow.String(),
+		}
+		if ratio, requests, ok := s.hitRatio.ratio(now); ok {
+			hits.HitRatio, hits.Requests = &ratio, requests
+		}
+		response = append(response, hits)
+	}
+	handlersMu.RUnlock()
+	slices.SortFunc(response, func(a, b handlerHits) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+type etagFilesConverted struct {
+	Name      string `json:"name"`
+	Root      string `json:"root"`
+	Converted int    `json:"converted"`
+}
+
+// handleConvertEtagFiles rewrites the ETag sidecar files of the mirror
+// handlers to their configured etag_file_format, or only those of the
+// handler named by the name query parameter. Roots with placeholders are
+// skipped, as the directories they stand for aren't known.
+func (adminAPI) handleConvertEtagFiles(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	name := r.URL.Query().Get("name")
+	handlersMu.RLock()
+	var mirrors []*Mirror
+	for mir := range handlers {
+		if mir.EtagFileSuffix != "" && !hasPlaceholders(mir.Root) && (name == "" || mir.Name == name) {
+			mirrors = append(mirrors, mir)
+		}
+	}
+	handlersMu.RUnlock()
+
+	response := []etagFilesConverted{}
+	for _, mir := range mirrors {
+		converted, err := mir.convertEtagFiles(mir.Root)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("converting ETag files of %s: %v", mir.Root, err),
+			}
+		}
+		response = append(response, etagFilesConverted{Name: mir.Name, Root: mir.Root, Converted: converted})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -2,11 +2,15 @@ package mirror
 
 import (
 	"errors"
+	"fmt"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"github.com/pkg/xattr"
+	"slices"
 	"strconv"
 )
 
@@ -45,11 +49,146 @@ func parseHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 // the static mirror writer and configures it with this syntax:
 //
 //	mirror [<matcher>] [<root>] {
-//	    root              <path>
-//	    etag_file_suffix  <suffix>
-//	    xattr             [<bool>]
-//	    sha256            xattr
+//	    root                 <path>
+//	    strip_prefix         <prefix>
+//	    path_template        <template>
+//	    path_rewrite         <find> <replace>
+//	    lowercase_paths
+//	    encoded_slashes      decode|keep_encoded|reject
+//	    path_conflicts       skip|replace|suffix
+//	    symlinks             refuse|follow|replace
+//	    status_actions {
+//	        <status|class> store|ignore|delete_local|tombstone|refresh
+//	    }
+//	    etag_file_suffix     <suffix>
+//	    etag_file_format     raw|unquoted|strong_only
+//	    metadata_file_suffix <suffix>
+//	    store_response_meta  [<headers...>]
+//	    strip_query_params   <names...>
+//	    no_referrer
+//	    heuristic_freshness
+//	    fallback
+//	    preserve_mtime
+//	    skip_unchanged
+//	    weak_etags
+//	    require_complete
+//	    only_upstream        [<header>]
+//	    xattr                [<bool>]
+//	    max_xattr_size       <size>
+//	    xattr_failures       <count>
+//	    read_only
+//	    skip_startup_check
+//	    skip_parent_check
+//	    strict_errors
+//	    sha256               xattr
+//	    max_hash_size        <size>
+//	    set_xattrs {
+//	        <name> <value>
+//	    }
+//	    dir_mode             <mode>
+//	    file_mode            <mode>
+//	    skip_content_types   <types...>
+//	    mirror_methods       <methods...>
+//	    skip_var             <name>
+//	    force_var            <name>
+//	    soft_not_found {
+//	        <extension> <type>
+//	    }
+//	    max_duration         <duration>
+//	    min_rate             <size> [<grace>]
+//	    min_free_space       <size> [<unknown_size_reservation>]
+//	    direct_io            <min_size>
+//	    verify_writes        [<max_size>]
+//	    write_timeout        <duration>
+//	    write_budget         <duration>
+//	    finalize_timeout     <duration>
+//	    completion_log_level <level>
+//	    log_sampling {
+//	        interval   <duration>
+//	        first      <count>
+//	        thereafter <count>
+//	    }
+//	    trace
+//	    tracing
+//	    no_access_log_fields
+//	    name                 <name>
+//	    metric_labels        name|host|content_type...
+//	    metric_hosts         <hosts...>
+//	    histogram_buckets {
+//	        size              <sizes...>
+//	        write_duration    <durations...>
+//	        finalize_duration <durations...>
+//	    }
+//	    health_check {
+//	        interval <duration>
+//	        failures <count>
+//	    }
+//	    track_access         [<interval>]
+//	    max_files            <count>
+//	    deletion_pacing {
+//	        rate      <files_per_second>
+//	        max_batch <count>
+//	    }
+//	    keep_partials {
+//	        min_size <size>
+//	        ttl      <duration>
+//	    }
+//	    complete_on_disconnect {
+//	        timeout  <duration>
+//	        max_size <size>
+//	    }
+//	    staging {
+//	        dir      <path>
+//	        max_size <size>
+//	        workers  <count>
+//	    }
+//	    replicas             <paths...>
+//	    replica_workers      <count>
+//	    sink                 <module> ...
+//	    sink_workers         <count>
+//	    validator            <module> ...
+//	    validator_timeout    <duration>
+//	    transformer          <module> ...
+//	    precompress          gzip|zstd...
+//	    read_through         always|expires|<ttl> [<paths...>]
+//	    max_age              <duration>
+//	    languages <tags...> {
+//	        default <tag>
+//	    }
+//	    stale_while_revalidate {
+//	        min_age        <duration>
+//	        max_concurrent <count>
+//	    }
+//	    refresh {
+//	        top            <count>
+//	        min_requests   <count>
+//	        interval       <duration>
+//	        ahead          <duration>
+//	        window         <hh:mm-hh:mm>
+//	        max_concurrent <count>
+//	    }
+//	    revalidate
+//	    immutable
+//	    quarantine_dir <path> {
+//	        max_age   <duration>
+//	        max_files <count>
+//	    }
+//	    warc <dir> {
+//	        max_size <size>
+//	        requests
+//	        only
+//	    }
+//	    exec_after <command> [<args...>] {
+//	        dir            <path>
+//	        timeout        <duration>
+//	        max_concurrent <count>
+//	    }
+//	    policy <name> <paths...> {
+//	        <options>
+//	    }
 //	}
+//
+// See Policy for the options a policy overrides.
 func (mir *Mirror) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume directive name
 	if d.CountRemainingArgs() > 0 {
@@ -61,10 +200,122 @@ func (mir *Mirror) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if !d.Args(&mir.Root) {
 				return d.ArgErr()
 			}
+		case "strip_prefix":
+			if !d.Args(&mir.StripPrefix) {
+				return d.ArgErr()
+			}
+		case "path_template":
+			if !d.Args(&mir.PathTemplate) {
+				return d.ArgErr()
+			}
+		case "path_rewrite":
+			pr := new(PathRewrite)
+			if !d.Args(&pr.Find, &pr.Replace) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.PathRewrites = append(mir.PathRewrites, pr)
+		case "lowercase_paths":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.LowercasePaths = true
+		case "encoded_slashes":
+			if !d.Args(&mir.EncodedSlashes) {
+				return d.ArgErr()
+			}
+		case "path_conflicts":
+			if !d.Args(&mir.PathConflicts) {
+				return d.ArgErr()
+			}
+		case "symlinks":
+			if !d.Args(&mir.Symlinks) {
+				return d.ArgErr()
+			}
 		case "etag_file_suffix":
 			if !d.Args(&mir.EtagFileSuffix) {
 				return d.ArgErr()
 			}
+		case "etag_file_format":
+			if !d.Args(&mir.EtagFileFormat) {
+				return d.ArgErr()
+			}
+		case "metadata_file_suffix":
+			if !d.Args(&mir.MetadataFileSuffix) {
+				return d.ArgErr()
+			}
+		case "store_response_meta":
+			mir.StoreResponseMeta = &ResponseMeta{Headers: d.RemainingArgs()}
+		case "strip_query_params":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.StripQueryParams = append(mir.StripQueryParams, args...)
+		case "no_referrer":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.NoReferrer = true
+		case "heuristic_freshness":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.HeuristicFreshness = true
+		case "fallback":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Fallback = true
+		case "preserve_mtime":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.PreserveMtime = true
+		case "skip_unchanged":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.SkipUnchanged = true
+		case "read_only":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.ReadOnly = true
+		case "skip_startup_check":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.SkipStartupCheck = true
+		case "skip_parent_check":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.SkipParentCheck = true
+		case "strict_errors":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.StrictErrors = true
+		case "require_complete":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.RequireComplete = true
+		case "only_upstream":
+			mir.OnlyUpstream = true
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 0:
+			case 1:
+				mir.UpstreamHeader = args[0]
+			default:
+				return d.ArgErr()
+			}
+		case "weak_etags":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.WeakEtags = true
 		case "xattr":
 			args := d.RemainingArgs()
 			switch len(args) {
@@ -93,11 +344,785 @@ func (mir *Mirror) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			default:
 				return d.ArgErr()
 			}
+		case "max_xattr_size":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(val)
+			if err != nil {
+				return d.Errf("parsing max_xattr_size: %v", err)
+			}
+			mir.MaxXattrSize = int(size)
+		case "max_hash_size":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(val)
+			if err != nil {
+				return d.Errf("parsing max_hash_size: %v", err)
+			}
+			mir.MaxHashSize = size
+		case "xattr_failures":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			failures, err := strconv.Atoi(val)
+			if err != nil {
+				return d.Errf("parsing xattr_failures: %v", err)
+			}
+			mir.XattrFailures = failures
+		case "set_xattrs":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			if mir.SetXattrs == nil {
+				mir.SetXattrs = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				name := d.Val()
+				var value string
+				if !d.Args(&value) {
+					return d.ArgErr()
+				}
+				mir.SetXattrs[name] = value
+			}
+		case "status_actions":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			if mir.StatusActions == nil {
+				mir.StatusActions = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				status := d.Val()
+				var action string
+				if !d.Args(&action) || d.CountRemainingArgs() > 0 {
+					return d.ArgErr()
+				}
+				mir.StatusActions[status] = action
+			}
+		case "skip_var":
+			if !d.Args(&mir.SkipVar) {
+				return d.ArgErr()
+			}
+		case "force_var":
+			if !d.Args(&mir.ForceVar) {
+				return d.ArgErr()
+			}
+		case "soft_not_found":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.SoftNotFound = new(SoftNotFound)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				extension := d.Val()
+				var mediaType string
+				if !d.Args(&mediaType) {
+					return d.ArgErr()
+				}
+				if mir.SoftNotFound.Types == nil {
+					mir.SoftNotFound.Types = make(map[string]string)
+				}
+				mir.SoftNotFound.Types[extension] = mediaType
+			}
 		case "hide_temp_files":
 			if d.CountRemainingArgs() > 0 {
 				return d.ArgErr()
 			}
 			mir.HideTempFiles = true
+		case "dir_mode":
+			if !d.Args(&mir.DirMode) {
+				return d.ArgErr()
+			}
+		case "file_mode":
+			if !d.Args(&mir.FileMode) {
+				return d.ArgErr()
+			}
+		case "skip_content_types":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.SkipContentTypes = args
+		case "mirror_methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.MirrorMethods = args
+		case "max_duration":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing max_duration: %v", err)
+			}
+			mir.MaxDuration = caddy.Duration(dur)
+		case "min_rate":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			rate, err := humanize.ParseBytes(args[0])
+			if err != nil {
+				return d.Errf("parsing min_rate: %v", err)
+			}
+			mir.MinRate = rate
+			if len(args) > 1 {
+				dur, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing min_rate grace: %v", err)
+				}
+				mir.MinRateGrace = caddy.Duration(dur)
+			}
+		case "min_free_space":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(args[0])
+			if err != nil {
+				return d.Errf("parsing min_free_space: %v", err)
+			}
+			mir.MinFreeSpace = size
+			if len(args) > 1 {
+				size, err := humanize.ParseBytes(args[1])
+				if err != nil {
+					return d.Errf("parsing min_free_space unknown size reservation: %v", err)
+				}
+				mir.UnknownSizeReservation = size
+			}
+		case "direct_io":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(val)
+			if err != nil {
+				return d.Errf("parsing direct_io: %v", err)
+			}
+			mir.DirectIOMinSize = size
+		case "verify_writes":
+			args := d.RemainingArgs()
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			mir.VerifyWrites = true
+			if len(args) > 0 {
+				size, err := humanize.ParseBytes(args[0])
+				if err != nil {
+					return d.Errf("parsing verify_writes max size: %v", err)
+				}
+				mir.VerifyMaxSize = size
+			}
+		case "write_timeout":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing write_timeout: %v", err)
+			}
+			mir.WriteTimeout = caddy.Duration(dur)
+		case "write_budget":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing write_budget: %v", err)
+			}
+			mir.WriteBudget = caddy.Duration(dur)
+		case "finalize_timeout":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing finalize_timeout: %v", err)
+			}
+			mir.FinalizeTimeout = caddy.Duration(dur)
+		case "completion_log_level":
+			if !d.Args(&mir.CompletionLogLevel) {
+				return d.ArgErr()
+			}
+		case "log_sampling":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.LogSampling = new(caddy.LogSampling)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "interval":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing log_sampling interval: %v", err)
+					}
+					mir.LogSampling.Interval = dur
+				case "first", "thereafter":
+					count, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing log_sampling %s: %v", subdirective, err)
+					}
+					if subdirective == "first" {
+						mir.LogSampling.First = count
+					} else {
+						mir.LogSampling.Thereafter = count
+					}
+				default:
+					return d.Errf("unknown log_sampling subdirective '%s'", subdirective)
+				}
+			}
+		case "trace":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Trace = true
+		case "tracing":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Tracing = true
+		case "no_access_log_fields":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.NoAccessLogFields = true
+		case "name":
+			if !d.Args(&mir.Name) {
+				return d.ArgErr()
+			}
+		case "metric_labels":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.MetricLabels = args
+		case "metric_hosts":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.MetricHosts = args
+		case "histogram_buckets":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.HistogramBuckets = new(HistogramBuckets)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "size":
+					for _, arg := range args {
+						size, err := humanize.ParseBytes(arg)
+						if err != nil {
+							return d.Errf("parsing histogram_buckets size: %v", err)
+						}
+						mir.HistogramBuckets.Size = append(mir.HistogramBuckets.Size, int64(size))
+					}
+				case "write_duration", "finalize_duration":
+					var durations []caddy.Duration
+					for _, arg := range args {
+						dur, err := caddy.ParseDuration(arg)
+						if err != nil {
+							return d.Errf("parsing histogram_buckets %s: %v", subdirective, err)
+						}
+						durations = append(durations, caddy.Duration(dur))
+					}
+					if subdirective == "write_duration" {
+						mir.HistogramBuckets.WriteDuration = durations
+					} else {
+						mir.HistogramBuckets.FinalizeDuration = durations
+					}
+				default:
+					return d.Errf("unknown histogram_buckets subdirective '%s'", subdirective)
+				}
+			}
+		case "health_check":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.HealthCheck = new(HealthCheck)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "interval":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing health_check interval: %v", err)
+					}
+					mir.HealthCheck.Interval = caddy.Duration(dur)
+				case "failures":
+					count, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing health_check failures: %v", err)
+					}
+					mir.HealthCheck.Failures = count
+				default:
+					return d.Errf("unknown health_check subdirective '%s'", subdirective)
+				}
+			}
+		case "track_access":
+			mir.TrackAccess = caddy.Duration(defaultTrackAccessInterval)
+			var val string
+			if d.Args(&val) {
+				dur, err := caddy.ParseDuration(val)
+				if err != nil {
+					return d.Errf("parsing track_access interval: %v", err)
+				}
+				mir.TrackAccess = caddy.Duration(dur)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+		case "max_files":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			count, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return d.Errf("parsing max_files: %v", err)
+			}
+			mir.MaxFiles = count
+		case "deletion_pacing":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.DeletionPacing = new(DeletionPacing)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "rate":
+					rate, err := strconv.ParseFloat(val, 64)
+					if err != nil {
+						return d.Errf("parsing deletion_pacing rate: %v", err)
+					}
+					mir.DeletionPacing.Rate = rate
+				case "max_batch":
+					count, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing deletion_pacing max_batch: %v", err)
+					}
+					mir.DeletionPacing.MaxBatch = count
+				default:
+					return d.Errf("unknown deletion_pacing subdirective '%s'", subdirective)
+				}
+			}
+		case "keep_partials":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.KeepPartials = new(KeepPartials)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "min_size":
+					size, err := humanize.ParseBytes(val)
+					if err != nil {
+						return d.Errf("parsing keep_partials min_size: %v", err)
+					}
+					mir.KeepPartials.MinSize = int64(size)
+				case "ttl":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing keep_partials ttl: %v", err)
+					}
+					mir.KeepPartials.TTL = caddy.Duration(dur)
+				default:
+					return d.Errf("unknown keep_partials subdirective '%s'", subdirective)
+				}
+			}
+		case "complete_on_disconnect":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.CompleteOnDisconnect = new(CompleteOnDisconnect)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "timeout":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing complete_on_disconnect timeout: %v", err)
+					}
+					mir.CompleteOnDisconnect.Timeout = caddy.Duration(dur)
+				case "max_size":
+					size, err := humanize.ParseBytes(val)
+					if err != nil {
+						return d.Errf("parsing complete_on_disconnect max_size: %v", err)
+					}
+					mir.CompleteOnDisconnect.MaxSize = int64(size)
+				default:
+					return d.Errf("unknown complete_on_disconnect subdirective '%s'", subdirective)
+				}
+			}
+		case "staging":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Staging = new(Staging)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "dir":
+					mir.Staging.Dir = val
+				case "max_size":
+					size, err := humanize.ParseBytes(val)
+					if err != nil {
+						return d.Errf("parsing staging max_size: %v", err)
+					}
+					mir.Staging.MaxSize = int64(size)
+				case "workers":
+					workers, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing staging workers: %v", err)
+					}
+					mir.Staging.Workers = workers
+				default:
+					return d.Errf("unknown staging subdirective '%s'", subdirective)
+				}
+			}
+		case "precompress":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.Precompress = args
+		case "replicas":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.Replicas = args
+		case "replica_workers":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			workers, err := strconv.Atoi(val)
+			if err != nil {
+				return d.Errf("parsing replica_workers: %v", err)
+			}
+			mir.ReplicaWorkers = workers
+		case "sink":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.mirror.sinks."+name)
+			if err != nil {
+				return err
+			}
+			sink, ok := unm.(Sink)
+			if !ok {
+				return d.Errf("module %s is not a mirror sink", name)
+			}
+			mir.SinksRaw = append(mir.SinksRaw, caddyconfig.JSONModuleObject(sink, "sink", name, nil))
+		case "validator":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.mirror.validators."+name)
+			if err != nil {
+				return err
+			}
+			validator, ok := unm.(Validator)
+			if !ok {
+				return d.Errf("module %s is not a mirror validator", name)
+			}
+			mir.ValidatorsRaw = append(mir.ValidatorsRaw, caddyconfig.JSONModuleObject(validator, "validator", name, nil))
+		case "transformer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.mirror.transformers."+name)
+			if err != nil {
+				return err
+			}
+			transformer, ok := unm.(Transformer)
+			if !ok {
+				return d.Errf("module %s is not a mirror transformer", name)
+			}
+			mir.TransformersRaw = append(mir.TransformersRaw, caddyconfig.JSONModuleObject(transformer, "transformer", name, nil))
+		case "validator_timeout":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing validator_timeout: %v", err)
+			}
+			mir.ValidatorTimeout = caddy.Duration(dur)
+		case "sink_workers":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			workers, err := strconv.Atoi(val)
+			if err != nil {
+				return d.Errf("parsing sink_workers: %v", err)
+			}
+			mir.SinkWorkers = workers
+		case "read_through":
+			policy, err := parseReadThrough(d)
+			if err != nil {
+				return err
+			}
+			mir.ReadThrough = append(mir.ReadThrough, policy)
+		case "max_age":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing max_age: %v", err)
+			}
+			mir.MaxAge = caddy.Duration(dur)
+		case "languages":
+			mir.Languages = &Languages{Tags: d.RemainingArgs()}
+			if len(mir.Languages.Tags) == 0 {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "default":
+					mir.Languages.Default = val
+				default:
+					return d.Errf("unknown languages subdirective '%s'", subdirective)
+				}
+			}
+		case "stale_while_revalidate":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.StaleWhileRevalidate = new(StaleWhileRevalidate)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "min_age":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing stale_while_revalidate min_age: %v", err)
+					}
+					mir.StaleWhileRevalidate.MinAge = caddy.Duration(dur)
+				case "max_concurrent":
+					n, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing stale_while_revalidate max_concurrent: %v", err)
+					}
+					mir.StaleWhileRevalidate.MaxConcurrent = n
+				default:
+					return d.Errf("unknown stale_while_revalidate subdirective '%s'", subdirective)
+				}
+			}
+		case "refresh":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Refresh = new(Refresh)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "top":
+					n, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing refresh top: %v", err)
+					}
+					mir.Refresh.Top = n
+				case "min_requests":
+					n, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing refresh min_requests: %v", err)
+					}
+					mir.Refresh.MinRequests = n
+				case "interval":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing refresh interval: %v", err)
+					}
+					mir.Refresh.Interval = caddy.Duration(dur)
+				case "ahead":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing refresh ahead: %v", err)
+					}
+					mir.Refresh.Ahead = caddy.Duration(dur)
+				case "window":
+					if _, err := parseWindow(val); err != nil {
+						return d.Errf("parsing refresh window: %v", err)
+					}
+					mir.Refresh.Window = val
+				case "max_concurrent":
+					n, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing refresh max_concurrent: %v", err)
+					}
+					mir.Refresh.MaxConcurrent = n
+				default:
+					return d.Errf("unknown refresh subdirective '%s'", subdirective)
+				}
+			}
+		case "revalidate":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Revalidate = true
+		case "immutable":
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			mir.Immutable = true
+		case "policy":
+			policy := new(Policy)
+			if err := policy.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			mir.Policies = append(mir.Policies, policy)
+		case "warc":
+			mir.Warc = new(Warc)
+			if !d.Args(&mir.Warc.Dir) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch subdirective := d.Val(); subdirective {
+				case "max_size":
+					var val string
+					if !d.Args(&val) {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(val)
+					if err != nil {
+						return d.Errf("parsing warc max_size: %v", err)
+					}
+					mir.Warc.MaxSize = size
+				case "requests":
+					if d.CountRemainingArgs() > 0 {
+						return d.ArgErr()
+					}
+					mir.Warc.Requests = true
+				case "only":
+					if d.CountRemainingArgs() > 0 {
+						return d.ArgErr()
+					}
+					mir.Warc.Only = true
+				default:
+					return d.Errf("unknown warc subdirective '%s'", subdirective)
+				}
+			}
+		case "quarantine_dir":
+			mir.Quarantine = new(Quarantine)
+			if !d.Args(&mir.Quarantine.Dir) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "max_age":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing quarantine_dir max_age: %v", err)
+					}
+					mir.Quarantine.MaxAge = caddy.Duration(dur)
+				case "max_files":
+					count, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing quarantine_dir max_files: %v", err)
+					}
+					mir.Quarantine.MaxFiles = count
+				default:
+					return d.Errf("unknown quarantine_dir subdirective '%s'", subdirective)
+				}
+			}
+		case "exec_after":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			mir.ExecAfter = &ExecAfter{Command: args[0], Args: args[1:]}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				subdirective := d.Val()
+				var val string
+				if !d.Args(&val) {
+					return d.ArgErr()
+				}
+				switch subdirective {
+				case "dir":
+					mir.ExecAfter.Dir = val
+				case "timeout":
+					dur, err := caddy.ParseDuration(val)
+					if err != nil {
+						return d.Errf("parsing exec_after timeout: %v", err)
+					}
+					mir.ExecAfter.Timeout = caddy.Duration(dur)
+				case "max_concurrent":
+					count, err := strconv.Atoi(val)
+					if err != nil {
+						return d.Errf("parsing exec_after max_concurrent: %v", err)
+					}
+					mir.ExecAfter.MaxConcurrent = count
+				default:
+					return d.Errf("unknown exec_after subdirective '%s'", subdirective)
+				}
+			}
 		default:
 			return d.Errf("unknown subdirective '%s'", d.Val())
 		}
@@ -105,6 +1130,27 @@ func (mir *Mirror) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// parseReadThrough parses the arguments of read_through
+func parseReadThrough(d *caddyfile.Dispenser) (*ReadThrough, error) {
+	var freshness string
+	if !d.Args(&freshness) {
+		return nil, d.ArgErr()
+	}
+	policy := &ReadThrough{Paths: d.RemainingArgs()}
+	switch freshness {
+	case "always":
+		policy.Always = true
+	case "expires":
+	default:
+		dur, err := caddy.ParseDuration(freshness)
+		if err != nil {
+			return nil, d.Errf("parsing read_through ttl: %v", err)
+		}
+		policy.TTL = caddy.Duration(dur)
+	}
+	return policy, nil
+}
+
 // Validate validates that the module has a usable config.
 func (mir Mirror) Validate() error {
 	if mir.Sha256Xattr && !mir.UseXattr {
@@ -113,6 +1159,84 @@ func (mir Mirror) Validate() error {
 	if mir.UseXattr && !xattr.XATTR_SUPPORTED {
 		return errors.New("missing platform xattr support")
 	}
+	if mir.TrackAccess > 0 && !mir.UseXattr && mir.MetadataFileSuffix == "" {
+		return errors.New("track_access requires xattr or metadata_file_suffix")
+	}
+	if len(mir.SetXattrs) > 0 && !xattr.XATTR_SUPPORTED {
+		return errors.New("missing platform xattr support")
+	}
+	for name := range mir.SetXattrs {
+		if !validXattrName(name) {
+			return fmt.Errorf("xattr name %q must start with a namespace prefix such as user.", name)
+		}
+	}
+	if mir.Immutable && mir.TrackAccess > 0 && mir.UseXattr {
+		return errors.New("immutable files can't have their access time recorded in xattrs")
+	}
+	if mir.MaxAge < 0 {
+		return errors.New("max_age can't be negative")
+	}
+	for _, method := range mir.MirrorMethods {
+		if !slices.Contains(uploadMethods, method) {
+			return fmt.Errorf("mirror_methods can only include PUT and POST, not %q", method)
+		}
+	}
+	switch mir.EncodedSlashes {
+	case "", encodedSlashesDecode, encodedSlashesKeep, encodedSlashesReject:
+	default:
+		return fmt.Errorf("unknown encoded_slashes policy %q", mir.EncodedSlashes)
+	}
+	switch mir.PathConflicts {
+	case "", pathConflictsSkip, pathConflictsReplace, pathConflictsSuffix:
+	default:
+		return fmt.Errorf("unknown path_conflicts policy %q", mir.PathConflicts)
+	}
+	switch mir.Symlinks {
+	case "", symlinksRefuse, symlinksFollow, symlinksReplace:
+	default:
+		return fmt.Errorf("unknown symlinks policy %q", mir.Symlinks)
+	}
+	if err := mir.validateStatusActions(); err != nil {
+		return err
+	}
+	switch mir.EtagFileFormat {
+	case "", etagFormatRaw, etagFormatUnquoted, etagFormatStrongOnly:
+	default:
+		return fmt.Errorf("unknown etag_file_format %q", mir.EtagFileFormat)
+	}
+	for _, encoding := range mir.Precompress {
+		if _, ok := precompressSuffixes[encoding]; !ok {
+			return fmt.Errorf("unknown precompress encoding %q", encoding)
+		}
+	}
+	if mir.HistogramBuckets != nil {
+		if err := mir.HistogramBuckets.validate(); err != nil {
+			return err
+		}
+	}
+	if mir.Quarantine != nil && mir.Quarantine.Dir == "" {
+		return errors.New("quarantine requires a dir")
+	}
+	if mir.Warc != nil && mir.Warc.Dir == "" {
+		return errors.New("warc requires a dir")
+	}
+	if len(mir.TransformersRaw) > 0 && mir.Warc != nil {
+		return errors.New("transformers can't be used with warc, which archives responses as received")
+	}
+	if len(mir.TransformersRaw) > 0 && mir.KeepPartials != nil {
+		return errors.New("transformers can't be used with keep_partials, as transformed partial files can't be resumed")
+	}
+	if mir.Languages != nil {
+		if err := mir.Languages.validate(); err != nil {
+			return err
+		}
+	}
+	if mir.ExecAfter != nil && mir.ExecAfter.Command == "" {
+		return errors.New("exec_after requires a command")
+	}
+	if mir.Staging != nil && mir.Staging.Dir == "" {
+		return errors.New("staging requires a dir")
+	}
 	return nil
 }
 
@@ -1,7 +1,10 @@
 package mirror
 
 import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"testing"
+	"time"
 )
 
 func TestValidate(t *testing.T) {
@@ -14,3 +17,44 @@ func TestValidate(t *testing.T) {
 		t.Errorf("Expected error for UseXattr=%v, Sha256Xattr=%v", mir.UseXattr, mir.Sha256Xattr)
 	}
 }
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		etag_file_suffix .etag
+		log_sampling {
+			interval 2s
+			first 10
+			thereafter 50
+		}
+		set_xattrs {
+			user.project demo
+		}
+		trace
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	expected := caddy.LogSampling{Interval: 2 * time.Second, First: 10, Thereafter: 50}
+	if mir.LogSampling == nil || *mir.LogSampling != expected {
+		t.Errorf("expected log_sampling %+v, got %+v", expected, mir.LogSampling)
+	}
+	if mir.EtagFileSuffix != ".etag" || !mir.Trace || mir.SetXattrs["user.project"] != "demo" {
+		t.Errorf("unexpected config %+v", mir)
+	}
+}
+
+func TestValidateSetXattrs(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"user.project":     true,
+		"security.selinux": true,
+		"project":          false,
+		"user.":            false,
+		"other.project":    false,
+	} {
+		mir := Mirror{SetXattrs: map[string]string{name: "value"}}
+		if err := mir.Validate(); (err == nil) != valid {
+			t.Errorf("expected %q valid %v, got error: %v", name, valid, err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package mirror
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// cloneFile makes dst a reflink of src with the FICLONE ioctl, sharing its
+// extents instead of copying them, as supported by e.g. btrfs and XFS
+func cloneFile(dst *os.File, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
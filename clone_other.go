@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mirror
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not supported, files are always copied
+func cloneFile(dst *os.File, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/pkg/xattr"
+	"github.com/spf13/cobra"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "mirror",
+		Usage: "<command>",
+		Short: "Maintains mirror roots offline",
+		Long: `
+Maintains the files of a mirror root directly, without a running server.
+
+The sidecar files that belong to mirrored files are those of the
+--etag-suffix, --metadata-suffix, --response-meta, --tombstones and
+--precompress flags, which should match the handler's configuration.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(purgeCommand())
+			cmd.AddCommand(verifyCommand())
+			cmd.AddCommand(hashCommand())
+		},
+	})
+}
+
+// layoutFlags adds the flags describing the layout of a mirror root to cmd
+func layoutFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("root", "r", "", "The mirror root")
+	cmd.Flags().String("etag-suffix", "", "The etag_file_suffix of the handler")
+	cmd.Flags().String("metadata-suffix", "", "The metadata_file_suffix of the handler")
+	cmd.Flags().Bool("response-meta", false, "Whether the handler has store_response_meta")
+	cmd.Flags().Bool("tombstones", false, "Whether the handler writes tombstones with status_actions")
+	cmd.Flags().StringSlice("precompress", nil, "The precompress encodings of the handler")
+	cmd.Flags().Bool("force", false, "Operate on the root even if it doesn't look like a mirror root")
+}
+
+// mirrorFromFlags returns a handler with the layout of the mirror root given
+// by the flags, for the commands to use the handler's own helpers. Unless
+// forced, roots that don't look like mirror roots are refused.
+func mirrorFromFlags(flags caddycmd.Flags) (*Mirror, error) {
+	root := flags.String("root")
+	if root == "" {
+		return nil, errors.New("--root is required")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	mir := &Mirror{
+		Root:               root,
+		EtagFileSuffix:     flags.String("etag-suffix"),
+		MetadataFileSuffix: flags.String("metadata-suffix"),
+	}
+	if flags.Bool("response-meta") {
+		mir.StoreResponseMeta = new(ResponseMeta)
+	}
+	if flags.Bool("tombstones") {
+		mir.StatusActions = map[string]string{"4xx": actionTombstone}
+	}
+	mir.Precompress, _ = flags.GetStringSlice("precompress")
+	for _, encoding := range mir.Precompress {
+		if _, ok := precompressSuffixes[encoding]; !ok {
+			return nil, fmt.Errorf("unknown precompress encoding %q", encoding)
+		}
+	}
+	if flags.Bool("force") {
+		return mir, nil
+	}
+	if filepath.Dir(root) == root {
+		return nil, fmt.Errorf("refusing to operate on %s, use --force to do so anyway", root)
+	}
+	if !mir.looksLikeMirror(root) {
+		return nil, fmt.Errorf("no mirrored files with metadata or sidecar files found in %s, use --force to operate on it anyway", root)
+	}
+	return mir, nil
+}
+
+// maxLayoutProbes is the number of files looked at to tell whether a root
+// is a mirror root
+const maxLayoutProbes = 10000
+
+// looksLikeMirror reports whether root has files that were mirrored: files
+// with mirror xattrs or sidecar files, among the first it has
+func (mir *Mirror) looksLikeMirror(root string) bool {
+	found, probes := false, 0
+	filepath.WalkDir(root, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !mir.isEntry(filename) {
+			return nil
+		}
+		if probes++; probes > maxLayoutProbes {
+			return fs.SkipAll
+		}
+		if _, err := xattr.Get(filename, xattrDownloaded); err == nil {
+			found = true
+			return fs.SkipAll
+		}
+		for _, suffix := range mir.sidecarSuffixes(filename) {
+			if _, err := os.Stat(filename + suffix); err == nil {
+				found = true
+				return fs.SkipAll
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+// prefixFlag returns the URL path prefix of the --prefix flag
+func prefixFlag(flags caddycmd.Flags) string {
+	prefix := flags.String("prefix")
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// prefixDir returns the directory of root the files under the URL path
+// prefix are in, the only one that needs to be walked for them
+func prefixDir(root string, prefix string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Dir(prefix+"_")))
+}
+
+// relativeURLPath returns the URL path of the file filename in root
+func relativeURLPath(root string, filename string) (string, error) {
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return "", err
+	}
+	return "/" + filepath.ToSlash(rel), nil
+}
+
+// matchPath reports whether the URL path urlp of a mirrored file is under
+// prefix and matches the glob pattern, if any. Patterns without a slash are
+// matched against the file name only.
+func matchPath(urlp string, prefix string, pattern string) bool {
+	if !strings.HasPrefix(urlp, prefix) {
+		return false
+	}
+	if pattern == "" {
+		return true
+	}
+	name := urlp
+	if !strings.Contains(pattern, "/") {
+		name = urlp[strings.LastIndex(urlp, "/")+1:]
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Policies for path conflicts, where a file is to be mirrored to a path
+// that is a directory, or below a path that is a file
+const (
+	pathConflictsSkip    = "skip"
+	pathConflictsReplace = "replace"
+	pathConflictsSuffix  = "suffix"
+
+	// conflictSuffix is appended to the names of files kept next to a
+	// directory of the same name with the suffix policy
+	conflictSuffix = ".file"
+)
+
+// pathConflict is the way to make for a mirror file under the
+// path_conflicts policy, once it is complete: the file in place of one of
+// its parent directories, or the empty directory in its place
+type pathConflict struct {
+	parent string
+	dir    string
+}
+
+// resolveConflicts returns where to mirror filename within root under the
+// path_conflicts policy, and the way to make for it, if any, or false if it
+// can't be mirrored. Nothing is changed until the way is made.
+func (mir *Mirror) resolveConflicts(root string, filename string, logger *zap.Logger) (string, *pathConflict, bool) {
+	var conflict *pathConflict
+	if parent, ok := fileParent(root, filename); ok {
+		switch mir.PathConflicts {
+		case pathConflictsReplace, pathConflictsSuffix:
+			conflict = &pathConflict{parent: parent}
+		default:
+			logger.Debug("skip mirroring below a file",
+				zap.String("file", parent))
+			return "", nil, false
+		}
+	}
+	stat, err := os.Lstat(filename)
+	if err != nil || !stat.IsDir() {
+		return filename, conflict, true
+	}
+	switch mir.PathConflicts {
+	case pathConflictsReplace:
+		// Only an empty directory is replaced, as what is in it may still
+		// be of use
+		if !emptyDir(filename) {
+			logger.Debug("skip mirroring in place of a directory that is not empty",
+				zap.String("path", filename))
+			return "", nil, false
+		}
+		return filename, &pathConflict{dir: filename}, true
+	case pathConflictsSuffix:
+		return filename + conflictSuffix, nil, true
+	default:
+		logger.Debug("skip mirroring in place of a directory",
+			zap.String("path", filename))
+		return "", nil, false
+	}
+}
+
+// makeWay makes the way for the mirror file filename within root decided
+// by resolveConflicts, and creates its directory. A file in place of a
+// parent directory that has become one meanwhile is left as is.
+func (mir *Mirror) makeWay(root string, filename string, conflict *pathConflict, logger *zap.Logger) error {
+	if conflict.dir != "" {
+		if err := os.Remove(conflict.dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else if stat, err := os.Lstat(conflict.parent); err == nil && !stat.IsDir() {
+		if mir.PathConflicts == pathConflictsReplace {
+			err = mir.removeEntry(conflict.parent)
+		} else {
+			err = mir.moveEntry(conflict.parent, conflict.parent+conflictSuffix)
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info("made way for a directory in place of a file",
+			zap.String("file", conflict.parent),
+			zap.String("path_conflicts", mir.PathConflicts))
+	}
+	return mir.mkdirAll(root, filepath.Dir(filename))
+}
+
+// emptyDir reports whether the directory name is empty
+func emptyDir(name string) bool {
+	dir, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	return err == io.EOF
+}
+
+// fileParent returns the parent of filename within root that is a file
+// rather than a directory, if there is one
+func fileParent(root string, filename string) (string, bool) {
+	for dir := filepath.Dir(filename); ; dir = filepath.Dir(dir) {
+		if !withinRoot(root, dir) {
+			return "", false
+		}
+		stat, err := os.Stat(dir)
+		if err == nil {
+			return dir, !stat.IsDir()
+		}
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", false
+		}
+	}
+}
+
+// moveEntry renames the mirrored file filename to target along with its
+// sidecar files. Its precompressed variants are removed.
+func (mir *Mirror) moveEntry(filename string, target string) error {
+	if err := mir.clearImmutable(filename); err != nil {
+		return err
+	}
+	for _, suffix := range mir.sidecarSuffixes(filename) {
+		if err := os.Rename(filename+suffix, target+suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := mir.removeVariants(filename); err != nil {
+		return err
+	}
+	return os.Rename(filename, target)
+}
+
+// conflictFilename returns where the local copy of filename is under the
+// suffix policy, which is next to the directory if filename is one
+func conflictFilename(filename string) string {
+	if stat, err := os.Lstat(filename); err == nil && stat.IsDir() {
+		return filename + conflictSuffix
+	}
+	return filename
+}
@@ -0,0 +1,132 @@
+package mirror
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathConflicts(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+		// in the way of the file mirrored to a/b/c: a directory at a/b/c,
+		// with a file in it if full, or a file at a/b
+		dir      bool
+		full     bool
+		mirrored string
+		// expected are the contents of files afterwards, "" for
+		// directories, nil if they shouldn't exist
+		expected map[string]*string
+	}{
+		{name: "skip directory", dir: true, expected: map[string]*string{"a/b/c": ptr("")}},
+		{name: "replace directory", policy: pathConflictsReplace, dir: true, mirrored: "a/b/c"},
+		{name: "replace full directory", policy: pathConflictsReplace, dir: true, full: true, expected: map[string]*string{"a/b/c/d": ptr("other")}},
+		{name: "suffix directory", policy: pathConflictsSuffix, dir: true, mirrored: "a/b/c.file", expected: map[string]*string{"a/b/c": ptr("")}},
+		{name: "skip file", expected: map[string]*string{"a/b": ptr("old"), "a/b.etag": ptr(`"old"`)}},
+		{name: "replace file", policy: pathConflictsReplace, mirrored: "a/b/c", expected: map[string]*string{"a/b.etag": nil, "a/b.file": nil}},
+		{name: "suffix file", policy: pathConflictsSuffix, mirrored: "a/b/c", expected: map[string]*string{"a/b.file": ptr("old"), "a/b.file.etag": ptr(`"old"`), "a/b.etag": nil}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			setup := map[string]string{"a/b": "old", "a/b.etag": `"old"`}
+			if test.dir {
+				setup = map[string]string{"a/b/c/": ""}
+				if test.full {
+					setup = map[string]string{"a/b/c/d": "other"}
+				}
+			}
+			for name, content := range setup {
+				// Names ending in a slash are directories
+				filename := filepath.Join(root, filepath.FromSlash(name))
+				if strings.HasSuffix(name, "/") {
+					if err := os.MkdirAll(filename, mkdirPerms); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, []byte(content), filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", PathConflicts: test.policy})
+			rec, err := serveMirror(mir, "/a/b/c", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil || rec.Code != http.StatusOK || rec.Body.String() != "content" {
+				t.Fatalf("expected response passed through, got %d %q, error: %v", rec.Code, rec.Body.String(), err)
+			}
+			if test.mirrored != "" {
+				content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(test.mirrored)))
+				if err != nil || string(content) != "content" {
+					t.Errorf("expected response mirrored to %s, got %q, error: %v", test.mirrored, content, err)
+				}
+			} else if stat, err := os.Stat(filepath.Join(root, "a", "b", "c")); err == nil && !stat.IsDir() {
+				t.Error("expected response not mirrored")
+			}
+			for name, expected := range test.expected {
+				filename := filepath.Join(root, filepath.FromSlash(name))
+				stat, err := os.Stat(filename)
+				switch {
+				case expected == nil:
+					if !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("expected %s removed, stat error: %v", name, err)
+					}
+				case *expected == "":
+					if err != nil || !stat.IsDir() {
+						t.Errorf("expected directory %s, stat error: %v", name, err)
+					}
+				default:
+					if content, err := os.ReadFile(filename); err != nil || string(content) != *expected {
+						t.Errorf("expected %s with %q, got %q, error: %v", name, *expected, content, err)
+					}
+				}
+			}
+			if test.policy == pathConflictsSuffix && test.dir {
+				if located := mir.locate(root, filepath.Join(root, "a", "b", "c")); located != filepath.Join(root, "a", "b", "c.file") {
+					t.Errorf("expected local copy located next to the directory, got %s", located)
+				}
+			}
+		})
+	}
+}
+
+func TestPathConflictsIncomplete(t *testing.T) {
+	root := t.TempDir()
+	parent := filepath.Join(root, "a")
+	if err := os.WriteFile(parent, []byte("old"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, PathConflicts: pathConflictsReplace})
+	_, err := serveMirror(mir, "/a/b", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The way is only made for complete files
+	if content, err := os.ReadFile(parent); err != nil || string(content) != "old" {
+		t.Errorf("expected file in the way kept, got %q, error: %v", content, err)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("expected only the file in the way left in the root, got %v", entries)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
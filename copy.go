@@ -0,0 +1,84 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/google/renameio/v2"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// moveFile moves src to dst within root, which may be on another
+// filesystem. The content, mtime and xattrs of src are preserved, and dst
+// is replaced atomically.
+func (mir *Mirror) moveFile(root string, src string, dst string) error {
+	if err := mir.mkdirAll(root, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := mir.copyFile(root, src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// replacePending completes the pending file pf by renaming it to dst
+// within root. Should they turn out to be on different filesystems, pf is
+// copied to dst instead, and removed with pf's cleanup.
+func (mir *Mirror) replacePending(root string, pf *renameio.PendingFile, dst string) error {
+	err := pf.CloseAtomicallyReplace()
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	mir.logger.Warn("pending file on another filesystem than its destination, copying it",
+		zap.String("pending", pf.Name()),
+		zap.String("path", dst))
+	return mir.copyFile(root, pf.Name(), dst)
+}
+
+// copyFile copies src to dst within root, preserving its mtime and xattrs.
+// Where the filesystem supports it, dst is a reflink sharing the extents of
+// src rather than a full copy.
+func (mir *Mirror) copyFile(root string, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := mir.createTempFile(root, dst)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	if err := cloneFile(out.File, in); err == nil {
+		mir.stats.reflinkBytesSaved.Add(stat.Size())
+	} else if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if names, err := xattr.FList(in); err == nil {
+		for _, name := range names {
+			value, err := xattr.FGet(in, name)
+			if err != nil {
+				return err
+			}
+			err = xattr.FSet(out.File, name, value)
+			if err != nil && !errors.Is(err, syscall.ENOTSUP) {
+				return err
+			}
+		}
+	}
+	if err := os.Chtimes(out.Name(), stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+	return out.CloseAtomicallyReplace()
+}
@@ -0,0 +1,35 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("content"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	mir := &Mirror{stats: new(stats)}
+	if err := mir.copyFile(dir, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v", mtime, stat.ModTime())
+	}
+	if content, err := os.ReadFile(dst); err != nil || string(content) != "content" {
+		t.Errorf("unexpected copy %q, error: %v", content, err)
+	}
+}
@@ -0,0 +1,14 @@
+package mirror
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// deviceID returns the ID of the device of the filesystem filename is on
+func deviceID(filename string) (uint64, bool) {
+	var stat unix.Stat_t
+	if err := unix.Stat(filename, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package mirror
+
+// deviceID is not implemented on other platforms, where moves across
+// filesystems are only detected when renaming fails
+func deviceID(filename string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// directAlign is the alignment of buffers, lengths and offsets of
+	// O_DIRECT writes, which covers the logical block size of common
+	// devices
+	directAlign = 4096
+
+	// directBufferSize is the size of the buffers in which data is
+	// accumulated before being written with O_DIRECT
+	directBufferSize = 1 << 20
+)
+
+var directBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, directBufferSize+directAlign)
+		offset := 0
+		if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlign); rem != 0 {
+			offset = directAlign - rem
+		}
+		buf = buf[offset : offset+directBufferSize]
+		return &buf
+	},
+}
+
+// directWriter writes to a file opened with O_DIRECT, bypassing the page
+// cache. Data is accumulated in an aligned buffer and written in aligned
+// blocks. The unaligned tail is written by flush, after dropping O_DIRECT.
+type directWriter struct {
+	file *os.File
+	buf  *[]byte
+	n    int
+	// direct is set while data is buffered, and cleared by flush, after
+	// which writes go straight to the file
+	direct bool
+}
+
+// newDirectWriter enables O_DIRECT on file, returning an error if it can't
+// be, e.g. on a platform or filesystem not supporting it
+func newDirectWriter(file *os.File) (*directWriter, error) {
+	if err := setDirect(file, true); err != nil {
+		return nil, err
+	}
+	return &directWriter{file: file, buf: directBuffers.Get().(*[]byte), direct: true}, nil
+}
+
+func (dw *directWriter) Write(p []byte) (int, error) {
+	if !dw.direct {
+		return dw.file.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		copied := copy((*dw.buf)[dw.n:], p)
+		dw.n += copied
+		written += copied
+		p = p[copied:]
+		if dw.n == len(*dw.buf) {
+			if err := dw.writeBlocks(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeBlocks writes the aligned blocks of the buffer, keeping the rest
+func (dw *directWriter) writeBlocks() error {
+	aligned := dw.n - dw.n%directAlign
+	if aligned == 0 {
+		return nil
+	}
+	_, err := dw.file.Write((*dw.buf)[:aligned])
+	if errors.Is(err, syscall.EINVAL) {
+		// The filesystem accepted O_DIRECT but not the writes, fall back to
+		// buffered writes
+		if err = setDirect(dw.file, false); err == nil {
+			_, err = dw.file.Write((*dw.buf)[:aligned])
+		}
+	}
+	if err != nil {
+		return err
+	}
+	dw.n = copy(*dw.buf, (*dw.buf)[aligned:dw.n])
+	return nil
+}
+
+// flush writes the buffered data and drops O_DIRECT, so that the file can
+// be written to and synced as usual afterwards
+func (dw *directWriter) flush() error {
+	if !dw.direct {
+		return nil
+	}
+	if err := dw.writeBlocks(); err != nil {
+		return err
+	}
+	dw.direct = false
+	if err := setDirect(dw.file, false); err != nil {
+		return err
+	}
+	_, err := dw.file.Write((*dw.buf)[:dw.n])
+	dw.n = 0
+	return err
+}
+
+// release returns the buffer to the pool. The writer must not be used
+// afterwards.
+func (dw *directWriter) release() {
+	if dw.buf != nil {
+		directBuffers.Put(dw.buf)
+		dw.buf = nil
+	}
+}
+
+// startDirect switches the pending mirror file to O_DIRECT writes if the
+// response is large enough for direct_io. Transformed content, whose size
+// isn't known in advance, is written through the page cache.
+func (rww *responseWriterWrapper) startDirect() {
+	minSize := rww.config.DirectIOMinSize
+	if minSize == 0 || rww.bytesExpected < 0 || uint64(rww.bytesExpected) < minSize || len(rww.config.transformers) > 0 {
+		return
+	}
+	direct, err := newDirectWriter(rww.file.File)
+	if err != nil {
+		rww.logger.Debug("O_DIRECT not available, writing through the page cache",
+			zap.Error(err))
+		return
+	}
+	rww.direct = direct
+}
+
+// flushDirect writes the data buffered for O_DIRECT writes to the pending
+// mirror file, discarding it if that fails. It reports whether the file is
+// still pending.
+func (rww *responseWriterWrapper) flushDirect() bool {
+	if rww.direct == nil {
+		return true
+	}
+	if err := rww.direct.flush(); err != nil {
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("failed to flush mirror file", err)
+		rww.discard(zapcore.ErrorLevel, "failed to flush mirror file", false, zap.Error(err))
+		return false
+	}
+	return true
+}
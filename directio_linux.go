@@ -0,0 +1,30 @@
+//go:build linux
+
+package mirror
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// setDirect sets or clears O_DIRECT on file
+func setDirect(file *os.File, direct bool) error {
+	fd := int(file.Fd())
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if direct {
+		flags |= unix.O_DIRECT
+	} else {
+		flags &^= unix.O_DIRECT
+	}
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags)
+	return err
+}
+
+// dropCache drops the pages of file from the page cache, so that it is read
+// from storage again
+func dropCache(file *os.File) error {
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
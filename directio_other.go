@@ -0,0 +1,18 @@
+//go:build !linux
+
+package mirror
+
+import (
+	"errors"
+	"os"
+)
+
+// setDirect is not supported
+func setDirect(file *os.File, direct bool) error {
+	return errors.ErrUnsupported
+}
+
+// dropCache is not supported
+func dropCache(file *os.File) error {
+	return errors.ErrUnsupported
+}
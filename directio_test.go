@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	testCases := []struct {
+		name   string
+		size   int
+		chunk  int
+		direct bool
+	}{
+		{name: "unaligned tail", size: 3*directBufferSize + 123, chunk: 32 << 10, direct: true},
+		{name: "smaller than a block", size: 100, chunk: 7, direct: true},
+		{name: "below min size", size: 50, chunk: 10},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			body := make([]byte, test.size)
+			for i := range body {
+				body[i] = byte(i % 251)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, DirectIOMinSize: 100})
+			rww := newTestWrapper(t, root, "/large.bin", &discardResponseWriter{})
+			rww.config = mir
+			rww.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			rww.WriteHeader(http.StatusOK)
+			if test.direct && rww.direct == nil {
+				t.Log("O_DIRECT not supported here, testing the fallback")
+			} else if !test.direct && rww.direct != nil {
+				t.Error("O_DIRECT used below direct_io_min_size")
+			}
+			for offset := 0; offset < len(body); offset += test.chunk {
+				if _, err := rww.Write(body[offset:min(offset+test.chunk, len(body))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rww.handlerDone(context.Background())
+			mirrored, err := os.ReadFile(filepath.Join(root, "large.bin"))
+			if err != nil || !bytes.Equal(mirrored, body) {
+				t.Errorf("mirror file has %d bytes, expected %d, error: %v", len(mirrored), len(body), err)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteDirectIO(b *testing.B) {
+	root := b.TempDir()
+	body := bytes.Repeat([]byte{0x5a}, 64<<20)
+	mir := provisionTestMirror(b, &Mirror{Root: root, DirectIOMinSize: 1})
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rww := newTestWrapper(b, root, "/large.bin", &discardResponseWriter{})
+		rww.config = mir
+		rww.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		rww.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(struct{ io.Writer }{rww}, bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+		rww.handlerDone(context.Background())
+	}
+}
@@ -0,0 +1,107 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"time"
+)
+
+// CompleteOnDisconnect configures completing the mirroring of a response
+// after the client went away mid-body. The request to the next handler is
+// no longer canceled along with the client's, and the rest of the response
+// is written to the mirror file only, until it is complete or the budget
+// is exceeded. Responses that aren't being mirrored by then are still cut
+// short by the next failing write to the client.
+type CompleteOnDisconnect struct {
+	// How long to keep receiving the response after the client went away.
+	// Default is 1m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Maximum number of bytes to receive after the client went away.
+	// Default is 1GiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+const (
+	defaultDisconnectTimeout = time.Minute
+	defaultDisconnectMaxSize = 1 << 30
+)
+
+func (cd *CompleteOnDisconnect) timeout() time.Duration {
+	if cd.Timeout > 0 {
+		return time.Duration(cd.Timeout)
+	}
+	return defaultDisconnectTimeout
+}
+
+func (cd *CompleteOnDisconnect) maxSize() int64 {
+	if cd.MaxSize > 0 {
+		return cd.MaxSize
+	}
+	return defaultDisconnectMaxSize
+}
+
+// detachContext returns a copy of r whose context isn't canceled when the
+// client goes away, but only once the timeout has passed after that. stop
+// releases its resources.
+func (cd *CompleteOnDisconnect) detachContext(r *http.Request) (detached *http.Request, stop func()) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stopAfter := context.AfterFunc(r.Context(), func() {
+		timer := time.NewTimer(cd.timeout())
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+	return r.WithContext(ctx), func() {
+		stopAfter()
+		cancel()
+	}
+}
+
+// completing reports whether writes failing as the client went away are
+// ignored, to complete mirroring the response
+func (rww *responseWriterWrapper) completing() bool {
+	return rww.config.CompleteOnDisconnect != nil && rww.file != nil
+}
+
+// detach continues mirroring the response without the client, after writing
+// to it failed with err
+func (rww *responseWriterWrapper) detach(err error) {
+	rww.detached = err
+	rww.detachedAt = time.Now()
+	rww.detachedBytes = rww.bytesWritten
+	rww.logger.Debug("client went away, completing mirroring without it",
+		zap.Int64("bytes_written", rww.bytesWritten),
+		zap.Int64("bytes_expected", rww.bytesExpected),
+		zap.Error(err))
+	rww.spanEvent("mirror.detached")
+}
+
+// writeDetached writes data to the mirror file only, once the client went
+// away. The client's error is returned once the budget is exceeded, so
+// that the next handler stops.
+func (rww *responseWriterWrapper) writeDetached(data []byte) (int, error) {
+	rww.mu.Lock()
+	defer rww.mu.Unlock()
+	cd := rww.config.CompleteOnDisconnect
+	if rww.file == nil {
+		return 0, rww.detached
+	}
+	if elapsed := time.Since(rww.detachedAt); elapsed > cd.timeout() {
+		rww.abort(zapcore.WarnLevel, "client went away, completing mirroring took too long",
+			zap.Duration("timeout", cd.timeout()))
+		return 0, rww.detached
+	}
+	if rww.bytesWritten+int64(len(data))-rww.detachedBytes > cd.maxSize() {
+		rww.abort(zapcore.WarnLevel, "client went away, too much left to complete mirroring",
+			zap.Int64("max_size", cd.maxSize()))
+		return 0, rww.detached
+	}
+	return rww.writeMirrorLocked(data)
+}
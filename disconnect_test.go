@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteOnDisconnect(t *testing.T) {
+	head := "head"
+	// The rest is large enough not to fit in the server's buffers, so that
+	// writing it to the client fails
+	rest := strings.Repeat("x", 1<<20)
+	testCases := []struct {
+		name     string
+		config   *CompleteOnDisconnect
+		mirrored bool
+	}{
+		{name: "default", mirrored: false},
+		{name: "complete", config: &CompleteOnDisconnect{}, mirrored: true},
+		{name: "max size", config: &CompleteOnDisconnect{MaxSize: 1 << 10}, mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, CompleteOnDisconnect: test.config})
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				clientGone := r.Context().Done()
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Length", strconv.Itoa(len(head)+len(rest)))
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(head))
+					http.NewResponseController(w).Flush()
+					<-clientGone
+					for i := 0; i < len(rest); i += 4 << 10 {
+						if _, err := w.Write([]byte(rest[i : i+4<<10])); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				mir.ServeHTTP(w, r, next)
+			}))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(head))
+			if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != head {
+				t.Fatalf("expected %q, got %q, error: %v", head, buf, err)
+			}
+			resp.Body.Close()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("handler didn't return after the client went away")
+			}
+
+			content, err := os.ReadFile(filepath.Join(root, "file.bin"))
+			if test.mirrored != (err == nil) {
+				t.Fatalf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if test.mirrored && string(content) != head+rest {
+				t.Errorf("expected %d bytes mirrored, got %d", len(head)+len(rest), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package mirror
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultUnknownSizeReservation = 64 << 20
+
+func (mir *Mirror) unknownSizeReservation() int64 {
+	if mir.UnknownSizeReservation > 0 {
+		return int64(mir.UnknownSizeReservation)
+	}
+	return defaultUnknownSizeReservation
+}
+
+var (
+	// reservedSpace is the number of bytes responses being mirrored are yet
+	// to write to each filesystem, by device ID. It is shared by all
+	// handlers and survives config reloads.
+	reservedSpace   = make(map[uint64]*atomic.Int64)
+	reservedSpaceMu sync.Mutex
+)
+
+// reservedOn returns the reservations of the filesystem with device ID dev
+func reservedOn(dev uint64) *atomic.Int64 {
+	reservedSpaceMu.Lock()
+	defer reservedSpaceMu.Unlock()
+	reserved, ok := reservedSpace[dev]
+	if !ok {
+		reserved = new(atomic.Int64)
+		reservedSpace[dev] = reserved
+	}
+	return reserved
+}
+
+// spaceReservation is the space reserved on the filesystem of a root for
+// the rest of a response being mirrored, with min_free_space. Written bytes
+// are taken off the reservation, as they take up space already.
+type spaceReservation struct {
+	dir       string
+	floor     uint64
+	ledger    *atomic.Int64
+	stats     *stats
+	remaining int64
+}
+
+// existingAncestor returns path or its deepest ancestor that exists
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// reserveSpace reserves space on the filesystem of root for a response of
+// size bytes, or the unknown size reservation if size is negative. ok is
+// false if the reservation would leave less than min_free_space free. The
+// reservation is nil where free space can't be determined.
+func (mir *Mirror) reserveSpace(root string, size int64) (sr *spaceReservation, ok bool) {
+	dir := existingAncestor(root)
+	dev, ok := deviceID(dir)
+	if !ok {
+		return nil, true
+	}
+	sr = &spaceReservation{
+		dir:    dir,
+		floor:  mir.MinFreeSpace,
+		ledger: reservedOn(dev),
+		stats:  mir.stats,
+	}
+	if size < 0 {
+		size = mir.unknownSizeReservation()
+	}
+	if !sr.extend(size) {
+		return nil, false
+	}
+	return sr, true
+}
+
+// extend reserves size more bytes, unless that would leave less than the
+// floor free
+func (sr *spaceReservation) extend(size int64) bool {
+	free, ok := freeSpace(sr.dir)
+	if !ok {
+		return true
+	}
+	reserved := sr.ledger.Add(size)
+	if reserved < 0 || uint64(reserved)+sr.floor > free {
+		sr.ledger.Add(-size)
+		return false
+	}
+	sr.remaining += size
+	sr.stats.reservedBytes.Add(size)
+	return true
+}
+
+// consume takes n written bytes off the reservation
+func (sr *spaceReservation) consume(n int64) {
+	n = min(n, sr.remaining)
+	sr.remaining -= n
+	sr.ledger.Add(-n)
+	sr.stats.reservedBytes.Add(-n)
+}
+
+// release releases what is left of the reservation
+func (sr *spaceReservation) release() {
+	sr.consume(sr.remaining)
+}
+
+// reserveResponse reserves space for the response about to be mirrored,
+// with min_free_space. It reports false if there isn't enough.
+func (rww *responseWriterWrapper) reserveResponse() bool {
+	if rww.config.MinFreeSpace == 0 {
+		return true
+	}
+	size, err := parseContentLength(rww.Header().Values("Content-Length"))
+	if err != nil {
+		size = -1
+	}
+	space, ok := rww.config.reserveSpace(rww.root, size)
+	if !ok {
+		rww.config.stats.noSpace.Add(1)
+		rww.logger.Warn("skip mirroring, not enough free space",
+			zap.Int64("content_length", size),
+			zap.Uint64("min_free_space", rww.config.MinFreeSpace))
+		return false
+	}
+	rww.space = space
+	return true
+}
+
+// spaceFor takes n bytes about to be written to the mirror file off the
+// reservation, extending it first if the response outgrew it. It reports
+// false if there isn't enough space left, having aborted mirroring.
+func (rww *responseWriterWrapper) spaceFor(n int64) bool {
+	if rww.space == nil {
+		return true
+	}
+	if extra := n - rww.space.remaining; extra > 0 {
+		if !rww.space.extend(max(extra, rww.config.unknownSizeReservation())) {
+			rww.config.stats.noSpace.Add(1)
+			rww.abort(zapcore.WarnLevel, "not enough free space to continue mirroring",
+				zap.Uint64("min_free_space", rww.config.MinFreeSpace))
+			return false
+		}
+	}
+	rww.space.consume(n)
+	return true
+}
@@ -0,0 +1,106 @@
+package mirror
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMinFreeSpace(t *testing.T) {
+	root := t.TempDir()
+	free, ok := freeSpace(root)
+	if !ok {
+		t.Skip("free space not supported")
+	}
+	const mib = 1 << 20
+	if free < 64*mib {
+		t.Skip("not enough free space")
+	}
+	// The headroom above the floor leaves a few MiB for other writes to the
+	// filesystem while testing
+	mir := provisionTestMirror(t, &Mirror{
+		Root:                   root,
+		MinFreeSpace:           free - 32*mib,
+		UnknownSizeReservation: 8 * mib,
+	})
+	reservedBefore := mir.stats.reservedBytes.Value()
+	held, ok := mir.reserveSpace(root, 20*mib)
+	if !ok {
+		t.Fatal("reservation within the headroom failed")
+	}
+	if _, ok := mir.reserveSpace(root, 20*mib); ok {
+		t.Error("reservation beyond the headroom succeeded")
+	}
+
+	testCases := []struct {
+		name     string
+		length   int
+		known    bool
+		mirrored bool
+	}{
+		{name: "fits", length: 7, known: true, mirrored: true},
+		{name: "too large", length: 16 * mib, known: true, mirrored: false},
+		{name: "unknown length fits", length: 7, mirrored: true},
+		{name: "unknown length outgrows", length: 9 * mib, mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			urlp := "/" + strconv.Itoa(test.length) + strconv.FormatBool(test.known)
+			body := bytes.Repeat([]byte("x"), test.length)
+			rec, err := serveMirror(mir, urlp, func(w http.ResponseWriter, r *http.Request) error {
+				if test.known {
+					w.Header().Set("Content-Length", strconv.Itoa(test.length))
+				}
+				w.WriteHeader(http.StatusOK)
+				for i := 0; i < len(body); i += mib {
+					w.Write(body[i:min(i+mib, len(body))])
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Body.Len() != test.length {
+				t.Errorf("expected %d bytes passed through, got %d", test.length, rec.Body.Len())
+			}
+			_, err = os.Stat(filepath.Join(root, urlp))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+		})
+	}
+
+	held.release()
+	if reserved := mir.stats.reservedBytes.Value() - reservedBefore; reserved != 0 {
+		t.Errorf("expected all reservations released, %d bytes still reserved", reserved)
+	}
+}
+
+func TestMinFreeSpaceConflict(t *testing.T) {
+	root := t.TempDir()
+	free, ok := freeSpace(root)
+	if !ok {
+		t.Skip("free space not supported")
+	}
+	parent := filepath.Join(root, "a")
+	if err := os.WriteFile(parent, []byte("old"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MinFreeSpace: free + 1<<30, PathConflicts: pathConflictsReplace})
+	_, err := serveMirror(mir, "/a/b", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Length", "7")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No way is made for a file there isn't space for
+	if content, err := os.ReadFile(parent); err != nil || string(content) != "old" {
+		t.Errorf("expected file in the way kept, got %q, error: %v", content, err)
+	}
+}
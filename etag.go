@@ -0,0 +1,190 @@
+package mirror
+
+import (
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isWeakEtag reports whether etag is a weak entity tag
+func isWeakEtag(etag string) bool {
+	return strings.HasPrefix(strings.TrimSpace(etag), "W/")
+}
+
+// canonicalEtag validates etag as an entity tag (RFC 9110, section 8.8.3) and
+// returns it in the form used in ETag and If-None-Match headers, i.e. with the
+// opaque tag in double quotes. Origins omitting the quotes are tolerated. ok is
+// false if etag can't be made valid, such as when it has illegal characters or
+// is several entity tags joined by commas.
+func canonicalEtag(etag string) (canonical string, ok bool) {
+	etag = strings.TrimSpace(etag)
+	prefix := ""
+	if strings.HasPrefix(etag, "W/") {
+		prefix = "W/"
+		etag = etag[2:]
+	}
+	if len(etag) >= 2 && strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) {
+		etag = etag[1 : len(etag)-1]
+	} else if strings.Contains(etag, ",") {
+		// most likely several ETags joined into one header value
+		return "", false
+	}
+	for i := 0; i < len(etag); i++ {
+		// etagc = %x21 / %x23-7E / obs-text
+		if c := etag[i]; c < 0x21 || c == '"' || c == 0x7f {
+			return "", false
+		}
+	}
+	return prefix + `"` + etag + `"`, true
+}
+
+// normalizeEtag returns the opaque part of etag, without the weak prefix and
+// quotes, for comparisons
+func normalizeEtag(etag string) string {
+	etag = strings.TrimSpace(etag)
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, `"`)
+}
+
+// etagsMatch reports whether the entity tags a and b identify the same
+// content. If either is weak, they only match if allowWeak is set.
+func etagsMatch(a, b string, allowWeak bool) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if !allowWeak && (isWeakEtag(a) || isWeakEtag(b)) {
+		return false
+	}
+	return normalizeEtag(a) == normalizeEtag(b)
+}
+
+// digestEtagPrefix starts the ETags synthesized from the sha256 of local
+// copies that have no stored ETag, which tells them from origin ETags
+const digestEtagPrefix = `"sha256-`
+
+// digestEtag returns the strong ETag synthesized from the sha256 recorded in
+// the metadata meta of a local copy, or "" if there is none
+func digestEtag(meta map[string]string) string {
+	sum := meta[xattrSha256]
+	if len(sum) < 32 {
+		return ""
+	}
+	return digestEtagPrefix + sum[:32] + `"`
+}
+
+// isDigestEtag reports whether etag was synthesized by digestEtag
+func isDigestEtag(etag string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), digestEtagPrefix)
+}
+
+// withoutDigestEtags returns r without the ETags synthesized by digestEtag
+// in its If-None-Match header, which mean nothing to upstream
+func withoutDigestEtags(r *http.Request) *http.Request {
+	var kept []string
+	stripped := false
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, etag := range strings.Split(value, ",") {
+			if etag = strings.TrimSpace(etag); isDigestEtag(etag) {
+				stripped = true
+			} else if etag != "" {
+				kept = append(kept, etag)
+			}
+		}
+	}
+	if !stripped {
+		return r
+	}
+	r = r.Clone(r.Context())
+	if len(kept) == 0 {
+		r.Header.Del("If-None-Match")
+	} else {
+		r.Header.Set("If-None-Match", strings.Join(kept, ", "))
+	}
+	return r
+}
+
+// etagListHeaders are the conditional request headers whose lists of ETags
+// may be split across several fields
+var etagListHeaders = []string{"If-Match", "If-None-Match"}
+
+// joinEtagLists returns r with the lists of ETags of its conditional headers
+// each joined into a single field, as http.ServeContent only reads the first
+func joinEtagLists(r *http.Request) *http.Request {
+	cloned := false
+	for _, name := range etagListHeaders {
+		values := r.Header.Values(name)
+		if len(values) < 2 {
+			continue
+		}
+		if !cloned {
+			r, cloned = r.Clone(r.Context()), true
+		}
+		r.Header.Set(name, strings.Join(values, ", "))
+	}
+	return r
+}
+
+// Formats of ETag sidecar files
+const (
+	// etagFormatRaw is the ETag as it appears in the ETag header, with
+	// quotes and any weak prefix, as served by file_server with
+	// etag_file_extensions
+	etagFormatRaw = "raw"
+	// etagFormatUnquoted is the opaque tag only, without quotes and weak
+	// prefix, e.g. a bare hex digest
+	etagFormatUnquoted = "unquoted"
+	// etagFormatStrongOnly is like etagFormatRaw, but weak ETags are not
+	// stored
+	etagFormatStrongOnly = "strong_only"
+)
+
+// formatEtag returns the canonical etag as written to ETag sidecar files in
+// format. ok is false if etag isn't written in that format.
+func formatEtag(etag string, format string) (formatted string, ok bool) {
+	switch format {
+	case etagFormatUnquoted:
+		return normalizeEtag(etag), true
+	case etagFormatStrongOnly:
+		return etag, !isWeakEtag(etag)
+	default:
+		return etag, true
+	}
+}
+
+// convertEtagFiles rewrites the ETag sidecar files in root to the
+// configured format, returning the number of files rewritten or removed
+func (mir *Mirror) convertEtagFiles(root string) (converted int, err error) {
+	if mir.EtagFileSuffix == "" {
+		return 0, nil
+	}
+	err = mir.walkEntries(root, func(filename string, d fs.DirEntry) {
+		for _, etagFilename := range mir.etagSidecars(filename) {
+			content, err := os.ReadFile(etagFilename)
+			if err != nil {
+				continue
+			}
+			etag, ok := canonicalEtag(string(content))
+			if !ok {
+				continue
+			}
+			formatted, ok := formatEtag(etag, mir.EtagFileFormat)
+			if !ok {
+				err = os.Remove(etagFilename)
+			} else if formatted != string(content) {
+				err = mir.writeFile(etagFilename, []byte(formatted))
+			} else {
+				continue
+			}
+			if err != nil {
+				mir.logger.Error("failed to convert ETag file",
+					zap.String("path", etagFilename),
+					zap.Error(err))
+				continue
+			}
+			converted++
+		}
+	})
+	return converted, err
+}
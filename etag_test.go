@@ -0,0 +1,248 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEtagsMatch(t *testing.T) {
+	testCases := []struct {
+		a, b      string
+		allowWeak bool
+		expected  bool
+	}{
+		{a: `"abc"`, b: `"abc"`, expected: true},
+		{a: `"abc"`, b: `abc`, expected: true},
+		{a: `"abc"`, b: `"abd"`, expected: false},
+		{a: ``, b: ``, expected: false},
+		// weak to strong
+		{a: `W/"abc"`, b: `"abc"`, allowWeak: false, expected: false},
+		{a: `W/"abc"`, b: `"abc"`, allowWeak: true, expected: true},
+		// strong to weak
+		{a: `"abc"`, b: `W/"abc"`, allowWeak: false, expected: false},
+		{a: `"abc"`, b: `W/"abc"`, allowWeak: true, expected: true},
+		{a: `W/"abc"`, b: `W/"abc"`, allowWeak: true, expected: true},
+		{a: `W/"abc"`, b: `W/"xyz"`, allowWeak: true, expected: false},
+	}
+	for i, test := range testCases {
+		actual := etagsMatch(test.a, test.b, test.allowWeak)
+		if actual != test.expected {
+			t.Errorf("Test %d (%s, %s, allowWeak: %v) - expected %v, got %v",
+				i, test.a, test.b, test.allowWeak, test.expected, actual)
+		}
+	}
+}
+
+func TestCanonicalEtag(t *testing.T) {
+	testCases := []struct {
+		etag     string
+		expected string
+		ok       bool
+	}{
+		{etag: `"abc"`, expected: `"abc"`, ok: true},
+		{etag: `abc`, expected: `"abc"`, ok: true},
+		{etag: ` "abc" `, expected: `"abc"`, ok: true},
+		{etag: `W/"abc"`, expected: `W/"abc"`, ok: true},
+		{etag: `W/abc`, expected: `W/"abc"`, ok: true},
+		{etag: `""`, expected: `""`, ok: true},
+		{etag: `"a,b"`, expected: `"a,b"`, ok: true},
+		{etag: `a, b`, ok: false},
+		{etag: `"a", "b"`, ok: false},
+		{etag: `"a b"`, ok: false},
+		{etag: `"a"b"`, ok: false},
+		{etag: "\"a\x00\"", ok: false},
+		{etag: `"abc`, ok: false},
+	}
+	for i, test := range testCases {
+		actual, ok := canonicalEtag(test.etag)
+		if ok != test.ok || actual != test.expected {
+			t.Errorf("Test %d (%s) - expected %q (ok: %v), got %q (ok: %v)",
+				i, test.etag, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestStoredEtagFormat(t *testing.T) {
+	testCases := []struct {
+		etag     string
+		expected string
+		stored   bool
+	}{
+		{etag: `"abc"`, expected: `"abc"`, stored: true},
+		{etag: `abc`, expected: `"abc"`, stored: true},
+		{etag: `W/"abc"`, expected: `W/"abc"`, stored: true},
+		{etag: `"a", "b"`, stored: false},
+	}
+	for i, test := range testCases {
+		root := t.TempDir()
+		mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag"})
+		_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("ETag", test.etag)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "file.txt")); err != nil {
+			t.Errorf("Test %d (%s) - file not mirrored: %v", i, test.etag, err)
+		}
+		content, err := os.ReadFile(filepath.Join(root, "file.txt.etag"))
+		if !test.stored {
+			if err == nil {
+				t.Errorf("Test %d (%s) - expected no ETag file, got %s", i, test.etag, content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.expected {
+			t.Errorf("Test %d (%s) - expected ETag file to contain %s, got %s", i, test.etag, test.expected, content)
+		}
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	respond := func(etag string, body string) func(w http.ResponseWriter, r *http.Request) error {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+			return nil
+		}
+	}
+	testCases := []struct {
+		name      string
+		first     string
+		second    string
+		weakEtags bool
+		// xattr is set for the ETag to be stored in an xattr rather than
+		// an ETag file
+		xattr    bool
+		expected string
+	}{
+		{name: "same strong", first: `"abc"`, second: `"abc"`, expected: "first"},
+		{name: "changed", first: `"abc"`, second: `"xyz"`, expected: "second"},
+		{name: "strong to weak", first: `"abc"`, second: `W/"abc"`, expected: "second"},
+		{name: "strong to weak allowed", first: `"abc"`, second: `W/"abc"`, weakEtags: true, expected: "first"},
+		{name: "weak to strong", first: `W/"abc"`, second: `"abc"`, expected: "second"},
+		{name: "weak to strong allowed", first: `W/"abc"`, second: `"abc"`, weakEtags: true, expected: "first"},
+		{name: "weak to strong in xattr", first: `W/"abc"`, second: `"abc"`, xattr: true, expected: "second"},
+		{name: "weak to strong allowed in xattr", first: `W/"abc"`, second: `"abc"`, weakEtags: true, xattr: true, expected: "first"},
+		{name: "strong to weak allowed in xattr", first: `"abc"`, second: `W/"abc"`, weakEtags: true, xattr: true, expected: "first"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			config := &Mirror{Root: root, EtagFileSuffix: ".etag", SkipUnchanged: true, WeakEtags: test.weakEtags}
+			if test.xattr {
+				config.EtagFileSuffix, config.UseXattr = "", true
+			}
+			mir := provisionTestMirror(t, config)
+			serveMirror(mir, "/file.txt", respond(test.first, "first"))
+			serveMirror(mir, "/file.txt", respond(test.second, "second"))
+			content, err := os.ReadFile(filepath.Join(root, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("expected %s response to be mirrored, got %s", test.expected, content)
+			}
+		})
+	}
+}
+
+func TestEtagFileFormat(t *testing.T) {
+	testCases := []struct {
+		format   string
+		etag     string
+		expected string
+		written  bool
+	}{
+		{format: "", etag: `W/"abc"`, expected: `W/"abc"`, written: true},
+		{format: etagFormatRaw, etag: `"abc"`, expected: `"abc"`, written: true},
+		{format: etagFormatUnquoted, etag: `"abc"`, expected: `abc`, written: true},
+		{format: etagFormatUnquoted, etag: `W/"abc"`, expected: `abc`, written: true},
+		{format: etagFormatStrongOnly, etag: `"abc"`, expected: `"abc"`, written: true},
+		{format: etagFormatStrongOnly, etag: `W/"abc"`},
+	}
+	for _, test := range testCases {
+		t.Run(test.format+" "+test.etag, func(t *testing.T) {
+			root := t.TempDir()
+			etagFilename := filepath.Join(root, "file.txt.etag")
+			// Left by an earlier version of the file
+			if err := os.WriteFile(etagFilename, []byte(`"old"`), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", EtagFileFormat: test.format})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("ETag", test.etag)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(etagFilename)
+			if !test.written {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected no ETag file, got %q, error: %v", content, err)
+				}
+				return
+			}
+			if err != nil || string(content) != test.expected {
+				t.Errorf("expected ETag file %q, got %q, error: %v", test.expected, content, err)
+			}
+			if stored := mir.storedEtag(filepath.Join(root, "file.txt"), mir.EtagFileSuffix, nil); !etagsMatch(stored, test.etag, true) {
+				t.Errorf("stored ETag %q doesn't match %q", stored, test.etag)
+			}
+		})
+	}
+}
+
+func TestConvertEtagFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt.etag":     `"abc"`,
+		"dir/b.txt.etag": `W/"def"`,
+		"c.txt.etag":     `ghi`,
+	}
+	for name, etag := range files {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []string{strings.TrimSuffix(filename, ".etag"), filename} {
+			if err := os.WriteFile(f, []byte(etag), filePerms); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	provisionTestMirror(t, &Mirror{Root: root, Name: "convert", EtagFileSuffix: ".etag", EtagFileFormat: etagFormatUnquoted})
+	rec := httptest.NewRecorder()
+	err := adminAPI{}.handleConvertEtagFiles(rec, httptest.NewRequest(http.MethodPost, "/mirror/etag-files/convert?name=convert", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response []etagFilesConverted
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 1 || response[0].Converted != 2 {
+		t.Errorf("expected 2 ETag files converted, got %+v", response)
+	}
+	for name, expected := range map[string]string{"a.txt.etag": "abc", "dir/b.txt.etag": "def", "c.txt.etag": "ghi"} {
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(content) != expected {
+			t.Errorf("expected %s to contain %q, got %q, error: %v", name, expected, content, err)
+		}
+	}
+}
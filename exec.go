@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ExecAfter configures a command run for each finalized file. The
+// placeholders {mirror.path}, {mirror.size}, {mirror.sha256},
+// {mirror.etag} and {mirror.request_id} are replaced in the arguments, and
+// the same values are passed in the MIRROR_PATH, MIRROR_SIZE,
+// MIRROR_SHA256, MIRROR_ETAG and MIRROR_REQUEST_ID environment variables.
+// Output is logged at debug level.
+type ExecAfter struct {
+	// Command to run.
+	Command string `json:"command,omitempty"`
+
+	// Arguments to the command, which may contain placeholders.
+	Args []string `json:"args,omitempty"`
+
+	// Working directory of the command. Default is the current directory.
+	Dir string `json:"dir,omitempty"`
+
+	// Time after which the command and its child processes are killed.
+	// Default is 1m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Maximum number of commands running at the same time. Default is 1.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	logger *zap.Logger
+}
+
+const (
+	defaultExecTimeout = caddy.Duration(time.Minute)
+
+	// maxExecOutput is the number of bytes of output kept for logging
+	maxExecOutput = 64 << 10
+)
+
+// Finalized runs the command for info
+func (ea *ExecAfter) Finalized(ctx context.Context, info FileInfo) error {
+	timeout := time.Duration(ea.Timeout)
+	if timeout <= 0 {
+		timeout = time.Duration(defaultExecTimeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	repl := caddy.NewReplacer()
+	size := strconv.FormatInt(info.Size, 10)
+	repl.Set("mirror.path", info.Path)
+	repl.Set("mirror.size", size)
+	repl.Set("mirror.sha256", info.SHA256)
+	repl.Set("mirror.etag", info.ETag)
+	repl.Set("mirror.request_id", info.RequestID)
+	args := make([]string, len(ea.Args))
+	for i, arg := range ea.Args {
+		args[i] = repl.ReplaceAll(arg, "")
+	}
+
+	cmd := exec.CommandContext(ctx, ea.Command, args...)
+	cmd.Dir = ea.Dir
+	cmd.Env = append(os.Environ(),
+		"MIRROR_PATH="+info.Path,
+		"MIRROR_SIZE="+size,
+		"MIRROR_SHA256="+info.SHA256,
+		"MIRROR_ETAG="+info.ETag,
+		"MIRROR_REQUEST_ID="+info.RequestID)
+	output := &limitedBuffer{limit: maxExecOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Run the command in its own process group, which is killed as a whole
+	// on timeout, so that no child processes are left behind
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait for descendants holding on to the output after a kill
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	ea.logger.Debug("exec_after command done",
+		zap.String("path", info.Path),
+		zap.String("command", ea.Command),
+		zap.Strings("args", args),
+		zap.Duration("duration", time.Since(start)),
+		zap.ByteString("output", output.Bytes()),
+		zap.Error(err))
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command %s killed after timeout of %v", ea.Command, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("command %s: %w", ea.Command, err)
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if room := lb.limit - lb.Len(); room > 0 {
+		lb.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
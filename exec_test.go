@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecAfter(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	info := FileInfo{Path: "/root/file.txt", Size: 7, SHA256: "abc"}
+	testCases := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		fails   bool
+		output  string
+	}{
+		{name: "placeholders and environment", script: `printf '%s %s %s' "$1" "$MIRROR_SIZE" "$MIRROR_SHA256" > "$0"`, output: "/root/file.txt 7 abc"},
+		{name: "non-zero exit", script: `exit 3`, fails: true},
+		{name: "killed on timeout", script: `sleep 10 & sleep 10`, timeout: 100 * time.Millisecond, fails: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ea := &ExecAfter{
+				Command: "sh",
+				Args:    []string{"-c", test.script, out, "{mirror.path}"},
+				Timeout: caddy.Duration(test.timeout),
+				logger:  zap.NewNop(),
+			}
+			start := time.Now()
+			err := ea.Finalized(context.Background(), info)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("command took %v", elapsed)
+			}
+			if (err != nil) != test.fails {
+				t.Fatalf("expected failure %v, got error %v", test.fails, err)
+			}
+			if test.output != "" {
+				content, err := os.ReadFile(out)
+				if err != nil || strings.TrimSpace(string(content)) != test.output {
+					t.Errorf("expected output %q, got %q, error: %v", test.output, content, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package mirror
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultExportMaxSize is the size of the files in a subtree above which
+// exporting it has to be confirmed
+const defaultExportMaxSize = 10 << 30
+
+// exportFormats are the archive formats of exports, by their name in the
+// format query parameter
+var exportFormats = map[string]string{
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// exportEntry is a file or directory to export
+type exportEntry struct {
+	filename string
+	// name is the slash separated path of the entry in the archive,
+	// relative to the root
+	name string
+	info fs.FileInfo
+}
+
+// handleExport streams an archive of the files below the prefix query
+// parameter in the root of the handler named by the name query parameter,
+// which may be left out if there is only one handler, including their
+// sidecar files. The format query parameter is one of `tar` (default),
+// `tar.gz` or `zip`. Tar archives carry xattrs as PAX records, which e.g.
+// GNU tar restores with --xattrs, zip archives don't carry them. Temp and
+// partial files are left out. Exports of more than 10GiB, or the size in
+// the max_size query parameter, have to be confirmed with confirm=true.
+func (adminAPI) handleExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("unknown export format %q", format),
+		}
+	}
+	maxSize := uint64(defaultExportMaxSize)
+	if val := query.Get("max_size"); val != "" {
+		size, err := humanize.ParseBytes(val)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("parsing max_size: %v", err),
+			}
+		}
+		maxSize = size
+	}
+	mir, err := selectHandler(query.Get("name"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	entries, size, err := mir.exportEntries(query.Get("prefix"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+	}
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	if confirmed, _ := strconv.ParseBool(query.Get("confirm")); uint64(size) > maxSize && !confirmed {
+		return caddy.APIError{
+			HTTPStatus: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("export of %s exceeds %s, confirm with confirm=true", humanize.IBytes(uint64(size)), humanize.IBytes(maxSize)),
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="mirror-export.`+format+`"`)
+	switch format {
+	case "zip":
+		err = writeZip(w, entries)
+	case "tar.gz":
+		zw := gzip.NewWriter(w)
+		err = writeTar(zw, entries)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+	default:
+		err = writeTar(w, entries)
+	}
+	if err != nil {
+		// The response has started, so all that can be done is to cut it
+		// short, which leaves the archive truncated
+		mir.logger.Error("export failed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// selectHandler returns the mirror handler named name, or the only one if
+// name is empty, for admin operations on its root. Handlers with
+// placeholders in their root are left out.
+func selectHandler(name string) (*Mirror, error) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	var found *Mirror
+	for mir := range handlers {
+		if hasPlaceholders(mir.Root) || (name != "" && mir.Name != name) {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("several mirror handlers, select one with the name parameter")
+		}
+		found = mir
+	}
+	if found == nil {
+		return nil, errors.New("no mirror handler with a root without placeholders")
+	}
+	return found, nil
+}
+
+// isInternalFile reports whether name is one of the mirror's own files, such
+// as eviction progress, or a temp file, named ".<name><random digits>".
+// Other hidden files and directories, like .well-known, are mirrored ones.
+func isInternalFile(name string, dir bool) bool {
+	if strings.HasPrefix(name, ".mirror-") {
+		return true
+	}
+	if dir || !strings.HasPrefix(name, ".") {
+		return false
+	}
+	trimmed := strings.TrimRight(name, "0123456789")
+	return len(trimmed) > 1 && len(trimmed) < len(name)
+}
+
+// exportEntries returns the directories and files to export below prefix,
+// and the total size of the files
+func (mir *Mirror) exportEntries(prefix string) ([]exportEntry, int64, error) {
+	root := mir.Root
+	dir := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, prefix), "/")
+	var entries []exportEntry
+	var size int64
+	err := filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filename != dir && (isInternalFile(d.Name(), d.IsDir()) || isPartialFile(d.Name())) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since it was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		entries = append(entries, exportEntry{filename: filename, name: filepath.ToSlash(rel), info: info})
+		return nil
+	})
+	return entries, size, err
+}
+
+// writeTar writes entries to w as a tar archive, with their xattrs as PAX
+// records
+func writeTar(w io.Writer, entries []exportEntry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		file, info, err := openEntry(entry)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, entry.name, file, info)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarEntry writes the entry named name to tw, with the content and
+// xattrs of file
+func writeTarEntry(tw *tar.Writer, name string, file *os.File, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// Ownership doesn't carry over to another node
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	header.Format = tar.FormatPAX
+	if names, err := xattr.FList(file); err == nil {
+		for _, name := range names {
+			value, err := xattr.FGet(file, name)
+			if err != nil {
+				return err
+			}
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		return copyFileTo(tw, file, info.Size())
+	}
+	return nil
+}
+
+// writeZip writes entries to w as a zip archive
+func writeZip(w io.Writer, entries []exportEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		file, info, err := openEntry(entry)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = writeZipEntry(zw, entry.name, file, info)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeZipEntry writes the entry named name to zw, with the content of file
+func writeZipEntry(zw *zip.Writer, name string, file *os.File, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		return copyFileTo(fw, file, info.Size())
+	}
+	return nil
+}
+
+// openEntry opens the file or directory of entry, before anything of it is
+// written to the archive, and returns it along with its current info. The
+// error is fs.ErrNotExist if it has been removed since it was listed, in
+// which case it is left out of the archive.
+func openEntry(entry exportEntry) (*os.File, fs.FileInfo, error) {
+	file, err := os.Open(entry.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Mode().Type() != entry.info.Mode().Type() {
+		// Replaced by something else since it was listed
+		err = fmt.Errorf("%s: %w", entry.filename, fs.ErrNotExist)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// copyFileTo copies the size bytes of file that were there when it was
+// opened to w
+func copyFileTo(w io.Writer, file *os.File, size int64) error {
+	n, err := io.Copy(w, io.LimitReader(file, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("%s: %w", file.Name(), io.ErrUnexpectedEOF)
+	}
+	return err
+}
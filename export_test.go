@@ -0,0 +1,179 @@
+package mirror
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/xattr"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"dists/stable/Release":                 "release",
+		"dists/stable/Release.etag":            `"v1"`,
+		"dists/stable/.Release12345":           "temp",
+		"dists/stable/.mirror-health-42":       "canary",
+		"dists/stable/.well-known/keys.txt":    "keys",
+		"dists/stable/big.iso" + partialSuffix: "partial",
+		"dists/testing/Release":                "other",
+		"pool/file.deb":                        "deb",
+	} {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), filePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasXattrs := xattr.Set(filepath.Join(root, "dists", "stable", "Release"), xattrEtag, []byte(`"v1"`)) == nil
+	provisionTestMirror(t, &Mirror{Root: root, Name: "export", EtagFileSuffix: ".etag"})
+
+	expected := map[string]string{
+		"dists/stable/":                     "",
+		"dists/stable/Release":              "release",
+		"dists/stable/Release.etag":         `"v1"`,
+		"dists/stable/.well-known/":         "",
+		"dists/stable/.well-known/keys.txt": "keys",
+	}
+	for _, format := range []string{"tar", "tar.gz", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleExport(rec, httptest.NewRequest(http.MethodGet, "/mirror/export?name=export&prefix=/dists/stable/&format="+format, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[string]string)
+			if format == "zip" {
+				zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					content, _ := io.ReadAll(rc)
+					rc.Close()
+					found[f.Name] = string(content)
+				}
+			} else {
+				var r io.Reader = rec.Body
+				if format == "tar.gz" {
+					if r, err = gzip.NewReader(r); err != nil {
+						t.Fatal(err)
+					}
+				}
+				tr := tar.NewReader(r)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					content, _ := io.ReadAll(tr)
+					found[header.Name] = string(content)
+					if header.Name == "dists/stable/Release" && hasXattrs && header.PAXRecords["SCHILY.xattr."+xattrEtag] != `"v1"` {
+						t.Errorf("xattr not exported as PAX record, got %v", header.PAXRecords)
+					}
+				}
+			}
+			if !reflect.DeepEqual(found, expected) {
+				t.Errorf("expected %v exported, got %v", expected, found)
+			}
+		})
+	}
+}
+
+func TestExportMaxSize(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.bin"), make([]byte, 100), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	provisionTestMirror(t, &Mirror{Root: root, Name: "export"})
+	err := adminAPI{}.handleExport(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mirror/export?name=export&max_size=10", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected export over max_size refused, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	err = adminAPI{}.handleExport(rec, httptest.NewRequest(http.MethodGet, "/mirror/export?name=export&max_size=10&confirm=true", nil))
+	if err != nil || rec.Body.Len() == 0 {
+		t.Errorf("confirmed export failed: %v", err)
+	}
+}
+
+func TestExportVanished(t *testing.T) {
+	for _, format := range []string{"tar", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			root := t.TempDir()
+			for _, name := range []string{"gone.txt", "kept.txt"} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(name), filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root})
+			entries, _, err := mir.exportEntries("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Removed between listing and archiving
+			if err := os.Remove(filepath.Join(root, "gone.txt")); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			found := make(map[string]string)
+			if format == "zip" {
+				if err := writeZip(&buf, entries); err != nil {
+					t.Fatal(err)
+				}
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					content, _ := io.ReadAll(rc)
+					rc.Close()
+					found[f.Name] = string(content)
+				}
+			} else {
+				if err := writeTar(&buf, entries); err != nil {
+					t.Fatal(err)
+				}
+				tr := tar.NewReader(&buf)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					content, _ := io.ReadAll(tr)
+					found[header.Name] = string(content)
+				}
+			}
+			if expected := map[string]string{"kept.txt": "kept.txt"}; !reflect.DeepEqual(found, expected) {
+				t.Errorf("expected %v exported, got %v", expected, found)
+			}
+		})
+	}
+}
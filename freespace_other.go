@@ -0,0 +1,9 @@
+//go:build !linux
+
+package mirror
+
+// freeSpace is not implemented on other platforms, where min_free_space
+// isn't enforced
+func freeSpace(dir string) (uint64, bool) {
+	return 0, false
+}
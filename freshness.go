@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshUntil computes the absolute time until which a response with the given
+// headers, received at now, is fresh: from Cache-Control s-maxage or max-age,
+// or else from Expires. If heuristic is set and neither is present, 10% of the
+// time since Last-Modified is used. ok is false if the response carries no
+// usable freshness information. Garbage values are ignored, except for an
+// invalid Expires, which means the response is already stale (RFC 9111).
+func freshUntil(header http.Header, now time.Time, heuristic bool) (expires time.Time, ok bool) {
+	// Age is the time the response already spent in upstream caches
+	var age time.Duration
+	if seconds, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	maxAge, sMaxAge := int64(-1), int64(-1)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			seconds, err := strconv.ParseInt(strings.Trim(arg, `"`), 10, 64)
+			switch strings.ToLower(name) {
+			case "no-cache", "no-store":
+				return now, true
+			case "max-age":
+				if err == nil && seconds >= 0 {
+					maxAge = seconds
+				}
+			case "s-maxage":
+				if err == nil && seconds >= 0 {
+					sMaxAge = seconds
+				}
+			}
+		}
+	}
+	// The mirror is a shared cache, so s-maxage takes precedence
+	if sMaxAge >= 0 {
+		return now.Add(time.Duration(sMaxAge)*time.Second - age), true
+	}
+	if maxAge >= 0 {
+		return now.Add(time.Duration(maxAge)*time.Second - age), true
+	}
+
+	if values := header.Values("Expires"); len(values) > 0 {
+		expiresAt, err := http.ParseTime(values[0])
+		if err != nil {
+			return now, true
+		}
+		// Expires is relative to the origin's clock, not ours
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			return now.Add(expiresAt.Sub(date)), true
+		}
+		return expiresAt, true
+	}
+
+	if heuristic {
+		if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			if since := date.Sub(lastModified); since > 0 {
+				return now.Add(since / 10), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,41 @@
+package mirror
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshUntil(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Hour).Format(http.TimeFormat)
+	testCases := []struct {
+		header    http.Header
+		heuristic bool
+		expires   time.Time
+		ok        bool
+	}{
+		{header: http.Header{}, ok: false},
+		{header: http.Header{"Cache-Control": {"max-age=60"}}, expires: now.Add(time.Minute), ok: true},
+		{header: http.Header{"Cache-Control": {"public, max-age=60, s-maxage=120"}}, expires: now.Add(2 * time.Minute), ok: true},
+		{header: http.Header{"Cache-Control": {"public", "MAX-AGE=\"60\""}}, expires: now.Add(time.Minute), ok: true},
+		{header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"30"}}, expires: now.Add(30 * time.Second), ok: true},
+		{header: http.Header{"Cache-Control": {"max-age=garbage, max-age=-5"}}, ok: false},
+		{header: http.Header{"Cache-Control": {"no-cache"}}, expires: now, ok: true},
+		{header: http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"0"}}, expires: now.Add(time.Minute), ok: true},
+		{header: http.Header{"Expires": {"0"}}, expires: now, ok: true},
+		{header: http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, expires: now.Add(time.Hour), ok: true},
+		// Expires relative to the origin's clock, which is an hour behind
+		{header: http.Header{"Expires": {now.Format(http.TimeFormat)}, "Date": {date}}, expires: now.Add(time.Hour), ok: true},
+		{header: http.Header{"Last-Modified": {now.Add(-100 * time.Hour).Format(http.TimeFormat)}}, ok: false},
+		{header: http.Header{"Last-Modified": {now.Add(-100 * time.Hour).Format(http.TimeFormat)}}, heuristic: true, expires: now.Add(10 * time.Hour), ok: true},
+		{header: http.Header{"Last-Modified": {"yesterday"}}, heuristic: true, ok: false},
+	}
+	for i, test := range testCases {
+		expires, ok := freshUntil(test.header, now, test.heuristic)
+		if ok != test.ok || !expires.Equal(test.expires) {
+			t.Errorf("Test %d (header: %v) - expected %v %v, got %v %v",
+				i, test.header, test.expires, test.ok, expires, ok)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"go.uber.org/zap"
+	"hash"
+	"runtime"
+	"sync"
+)
+
+// maxHashQueue is the number of bytes a pipelined hash holds on to while
+// the hashing goroutine catches up
+const maxHashQueue = 1 << 20
+
+// pipelineHashes enables hashing responses in a goroutine of their own, if
+// there is more than one CPU to run it on
+var pipelineHashes = true
+
+// newContentHash returns the hash of the content of a response being
+// mirrored, pipelined where it pays off
+func newContentHash() hash.Hash {
+	if !pipelineHashes || runtime.GOMAXPROCS(0) < 2 {
+		return sha256.New()
+	}
+	return newPipelinedHash(sha256.New())
+}
+
+// overHashSize reports whether a response of size bytes is too large to be
+// hashed, with max_hash_size
+func (rww *responseWriterWrapper) overHashSize(size int64) bool {
+	maxSize := rww.config.MaxHashSize
+	return maxSize > 0 && size > 0 && uint64(size) > maxSize
+}
+
+// skipHash stops hashing the response, noting in the metadata that the
+// digest is missing on purpose
+func (rww *responseWriterWrapper) skipHash() {
+	rww.contentHash = nil
+	rww.hashSkipped = true
+	rww.config.stats.hashSkipped.Add(1)
+	if rww.config.Sha256Xattr {
+		rww.setMetadata(xattrHashSkipped, "max_hash_size")
+	}
+	rww.config.trace(rww.logger, "hash skipped",
+		zap.Uint64("max_hash_size", rww.config.MaxHashSize))
+}
+
+// pipelinedHash is a hash whose writes return as soon as the data is queued,
+// for a goroutine to hash it while the response is written to the client
+// and the mirror file. Once the queue holds maxHashQueue bytes, writes wait
+// for it to drain and hash the data themselves, so memory use is bounded.
+// Sum waits for the queue to drain. Writes must not be concurrent.
+type pipelinedHash struct {
+	hash.Hash
+
+	mu       sync.Mutex
+	drained  *sync.Cond
+	queue    [][]byte
+	queued   int
+	draining bool
+}
+
+func newPipelinedHash(h hash.Hash) *pipelinedHash {
+	ph := &pipelinedHash{Hash: h}
+	ph.drained = sync.NewCond(&ph.mu)
+	return ph
+}
+
+// hashChunks are the buffers of queued data, recycled
+var hashChunks = sync.Pool{
+	New: func() any {
+		chunk := make([]byte, 0, 32<<10)
+		return &chunk
+	},
+}
+
+func (ph *pipelinedHash) Write(p []byte) (int, error) {
+	ph.mu.Lock()
+	if ph.queued+len(p) > maxHashQueue {
+		ph.wait()
+		ph.mu.Unlock()
+		return ph.Hash.Write(p)
+	}
+	chunk := hashChunks.Get().(*[]byte)
+	*chunk = append((*chunk)[:0], p...)
+	ph.queue = append(ph.queue, *chunk)
+	ph.queued += len(p)
+	if !ph.draining {
+		ph.draining = true
+		go ph.drain()
+	}
+	ph.mu.Unlock()
+	return len(p), nil
+}
+
+// drain hashes the queued data until there is none left
+func (ph *pipelinedHash) drain() {
+	ph.mu.Lock()
+	for len(ph.queue) > 0 {
+		chunk := ph.queue[0]
+		ph.queue[0] = nil
+		ph.queue = ph.queue[1:]
+		ph.mu.Unlock()
+		ph.Hash.Write(chunk)
+		hashChunks.Put(&chunk)
+		ph.mu.Lock()
+		ph.queued -= len(chunk)
+	}
+	ph.draining = false
+	ph.drained.Broadcast()
+	ph.mu.Unlock()
+}
+
+// wait waits for the queue to drain, with mu held
+func (ph *pipelinedHash) wait() {
+	for ph.draining {
+		ph.drained.Wait()
+	}
+}
+
+func (ph *pipelinedHash) Sum(b []byte) []byte {
+	ph.mu.Lock()
+	ph.wait()
+	ph.mu.Unlock()
+	return ph.Hash.Sum(b)
+}
+
+func (ph *pipelinedHash) Reset() {
+	ph.mu.Lock()
+	ph.wait()
+	ph.mu.Unlock()
+	ph.Hash.Reset()
+}
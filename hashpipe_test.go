@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestPipelinedHash(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	expected := sha256.Sum256(data)
+	testCases := []struct {
+		name  string
+		chunk int
+	}{
+		{name: "small writes", chunk: 100},
+		{name: "buffer sized writes", chunk: 32 << 10},
+		// Writes larger than the queue are hashed inline
+		{name: "large writes", chunk: maxHashQueue + 1},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ph := newPipelinedHash(sha256.New())
+			for i := 0; i < len(data); i += test.chunk {
+				ph.Write(data[i:min(i+test.chunk, len(data))])
+			}
+			if sum := ph.Sum(nil); !bytes.Equal(sum, expected[:]) {
+				t.Errorf("expected sha256 %x, got %x", expected, sum)
+			}
+			ph.Reset()
+			ph.Write([]byte("x"))
+			if sum, expected := ph.Sum(nil), sha256.Sum256([]byte("x")); !bytes.Equal(sum, expected[:]) {
+				t.Errorf("expected sha256 %x after reset, got %x", expected, sum)
+			}
+		})
+	}
+}
+
+func TestMaxHashSize(t *testing.T) {
+	testCases := []struct {
+		name          string
+		body          string
+		contentLength bool
+		hashed        bool
+	}{
+		{name: "small", body: "0123456789", contentLength: true, hashed: true},
+		{name: "large", body: "0123456789a", contentLength: true, hashed: false},
+		{name: "unknown length", body: "0123456789a", contentLength: false, hashed: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			// The sha256 goes to the metadata file without xattrs
+			mir := provisionTestMirror(t, &Mirror{Root: root, Sha256Xattr: true, MetadataFileSuffix: ".meta", MaxHashSize: 10, VerifyWrites: true})
+			skippedBefore := mir.stats.hashSkipped.Value()
+			_, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				if test.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+				}
+				w.WriteHeader(http.StatusOK)
+				for i := range test.body {
+					w.Write([]byte{test.body[i]})
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta := mir.readMetadata(filepath.Join(root, "file.bin"))
+			sum := sha256.Sum256([]byte(test.body))
+			if test.hashed && meta[xattrSha256] != hex.EncodeToString(sum[:]) {
+				t.Errorf("expected sha256 recorded, got %v", meta)
+			}
+			if !test.hashed && (meta[xattrSha256] != "" || meta[xattrHashSkipped] == "") {
+				t.Errorf("expected hash skipped recorded, got %v", meta)
+			}
+			if skipped := mir.stats.hashSkipped.Value() - skippedBefore; skipped != map[bool]int64{false: 1, true: 0}[test.hashed] {
+				t.Errorf("expected hashed %v, got %d skipped", test.hashed, skipped)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteHashing(b *testing.B) {
+	defer func(pipeline bool) { pipelineHashes = pipeline }(pipelineHashes)
+	body := bytes.Repeat([]byte{0x5a}, 64<<20)
+	for _, pipeline := range []bool{false, true} {
+		name := "inline"
+		if pipeline {
+			name = "pipelined"
+		}
+		b.Run(name, func(b *testing.B) {
+			if pipeline && runtime.GOMAXPROCS(0) < 2 {
+				b.Skip("pipelined hashing needs more than one CPU")
+			}
+			pipelineHashes = pipeline
+			root := b.TempDir()
+			mir := provisionTestMirror(b, &Mirror{Root: root, VerifyWrites: true})
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rww := newTestWrapper(b, root, "/large.bin", &discardResponseWriter{})
+				rww.config = mir
+				rww.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				rww.WriteHeader(http.StatusOK)
+				// Hide ReadFrom so io.Copy goes through Write
+				if _, err := io.Copy(struct{ io.Writer }{rww}, bytes.NewReader(body)); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				rww.handlerDone(context.Background())
+				b.StartTimer()
+			}
+		})
+	}
+}
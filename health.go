@@ -0,0 +1,242 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures periodic probing of the storage of each root the
+// handler has written to. Mirroring to an unhealthy root is suspended until
+// a probe succeeds again, responses are then passed through unmodified.
+// Roots that haven't been mirrored to for 10 intervals are no longer
+// probed.
+type HealthCheck struct {
+	// How often to probe each root by writing and removing a canary file.
+	// Default is 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Number of consecutive failed probes after which a root is
+	// considered unhealthy. Default is 3.
+	Failures int `json:"failures,omitempty"`
+}
+
+// rootHealth is the health status of a single mirror root
+type rootHealth struct {
+	Root                string     `json:"root"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	// probing is set while a probe of the root is running
+	probing bool
+	// lastSeen is when mirroring to the root was last considered, updated
+	// at most once per interval
+	lastSeen time.Time
+}
+
+// healthIdleIntervals is the number of probe intervals after which a root
+// that hasn't been mirrored to is forgotten, so that roots with
+// placeholders don't pile up
+const healthIdleIntervals = 10
+
+// healthChecker probes the roots of a mirror handler in the background
+type healthChecker struct {
+	interval time.Duration
+	failures int
+	logger   *zap.Logger
+	stats    *stats
+
+	mu    sync.RWMutex
+	roots map[string]*rootHealth
+	// stopped is set once Stop has been called, after which no more
+	// probes are started
+	stopped bool
+	// probes tracks the probes in flight, for Stop to wait for
+	probes sync.WaitGroup
+	// wake triggers probing when a new root is seen
+	wake chan struct{}
+	stop chan struct{}
+}
+
+func newHealthChecker(config *HealthCheck, logger *zap.Logger, stats *stats) *healthChecker {
+	hc := &healthChecker{
+		interval: time.Duration(config.Interval),
+		failures: config.Failures,
+		logger:   logger,
+		stats:    stats,
+		roots:    make(map[string]*rootHealth),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	if hc.interval <= 0 {
+		hc.interval = 30 * time.Second
+	}
+	if hc.failures <= 0 {
+		hc.failures = 3
+	}
+	return hc
+}
+
+// healthy reports whether root is healthy. Roots seen for the first time are
+// assumed healthy until probed, which happens right away.
+func (hc *healthChecker) healthy(root string) bool {
+	now := time.Now()
+	hc.mu.RLock()
+	h, ok := hc.roots[root]
+	healthy := ok && h.Healthy
+	seen := ok && now.Sub(h.lastSeen) < hc.interval
+	hc.mu.RUnlock()
+	if seen {
+		return healthy
+	}
+
+	hc.mu.Lock()
+	if h, ok := hc.roots[root]; ok {
+		h.lastSeen = now
+		healthy = h.Healthy
+	} else {
+		healthy = true
+		hc.roots[root] = &rootHealth{Root: root, Healthy: true, lastSeen: now}
+		select {
+		case hc.wake <- struct{}{}:
+		default:
+		}
+	}
+	hc.mu.Unlock()
+	return healthy
+}
+
+// status returns a snapshot of the health of all known roots
+func (hc *healthChecker) status() []rootHealth {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	status := make([]rootHealth, 0, len(hc.roots))
+	for _, h := range hc.roots {
+		status = append(status, *h)
+	}
+	return status
+}
+
+// run probes all known roots every interval, and whenever a new one is seen,
+// until stopped
+func (hc *healthChecker) run() {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-hc.wake:
+		case <-hc.stop:
+			return
+		}
+		hc.probeAll()
+	}
+}
+
+// probeAll starts probing each known root, each in its own goroutine so that
+// a root whose storage hangs doesn't hold up the others. Roots whose previous
+// probe hasn't returned are skipped, and those that haven't been mirrored to
+// for healthIdleIntervals are forgotten.
+func (hc *healthChecker) probeAll() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.stopped {
+		return
+	}
+	idleSince := time.Now().Add(-healthIdleIntervals * hc.interval)
+	for root, h := range hc.roots {
+		if h.probing {
+			hc.logger.Debug("previous health probe still running, skipping root",
+				zap.String("root", root))
+			continue
+		}
+		if h.lastSeen.Before(idleSince) {
+			if !h.Healthy {
+				hc.stats.unhealthyRoots.Add(-1)
+			}
+			delete(hc.roots, root)
+			continue
+		}
+		h.probing = true
+		hc.probes.Add(1)
+		go func() {
+			defer hc.probes.Done()
+			hc.probe(root)
+		}()
+	}
+}
+
+// probe writes and removes a canary file in root and records the outcome
+func (hc *healthChecker) probe(root string) {
+	err := probeRoot(root)
+	now := time.Now()
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	h, ok := hc.roots[root]
+	if !ok {
+		return
+	}
+	h.probing = false
+	if err == nil {
+		if !h.Healthy {
+			hc.logger.Info("mirror root healthy again",
+				zap.String("root", root))
+			hc.stats.unhealthyRoots.Add(-1)
+		}
+		h.Healthy = true
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = &now
+		h.LastError = ""
+		return
+	}
+	h.ConsecutiveFailures++
+	h.LastFailure = &now
+	h.LastError = err.Error()
+	hc.logger.Warn("mirror root health probe failed",
+		zap.String("root", root),
+		zap.Int("consecutive_failures", h.ConsecutiveFailures),
+		zap.Error(err))
+	if h.Healthy && h.ConsecutiveFailures >= hc.failures {
+		hc.logger.Error("mirror root unhealthy, suspending mirroring",
+			zap.String("root", root))
+		hc.stats.unhealthyRoots.Add(1)
+		h.Healthy = false
+	}
+}
+
+// Stop stops probing, waiting for the probes in flight. Roots still marked
+// unhealthy are no longer counted.
+func (hc *healthChecker) Stop() {
+	close(hc.stop)
+	hc.mu.Lock()
+	hc.stopped = true
+	hc.mu.Unlock()
+	// No probe is started once stopped is set, so none is added while
+	// waiting
+	hc.probes.Wait()
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, h := range hc.roots {
+		if !h.Healthy {
+			hc.stats.unhealthyRoots.Add(-1)
+		}
+	}
+}
+
+func probeRoot(root string) error {
+	if err := os.MkdirAll(root, mkdirPerms); err != nil {
+		return err
+	}
+	canary, err := os.CreateTemp(root, ".mirror-health-*")
+	if err != nil {
+		return err
+	}
+	_, err = canary.WriteString("ok")
+	return errors.Join(err, canary.Close(), os.Remove(canary.Name()))
+}
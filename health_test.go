@@ -0,0 +1,133 @@
+package mirror
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	goodRoot := filepath.Join(dir, "good")
+	// A root below a regular file can never be created
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	badRoot := filepath.Join(dir, "file", "bad")
+
+	// The checker isn't run, so that only the probes below happen
+	mir := &Mirror{Name: "health_test", stats: statsFor("health_test")}
+	hc := newHealthChecker(&HealthCheck{Failures: 2}, zap.NewNop(), mir.stats)
+	mir.health = hc
+	defer hc.Stop()
+	registerHandler(mir)
+	defer unregisterHandler(mir)
+	if !hc.healthy(goodRoot) || !hc.healthy(badRoot) {
+		t.Fatal("roots should be assumed healthy until probed")
+	}
+	for i := 0; i < 2; i++ {
+		hc.probe(goodRoot)
+		hc.probe(badRoot)
+	}
+	if !hc.healthy(goodRoot) {
+		t.Error("writable root reported unhealthy")
+	}
+	if hc.healthy(badRoot) {
+		t.Error("unwritable root reported healthy")
+	}
+	if unhealthy := mir.stats.unhealthyRoots.Value(); unhealthy != 1 {
+		t.Errorf("expected 1 unhealthy root, got %d", unhealthy)
+	}
+	if entries, _ := os.ReadDir(goodRoot); len(entries) != 0 {
+		t.Errorf("canary files left behind: %v", entries)
+	}
+
+	rec := httptest.NewRecorder()
+	err := adminAPI{}.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/mirror/health", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 with an unhealthy root, got %d", rec.Code)
+	}
+	var response []handlerHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	for _, handler := range response {
+		if handler.Name == "health_test" && len(handler.Roots) == 2 {
+			return
+		}
+	}
+	t.Errorf("health of both roots not reported: %+v", response)
+}
+
+func TestHealthCheckBusyRoot(t *testing.T) {
+	busyRoot, idleRoot := t.TempDir(), t.TempDir()
+	hc := newHealthChecker(&HealthCheck{}, zap.NewNop(), statsFor("health_busy_test"))
+	hc.healthy(busyRoot)
+	hc.healthy(idleRoot)
+	// As if the previous probe of the root hung
+	hc.roots[busyRoot].probing = true
+	hc.probeAll()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		hc.mu.RLock()
+		probed := hc.roots[idleRoot].LastSuccess != nil
+		hc.mu.RUnlock()
+		if probed {
+			break
+		}
+	}
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if hc.roots[idleRoot].LastSuccess == nil {
+		t.Error("idle root not probed")
+	}
+	if busy := hc.roots[busyRoot]; busy.LastSuccess != nil || !busy.probing {
+		t.Errorf("root still being probed was probed again: %+v", busy)
+	}
+}
+
+func TestHealthCheckIdleRoot(t *testing.T) {
+	idleRoot, busyRoot := t.TempDir(), t.TempDir()
+	stats := statsFor("health_idle_test")
+	hc := newHealthChecker(&HealthCheck{}, zap.NewNop(), stats)
+	hc.healthy(idleRoot)
+	hc.healthy(busyRoot)
+	hc.mu.Lock()
+	idle := hc.roots[idleRoot]
+	idle.lastSeen = idle.lastSeen.Add(-healthIdleIntervals * hc.interval)
+	idle.Healthy = false
+	hc.mu.Unlock()
+	stats.unhealthyRoots.Add(1)
+
+	hc.probeAll()
+	// Stop waits for the probe of the busy root
+	hc.Stop()
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if _, ok := hc.roots[idleRoot]; ok {
+		t.Error("idle root not forgotten")
+	}
+	if busy := hc.roots[busyRoot]; busy == nil || busy.probing || busy.LastSuccess == nil {
+		t.Errorf("busy root not probed before Stop returned: %+v", busy)
+	}
+	if unhealthy := stats.unhealthyRoots.Value(); unhealthy != 0 {
+		t.Errorf("forgotten unhealthy root still counted, got %d", unhealthy)
+	}
+}
+
+func TestHealthStatusJSON(t *testing.T) {
+	encoded, err := json.Marshal(rootHealth{Root: "/srv", Healthy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"root":"/srv","healthy":true,"consecutive_failures":0}`; string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
@@ -0,0 +1,191 @@
+package mirror
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistogramBuckets overrides the upper bounds of the buckets of the
+// histograms published in the `mirror_histograms` expvar map
+type HistogramBuckets struct {
+	// Buckets of the body_size_bytes histogram, in bytes. Default is
+	// powers of 4 from 1KiB to 16GiB.
+	Size []int64 `json:"size,omitempty"`
+
+	// Buckets of the write_duration_seconds histogram, the time from the
+	// first bytes of the body being written to the end of the body, which
+	// leaves out the time upstream takes to respond. Default is powers of
+	// 4 from 1ms to about 70m.
+	WriteDuration []caddy.Duration `json:"write_duration,omitempty"`
+
+	// Buckets of the finalize_duration_seconds histogram, the time taken
+	// to hash, rename and set the xattrs of a file once its body has been
+	// written. Default is powers of 4 from 100µs to about 26s.
+	FinalizeDuration []caddy.Duration `json:"finalize_duration,omitempty"`
+}
+
+var (
+	defaultSizeBuckets             = exponentialBuckets(1<<10, 4, 13)
+	defaultWriteDurationBuckets    = exponentialBuckets(0.001, 4, 12)
+	defaultFinalizeDurationBuckets = exponentialBuckets(0.0001, 4, 10)
+)
+
+// exponentialBuckets returns count bucket bounds starting at start, each
+// factor times the previous one
+func exponentialBuckets(start float64, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// histogram is a distribution of observed values. It is published with
+// expvar as the cumulative count of values up to each bound, like
+// Prometheus histograms.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts are the number of values in each bucket, with the last one for
+	// values above all bounds
+	counts []int64
+	sum    float64
+}
+
+// setBounds sets the upper bounds of the buckets, resetting the
+// histogram if they change
+func (h *histogram) setBounds(bounds []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if slices.Equal(h.bounds, bounds) {
+		return
+	}
+	h.bounds = bounds
+	h.counts = make([]int64, len(bounds)+1)
+	h.sum = 0
+}
+
+// observe adds value to the histogram
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, _ := slices.BinarySearch(h.bounds, value)
+	h.counts[i]++
+	h.sum += value
+}
+
+// String returns the histogram as JSON, for expvar
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	var count int64
+	for i, n := range h.counts {
+		count += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+			b.WriteString(fmt.Sprintf("%q: %d, ", le, count))
+		} else {
+			b.WriteString(fmt.Sprintf("%q: %d", le, count))
+		}
+	}
+	b.WriteString(fmt.Sprintf(`}, "count": %d, "sum": %s}`, count, strconv.FormatFloat(h.sum, 'g', -1, 64)))
+	return b.String()
+}
+
+// histograms are the histograms of a mirror handler, published under its
+// name in the "mirror_histograms" expvar map
+type histograms struct {
+	bodySize         histogram
+	writeDuration    histogram
+	finalizeDuration histogram
+}
+
+var expvarHistograms = expvar.NewMap("mirror_histograms")
+
+// newHistograms returns the histograms published under name
+func newHistograms(name string) *histograms {
+	h := new(histograms)
+	h.setBuckets(nil)
+	m := new(expvar.Map).Init()
+	m.Set("body_size_bytes", &h.bodySize)
+	m.Set("write_duration_seconds", &h.writeDuration)
+	m.Set("finalize_duration_seconds", &h.finalizeDuration)
+	expvarHistograms.Set(name, m)
+	return h
+}
+
+// setBuckets sets the bucket bounds configured in hb, or the defaults
+func (h *histograms) setBuckets(hb *HistogramBuckets) {
+	size, write, finalize := defaultSizeBuckets, defaultWriteDurationBuckets, defaultFinalizeDurationBuckets
+	if hb != nil {
+		if len(hb.Size) > 0 {
+			size = make([]float64, len(hb.Size))
+			for i, bound := range hb.Size {
+				size[i] = float64(bound)
+			}
+		}
+		if len(hb.WriteDuration) > 0 {
+			write = durationBuckets(hb.WriteDuration)
+		}
+		if len(hb.FinalizeDuration) > 0 {
+			finalize = durationBuckets(hb.FinalizeDuration)
+		}
+	}
+	h.bodySize.setBounds(size)
+	h.writeDuration.setBounds(write)
+	h.finalizeDuration.setBounds(finalize)
+}
+
+// durationBuckets returns the bounds of durations in seconds
+func durationBuckets(durations []caddy.Duration) []float64 {
+	bounds := make([]float64, len(durations))
+	for i, d := range durations {
+		bounds[i] = time.Duration(d).Seconds()
+	}
+	return bounds
+}
+
+// validate checks that the bounds are positive and ascending
+func (hb *HistogramBuckets) validate() error {
+	for name, bounds := range map[string][]int64{
+		"size":              hb.Size,
+		"write_duration":    int64s(hb.WriteDuration),
+		"finalize_duration": int64s(hb.FinalizeDuration),
+	} {
+		for i, bound := range bounds {
+			if bound <= 0 {
+				return fmt.Errorf("histogram_buckets %s must be positive", name)
+			}
+			if i > 0 && bound <= bounds[i-1] {
+				return fmt.Errorf("histogram_buckets %s must be ascending", name)
+			}
+		}
+	}
+	return nil
+}
+
+func int64s(durations []caddy.Duration) []int64 {
+	values := make([]int64, len(durations))
+	for i, d := range durations {
+		values[i] = int64(d)
+	}
+	return values
+}
+
+// observeFile adds a mirrored file of size bytes, whose body took write
+// and finalizing it took finalize, to the histograms
+func (h *histograms) observeFile(size int64, write time.Duration, finalize time.Duration) {
+	h.bodySize.observe(float64(size))
+	h.writeDuration.observe(write.Seconds())
+	h.finalizeDuration.observe(finalize.Seconds())
+}
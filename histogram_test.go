@@ -0,0 +1,104 @@
+package mirror
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistograms(t *testing.T) {
+	type histogramVar struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+	}
+	readHistograms := func() map[string]histogramVar {
+		rec := httptest.NewRecorder()
+		expvar.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+		var vars struct {
+			Histograms map[string]map[string]histogramVar `json:"mirror_histograms"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return vars.Histograms["histogram_test"]
+	}
+
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Name: "histogram_test", HistogramBuckets: &HistogramBuckets{Size: []int64{10, 100}}})
+	for _, body := range []string{"small", strings.Repeat("x", 50), strings.Repeat("x", 500)} {
+		serveMirror(mir, "/"+body[:1]+".bin", func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+			return nil
+		})
+	}
+	histograms := readHistograms()
+	size := histograms["body_size_bytes"]
+	expected := map[string]int64{"10": 1, "100": 2, "+Inf": 3}
+	for le, count := range expected {
+		if size.Buckets[le] != count {
+			t.Errorf("expected %d sizes up to %s, got %v", count, le, size.Buckets)
+		}
+	}
+	if size.Count != 3 || size.Sum != 555 {
+		t.Errorf("expected 3 sizes summing to 555, got %+v", size)
+	}
+	for _, name := range []string{"write_duration_seconds", "finalize_duration_seconds"} {
+		if histograms[name].Count != 3 || len(histograms[name].Buckets) < 2 {
+			t.Errorf("expected 3 %s in default buckets, got %+v", name, histograms[name])
+		}
+	}
+
+	// Changing the buckets resets the histograms
+	provisionTestMirror(t, &Mirror{Root: t.TempDir(), Name: "histogram_test", HistogramBuckets: &HistogramBuckets{Size: []int64{1000}}})
+	if size := readHistograms()["body_size_bytes"]; size.Count != 0 || len(size.Buckets) != 2 {
+		t.Errorf("expected histogram reset with new buckets, got %+v", size)
+	}
+}
+
+func TestWriteDurationHistogram(t *testing.T) {
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Name: "histogram_write_test"})
+	serveMirror(mir, "/slow.bin", func(w http.ResponseWriter, r *http.Request) error {
+		// Upstream takes its time to respond, then sends the body at once
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	h := &mir.stats.histograms.writeDuration
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sum >= 0.05 {
+		t.Errorf("expected the write duration to leave out the time to first byte, got %vs", h.sum)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		histogram_buckets {
+			size 1KiB 1MiB
+			write_duration 100ms 1s
+		}
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	hb := mir.HistogramBuckets
+	if hb == nil || len(hb.Size) != 2 || hb.Size[1] != 1<<20 || len(hb.WriteDuration) != 2 || hb.WriteDuration[0] != caddy.Duration(100*time.Millisecond) {
+		t.Errorf("unexpected histogram_buckets %+v", hb)
+	}
+	if err := mir.Validate(); err != nil {
+		t.Error(err)
+	}
+	mir.HistogramBuckets.Size = []int64{100, 10}
+	if err := mir.Validate(); err == nil {
+		t.Error("expected descending buckets to be invalid")
+	}
+}
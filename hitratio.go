@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// hitRatioWindow is the period the rolling hit ratio is computed over
+	hitRatioWindow = 5 * time.Minute
+	// hitRatioSlots is the number of slots hitRatioWindow is divided into,
+	// which expire one at a time
+	hitRatioSlots = 30
+)
+
+// rollingRatio counts requests and the hits among them over the last
+// hitRatioWindow
+type rollingRatio struct {
+	mu    sync.Mutex
+	slots [hitRatioSlots]ratioSlot
+}
+
+// ratioSlot counts the requests of a period of hitRatioWindow/hitRatioSlots,
+// the index-th since the epoch
+type ratioSlot struct {
+	index    int64
+	hits     int64
+	requests int64
+}
+
+// slotIndex returns the index of the slot now falls in
+func slotIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(hitRatioWindow/hitRatioSlots)
+}
+
+// add counts a request at now, which is a hit if hit is set
+func (rr *rollingRatio) add(hit bool, now time.Time) {
+	index := slotIndex(now)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	slot := &rr.slots[index%hitRatioSlots]
+	if slot.index != index {
+		*slot = ratioSlot{index: index}
+	}
+	slot.requests++
+	if hit {
+		slot.hits++
+	}
+}
+
+// ratio returns the ratio of hits among the requests of the window ending
+// at now, and the number of requests. ok is false if there were none.
+func (rr *rollingRatio) ratio(now time.Time) (ratio float64, requests int64, ok bool) {
+	index := slotIndex(now)
+	var hits int64
+	rr.mu.Lock()
+	for _, slot := range rr.slots {
+		if slot.index > index-hitRatioSlots && slot.index <= index {
+			hits += slot.hits
+			requests += slot.requests
+		}
+	}
+	rr.mu.Unlock()
+	if requests == 0 {
+		return 0, 0, false
+	}
+	return float64(hits) / float64(requests), requests, true
+}
+
+// hit counts a request served from a local copy, whatever kept the next
+// handler from serving it
+func (s *stats) hit() {
+	s.hitRatio.add(true, time.Now())
+}
+
+// miss counts a request that could have been served from a local copy, but
+// was passed on to the next handler, with fetched bytes of its response
+func (s *stats) miss(fetched int64) {
+	s.misses.Add(1)
+	s.bytesFetched.Add(fetched)
+	s.hitRatio.add(false, time.Now())
+}
+
+// isBackground reports whether w is the response writer of a background
+// refresh rather than of a client, whose requests don't count as hits or
+// misses
+func isBackground(w http.ResponseWriter) bool {
+	_, ok := w.(*backgroundResponseWriter)
+	return ok
+}
+
+// countingResponseWriter counts the bytes of the body written to it, still
+// letting the next ResponseWriter use its own io.ReaderFrom
+type countingResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	written int64
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriterWrapper.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := cw.ResponseWriterWrapper.ReadFrom(r)
+	cw.written += n
+	return n, err
+}
@@ -0,0 +1,101 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollingRatio(t *testing.T) {
+	var rr rollingRatio
+	start := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	if _, _, ok := rr.ratio(start); ok {
+		t.Error("expected no ratio without requests")
+	}
+	rr.add(true, start)
+	rr.add(false, start.Add(time.Minute))
+	rr.add(true, start.Add(2*time.Minute))
+	rr.add(true, start.Add(3*time.Minute))
+
+	testCases := []struct {
+		at       time.Duration
+		ratio    float64
+		requests int64
+	}{
+		{at: 3 * time.Minute, ratio: 0.75, requests: 4},
+		{at: hitRatioWindow + 30*time.Second, ratio: 2.0 / 3, requests: 3},
+		{at: hitRatioWindow + 2*time.Minute + 30*time.Second, ratio: 1, requests: 1},
+		{at: hitRatioWindow + 4*time.Minute, requests: 0},
+	}
+	for _, test := range testCases {
+		ratio, requests, _ := rr.ratio(start.Add(test.at))
+		if ratio != test.ratio || requests != test.requests {
+			t.Errorf("at %v: expected ratio %v of %d requests, got %v of %d", test.at, test.ratio, test.requests, ratio, requests)
+		}
+	}
+}
+
+func TestHitStats(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{
+		Root:               root,
+		Name:               "hit_stats_test",
+		MetadataFileSuffix: ".meta",
+		Fallback:           true,
+		ReadThrough:        []*ReadThrough{{TTL: caddy.Duration(time.Hour)}},
+	})
+	upstream := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("0123456789"))
+		return nil
+	}
+	down := func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	}
+
+	// A miss, a fresh hit, then a fallback hit once the local copy is stale
+	steps := []caddyhttp.HandlerFunc{upstream, upstream, down}
+	for i, next := range steps {
+		if i == 2 {
+			err := mir.updateMetadata(filepath.Join(root, "file.txt"), xattrDownloaded, time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec, err := serveMirror(mir, "/file.txt", next)
+		if err != nil || rec.Body.String() != "0123456789" {
+			t.Fatalf("step %d: unexpected response %q: %v", i, rec.Body.String(), err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleStats(rec, httptest.NewRequest(http.MethodGet, "/mirror/stats", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var response []handlerHits
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	for _, hits := range response {
+		if hits.Name != "hit_stats_test" {
+			continue
+		}
+		if hits.FreshHits != 1 || hits.FallbackHits != 1 || hits.Misses != 1 {
+			t.Errorf("expected one fresh hit, one fallback hit and one miss, got %+v", hits)
+		}
+		if hits.BytesServedLocally != 20 || hits.BytesFetched != 10 {
+			t.Errorf("expected 20 bytes served locally and 10 fetched, got %+v", hits)
+		}
+		if hits.HitRatio == nil || *hits.HitRatio != 2.0/3 || hits.Requests != 3 {
+			t.Errorf("expected hit ratio 2/3 of 3 requests, got %v of %d", hits.HitRatio, hits.Requests)
+		}
+		return
+	}
+	t.Errorf("handler not reported: %s", rec.Body.String())
+}
@@ -0,0 +1,55 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+)
+
+// replaceImmutable calls replace to replace filename. With the immutable
+// option, the immutable attribute of the file being replaced is cleared
+// first, and set on the replacement afterwards. If replace fails, it is
+// set on the file being replaced again.
+func (mir *Mirror) replaceImmutable(filename string, replace func() error) error {
+	if !mir.Immutable {
+		return replace()
+	}
+	if err := setImmutable(filename, false); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := replace(); err != nil {
+		if err := setImmutable(filename, true); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			mir.logger.Error("failed to restore immutable attribute",
+				zap.String("path", filename),
+				zap.Error(err))
+		}
+		return err
+	}
+	return setImmutable(filename, true)
+}
+
+// clearImmutable clears the immutable attribute of filename with the
+// immutable option, so that it can be removed
+func (mir *Mirror) clearImmutable(filename string) error {
+	if !mir.Immutable {
+		return nil
+	}
+	if err := setImmutable(filename, false); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// updateImmutable calls update to change the xattrs of filename. If the
+// file has the immutable attribute, which forbids that, it is cleared
+// meanwhile and set again afterwards, whether or not with the immutable
+// option, as the commands operate on files mirrored with it.
+func updateImmutable(filename string, update func() error) error {
+	if immutable, err := isImmutable(filename); err != nil || !immutable {
+		return update()
+	}
+	if err := setImmutable(filename, false); err != nil {
+		return err
+	}
+	return errors.Join(update(), setImmutable(filename, true))
+}
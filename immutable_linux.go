@@ -0,0 +1,63 @@
+//go:build linux
+
+package mirror
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+const (
+	// fsImmutableFlag is FS_IMMUTABLE_FL, the flag set by chattr +i
+	fsImmutableFlag = 0x10
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// setImmutable sets or clears the immutable attribute of filename, if it
+// isn't already
+func setImmutable(filename string, immutable bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return &os.PathError{Op: "getflags", Path: filename, Err: err}
+	}
+	if (flags&fsImmutableFlag != 0) == immutable {
+		return nil
+	}
+	flags ^= fsImmutableFlag
+	if err := unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		return &os.PathError{Op: "setflags", Path: filename, Err: err}
+	}
+	return nil
+}
+
+// isImmutable reports whether filename has the immutable attribute
+func isImmutable(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	flags, err := unix.IoctlGetUint32(int(file.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, &os.PathError{Op: "getflags", Path: filename, Err: err}
+	}
+	return flags&fsImmutableFlag != 0, nil
+}
+
+// canSetImmutable reports whether the process has CAP_LINUX_IMMUTABLE,
+// which is required to set and clear the immutable attribute
+func canSetImmutable() (bool, error) {
+	hdr := unix.CapUserHeader{Version: linuxCapabilityVersion3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false, err
+	}
+	return data[0].Effective&(1<<unix.CAP_LINUX_IMMUTABLE) != 0, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package mirror
+
+import (
+	"errors"
+)
+
+// setImmutable is not supported
+func setImmutable(filename string, immutable bool) error {
+	return errors.ErrUnsupported
+}
+
+// isImmutable is not supported
+func isImmutable(filename string) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+// canSetImmutable is not supported
+func canSetImmutable() (bool, error) {
+	return false, errors.ErrUnsupported
+}
@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImmutable(t *testing.T) {
+	if ok, err := canSetImmutable(); !ok {
+		t.Skipf("can't set the immutable attribute: %v", err)
+	}
+	root := t.TempDir()
+	filename := filepath.Join(root, "file.txt")
+	t.Cleanup(func() {
+		// Let the temporary directory be removed
+		setImmutable(filename, false)
+	})
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Immutable: true})
+
+	for _, content := range []string{"v1", "v2"} {
+		_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("ETag", `"`+content+`"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(content))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filename); err != nil || string(data) != content {
+			t.Fatalf("expected mirrored file with %q, got %q, error: %v", content, data, err)
+		}
+		if immutable, err := isImmutable(filename); err != nil || !immutable {
+			t.Fatalf("expected mirrored file %q to be immutable, error: %v", content, err)
+		}
+		if err := os.WriteFile(filename, []byte("modified"), filePerms); err == nil {
+			t.Fatal("immutable file could be modified")
+		}
+	}
+
+	if err := mir.removeEntry(filename); err != nil {
+		t.Fatalf("failed to remove immutable file: %v", err)
+	}
+	for _, name := range []string{filename, filename + ".etag"} {
+		if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s not removed, stat error: %v", name, err)
+		}
+	}
+}
+
+func TestReplaceImmutableFailure(t *testing.T) {
+	if ok, err := canSetImmutable(); !ok {
+		t.Skipf("can't set the immutable attribute: %v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, []byte("content"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setImmutable(filename, false)
+	})
+	if err := setImmutable(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	mir := &Mirror{Immutable: true, logger: zap.NewNop()}
+
+	failure := errors.New("replace failed")
+	err := mir.replaceImmutable(filename, func() error {
+		// The attribute is cleared while replacing
+		if immutable, err := isImmutable(filename); err != nil || immutable {
+			t.Errorf("file still immutable while being replaced, error: %v", err)
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("expected replace error, got %v", err)
+	}
+	if immutable, err := isImmutable(filename); err != nil || !immutable {
+		t.Errorf("expected immutable attribute restored after failed replace, error: %v", err)
+	}
+}
+
+func TestUpdateImmutable(t *testing.T) {
+	if ok, err := canSetImmutable(); !ok {
+		t.Skipf("can't set the immutable attribute: %v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, []byte("content"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setImmutable(filename, false)
+	})
+	if err := setImmutable(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	err := updateImmutable(filename, func() error {
+		return xattr.Set(filename, xattrAccessed, []byte("now"))
+	})
+	if err != nil {
+		t.Fatalf("failed to set xattr of immutable file: %v", err)
+	}
+	if value, err := xattr.Get(filename, xattrAccessed); err != nil || string(value) != "now" {
+		t.Errorf("expected xattr set, got %q, error: %v", value, err)
+	}
+	if immutable, err := isImmutable(filename); err != nil || !immutable {
+		t.Errorf("expected immutable attribute restored, error: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package mirror
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightRateInterval is the period over which the rate of in-flight
+// writes is measured, the rate reported covers the last one or two
+const inflightRateInterval = 5 * time.Second
+
+var (
+	inflightMu sync.RWMutex
+	// inflight are the mirror files being written by all handlers, by ID,
+	// for the admin API
+	inflight   = make(map[uint64]*inflightWrite)
+	inflightID atomic.Uint64
+)
+
+// inflightWrite is the progress of a mirror file being written. Only the
+// bytes written and the rate marks change once it is registered, which
+// the writer updates atomically.
+type inflightWrite struct {
+	id       uint64
+	name     string
+	path     string
+	url      string
+	expected int64
+	start    time.Time
+
+	written atomic.Int64
+	// prev is the mark the rate is measured from, mark the one replacing
+	// it once an inflightRateInterval has passed since, which only the
+	// writer touches
+	prev atomic.Pointer[rateMark]
+	mark rateMark
+	// abandoned is set to have the writer give up the file
+	abandoned atomic.Bool
+}
+
+// rateMark is the number of bytes written by a time
+type rateMark struct {
+	bytes int64
+	time  time.Time
+}
+
+// startInflight registers the mirror file just created as in-flight
+func (rww *responseWriterWrapper) startInflight() {
+	iw := &inflightWrite{
+		id:       inflightID.Add(1),
+		name:     rww.config.stats.name,
+		path:     rww.filename,
+		url:      rww.url,
+		expected: rww.bytesExpected,
+		start:    rww.start,
+		mark:     rateMark{time: rww.start},
+	}
+	iw.prev.Store(&rateMark{time: rww.start})
+	inflightMu.Lock()
+	inflight[iw.id] = iw
+	inflightMu.Unlock()
+	rww.config.stats.inFlight.Add(1)
+	rww.inflight = iw
+}
+
+// endInflight unregisters the mirror file, once it is no longer written
+func (rww *responseWriterWrapper) endInflight() {
+	rww.config.stats.inFlight.Add(-1)
+	if rww.inflight == nil {
+		return
+	}
+	inflightMu.Lock()
+	delete(inflight, rww.inflight.id)
+	inflightMu.Unlock()
+	rww.inflight = nil
+}
+
+// wrote records that n more bytes have been written by now
+func (iw *inflightWrite) wrote(n int64, now time.Time) {
+	written := iw.written.Add(n)
+	if now.Sub(iw.mark.time) >= inflightRateInterval {
+		prev := iw.mark
+		iw.prev.Store(&prev)
+		iw.mark = rateMark{bytes: written, time: now}
+	}
+}
+
+// abandon stops mirroring the response if its file was abandoned through
+// the admin API, reporting whether it was
+func (rww *responseWriterWrapper) abandon() bool {
+	if rww.inflight == nil || !rww.inflight.abandoned.Load() {
+		return false
+	}
+	rww.discard(zapcore.WarnLevel, "abandoned through the admin API", false)
+	return true
+}
+
+type inflightStatus struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	// Path the file is written to, and URL it is mirrored from
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// BytesWritten so far, out of BytesExpected, the Content-Length of the
+	// response, or -1 if unknown
+	BytesWritten  int64  `json:"bytes_written"`
+	BytesExpected int64  `json:"bytes_expected"`
+	Elapsed       string `json:"elapsed"`
+	// BytesPerSecond is the rate the file has been written at lately
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	Abandoned      bool  `json:"abandoned,omitempty"`
+}
+
+// status returns the progress of the write at now
+func (iw *inflightWrite) status(now time.Time) inflightStatus {
+	written := iw.written.Load()
+	prev := iw.prev.Load()
+	var rate int64
+	if elapsed := now.Sub(prev.time); elapsed > 0 {
+		rate = int64(float64(written-prev.bytes) / elapsed.Seconds())
+	}
+	return inflightStatus{
+		ID:             iw.id,
+		Name:           iw.name,
+		Path:           iw.path,
+		URL:            iw.url,
+		BytesWritten:   written,
+		BytesExpected:  iw.expected,
+		Elapsed:        now.Sub(iw.start).Round(time.Millisecond).String(),
+		BytesPerSecond: rate,
+		Abandoned:      iw.abandoned.Load(),
+	}
+}
+
+// handleInflight lists the mirror files being written, oldest first, or
+// abandons the one whose ID follows the path with DELETE. An abandoned
+// file is discarded by its writer when it next writes to it.
+func (adminAPI) handleInflight(w http.ResponseWriter, r *http.Request) error {
+	if id, ok := strings.CutPrefix(r.URL.Path, "/mirror/inflight/"); ok && id != "" {
+		return abandonInflight(w, r, id)
+	}
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	now := time.Now()
+	response := []inflightStatus{}
+	inflightMu.RLock()
+	for _, iw := range inflight {
+		response = append(response, iw.status(now))
+	}
+	inflightMu.RUnlock()
+	slices.SortFunc(response, func(a, b inflightStatus) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// abandonInflight abandons the write with id
+func abandonInflight(w http.ResponseWriter, r *http.Request, id string) error {
+	if r.Method != http.MethodDelete {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid in-flight write ID %q", id),
+		}
+	}
+	inflightMu.RLock()
+	iw, ok := inflight[n]
+	inflightMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no in-flight write %d", n),
+		}
+	}
+	iw.abandoned.Store(true)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,76 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInflight(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, Name: "inflight_test"})
+	list := func() []inflightStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleInflight(rec, httptest.NewRequest(http.MethodGet, "/mirror/inflight", nil)); err != nil {
+			t.Fatal(err)
+		}
+		var response []inflightStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		var mine []inflightStatus
+		for _, status := range response {
+			if status.Name == "inflight_test" {
+				mine = append(mine, status)
+			}
+		}
+		return mine
+	}
+	for _, abandon := range []bool{false, true} {
+		t.Run(fmt.Sprintf("abandon %v", abandon), func(t *testing.T) {
+			_, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Length", "10")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("01234"))
+				writes := list()
+				if len(writes) != 1 {
+					t.Fatalf("expected one in-flight write, got %+v", writes)
+				}
+				status := writes[0]
+				if status.Path != filepath.Join(root, "file.bin") || status.URL != "http://example.com/file.bin" ||
+					status.BytesWritten != 5 || status.BytesExpected != 10 || status.BytesPerSecond <= 0 {
+					t.Errorf("unexpected in-flight write %+v", status)
+				}
+				if abandon {
+					rec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/mirror/inflight/%d", status.ID), nil)
+					if err := (adminAPI{}).handleInflight(rec, req); err != nil || rec.Code != http.StatusNoContent {
+						t.Errorf("abandoning in-flight write failed: %d %v", rec.Code, err)
+					}
+				}
+				w.Write([]byte("56789"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "file.bin")); (err == nil) == abandon {
+				t.Errorf("expected mirrored %v, got %v", !abandon, err)
+			}
+			if writes := list(); len(writes) != 0 {
+				t.Errorf("expected in-flight write gone, got %+v", writes)
+			}
+			os.Remove(filepath.Join(root, "file.bin"))
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/mirror/inflight/0", nil)
+	if err := (adminAPI{}).handleInflight(httptest.NewRecorder(), req); err == nil {
+		t.Error("expected unknown in-flight write not found")
+	}
+}
@@ -0,0 +1,369 @@
+package mirror
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// verifyOptions configure the verification of a mirror root
+type verifyOptions struct {
+	prefix string
+	fix    bool
+	// quarantine is the directory corrupt files are moved to when fixing,
+	// instead of being deleted
+	quarantine string
+	// rate is the maximum number of bytes read per second, if positive
+	rate int64
+	// progress is called every progressInterval with the summary so far
+	progress         func(verifySummary)
+	progressInterval time.Duration
+}
+
+// corruptFile is a mirrored file whose content doesn't match its digest
+type corruptFile struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// verifyError is a file that couldn't be verified or fixed
+type verifyError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// verifySummary is the outcome of verifying a mirror root, printed as JSON
+type verifySummary struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Verified is the number of files whose digest was checked
+	Verified int `json:"verified"`
+	// HashSkipped is the number of files that weren't hashed when they
+	// were mirrored, with max_hash_size, so can't be verified
+	HashSkipped int `json:"hash_skipped"`
+	// Corrupt are the files that don't match their digest
+	Corrupt []corruptFile `json:"corrupt"`
+	// MissingEtag are the files without ETag sidecar file
+	MissingEtag []string `json:"missing_etag"`
+	// Orphans are the sidecar files and precompressed variants of files
+	// that don't exist
+	Orphans []string      `json:"orphans"`
+	Errors  []verifyError `json:"errors"`
+	// Fixed is the number of corrupt files and orphans removed
+	Fixed int `json:"fixed"`
+}
+
+// problems returns the number of problems found
+func (vs verifySummary) problems() int {
+	return len(vs.Corrupt) + len(vs.MissingEtag) + len(vs.Orphans) + len(vs.Errors)
+}
+
+func verifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify --root <path> [--prefix <path>] [--fix [--quarantine <dir>]] [--rate <size>] [--progress <interval>]",
+		Short: "Verifies the integrity of mirrored files",
+		Long: `
+Checks the mirrored files of a root: their content against the SHA-256
+digest recorded in their metadata, if any, that they have an ETag sidecar
+file with --etag-suffix, and that sidecar files and precompressed variants
+belong to a mirrored file. A JSON summary is printed, and the exit status
+is non-zero if problems were found.
+
+With --fix, corrupt files are deleted along with their sidecar files, or
+moved to the --quarantine directory, and orphaned sidecar files are deleted.
+Progress is reported on stderr.`,
+		Example: "caddy mirror verify --root /srv/mirror --metadata-suffix .meta --rate 200MiB --fix",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return cmdVerify(caddycmd.Flags{FlagSet: cmd.Flags()}, cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	layoutFlags(cmd)
+	cmd.Flags().String("prefix", "/", "Only verify files under this URL path prefix")
+	cmd.Flags().Bool("fix", false, "Delete corrupt files and orphaned sidecar files")
+	cmd.Flags().String("quarantine", "", "Move corrupt files to this directory instead of deleting them, with --fix")
+	cmd.Flags().String("rate", "", "Maximum number of bytes read per second, e.g. 200MiB")
+	cmd.Flags().Duration("progress", 10*time.Second, "Interval to report progress at, 0 for none")
+	return cmd
+}
+
+func cmdVerify(flags caddycmd.Flags, stdout io.Writer, stderr io.Writer) error {
+	mir, err := mirrorFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	// Digests are read from xattrs where there are any
+	mir.UseXattr = true
+	opts := verifyOptions{
+		prefix:           prefixFlag(flags),
+		fix:              flags.Bool("fix"),
+		quarantine:       flags.String("quarantine"),
+		progressInterval: flags.Duration("progress"),
+		progress: func(vs verifySummary) {
+			fmt.Fprintf(stderr, "verified %d files, %s, %d problems\n", vs.Files, humanize.IBytes(uint64(vs.Bytes)), vs.problems())
+		},
+	}
+	if rate := flags.String("rate"); rate != "" {
+		size, err := humanize.ParseBytes(rate)
+		if err != nil {
+			return fmt.Errorf("invalid --rate: %v", err)
+		}
+		opts.rate = int64(size)
+	}
+	if opts.quarantine != "" {
+		if !opts.fix {
+			return errors.New("--quarantine requires --fix")
+		}
+		if opts.quarantine, err = filepath.Abs(opts.quarantine); err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(mir.Root, opts.quarantine); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("quarantine directory %s must be outside of the root", opts.quarantine)
+		}
+	}
+	summary := mir.verify(mir.Root, opts)
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(summary); err != nil {
+		return err
+	}
+	if problems := summary.problems(); problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	return nil
+}
+
+// verify checks the mirrored files in root under the prefix of opts, and
+// the sidecar files and variants alongside them, fixing what it can if
+// asked to
+func (mir *Mirror) verify(root string, opts verifyOptions) verifySummary {
+	summary := verifySummary{
+		Corrupt:     []corruptFile{},
+		MissingEtag: []string{},
+		Orphans:     []string{},
+		Errors:      []verifyError{},
+	}
+	failed := func(filename string, err error) {
+		summary.Errors = append(summary.Errors, verifyError{Path: filename, Error: err.Error()})
+	}
+	limiter := newByteLimiter(opts.rate)
+	lastProgress := time.Now()
+	filepath.WalkDir(prefixDir(root, opts.prefix), func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				failed(filename, err)
+			}
+			return nil
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || strings.HasPrefix(name, ".") || isPartialFile(name) {
+			return nil
+		}
+		urlp, err := relativeURLPath(root, filename)
+		if err != nil || !matchPath(urlp, opts.prefix, "") {
+			return nil
+		}
+		if opts.progress != nil && opts.progressInterval > 0 && time.Since(lastProgress) >= opts.progressInterval {
+			opts.progress(summary)
+			lastProgress = time.Now()
+		}
+		if !mir.isEntry(filename) {
+			owner := mir.sidecarOwner(filename)
+			if owner == "" {
+				return nil
+			}
+			if _, err := os.Lstat(owner); !errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if _, err := os.Lstat(filename); err != nil {
+				// Removed along with a corrupt file
+				return nil
+			}
+			summary.Orphans = append(summary.Orphans, filename)
+			if opts.fix {
+				if err := os.Remove(filename); err != nil {
+					failed(filename, err)
+				} else {
+					summary.Fixed++
+				}
+			}
+			return nil
+		}
+		summary.Files++
+		if info, err := d.Info(); err == nil {
+			summary.Bytes += info.Size()
+		}
+		if mir.EtagFileSuffix != "" && !mir.hasEtagSidecar(filename) {
+			summary.MissingEtag = append(summary.MissingEtag, filename)
+		}
+		meta := mir.readMetadata(filename)
+		expected := meta[xattrSha256]
+		if expected == "" {
+			if meta[xattrHashSkipped] != "" {
+				summary.HashSkipped++
+			}
+			return nil
+		}
+		actual, err := hashFile(filename, limiter)
+		if err != nil {
+			failed(filename, err)
+			return nil
+		}
+		summary.Verified++
+		if actual == expected {
+			return nil
+		}
+		summary.Corrupt = append(summary.Corrupt, corruptFile{Path: filename, Expected: expected, Actual: actual})
+		if !opts.fix {
+			return nil
+		}
+		if opts.quarantine != "" {
+			err = mir.quarantineFile(filename, opts.quarantine, expected, actual)
+		} else {
+			err = mir.removeEntry(filename)
+		}
+		if err != nil {
+			failed(filename, err)
+		} else {
+			summary.Fixed++
+		}
+		return nil
+	})
+	return summary
+}
+
+// sidecarOwner returns the mirrored file or variant the sidecar file or
+// precompressed variant filename belongs to, or "" if it isn't one that
+// should only exist alongside it. Tombstones are left out, as they stand in
+// for files that don't exist, and so are files with the suffix of a variant
+// not marked as one, which were mirrored as such.
+func (mir *Mirror) sidecarOwner(filename string) string {
+	if owner, ok := mir.trimEtagSuffix(filename); ok {
+		return owner
+	}
+	suffixes := make([]string, 0, len(mir.Precompress)+2)
+	if mir.isVariant(filename) {
+		for _, encoding := range mir.Precompress {
+			suffixes = append(suffixes, precompressSuffixes[encoding])
+		}
+	}
+	if mir.MetadataFileSuffix != "" {
+		suffixes = append(suffixes, mir.MetadataFileSuffix)
+	}
+	if mir.StoreResponseMeta != nil {
+		suffixes = append(suffixes, ResponseMetaSuffix)
+	}
+	for _, suffix := range suffixes {
+		if owner, ok := strings.CutSuffix(filename, suffix); ok && !strings.HasSuffix(owner, string(filepath.Separator)) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// hasEtagSidecar reports whether the mirrored file filename has an ETag
+// sidecar file
+func (mir *Mirror) hasEtagSidecar(filename string) bool {
+	for _, sidecar := range mir.etagSidecars(filename) {
+		if _, err := os.Stat(sidecar); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantineFile moves the corrupt mirrored file filename to the directory
+// dir, next to a quarantine info file, and removes its sidecar files and
+// variants
+func (mir *Mirror) quarantineFile(filename string, dir string, expected string, actual string) error {
+	var random [4]byte
+	rand.Read(random[:])
+	now := time.Now().UTC()
+	quarantined := filepath.Join(dir, now.Format("20060102T150405Z")+"-"+hex.EncodeToString(random[:])+"-"+filepath.Base(filename))
+	info, err := json.MarshalIndent(quarantineInfo{
+		URL:      mir.readMetadata(filename)[xattrOriginURL],
+		Path:     filename,
+		Digest:   "sha256",
+		Expected: expected,
+		Actual:   actual,
+		Time:     now,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := mir.clearImmutable(filename); err != nil {
+		return err
+	}
+	if err := mir.moveFile(dir, filename, quarantined); err != nil {
+		return err
+	}
+	if err := mir.writeFile(quarantined+quarantineInfoSuffix, info); err != nil {
+		return err
+	}
+	return mir.removeEntry(filename)
+}
+
+// hashFile returns the hex SHA-256 digest of the content of filename, read
+// at the rate of limiter
+func hashFile(filename string, limiter *byteLimiter) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, limiter.reader(file)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// byteLimiter limits the rate bytes are read at, on average since it was
+// created. A nil byteLimiter doesn't limit.
+type byteLimiter struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: rate, start: time.Now()}
+}
+
+// reader returns r read at the rate of the limiter
+func (bl *byteLimiter) reader(r io.Reader) io.Reader {
+	if bl == nil {
+		return r
+	}
+	return readerFunc(func(p []byte) (int, error) {
+		// Keep reads small enough for the pauses to be short
+		n, err := r.Read(p[:min(len(p), int(max(bl.rate/10, 1)))])
+		bl.read += int64(n)
+		if ahead := time.Duration(float64(bl.read)/float64(bl.rate)*float64(time.Second)) - time.Since(bl.start); ahead > 0 {
+			time.Sleep(ahead)
+		}
+		return n, err
+	})
+}
+
+// readerFunc adapts a function to the io.Reader interface
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,193 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/xattr"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCommand(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	meta, _ := json.Marshal(map[string]string{xattrSha256: hex.EncodeToString(sum[:])})
+	files := map[string]string{
+		"good.bin":               "content",
+		"good.bin.etag":          `"1"`,
+		"good.bin.meta":          string(meta),
+		"corrupt.bin":            "tampered",
+		"corrupt.bin.etag":       `"2"`,
+		"corrupt.bin.meta":       string(meta),
+		"noetag.bin":             "content",
+		"gone.bin.etag":          `"3"`,
+		"gone.bin.meta":          string(meta),
+		"dir/.partial.bin~":      "ignored",
+		"dir/unchecked.bin":      "no digest",
+		"dir/unchecked.bin.etag": `"4"`,
+	}
+	testCases := []struct {
+		name        string
+		args        []string
+		corrupt     []string
+		missingEtag []string
+		orphans     []string
+		removed     []string
+		quarantined bool
+	}{
+		{
+			name:        "report",
+			corrupt:     []string{"corrupt.bin"},
+			missingEtag: []string{"noetag.bin"},
+			orphans:     []string{"gone.bin.etag", "gone.bin.meta"},
+		},
+		{
+			name:    "prefix",
+			args:    []string{"--prefix", "/corrupt"},
+			corrupt: []string{"corrupt.bin"},
+		},
+		{
+			name:        "fix",
+			args:        []string{"--fix"},
+			corrupt:     []string{"corrupt.bin"},
+			missingEtag: []string{"noetag.bin"},
+			orphans:     []string{"gone.bin.etag", "gone.bin.meta"},
+			removed:     []string{"corrupt.bin", "corrupt.bin.etag", "corrupt.bin.meta", "gone.bin.etag", "gone.bin.meta"},
+		},
+		{
+			name:        "quarantine",
+			args:        []string{"--prefix", "/corrupt", "--fix", "--quarantine"},
+			corrupt:     []string{"corrupt.bin"},
+			removed:     []string{"corrupt.bin", "corrupt.bin.etag", "corrupt.bin.meta"},
+			quarantined: true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range files {
+				filename := filepath.Join(root, name)
+				os.MkdirAll(filepath.Dir(filename), 0o755)
+				if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			quarantine := t.TempDir()
+			args := append([]string{"--root", root, "--etag-suffix", ".etag", "--metadata-suffix", ".meta", "--progress", "0"}, test.args...)
+			if test.quarantined {
+				args = append(args, quarantine)
+			}
+			cmd := verifyCommand()
+			var stdout, stderr bytes.Buffer
+			cmd.SetArgs(args)
+			cmd.SetOut(&stdout)
+			cmd.SetErr(&stderr)
+			cmd.SilenceUsage = true
+			err := cmd.Execute()
+			if err == nil || !strings.Contains(err.Error(), "problems") {
+				t.Errorf("expected problems reported, got %v", err)
+			}
+
+			var summary verifySummary
+			if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil {
+				t.Fatalf("expected JSON summary, got %v:\n%s", err, stdout.String())
+			}
+			relative := func(paths []string) []string {
+				rel := []string{}
+				for _, p := range paths {
+					r, _ := filepath.Rel(root, p)
+					rel = append(rel, filepath.ToSlash(r))
+				}
+				return rel
+			}
+			var corrupt []string
+			for _, c := range summary.Corrupt {
+				corrupt = append(corrupt, c.Path)
+				if c.Actual == c.Expected {
+					t.Errorf("expected digests of %s to differ, got %s", c.Path, c.Actual)
+				}
+			}
+			for _, check := range []struct {
+				what     string
+				expected []string
+				actual   []string
+			}{
+				{"corrupt", test.corrupt, corrupt},
+				{"missing ETag", test.missingEtag, summary.MissingEtag},
+				{"orphans", test.orphans, summary.Orphans},
+			} {
+				actual := strings.Join(relative(check.actual), " ")
+				if expected := strings.Join(check.expected, " "); actual != expected {
+					t.Errorf("expected %s %q, got %q", check.what, expected, actual)
+				}
+			}
+			if len(summary.Errors) > 0 {
+				t.Errorf("expected no errors, got %v", summary.Errors)
+			}
+
+			removed := make(map[string]bool)
+			for _, name := range test.removed {
+				removed[name] = true
+			}
+			for name := range files {
+				_, err := os.Stat(filepath.Join(root, name))
+				if removed[name] != os.IsNotExist(err) {
+					t.Errorf("expected %s removed %v, got %v", name, removed[name], err)
+				}
+			}
+			entries, _ := os.ReadDir(quarantine)
+			if test.quarantined != (len(entries) == 2) {
+				t.Errorf("expected quarantined %v, got %d files", test.quarantined, len(entries))
+			}
+		})
+	}
+}
+
+func TestVerifyCommandClean(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.bin"), []byte("content"), 0o644)
+	os.WriteFile(filepath.Join(root, "file.bin.etag"), []byte(`"1"`), 0o644)
+	output, err := runCommand(verifyCommand(), "--root", root, "--etag-suffix", ".etag")
+	if err != nil {
+		t.Fatalf("expected no problems, got %v:\n%s", err, output)
+	}
+	if !strings.Contains(output, `"files": 1`) {
+		t.Errorf("expected 1 file in summary:\n%s", output)
+	}
+}
+
+func TestSidecarOwnerVariants(t *testing.T) {
+	root := t.TempDir()
+	mir := &Mirror{EtagFileSuffix: ".etag", Precompress: []string{"gzip"}}
+	for _, name := range []string{"archive.tar.gz", "file.txt.gz"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xattr.Set(filepath.Join(root, "file.txt.gz"), xattrPrecompressed, []byte("gzip")); err != nil {
+		t.Skip("xattrs not supported:", err)
+	}
+	if owner := mir.sidecarOwner(filepath.Join(root, "archive.tar.gz")); owner != "" {
+		t.Errorf("expected mirrored archive.tar.gz to have no owner, got %s", owner)
+	}
+	if owner := mir.sidecarOwner(filepath.Join(root, "file.txt.gz")); owner != filepath.Join(root, "file.txt") {
+		t.Errorf("expected variant owned by file.txt, got %q", owner)
+	}
+}
+
+func TestByteLimiter(t *testing.T) {
+	limiter := newByteLimiter(100 << 10)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, limiter.reader(bytes.NewReader(make([]byte, 50<<10))))
+	if err != nil || n != 50<<10 {
+		t.Fatalf("expected %d bytes read, got %d, error: %v", 50<<10, n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected reading to take about 500ms, took %v", elapsed)
+	}
+}
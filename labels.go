@@ -0,0 +1,140 @@
+package mirror
+
+import (
+	"expvar"
+	"fmt"
+	"mime"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Metric labels, all of low cardinality. Labels that would take a value
+// per path or per client are deliberately not offered.
+const (
+	labelName        = "name"
+	labelHost        = "host"
+	labelContentType = "content_type"
+
+	// otherLabel is the value of labels not in their allowlist
+	otherLabel = "other"
+
+	// maxLabelSets is the maximum number of distinct label sets per
+	// handler. Further sets are counted with the host label "other".
+	maxLabelSets = 100
+)
+
+// labeledStats are the counters kept for a set of labels
+type labeledStats struct {
+	filesWritten expvar.Int
+	bytesWritten expvar.Int
+	discards     expvar.Int
+}
+
+// validateLabels checks the metric_labels and metric_hosts config
+func (mir *Mirror) validateLabels() error {
+	for _, label := range mir.MetricLabels {
+		switch label {
+		case labelName, labelHost, labelContentType:
+		default:
+			return fmt.Errorf("unknown metric label %q, must be one of %s, %s or %s", label, labelName, labelHost, labelContentType)
+		}
+	}
+	if len(mir.MetricHosts) > 0 && !slices.Contains(mir.MetricLabels, labelHost) {
+		return fmt.Errorf("metric_hosts requires the %s metric label", labelHost)
+	}
+	if len(mir.MetricHosts) > maxLabelSets {
+		return fmt.Errorf("metric_hosts has %d hosts, at most %d are allowed", len(mir.MetricHosts), maxLabelSets)
+	}
+	return nil
+}
+
+// labeled returns the counters for the labels of a response for host with
+// contentType, or nil without metric labels
+func (mir *Mirror) labeled(host string, contentType string) *labeledStats {
+	if len(mir.MetricLabels) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(mir.MetricLabels))
+	hostIndex := -1
+	for _, label := range mir.MetricLabels {
+		var value string
+		switch label {
+		case labelName:
+			value = mir.Name
+		case labelHost:
+			value = mir.hostLabel(host)
+			hostIndex = len(values)
+		case labelContentType:
+			value = contentClass(contentType)
+		}
+		values = append(values, label+"="+value)
+	}
+	ls := mir.stats.labeledFor(strings.Join(values, ","))
+	if ls == nil && hostIndex >= 0 {
+		values[hostIndex] = labelHost + "=" + otherLabel
+		ls = mir.stats.labeledFor(strings.Join(values, ","))
+	}
+	return ls
+}
+
+// hostLabel returns the value of the host label for host
+func (mir *Mirror) hostLabel(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// Only configured hosts are reported as themselves, as the Host header
+	// is up to the client
+	if !slices.ContainsFunc(mir.MetricHosts, func(allowed string) bool {
+		return strings.EqualFold(allowed, host)
+	}) {
+		return otherLabel
+	}
+	return strings.ToLower(host)
+}
+
+// contentClass returns the coarse class of contentType: image, text or
+// binary
+func contentClass(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return "image"
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		mediaType == "application/javascript":
+		return "text"
+	default:
+		return "binary"
+	}
+}
+
+// labeledFor returns the counters for the label set key, published in the
+// "mirror_labeled" map. It returns nil if there are already maxLabelSets
+// other sets.
+func (s *stats) labeledFor(key string) *labeledStats {
+	s.labeledMu.Lock()
+	defer s.labeledMu.Unlock()
+	if ls, ok := s.labeled[key]; ok {
+		return ls
+	}
+	if len(s.labeled) >= maxLabelSets && !strings.Contains(key, labelHost+"="+otherLabel) {
+		return nil
+	}
+	if s.labeled == nil {
+		s.labeled = make(map[string]*labeledStats)
+		s.labeledVars = new(expvar.Map).Init()
+		expvarLabels.Set(s.name, s.labeledVars)
+	}
+	ls := new(labeledStats)
+	m := new(expvar.Map).Init()
+	m.Set("files_written", &ls.filesWritten)
+	m.Set("bytes_written", &ls.bytesWritten)
+	m.Set("discards", &ls.discards)
+	s.labeledVars.Set(key, m)
+	s.labeled[key] = ls
+	return ls
+}
@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricLabels(t *testing.T) {
+	mir := provisionTestMirror(t, &Mirror{
+		Root:         t.TempDir(),
+		Name:         "labels_test",
+		MetricLabels: []string{labelHost, labelContentType},
+		MetricHosts:  []string{"A.example"},
+	})
+	for _, request := range []struct {
+		host        string
+		path        string
+		contentType string
+	}{
+		{host: "a.example:8080", path: "/a.bin", contentType: "application/octet-stream"},
+		{host: "a.example", path: "/a.png", contentType: "image/png"},
+		{host: "b.example", path: "/b.json", contentType: "application/json; charset=utf-8"},
+		{host: "c.example", path: "/c.json", contentType: "application/json"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+request.host+request.path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", request.contentType)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, files := range map[string]int64{
+		"host=a.example,content_type=binary": 1,
+		"host=a.example,content_type=image":  1,
+		"host=other,content_type=text":       2,
+	} {
+		ls := mir.stats.labeled[key]
+		if ls == nil {
+			t.Errorf("no counters for %s, got %v", key, mir.stats.labeledVars)
+			continue
+		}
+		if written := ls.filesWritten.Value(); written != files {
+			t.Errorf("expected %d files written for %s, got %d", files, key, written)
+		}
+		if written := ls.bytesWritten.Value(); written != files*int64(len("content")) {
+			t.Errorf("expected %d bytes written for %s, got %d", files*int64(len("content")), key, written)
+		}
+	}
+	if len(mir.stats.labeled) != 3 {
+		t.Errorf("expected 3 label sets, got %v", mir.stats.labeledVars)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	for _, mir := range []*Mirror{
+		{MetricLabels: []string{"path"}},
+		{MetricLabels: []string{labelName}, MetricHosts: []string{"a.example"}},
+	} {
+		if err := mir.validateLabels(); err == nil {
+			t.Errorf("expected error for labels %v with hosts %v", mir.MetricLabels, mir.MetricHosts)
+		}
+	}
+}
+
+func TestHostLabel(t *testing.T) {
+	testCases := []struct {
+		hosts    []string
+		host     string
+		expected string
+	}{
+		{hosts: []string{"A.example"}, host: "a.example:443", expected: "a.example"},
+		{hosts: []string{"A.example"}, host: "random.example", expected: otherLabel},
+		// Without an allowlist, the Host header can't add label values
+		{host: "a.example", expected: otherLabel},
+	}
+	for _, test := range testCases {
+		mir := &Mirror{MetricHosts: test.hosts}
+		if actual := mir.hostLabel(test.host); actual != test.expected {
+			t.Errorf("host %q with metric_hosts %v: expected %q, got %q", test.host, test.hosts, test.expected, actual)
+		}
+	}
+}
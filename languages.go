@@ -0,0 +1,250 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Languages stores the variants of a file in different languages side by
+// side, for origins that serve the same URL in the language the client
+// accepts, rather than one replacing the other. A response is a language
+// variant if it has a Content-Language, or varies on Accept-Language, in
+// which case it is in the language negotiated for the request. Variants
+// are stored under the name of the file suffixed with their language tag,
+// such as page.html.de, and the variant in the default language under the
+// name of the file too. Local copies are served in the language the client
+// accepts best.
+type Languages struct {
+	// Language tags of the variants stored, such as en or pt-BR.
+	// Variants in other languages aren't mirrored.
+	Tags []string `json:"tags,omitempty"`
+
+	// Language of the variant also stored under the name of the file, and
+	// served to clients accepting none of tags. Default is the first of
+	// tags.
+	Default string `json:"default,omitempty"`
+}
+
+// validate checks that there are tags, which make valid file name
+// suffixes, and that the default is one of them
+func (l *Languages) validate() error {
+	if len(l.Tags) == 0 {
+		return errors.New("languages requires tags")
+	}
+	for _, tag := range l.Tags {
+		if tag == "" || strings.ContainsAny(tag, `/\. `) {
+			return errors.New("invalid language tag " + strconv.Quote(tag))
+		}
+	}
+	if l.Default != "" && l.lookup(l.Default) != l.Default {
+		return errors.New("default language " + strconv.Quote(l.Default) + " is not one of the tags")
+	}
+	return nil
+}
+
+// defaultTag returns the language of the variant stored unsuffixed
+func (l *Languages) defaultTag() string {
+	if l.Default != "" {
+		return l.Default
+	}
+	return l.Tags[0]
+}
+
+// lookup returns the tag that lang is in, trying ever shorter prefixes of
+// it, so that en-US is in en, or "" if it is in none of them
+func (l *Languages) lookup(lang string) string {
+	for lang != "" {
+		for _, tag := range l.Tags {
+			if strings.EqualFold(tag, lang) {
+				return tag
+			}
+		}
+		i := strings.LastIndexByte(lang, '-')
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	return ""
+}
+
+// negotiate returns the tag of the variant to serve to clients sending
+// acceptLanguage, the one they accept best, in the way of the lookup and
+// filtering schemes of RFC 4647. ok is false if they accept none of them,
+// in which case it is the default tag.
+func (l *Languages) negotiate(acceptLanguage string) (tag string, ok bool) {
+	best := -1.0
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		lang, params, _ := strings.Cut(item, ";")
+		lang = strings.TrimSpace(lang)
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if lang == "" || q <= 0 || q <= best {
+			continue
+		}
+		match := l.lookup(lang)
+		if lang == "*" {
+			match = l.defaultTag()
+		}
+		for _, candidate := range l.Tags {
+			if match == "" && len(candidate) > len(lang) && strings.EqualFold(candidate[:len(lang)+1], lang+"-") {
+				match = candidate
+			}
+		}
+		if match != "" {
+			tag, best = match, q
+		}
+	}
+	if tag == "" {
+		return l.defaultTag(), false
+	}
+	return tag, true
+}
+
+// variantLanguage returns the language the response is a variant in, ""
+// if it isn't a language variant. ok is false if it is a variant in none
+// of the languages stored.
+func (rww *responseWriterWrapper) variantLanguage() (tag string, ok bool) {
+	languages := rww.config.Languages
+	if contentLanguage := rww.Header().Values("Content-Language"); len(contentLanguage) > 0 {
+		// Content meant for several audiences at once isn't a variant of
+		// any one of them
+		lang := strings.TrimSpace(strings.Join(contentLanguage, ","))
+		if strings.Contains(lang, ",") {
+			return "", false
+		}
+		tag := languages.lookup(lang)
+		return tag, tag != ""
+	}
+	if !varies(rww.Header(), "Accept-Language") {
+		return "", true
+	}
+	if rww.acceptLanguage == "" {
+		// Upstream served its default language
+		return languages.defaultTag(), true
+	}
+	return languages.negotiate(rww.acceptLanguage)
+}
+
+// varies reports whether the Vary header of a response lists name
+func varies(header http.Header, name string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admitLanguage stores the response under the name of the variant in its
+// language, if it is a language variant. It reports false if it is a
+// variant in a language not stored.
+func (rww *responseWriterWrapper) admitLanguage() bool {
+	if rww.config.Languages == nil {
+		return true
+	}
+	tag, ok := rww.variantLanguage()
+	if !ok {
+		rww.logger.Debug("skip mirroring variant in a language not stored",
+			zap.Strings("content_language", rww.Header().Values("Content-Language")),
+			zap.String("accept_language", rww.acceptLanguage))
+		return false
+	}
+	if tag != "" {
+		rww.language = tag
+		rww.path += "." + tag
+		rww.setMetadata(xattrLanguage, tag)
+	}
+	return true
+}
+
+// languageCopy returns the local copy of the file at urlp within root in
+// the language r accepts best. It is the file itself if it isn't a
+// language variant, or is the variant in that language.
+func (mir *Mirror) languageCopy(r *http.Request, root string, urlp string) string {
+	filename := mir.locate(root, pathInsideRoot(root, urlp))
+	if mir.Languages == nil {
+		return filename
+	}
+	tag, _ := mir.Languages.negotiate(r.Header.Get("Accept-Language"))
+	variant := mir.locate(root, pathInsideRoot(root, urlp)+"."+tag)
+	if _, err := os.Stat(variant); err == nil {
+		return variant
+	}
+	if lang, ok := mir.readMetadata(filename)[xattrLanguage]; !ok || lang == tag {
+		return filename
+	}
+	return variant
+}
+
+// fallbackCopy returns the local copy of the file at urlp within root to
+// serve r when upstream fails: the one in the language r accepts best,
+// else the one in the default language, else whatever the file is.
+func (mir *Mirror) fallbackCopy(r *http.Request, root string, urlp string) string {
+	filename := mir.languageCopy(r, root, urlp)
+	if mir.Languages == nil {
+		return filename
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return filename
+	}
+	variant := mir.locate(root, pathInsideRoot(root, urlp)+"."+mir.Languages.defaultTag())
+	if _, err := os.Stat(variant); err == nil {
+		return variant
+	}
+	return mir.locate(root, pathInsideRoot(root, urlp))
+}
+
+// storeDefaultLanguage copies the variant in the default language just
+// finalized in root to the name of the file, followed by its sidecars, each
+// replacing the previous one atomically. The sidecars and precompressed
+// variants of the previous file that aren't replaced are removed afterwards,
+// as they no longer match it.
+func (mir *Mirror) storeDefaultLanguage(root string, info FileInfo) {
+	if mir.Languages == nil || info.Language != mir.Languages.defaultTag() {
+		return
+	}
+	target := strings.TrimSuffix(info.Path, "."+info.Language)
+	stale := mir.sidecarSuffixes(target)
+	err := mir.copyFile(root, info.Path, target)
+	for _, suffix := range mir.sidecarSuffixes(info.Path) {
+		if err == nil {
+			if err = mir.copyFile(root, info.Path+suffix, target+suffix); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			} else if err == nil {
+				stale = slices.DeleteFunc(stale, func(s string) bool { return s == suffix })
+			}
+		}
+	}
+	for _, suffix := range stale {
+		if err == nil {
+			if err = os.Remove(target + suffix); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+	}
+	if err == nil {
+		err = mir.removeVariants(target)
+	}
+	if err != nil {
+		mir.logger.Error("failed to store variant in the default language",
+			zap.String("path", info.Path),
+			zap.String("target", target),
+			zap.Error(err))
+		return
+	}
+	mir.replicate(root, target)
+}
@@ -0,0 +1,180 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	languages := &Languages{Tags: []string{"en", "de", "pt-BR"}}
+	testCases := []struct {
+		acceptLanguage string
+		tag            string
+		ok             bool
+	}{
+		{acceptLanguage: "", tag: "en", ok: false},
+		{acceptLanguage: "de-CH, en;q=0.5", tag: "de", ok: true},
+		{acceptLanguage: "fr, de;q=0.1", tag: "de", ok: true},
+		{acceptLanguage: "en;q=0.2, DE;q=0.8", tag: "de", ok: true},
+		{acceptLanguage: "pt", tag: "pt-BR", ok: true},
+		{acceptLanguage: "fr", tag: "en", ok: false},
+		{acceptLanguage: "fr, *;q=0.5", tag: "en", ok: true},
+		{acceptLanguage: "de;q=0, en-US;q=0.3", tag: "en", ok: true},
+		{acceptLanguage: "de;q=bogus", tag: "en", ok: false},
+	}
+	for _, test := range testCases {
+		tag, ok := languages.negotiate(test.acceptLanguage)
+		if tag != test.tag || ok != test.ok {
+			t.Errorf("%q: expected %s %v, got %s %v", test.acceptLanguage, test.tag, test.ok, tag, ok)
+		}
+	}
+}
+
+func TestLanguagesValidation(t *testing.T) {
+	testCases := []struct {
+		languages Languages
+		valid     bool
+	}{
+		{languages: Languages{Tags: []string{"en", "de"}, Default: "de"}, valid: true},
+		{languages: Languages{}, valid: false},
+		{languages: Languages{Tags: []string{"en", "../de"}}, valid: false},
+		{languages: Languages{Tags: []string{"en"}, Default: "fr"}, valid: false},
+	}
+	for _, test := range testCases {
+		if err := test.languages.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %v, got %v", test.languages, test.valid, err)
+		}
+	}
+}
+
+func TestLanguageVariants(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{
+		Root:               root,
+		Fallback:           true,
+		MetadataFileSuffix: ".meta",
+		Languages:          &Languages{Tags: []string{"en", "de"}},
+	})
+	bodies := map[string]string{"en": "Hello", "de": "Hallo", "fr": "Bonjour"}
+	negotiating := func(vary bool) caddyhttp.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			lang := r.Header.Get("Accept-Language")
+			if lang == "" {
+				lang = "en"
+			}
+			if vary {
+				w.Header().Set("Vary", "Accept-Encoding, Accept-Language")
+			} else {
+				w.Header().Set("Content-Language", lang)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(bodies[lang]))
+			return nil
+		}
+	}
+	upstreamErr := caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	down := func(w http.ResponseWriter, r *http.Request) error {
+		return upstreamErr
+	}
+	serve := func(acceptLanguage string, next caddyhttp.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page.html", nil)
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		rec := httptest.NewRecorder()
+		if err := mir.ServeHTTP(rec, req, next); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	stored := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return ""
+		}
+		return string(content)
+	}
+
+	serve("de", negotiating(false))
+	if stored("page.html.de") != "Hallo" || stored("page.html") != "" {
+		t.Fatalf("expected only the de variant stored, got %q and %q", stored("page.html.de"), stored("page.html"))
+	}
+	serve("", negotiating(false))
+	if stored("page.html.en") != "Hello" || stored("page.html") != "Hello" {
+		t.Fatalf("expected the en variant stored under both names, got %q and %q", stored("page.html.en"), stored("page.html"))
+	}
+	if stored("page.html.meta") == "" {
+		t.Error("expected sidecar of the default variant copied")
+	}
+	serve("fr", negotiating(false))
+	if stored("page.html.fr") != "" || stored("page.html") != "Hello" {
+		t.Error("variant in a language not stored was mirrored")
+	}
+
+	for acceptLanguage, expected := range map[string]string{"de-AT, en;q=0.5": "Hallo", "en": "Hello", "fr": "Hello"} {
+		rec := serve(acceptLanguage, down)
+		if rec.Body.String() != expected {
+			t.Errorf("%q: expected %q served after upstream error, got %q", acceptLanguage, expected, rec.Body.String())
+		}
+		if rec.Header().Get("Vary") != "Accept-Language" || rec.Header().Get("Content-Language") == "" {
+			t.Errorf("%q: expected language headers, got %v", acceptLanguage, rec.Header())
+		}
+	}
+
+	os.Remove(filepath.Join(root, "page.html.de"))
+	serve("de", negotiating(true))
+	if stored("page.html.de") != "Hallo" || stored("page.html") != "Hello" {
+		t.Errorf("expected de variant negotiated for response varying on Accept-Language, got %q", stored("page.html.de"))
+	}
+}
+
+func TestLanguageReadThrough(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{
+		Root:               root,
+		MetadataFileSuffix: ".meta",
+		MaxAge:             caddy.Duration(time.Hour),
+		Languages:          &Languages{Tags: []string{"en", "de"}},
+	})
+	os.WriteFile(filepath.Join(root, "page.html.en"), []byte("Hello"), 0o644)
+	os.WriteFile(filepath.Join(root, "page.html"), []byte("Hello"), 0o644)
+	os.WriteFile(filepath.Join(root, "page.html.meta"), []byte(`{"`+xattrLanguage+`":"en"}`), 0o644)
+	os.WriteFile(filepath.Join(root, "style.css"), []byte("body {}"), 0o644)
+	testCases := []struct {
+		path           string
+		acceptLanguage string
+		local          bool
+	}{
+		{path: "/page.html", acceptLanguage: "en", local: true},
+		{path: "/page.html", acceptLanguage: "fr", local: true},
+		{path: "/page.html", acceptLanguage: "de", local: false},
+		{path: "/style.css", acceptLanguage: "de", local: true},
+	}
+	for _, test := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil)
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		upstream := false
+		err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			upstream = true
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upstream == test.local {
+			t.Errorf("%s in %s: expected served locally %v", test.path, test.acceptLanguage, test.local)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mirror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Values of the mirror_status access log field besides the decision
+// constants, for requests answered without mirroring the response
+const (
+	logStatusPassThrough = "pass_through"
+	logStatusReadThrough = "read_through"
+	logStatusStale       = "stale"
+	logStatusNotModified = "not_modified"
+	logStatusFallback    = "fallback"
+)
+
+// requestIDCtxKey is the context key of the ID returned by requestID
+type requestIDCtxKey struct{}
+
+// requestID returns the ID correlating the logs about r. It is Caddy's
+// request UUID where the server provides one, which is then also added to
+// the access log entry, like the {http.request.uuid} placeholder does.
+// Otherwise it is a short random ID.
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDCtxKey{}).(string); ok {
+		return id
+	}
+	if uuid, ok := caddyhttp.GetVar(r.Context(), "uuid").(fmt.Stringer); ok {
+		id := uuid.String()
+		if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+			extra.Set(zap.String("uuid", id))
+		}
+		return id
+	}
+	var random [6]byte
+	rand.Read(random[:])
+	return hex.EncodeToString(random[:])
+}
+
+// setLogFields attaches what the handler did for r to its access log
+// entry: the status, the number of bytes mirrored, the path of the
+// mirrored or served file and the policy applied, if any
+func (mir *Mirror) setLogFields(r *http.Request, status string, bytes int64, filename string) {
+	if mir.NoAccessLogFields {
+		return
+	}
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok {
+		return
+	}
+	extra.Set(zap.String("mirror_status", status))
+	extra.Set(zap.Int64("mirror_bytes", bytes))
+	extra.Set(zap.String("mirror_path", filename))
+	if mir.policyName != "" {
+		extra.Set(zap.String("mirror_policy", mir.policyName))
+	}
+}
@@ -0,0 +1,127 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// logFields returns the string and integer extra log fields in extra, which
+// are not exported
+func logFields(extra *caddyhttp.ExtraLogFields) map[string]any {
+	fields := make(map[string]any)
+	list := reflect.ValueOf(extra).Elem().FieldByName("fields")
+	for i := 0; i < list.Len(); i++ {
+		field := list.Index(i)
+		switch zapcore.FieldType(field.FieldByName("Type").Uint()) {
+		case zapcore.StringType:
+			fields[field.FieldByName("Key").String()] = field.FieldByName("String").String()
+		case zapcore.Int64Type:
+			fields[field.FieldByName("Key").String()] = field.FieldByName("Integer").Int()
+		}
+	}
+	return fields
+}
+
+func TestAccessLogFields(t *testing.T) {
+	root := t.TempDir()
+	ok := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	}
+	testCases := []struct {
+		name     string
+		method   string
+		next     caddyhttp.HandlerFunc
+		disabled bool
+		expected map[string]any
+	}{
+		{name: "stored", next: ok, expected: map[string]any{"mirror_status": decisionStore, "mirror_bytes": int64(7), "mirror_path": filepath.Join(root, "file.txt")}},
+		{name: "pass through", method: http.MethodPost, next: ok, expected: map[string]any{"mirror_status": logStatusPassThrough, "mirror_bytes": int64(0), "mirror_path": ""}},
+		{name: "skipped", next: func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}, expected: map[string]any{"mirror_status": decisionSkip, "mirror_bytes": int64(0), "mirror_path": ""}},
+		{name: "fallback", next: func(w http.ResponseWriter, r *http.Request) error {
+			return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+		}, expected: map[string]any{"mirror_status": logStatusFallback, "mirror_bytes": int64(0), "mirror_path": filepath.Join(root, "file.txt")}},
+		{name: "disabled", next: ok, disabled: true, expected: map[string]any{}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mir := provisionTestMirror(t, &Mirror{Root: root, Fallback: true, NoAccessLogFields: test.disabled})
+			extra := new(caddyhttp.ExtraLogFields)
+			req := httptest.NewRequest(test.method, "http://example.com/file.txt", nil)
+			ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			req = req.WithContext(context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, extra))
+			if err := mir.ServeHTTP(httptest.NewRecorder(), req, test.next); err != nil {
+				t.Fatal(err)
+			}
+			if fields := logFields(extra); !reflect.DeepEqual(fields, test.expected) {
+				t.Errorf("expected log fields %v, got %v", test.expected, fields)
+			}
+		})
+	}
+}
+
+// stringID stands in for Caddy's request UUID, which is not exported
+type stringID string
+
+func (id stringID) String() string {
+	return string(id)
+}
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Trace: true, logger: zap.New(core)})
+	serve := func(ctx context.Context) string {
+		logs.TakeAll()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil).WithContext(ctx)
+		err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := logs.AllUntimed()
+		if len(entries) < 2 || entries[len(entries)-1].Message != "mirrored file" {
+			t.Fatalf("expected logs ending with the completion log, got %v", entries)
+		}
+		id, _ := entries[0].ContextMap()["request_id"].(string)
+		for _, entry := range entries {
+			if entry.ContextMap()["request_id"] != id {
+				t.Errorf("expected request_id %q in %q log, got %v", id, entry.Message, entry.ContextMap())
+			}
+		}
+		return id
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	first, second := serve(ctx), serve(ctx)
+	if first == "" || first == second {
+		t.Errorf("expected distinct generated request IDs, got %q and %q", first, second)
+	}
+
+	// Caddy's request UUID is used where there is one
+	extra := new(caddyhttp.ExtraLogFields)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{"uuid": stringID("a3f5c1d2-uuid")})
+	ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, extra)
+	if id := serve(ctx); id != "a3f5c1d2-uuid" {
+		t.Errorf("expected Caddy's request UUID, got %q", id)
+	}
+	if uuid := logFields(extra)["uuid"]; uuid != "a3f5c1d2-uuid" {
+		t.Errorf("expected uuid access log field, got %v", uuid)
+	}
+}
@@ -0,0 +1,313 @@
+package mirror
+
+import (
+	"encoding/json"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Names of the extended attributes metadata is recorded in. The same names
+// are used as keys in metadata sidecar files.
+const (
+	xattrEtag    = "user.xdg.origin.etag"
+	xattrSha256  = "user.xdg.origin.sha256"
+	xattrExpires = "user.mirror.expires"
+	// xattrLastModified is the Last-Modified header of the response
+	xattrLastModified = "user.mirror.last_modified"
+	// xattrDownloaded is the time the file was mirrored
+	xattrDownloaded = "user.mirror.downloaded"
+	// xattrAccessed is the time the file was last requested
+	xattrAccessed = "user.mirror.atime"
+	// xattrOriginURL is the URL the file was mirrored from, as in the XDG
+	// shared MIME-info spec
+	xattrOriginURL = "user.xdg.origin.url"
+	// xattrReferrerURL is the Referer of the request the file was mirrored
+	// for
+	xattrReferrerURL = "user.xdg.referrer.url"
+	// xattrMimeType is the Content-Type of the response, as in the XDG
+	// shared MIME-info spec
+	xattrMimeType = "user.mime_type"
+	// xattrMimeTypeInferred is the media type guessed from the file
+	// extension or content, for responses without a useful Content-Type
+	xattrMimeTypeInferred = "user.mirror.mime_type_inferred"
+	// xattrSha512 is the SHA-512 digest of the content, which only the
+	// hash command records
+	xattrSha512 = "user.xdg.origin.sha512"
+	// xattrHashSkipped is set when the content wasn't hashed as it is
+	// larger than max_hash_size
+	xattrHashSkipped = "user.mirror.hash_skipped"
+	// xattrHashed is the modification time of the file when the hash
+	// command recorded its digests
+	xattrHashed = "user.mirror.hashed"
+	// xattrLanguage is the language of a variant stored with languages
+	xattrLanguage = "user.mirror.language"
+	// xattrPrecompressed is the encoding of a precompressed variant, which
+	// tells it from a mirrored file of the same name
+	xattrPrecompressed = "user.mirror.precompressed"
+)
+
+// usefulContentType reports whether contentType says more about the
+// response than that it is some bytes
+func usefulContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType != "application/octet-stream"
+}
+
+// inferContentType guesses the media type of filename from its extension,
+// or else from its first bytes, sniffed. It returns "" if there is no
+// better guess than application/octet-stream.
+func inferContentType(filename string, sniffed []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); usefulContentType(contentType) {
+		return contentType
+	}
+	if len(sniffed) > 0 {
+		if contentType := http.DetectContentType(sniffed); usefulContentType(contentType) {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// recordContentType records the Content-Type of the response in the
+// metadata, or the inferred media type if it has none or only
+// application/octet-stream. The response header is left as it is.
+func (rww *responseWriterWrapper) recordContentType() {
+	if contentType := rww.Header().Get("Content-Type"); usefulContentType(contentType) {
+		rww.setMetadata(xattrMimeType, contentType)
+		return
+	}
+	// Resumed responses replay their partial file first, so the sniffed
+	// bytes are the start of the file as well
+	if inferred := inferContentType(rww.filename, rww.sniffed); inferred != "" {
+		rww.setMetadata(xattrMimeTypeInferred, inferred)
+	}
+}
+
+// maxReferrerLength is the length Referer values are truncated to, well
+// within the size limits of xattr values
+const maxReferrerLength = 1024
+
+// referrerURL returns the Referer header of r to record, truncated to
+// maxReferrerLength bytes, or "" if there is none or recording it is
+// disabled
+func (mir *Mirror) referrerURL(r *http.Request) string {
+	if mir.NoReferrer {
+		return ""
+	}
+	referrer := r.Header.Get("Referer")
+	if len(referrer) > maxReferrerLength {
+		// Don't cut a multi-byte character in half
+		referrer = strings.ToValidUTF8(referrer[:maxReferrerLength], "")
+	}
+	return referrer
+}
+
+// originURL returns the absolute URL of r, without the query parameters
+// configured to be stripped
+func (mir *Mirror) originURL(r *http.Request) string {
+	if len(mir.StripQueryParams) == 0 || r.URL.RawQuery == "" {
+		return requestURL(r)
+	}
+	query := r.URL.Query()
+	for _, name := range mir.StripQueryParams {
+		query.Del(name)
+	}
+	stripped := r.Clone(r.Context())
+	stripped.URL.RawQuery = query.Encode()
+	return requestURL(stripped)
+}
+
+// setMetadata records metadata about the mirrored file, to be written when
+// it is finalized
+func (rww *responseWriterWrapper) setMetadata(name string, value string) {
+	if rww.meta == nil {
+		rww.meta = make(map[string]string)
+	}
+	rww.meta[name] = value
+}
+
+// defaultMaxXattrSize is the default size of the largest value stored in an
+// xattr, well below the single block ext4 keeps all xattrs of a file in
+const defaultMaxXattrSize = 2048
+
+func (mir *Mirror) maxXattrSize() int {
+	if mir.MaxXattrSize > 0 {
+		return mir.MaxXattrSize
+	}
+	return defaultMaxXattrSize
+}
+
+// fitsXattr reports whether value is small enough to be stored in the xattr
+// name. Oversized values are recorded, to be logged once the file is
+// finalized.
+func (rww *responseWriterWrapper) fitsXattr(name string, value string) bool {
+	if len(value) <= rww.config.maxXattrSize() {
+		return true
+	}
+	if rww.oversized == nil {
+		rww.oversized = make(map[string]int)
+	}
+	rww.oversized[name] = len(value)
+	return false
+}
+
+// logOversized logs the metadata values that weren't stored in xattrs as
+// they were too large
+func (rww *responseWriterWrapper) logOversized() {
+	if len(rww.oversized) == 0 {
+		return
+	}
+	names := make([]string, 0, len(rww.oversized))
+	for name := range rww.oversized {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	rww.logger.Warn("metadata values too large for xattrs",
+		zap.Strings("names", names),
+		zap.Int("max_xattr_size", rww.config.maxXattrSize()),
+		zap.Bool("stored_in_sidecar", rww.config.MetadataFileSuffix != ""))
+}
+
+// writeMetadata writes the recorded metadata to xattrs of the pending file if
+// xattrs are enabled, or else to a pending metadata sidecar file if a suffix
+// for those is configured. With both, values too large for xattrs are
+// written to the sidecar file, as is all metadata once setting xattrs kept
+// failing on the root.
+func (rww *responseWriterWrapper) writeMetadata() {
+	if len(rww.meta) == 0 {
+		return
+	}
+	sidecar := rww.meta
+	if rww.useXattr() {
+		sidecar = nil
+		for name, value := range rww.meta {
+			if !rww.fitsXattr(name, value) {
+				if sidecar == nil {
+					sidecar = make(map[string]string)
+				}
+				sidecar[name] = value
+				continue
+			}
+			err := rww.setMetadataXattr(name, value)
+			if err != nil {
+				rww.logger.Error("failed to set metadata xattr",
+					zap.String("name", name),
+					zap.Error(err))
+				rww.spanFailure("failed to set metadata xattr", err)
+			}
+		}
+	}
+	if len(sidecar) == 0 || rww.config.MetadataFileSuffix == "" {
+		return
+	}
+	metaFile, err := rww.createPending(rww.pending + rww.config.MetadataFileSuffix)
+	if err != nil {
+		rww.logger.Error("failed to create metadata temp file, continuing without writing metadata sidecar file",
+			zap.Error(err))
+		rww.spanFailure("failed to create metadata temp file", err)
+		return
+	}
+	err = json.NewEncoder(metaFile).Encode(sidecar)
+	if err != nil {
+		rww.logger.Error("failed to write temp metadata file",
+			zap.Error(err))
+		rww.spanFailure("failed to write temp metadata file", err)
+		metaFile.Cleanup()
+		return
+	}
+	rww.metaFile = metaFile
+}
+
+// xattrNamespaces are the namespaces extended attribute names may be in
+var xattrNamespaces = []string{"user.", "trusted.", "security.", "system."}
+
+// validXattrName reports whether name is in one of the xattr namespaces
+func validXattrName(name string) bool {
+	for _, namespace := range xattrNamespaces {
+		if len(name) > len(namespace) && strings.HasPrefix(name, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeXattrs sets the configured extra xattrs on the pending file, with
+// placeholders in their names and values replaced. Failing attributes are
+// left out.
+func (rww *responseWriterWrapper) writeXattrs() {
+	for name, value := range rww.config.SetXattrs {
+		if rww.repl != nil {
+			value = rww.repl.ReplaceAll(value, "")
+			if hasPlaceholders(name) {
+				name = rww.repl.ReplaceAll(name, "")
+				if !validXattrName(name) {
+					rww.logger.Error("invalid xattr name after replacing placeholders",
+						zap.String("name", name))
+					continue
+				}
+			}
+		}
+		if !rww.fitsXattr(name, value) {
+			continue
+		}
+		err := xattr.FSet(rww.file.File, name, []byte(value))
+		if err != nil {
+			rww.config.countXattrFailure(err)
+			rww.logger.Error("failed to set xattr",
+				zap.String("name", name),
+				zap.Error(err))
+			rww.spanFailure("failed to set xattr", err)
+		}
+	}
+}
+
+// readMetadata reads the metadata recorded for the mirrored file filename,
+// from xattrs if enabled and from its metadata sidecar file, which with
+// xattrs only has the values too large for them. Metadata that can't be
+// read is left out.
+func (mir *Mirror) readMetadata(filename string) map[string]string {
+	meta := make(map[string]string)
+	if mir.UseXattr {
+		names, err := xattr.List(filename)
+		if err == nil {
+			for _, name := range names {
+				if value, err := xattr.Get(filename, name); err == nil {
+					meta[name] = string(value)
+				}
+			}
+		}
+	}
+	if mir.MetadataFileSuffix == "" {
+		return meta
+	}
+	data, err := os.ReadFile(filename + mir.MetadataFileSuffix)
+	if err != nil {
+		return meta
+	}
+	var sidecar map[string]string
+	_ = json.Unmarshal(data, &sidecar)
+	for name, value := range sidecar {
+		if _, ok := meta[name]; !ok {
+			meta[name] = value
+		}
+	}
+	return meta
+}
+
+// updateMetadata sets a single metadata value of the mirrored file filename
+// in its metadata sidecar file, which is replaced atomically
+func (mir *Mirror) updateMetadata(filename string, name string, value string) error {
+	meta := mir.readMetadata(filename)
+	meta[name] = value
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return mir.writeFile(filename+mir.MetadataFileSuffix, append(data, '\n'))
+}
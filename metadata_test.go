@@ -0,0 +1,270 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMetadataSidecar(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta"})
+	before := time.Now().Truncate(time.Second)
+	_, err := serveMirror(mir, "/fresh.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "content")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "fresh.bin.meta"))
+	if err != nil {
+		t.Fatalf("metadata sidecar not written: %v", err)
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	expires, err := time.Parse(time.RFC3339, meta[xattrExpires])
+	if err != nil {
+		t.Fatalf("invalid expiry in metadata %v: %v", meta, err)
+	}
+	if expires.Before(before.Add(time.Hour)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry %v not an hour from now", expires)
+	}
+}
+
+func TestSetXattrs(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("MIRROR_TEST_PROJECT", "demo")
+	mir := provisionTestMirror(t, &Mirror{Root: root, SetXattrs: map[string]string{
+		"user.project": "{env.MIRROR_TEST_PROJECT}",
+		// Not supported, which doesn't stop the other attributes
+		"system.mirror_test": "value",
+	}})
+	_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(root, "file.txt")
+	if content, err := os.ReadFile(filename); err != nil || string(content) != "content" {
+		t.Fatalf("file not mirrored: %q, error: %v", content, err)
+	}
+	value, err := xattr.Get(filename, "user.project")
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("xattrs not supported")
+	}
+	if err != nil || string(value) != "demo" {
+		t.Errorf("expected user.project xattr %q, got %q, error: %v", "demo", value, err)
+	}
+}
+
+func TestOriginURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strip    []string
+		urlp     string
+		expected string
+	}{
+		{"path", nil, "/file.txt", "http://example.com/file.txt"},
+		{"query", nil, "/file.txt?v=1&token=secret", "http://example.com/file.txt?v=1&token=secret"},
+		{"stripped", []string{"token", "sig"}, "/file.txt?v=1&token=secret&sig=abc", "http://example.com/file.txt?v=1"},
+		{"all stripped", []string{"token"}, "/file.txt?token=secret", "http://example.com/file.txt"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", StripQueryParams: tc.strip})
+			_, err := serveMirror(mir, tc.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				io.WriteString(w, "content")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(root, "file.txt.meta"))
+			if err != nil {
+				t.Fatalf("metadata sidecar not written: %v", err)
+			}
+			var meta map[string]string
+			if err := json.Unmarshal(data, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta[xattrOriginURL] != tc.expected {
+				t.Errorf("expected origin URL %q, got %q", tc.expected, meta[xattrOriginURL])
+			}
+		})
+	}
+}
+
+func TestReferrerURL(t *testing.T) {
+	long := "http://example.com/" + strings.Repeat("é", maxReferrerLength)
+	testCases := []struct {
+		name       string
+		noReferrer bool
+		referrer   string
+		expected   string
+	}{
+		{"none", false, "", ""},
+		{"recorded", false, "http://example.com/index.html", "http://example.com/index.html"},
+		{"disabled", true, "http://example.com/index.html", ""},
+		{"truncated", false, long, long[:maxReferrerLength-1]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", NoReferrer: tc.noReferrer})
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			if tc.referrer != "" {
+				req.Header.Set("Referer", tc.referrer)
+			}
+			err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				io.WriteString(w, "content")
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(root, "file.txt.meta"))
+			if err != nil {
+				t.Fatalf("metadata sidecar not written: %v", err)
+			}
+			var meta map[string]string
+			if err := json.Unmarshal(data, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if referrer, ok := meta[xattrReferrerURL]; referrer != tc.expected || ok != (tc.expected != "") {
+				t.Errorf("expected referrer %q, got %q (present: %v)", tc.expected, referrer, ok)
+			}
+		})
+	}
+}
+
+func TestInferredContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	testCases := []struct {
+		name        string
+		urlp        string
+		contentType string
+		body        string
+		mimeType    string
+		inferred    string
+	}{
+		{"header", "/file.png", "text/plain; charset=utf-8", "content", "text/plain; charset=utf-8", ""},
+		{"extension", "/file.png", "", "content", "", "image/png"},
+		{"octet-stream", "/file.json", "application/octet-stream", "{}", "", "application/json"},
+		{"sniffed", "/file", "", png, "", "image/png"},
+		{"unknown", "/file", "", "\x00\x01\x02", "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta"})
+			rec, err := serveMirror(mir, tc.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				w.WriteHeader(http.StatusOK)
+				io.WriteString(w, tc.body)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != tc.contentType {
+				t.Errorf("expected Content-Type %q sent to the client, got %q", tc.contentType, contentType)
+			}
+			data, err := os.ReadFile(filepath.Join(root, tc.urlp[1:]+".meta"))
+			if err != nil {
+				t.Fatalf("metadata sidecar not written: %v", err)
+			}
+			var meta map[string]string
+			if err := json.Unmarshal(data, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta[xattrMimeType] != tc.mimeType || meta[xattrMimeTypeInferred] != tc.inferred {
+				t.Errorf("expected media type %q and inferred %q, got %q and %q", tc.mimeType, tc.inferred, meta[xattrMimeType], meta[xattrMimeTypeInferred])
+			}
+		})
+	}
+}
+
+func TestOversizedXattrs(t *testing.T) {
+	probe := filepath.Join(t.TempDir(), "probe")
+	if err := os.WriteFile(probe, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.Set(probe, "user.probe", []byte("1")); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	etag := `"` + strings.Repeat("e", 5000) + `"`
+	testCases := []struct {
+		name   string
+		suffix string
+	}{
+		{name: "sidecar", suffix: ".meta"},
+		{name: "no sidecar"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			core, logs := observer.New(zapcore.DebugLevel)
+			mir := provisionTestMirror(t, &Mirror{Root: root, UseXattr: true, MetadataFileSuffix: test.suffix, logger: zap.New(core)})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(root, "file.txt")
+			if content, err := os.ReadFile(filename); err != nil || string(content) != "content" {
+				t.Fatalf("file not mirrored: %q, error: %v", content, err)
+			}
+			if _, err := xattr.Get(filename, xattrEtag); err == nil {
+				t.Error("oversized ETag stored in xattr")
+			}
+			if value, err := xattr.Get(filename, xattrMimeType); err != nil || string(value) != "text/plain" {
+				t.Errorf("expected Content-Type xattr, got %q, error: %v", value, err)
+			}
+			meta := mir.readMetadata(filename)
+			if stored := meta[xattrEtag]; (stored == etag) != (test.suffix != "") {
+				t.Errorf("expected ETag in metadata %v, got %d bytes", test.suffix != "", len(stored))
+			}
+			if meta[xattrMimeType] != "text/plain" {
+				t.Errorf("expected Content-Type in metadata, got %q", meta[xattrMimeType])
+			}
+			if logged := logs.FilterMessage("metadata values too large for xattrs").Len(); logged != 1 {
+				t.Errorf("expected oversized values logged once, got %d logs", logged)
+			}
+		})
+	}
+}
@@ -1,24 +1,34 @@
 package mirror
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/google/renameio/v2"
-	"github.com/pkg/xattr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"hash"
 	"io"
 	"io/fs"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 func init() {
@@ -37,259 +47,2294 @@ type Mirror struct {
 	// Responses from upstreams will be written to files within this root directory to be used as a local mirror of static content
 	Root string `json:"root,omitempty"`
 
+	// Prefix removed from URL paths to get the path of their files within
+	// the root, e.g. `/artifactory/api/storage`. Requests for other paths
+	// are passed through without being mirrored.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+
+	// Path of the file of a request within the root, which may contain
+	// placeholders, `{mirror.path}` standing for the URL path after
+	// strip_prefix. The expansion is still sanitized to stay within the
+	// root. Requests for which it is not an absolute file path are passed
+	// through without being mirrored. Default is `{mirror.path}`.
+	PathTemplate string `json:"path_template,omitempty"`
+
+	// Regular expression replacements applied in order to the cleaned URL
+	// path, after strip_prefix, e.g. to drop build numbers from paths.
+	// Requests for which the result is empty or has `..` segments are
+	// passed through without being mirrored.
+	PathRewrites []*PathRewrite `json:"path_rewrites,omitempty"`
+
+	// Lowercase the paths of files, Unicode-aware, so that URLs differing
+	// only in case share a file. Requests are passed on unchanged. On
+	// case-insensitive filesystems, such as the macOS and Windows
+	// defaults, such URLs share a file anyway, but the file keeps the case
+	// of the URL it was first mirrored for.
+	LowercasePaths bool `json:"lowercase_paths,omitempty"`
+
+	// How percent-encoded slashes (`%2F`) in URL paths are handled, as
+	// well as encoded backslashes (`%5C`) on Windows: `decode`, the
+	// default, decodes them into directory separators, `keep_encoded`
+	// keeps them encoded in file names, with percent signs encoded as
+	// `%25` so that names remain distinct, and `reject` passes such
+	// requests through without mirroring them.
+	EncodedSlashes string `json:"encoded_slashes,omitempty"`
+
+	// What to do when a file is to be mirrored to a path that is a
+	// directory, or below a path that is a file, as when upstream turned a
+	// directory into a file or vice versa: `skip` passes the response
+	// through without mirroring it, the default, `replace` removes the
+	// directory if it is empty, or the file with its sidecar files, and
+	// `suffix` stores the file as `<path>.file` next to the directory,
+	// renaming a file in the way of a directory likewise. The way is only
+	// made once the file is complete. With `suffix`, local copies are
+	// looked up there where their path is a directory.
+	PathConflicts string `json:"path_conflicts,omitempty"`
+
+	// What to do when the path a file is to be mirrored to is a symlink:
+	// `refuse` to mirror it, the default, `follow` the symlink and mirror
+	// the file to its target, provided that is inside the root, or
+	// `replace` the symlink with the file.
+	Symlinks string `json:"symlinks,omitempty"`
+
+	// Actions taken for responses by status code, or by class such as
+	// `4xx`, a code taking precedence over its class: `store` mirrors the
+	// response, which only 200 responses can be, `ignore` passes it
+	// through, `delete_local` removes the local copy with its sidecar
+	// files, `tombstone` records the status in a `.tombstone` file next to
+	// where the local copy would be, and `refresh` updates the freshness
+	// metadata of the local copy from the response header, as for 304
+	// responses. Default is storing 200 responses and ignoring others.
+	StatusActions map[string]string `json:"status_actions,omitempty"`
+
 	// File name suffix to add to write ETags to.
 	// If set, file ETags will be written to sidecar files
 	// with this suffix.
+	//
+	// ETags are validated and stored as they would appear in an ETag or
+	// If-None-Match header, including the quotes and any weak prefix, e.g.
+	// `"abc"` or `W/"abc"`, without a trailing newline. The same format is
+	// used for the ETag xattr. Invalid ETags are not stored. An ETag
+	// delivered as a trailer is stored unless the header had one, once the
+	// response has ended but before the file is renamed into place.
+	//
+	// The suffix may contain placeholders, e.g. `.etag-{http.request.host}`,
+	// after some text which tells the sidecars of a file from those of
+	// others. Requests for which their expansion is empty or contains a path
+	// separator or `..` are handled without ETag files.
+	//
+	// ETag and metadata sidecar files are removed before the file they
+	// belong to is replaced and renamed into place after it, so they never
+	// describe an earlier version of it. A crash or failed rename may leave
+	// a file without its sidecars.
 	EtagFileSuffix string `json:"etag_file_suffix,omitempty"`
 
-	UseXattr bool `json:"xattr,omitempty"`
+	// Format of ETag sidecar files: `raw`, the default, as described
+	// above, which is what file_server with etag_file_extensions serves as
+	// is; `unquoted`, the opaque tag without quotes and weak prefix, e.g.
+	// a bare hex digest, which loses whether the ETag was weak; or
+	// `strong_only`, like raw but without sidecars for weak ETags. A new
+	// format only applies to newly written sidecars, existing ones can be
+	// rewritten with a POST to the /mirror/etag-files/convert admin
+	// endpoint.
+	EtagFileFormat string `json:"etag_file_format,omitempty"`
+
+	UseXattr bool `json:"xattr,omitempty"`
+
+	// Size in bytes of the largest value stored in an xattr. Larger values,
+	// such as pathological ETags, are written to the metadata sidecar file
+	// if metadata_file_suffix is set, or else left out. Default is 2KiB.
+	MaxXattrSize int `json:"max_xattr_size,omitempty"`
+
+	// Number of consecutive failures to set metadata xattrs on files in a
+	// root after which metadata of that root is written to sidecar files
+	// instead if metadata_file_suffix is set, or else no longer stored,
+	// until the handler is reloaded. Default is 10.
+	XattrFailures int `json:"xattr_failures,omitempty"`
+
+	// Never write to the root, e.g. on nodes where it is mounted read-only,
+	// passing responses through instead. Local copies are still served by
+	// fallback. The handler also switches to this mode by itself when it
+	// finds the root on a read-only filesystem.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// Don't check that the root is writable. Unless set, a root without
+	// placeholders is checked when the config is loaded, which fails if it
+	// isn't writable. Roots with placeholders are checked on first use, and
+	// not mirrored to if they aren't writable, until checked again a
+	// minute later.
+	SkipStartupCheck bool `json:"skip_startup_check,omitempty"`
+
+	// Don't check that the parent directory of a file to be mirrored is
+	// inside the root once symlinks are resolved. Unless set, files are not
+	// mirrored through symlinks to directories outside of the root, such
+	// as ones planted by other tooling.
+	SkipParentCheck bool `json:"skip_parent_check,omitempty"`
+
+	// Fail requests whose response can't be mirrored as the mirror file
+	// can't be created, with 507 Insufficient Storage where the disk is
+	// full and 500 otherwise. By default, such responses are passed
+	// through without being mirrored.
+	StrictErrors bool `json:"strict_errors,omitempty"`
+
+	Sha256Xattr   bool `json:"sha256_xattr,omitempty"`
+	HideTempFiles bool `json:"hide_temp_files,omitempty"`
+
+	// Responses larger than this many bytes aren't hashed, to spare the
+	// CPU time. Their files get no sha256 xattr, but a
+	// `user.mirror.hash_skipped` xattr instead, and their digests aren't
+	// verified. Responses of unknown length stop being hashed once they
+	// exceed it. Default is to hash responses of any size.
+	MaxHashSize uint64 `json:"max_hash_size,omitempty"`
+
+	// Octal permissions of the directories created below the root, e.g.
+	// `0755`, set regardless of the umask. Existing directories on the
+	// path of a mirrored file are changed too if their permissions differ.
+	DirMode string `json:"dir_mode,omitempty"`
+
+	// Octal permissions of mirrored files and their sidecar files, e.g.
+	// `0644`, set regardless of the umask.
+	FileMode string `json:"file_mode,omitempty"`
+
+	// Extra xattrs to set on mirrored files, e.g. `security.selinux` to
+	// give them the right SELinux context, or `user.project`. Names must
+	// be in the user, trusted, security or system namespace. Names and
+	// values may contain placeholders. Attributes that can't be set are
+	// logged and left out.
+	SetXattrs map[string]string `json:"set_xattrs,omitempty"`
+
+	// File name suffix of metadata sidecar files. If set and xattrs are
+	// not enabled, metadata that would otherwise be stored in xattrs, such
+	// as the expiry time, is written as a JSON object to sidecar files with
+	// this suffix, keyed by the xattr names.
+	MetadataFileSuffix string `json:"metadata_file_suffix,omitempty"`
+
+	// Store the status, headers and trailers of responses in sidecar
+	// files, to be able to replay them.
+	StoreResponseMeta *ResponseMeta `json:"store_response_meta,omitempty"`
+
+	// Query parameters left out of the origin URL recorded in the
+	// user.xdg.origin.url metadata of mirrored files, e.g. access tokens
+	// or signatures.
+	StripQueryParams []string `json:"strip_query_params,omitempty"`
+
+	// Don't record the Referer of requests in the user.xdg.referrer.url
+	// metadata of mirrored files. Referers longer than 1024 bytes are
+	// truncated.
+	NoReferrer bool `json:"no_referrer,omitempty"`
+
+	// Derive the expiry time of responses without Cache-Control max-age
+	// or Expires headers from their Last-Modified header, as 10% of the
+	// time since then.
+	HeuristicFreshness bool `json:"heuristic_freshness,omitempty"`
+
+	// Serve the local copy of a file when the next handler fails with an
+	// error before writing a response, e.g. when the upstream is
+	// unreachable. An Age header is derived from the time the file was
+	// mirrored, and stale copies are marked with a Warning and an
+	// X-Mirror-Stale header.
+	Fallback bool `json:"fallback,omitempty"`
+
+	// Store the variants of files in different languages side by side,
+	// and serve local copies in the language the client accepts.
+	Languages *Languages `json:"languages,omitempty"`
+
+	// Set the modification time of mirrored files to the Last-Modified
+	// time of the response, so that it is preserved when the local copy is
+	// served.
+	PreserveMtime bool `json:"preserve_mtime,omitempty"`
+
+	// Don't rewrite the local copy of a file when the ETag of the response
+	// matches the stored ETag, as the content is then unchanged.
+	SkipUnchanged bool `json:"skip_unchanged,omitempty"`
+
+	// Accept weak ETags, e.g. from upstreams that compress responses, when
+	// deciding whether content is unchanged. Weak ETags only promise
+	// semantically equivalent content, so by default they never match.
+	WeakEtags bool `json:"weak_etags,omitempty"`
+
+	// Only finalize mirrored files when the response is known to be
+	// complete: the body matched the Content-Length, a digest trailer
+	// verified, or, for a body without Content-Length, the next handler
+	// returned cleanly while the client was still connected and no
+	// announced digest trailer is missing. Other responses are discarded.
+	// By default, any response without an error or a length mismatch is
+	// finalized.
+	RequireComplete bool `json:"require_complete,omitempty"`
+
+	// Only mirror responses produced by an upstream, e.g. when a
+	// file_server before the reverse_proxy serves local hits. A response
+	// counts as coming from an upstream if it has the UpstreamHeader
+	// header, or, if that isn't set, if the reverse_proxy handler has set
+	// the `{http.reverse_proxy.upstream.host}` placeholder. Other
+	// responses are passed through without touching the disk.
+	OnlyUpstream bool `json:"only_upstream,omitempty"`
+
+	// Response header that marks responses produced by an upstream for
+	// OnlyUpstream, e.g. one added with `header_down`.
+	UpstreamHeader string `json:"upstream_header,omitempty"`
+
+	// Media types of responses that are never mirrored, such as
+	// never-ending streams. A type ending in `/*` matches all subtypes.
+	// Default is `text/event-stream` and `multipart/x-mixed-replace`.
+	SkipContentTypes []string `json:"skip_content_types,omitempty"`
+
+	// Methods of requests whose bodies are mirrored too, as uploads, to
+	// the file a GET of the same URL is mirrored to: PUT and POST. An
+	// upload is only kept if the next handler read all of it and
+	// responded with a 2xx status. Default is to only mirror responses to
+	// GET requests.
+	MirrorMethods []string `json:"mirror_methods,omitempty"`
+
+	// Discard HTML error pages sent with a 200 status for files of other
+	// types instead of mirroring them.
+	SoftNotFound *SoftNotFound `json:"soft_not_found,omitempty"`
+
+	// Name of the request var that, when true, makes the handler pass the
+	// request through without mirroring it, e.g. as set by the vars or
+	// map directives. Default is `mirror.skip`.
+	SkipVar string `json:"skip_var,omitempty"`
+
+	// Name of the request var that, when true, makes the handler mirror
+	// the response regardless of skip_content_types and soft_not_found.
+	// Default is `mirror.force`.
+	ForceVar string `json:"force_var,omitempty"`
+
+	// Maximum time to spend mirroring a single response. If the body has
+	// not been completely written after this duration, mirroring is
+	// abandoned while the response continues to the client, even if
+	// upstream has stopped sending it meanwhile. Default is no limit.
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+
+	// Minimum average rate, in bytes per second, at which the response
+	// body must arrive from upstream once min_rate_grace has passed. A
+	// slower response is not mirrored, while it continues to the client
+	// untouched. Default is no minimum.
+	MinRate uint64 `json:"min_rate,omitempty"`
+
+	// Time from passing the request on during which the rate isn't
+	// checked. Default is 10s.
+	MinRateGrace caddy.Duration `json:"min_rate_grace,omitempty"`
+
+	// Bytes to keep free on the filesystem of the root. A response is
+	// only mirrored if its Content-Length can be reserved without the
+	// free space, less what the responses being mirrored are yet to
+	// write, dropping below this, and mirroring stops once a response
+	// outgrows its reservation with no space left. Linux only. Default
+	// is no minimum.
+	MinFreeSpace uint64 `json:"min_free_space,omitempty"`
+
+	// Bytes reserved at a time for responses without Content-Length, with
+	// min_free_space. Default is 64MiB.
+	UnknownSizeReservation uint64 `json:"unknown_size_reservation,omitempty"`
+
+	// Write mirror files with O_DIRECT, bypassing the page cache, for
+	// responses with a Content-Length of at least this many bytes. This
+	// only pays off for large sequential writes, multi-gigabyte artifacts
+	// that would otherwise evict the page cache, so compare
+	// BenchmarkWrite and BenchmarkWriteDirectIO on the target filesystem
+	// before enabling it. Linux only, files are written as usual where
+	// O_DIRECT isn't supported. Default is never.
+	DirectIOMinSize uint64 `json:"direct_io_min_size,omitempty"`
+
+	// Read mirrored files back once they are complete and compare them to
+	// what was written, for storage that may report writes as successful
+	// without keeping them. Files that don't read back the same are
+	// removed. This doubles the read I/O of mirroring.
+	VerifyWrites bool `json:"verify_writes,omitempty"`
+
+	// With verify_writes, files larger than this many bytes are only
+	// verified by their size and their first and last 64KiB. Default is
+	// to verify whole files.
+	VerifyMaxSize uint64 `json:"verify_max_size,omitempty"`
+
+	// Maximum time a single write to a mirror file may block, e.g. on a
+	// hung network filesystem. When exceeded, mirroring of the response
+	// is abandoned and the response continues to the client. Writes are
+	// then made from a goroutine of their own, on a copy of the data.
+	// Disabled by default.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+
+	// Maximum wall time that mirroring a single response may add to it,
+	// accumulated across writes to the mirror file and hashing, including
+	// time spent blocked on a write up to write_timeout. When exceeded,
+	// mirroring of the response is skipped while the response continues to
+	// the client. Default is no limit.
+	WriteBudget caddy.Duration `json:"write_budget,omitempty"`
+
+	// Maximum time to wait for mirrored files that are being finalized
+	// when the handler is unloaded, e.g. on config reload or shutdown, so
+	// that no file is left without its sidecar files. Default is 10s.
+	FinalizeTimeout caddy.Duration `json:"finalize_timeout,omitempty"`
+
+	// Log level of the message logged for every mirrored file, with its
+	// path, size, duration, sha256 and ETag. Default is `info`.
+	CompletionLogLevel string `json:"completion_log_level,omitempty"`
+
+	// Sample the handler's log messages, so that enabling debug logs
+	// remains bearable at high request rates. Interval defaults to 1s,
+	// First and Thereafter to 100.
+	LogSampling *caddy.LogSampling `json:"log_sampling,omitempty"`
+
+	// Log the noisiest per-request debug messages, such as every
+	// WriteHeader call and temp file creation. These are omitted from
+	// debug logs unless enabled.
+	Trace bool `json:"trace,omitempty"`
+
+	// Annotate the active trace span, as started by the tracing handler,
+	// with the outcome of mirroring the response.
+	Tracing bool `json:"tracing,omitempty"`
+
+	// Don't add the mirror_status, mirror_bytes and mirror_path fields to
+	// the access log entries of requests, e.g. where paths are sensitive.
+	NoAccessLogFields bool `json:"no_access_log_fields,omitempty"`
+
+	// Name of this handler instance. Its stats are published with expvar
+	// under this key of the `mirror` map. Handlers with the same name share
+	// their stats. Default is `default`.
+	Name string `json:"name,omitempty"`
+
+	// Labels of the files_written, bytes_written and discards counters
+	// published under the handler's name in the `mirror_labeled` expvar
+	// map, keyed by their labels, among `name`, `host` and
+	// `content_type`, the latter being one of binary, text or image.
+	// Default is no labeled counters.
+	MetricLabels []string `json:"metric_labels,omitempty"`
+
+	// Hosts reported as themselves by the host label, others are reported
+	// as `other`. Default is reporting all hosts as `other`.
+	MetricHosts []string `json:"metric_hosts,omitempty"`
+
+	// Bucket bounds of the body size, write duration and finalize duration
+	// histograms published under the handler's name in the
+	// `mirror_histograms` expvar map. Handlers sharing a name share their
+	// histograms, which are reset when their bounds change.
+	HistogramBuckets *HistogramBuckets `json:"histogram_buckets,omitempty"`
+
+	// Periodically probe the storage of each root the handler writes to,
+	// and suspend mirroring to roots that fail. The status is reported on
+	// the admin API at `/mirror/health`.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// Record the time mirrored files were last requested, at most once per
+	// this interval per file, in the `user.mirror.atime` xattr or the
+	// metadata sidecar file. Filesystem atime is unreliable, as mirrors are
+	// commonly mounted with noatime, so this is what eviction goes by if
+	// present. Requires xattrs or a metadata file suffix. Disabled by
+	// default.
+	TrackAccess caddy.Duration `json:"track_access,omitempty"`
+
+	// Maximum number of files to mirror to a root, not counting sidecar
+	// files, but counting tombstones. When reached, the least recently used files are evicted until
+	// there are 10% fewer, and at least one fewer, and new files other than
+	// the one that triggered it are not mirrored meanwhile. Files are
+	// counted by walking the root when it is first seen. Default is no
+	// limit.
+	MaxFiles int64 `json:"max_files,omitempty"`
+
+	// Pace the deletion of files by eviction and expiry sweeps. Default is
+	// 50 files per second and at most 10000 files per sweep.
+	DeletionPacing *DeletionPacing `json:"deletion_pacing,omitempty"`
+
+	// Keep the content received so far when mirroring a substantial
+	// response is aborted, instead of discarding it.
+	KeepPartials *KeepPartials `json:"keep_partials,omitempty"`
+
+	// Complete mirroring a response after the client went away mid-body,
+	// instead of aborting with the client.
+	CompleteOnDisconnect *CompleteOnDisconnect `json:"complete_on_disconnect,omitempty"`
+
+	// Mirror files to a fast staging directory first, moving them to the
+	// root in the background.
+	Staging *Staging `json:"staging,omitempty"`
+
+	// Copy mirrored files, along with their sidecar files, to these
+	// directories in the background. Copying is best-effort, files that
+	// failed to be copied are copied when the handler is provisioned.
+	Replicas []string `json:"replicas,omitempty"`
+
+	// Maximum number of files copied to the replicas at the same time.
+	// Default is 2.
+	ReplicaWorkers int `json:"replica_workers,omitempty"`
+
+	// Sinks receive each mirrored file once it has been finalized, in
+	// the background.
+	SinksRaw []json.RawMessage `json:"sinks,omitempty" caddy:"namespace=http.handlers.mirror.sinks inline_key=sink"`
+
+	// Maximum number of files each sink receives at the same time.
+	// Default is 1, which passes files to sinks in the order they were
+	// finalized.
+	SinkWorkers int `json:"sink_workers,omitempty"`
+
+	// Validators approve each mirrored file before it is renamed into
+	// place. Files rejected by any of them are discarded, or quarantined
+	// with quarantine_dir.
+	ValidatorsRaw []json.RawMessage `json:"validators,omitempty" caddy:"namespace=http.handlers.mirror.validators inline_key=validator"`
+
+	// Maximum time the validators of a file may take altogether, after
+	// which the file is discarded. Default is 30s.
+	ValidatorTimeout caddy.Duration `json:"validator_timeout,omitempty"`
+
+	// Transformers rewrite the content of responses before it is stored,
+	// in order, leaving what is sent to the client as is. The stored file
+	// is complete at the end of their output, whose size and sha256 are
+	// those recorded. Not supported with warc or keep_partials.
+	TransformersRaw []json.RawMessage `json:"transformers,omitempty" caddy:"namespace=http.handlers.mirror.transformers inline_key=transformer"`
+
+	// Run a command for each mirrored file once it has been finalized, in
+	// the background.
+	ExecAfter *ExecAfter `json:"exec_after,omitempty"`
+
+	// Write precompressed variants of mirrored files in these encodings,
+	// gzip and zstd, for file_server's precompressed option. A variant is
+	// named after the file with the .gz or .zst extension, and is written
+	// in the background, only if smaller. With etag_file_suffix, each
+	// variant gets its own sidecar with a strong ETag derived from its
+	// SHA-256. Mirrored files whose names end with these extensions are
+	// overwritten by the variants of their siblings.
+	Precompress []string `json:"precompress,omitempty"`
+
+	// Set the immutable attribute on mirrored files, so that they can't be
+	// modified, not even by the user running Caddy. It is cleared when the
+	// handler itself replaces or removes a file. Requires the
+	// CAP_LINUX_IMMUTABLE capability.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// Serve fresh local copies directly instead of calling the next
+	// handler, according to the first policy applying to the request
+	// path. Missing and stale local copies are mirrored as usual.
+	ReadThrough []*ReadThrough `json:"read_through,omitempty"`
+
+	// Serve local copies mirrored less than this long ago directly instead
+	// of calling the next handler, for requests no read_through policy
+	// applies to. Older local copies are mirrored again as usual, and
+	// still served by fallback if that fails. Age is judged by the
+	// recorded time of download, or else the mtime. Default is 0, which
+	// disables it.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Serve stale local copies immediately while refreshing them in the
+	// background.
+	StaleWhileRevalidate *StaleWhileRevalidate `json:"stale_while_revalidate,omitempty"`
+
+	// Refresh the most requested local copies in the background before
+	// they go stale.
+	Refresh *Refresh `json:"refresh,omitempty"`
+
+	// Ask upstream whether the local copy of a file is still valid, with
+	// If-None-Match from its stored ETag and If-Modified-Since from its
+	// Last-Modified time, which is recorded with xattr or
+	// metadata_file_suffix, or kept as its mtime by preserve_mtime. The
+	// local copy is served if upstream answers 304 Not Modified, with its
+	// expiry refreshed from the 304, otherwise the response is mirrored as
+	// usual. Requests that are conditional themselves are
+	// passed on as is.
+	Revalidate bool `json:"revalidate,omitempty"`
+
+	// Keep the bodies of responses that failed digest verification in a
+	// quarantine directory, instead of discarding them.
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+
+	// Archive mirrored responses to WARC files, in addition to or instead
+	// of mirroring them to the root.
+	Warc *Warc `json:"warc,omitempty"`
+
+	// Override storage options for the requests whose path matches a
+	// policy, with the first matching policy applying. Other requests are
+	// mirrored with the options of the handler.
+	Policies []*Policy `json:"policies,omitempty"`
+
+	logger          *zap.Logger
+	completionLevel zapcore.Level
+	warc            *warcWriter
+	stats           *stats
+	dirMode         fs.FileMode
+	fileMode        fs.FileMode
+	access          *accessTracker
+	finalizes       *finalizeTracker
+	rootChecks      *rootChecks
+	parentChecks    *parentChecks
+	stager          *stager
+	replicator      *replicator
+	refresher       *refresher
+	maxAgePolicy    *ReadThrough
+	popularity      *popularity
+	sinks           *sinkDispatcher
+	validators      []namedValidator
+	transformers    []namedTransformer
+	// policies are the variants of the handler with the options of each
+	// of Policies, policyName the name of the policy of a variant
+	policies   []*Mirror
+	policyName string
+	// readOnly is set when the handler must not write to the root
+	readOnly *atomic.Bool
+	// done is closed when the handler is unloaded
+	done        <-chan struct{}
+	health      *healthChecker
+	xattrHealth *xattrHealth
+	// partialSweeps sweeps expired partial files, with keep_partials
+	partialSweeps *partialSweeper
+}
+
+const defaultFinalizeTimeout = caddy.Duration(10 * time.Second)
+
+const (
+	defaultSkipVar  = "mirror.skip"
+	defaultForceVar = "mirror.force"
+)
+
+var defaultSkipContentTypes = []string{
+	"text/event-stream",
+	"multipart/x-mixed-replace",
+}
+
+func (Mirror) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirror",
+		New: func() caddy.Module { return new(Mirror) },
+	}
+}
+
+// Provision sets up the mirror handler
+func (mir *Mirror) Provision(ctx caddy.Context) error {
+	mir.logger = ctx.Logger()
+	mir.done = ctx.Done()
+	if sampling := mir.LogSampling; sampling != nil {
+		if sampling.Interval == 0 {
+			sampling.Interval = 1 * time.Second
+		}
+		if sampling.First == 0 {
+			sampling.First = 100
+		}
+		if sampling.Thereafter == 0 {
+			sampling.Thereafter = 100
+		}
+		mir.logger = mir.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, sampling.Interval, sampling.First, sampling.Thereafter)
+		}))
+	}
+	if mir.Root == "" {
+		mir.Root = "{http.vars.root}"
+	}
+	if mir.Name == "" {
+		mir.Name = "default"
+	}
+	if mir.DirMode != "" {
+		mode, err := parseMode(mir.DirMode)
+		if err != nil {
+			return fmt.Errorf("dir_mode: %w", err)
+		}
+		mir.dirMode = mode
+	}
+	if mir.FileMode != "" {
+		mode, err := parseMode(mir.FileMode)
+		if err != nil {
+			return fmt.Errorf("file_mode: %w", err)
+		}
+		mir.fileMode = mode
+	}
+	mir.readOnly = new(atomic.Bool)
+	if mir.ReadOnly {
+		mir.readOnly.Store(true)
+	} else if !mir.SkipStartupCheck {
+		if hasPlaceholders(mir.Root) {
+			mir.rootChecks = &rootChecks{mir: mir}
+		} else if err := checkRoot(mir.Root); errors.Is(err, syscall.EROFS) {
+			mir.enterReadOnly(err)
+		} else if err != nil {
+			return err
+		}
+	}
+	if !mir.SkipParentCheck {
+		mir.parentChecks = new(parentChecks)
+	}
+	if err := mir.validateLabels(); err != nil {
+		return err
+	}
+	if err := mir.validateSuffixes(); err != nil {
+		return err
+	}
+	for _, pr := range mir.PathRewrites {
+		if err := pr.Provision(); err != nil {
+			return err
+		}
+	}
+	mir.stats = statsFor(mir.Name)
+	mir.stats.histograms.setBuckets(mir.HistogramBuckets)
+	if mir.HealthCheck != nil {
+		mir.health = newHealthChecker(mir.HealthCheck, mir.logger, mir.stats)
+		go mir.health.run()
+	}
+	if mir.UseXattr {
+		mir.xattrHealth = newXattrHealth(mir.XattrFailures, mir.logger, mir.stats)
+	}
+	if mir.TrackAccess > 0 {
+		mir.access = newAccessTracker(time.Duration(mir.TrackAccess))
+	}
+	registerHandler(mir)
+	if mir.SkipVar == "" {
+		mir.SkipVar = defaultSkipVar
+	}
+	if mir.ForceVar == "" {
+		mir.ForceVar = defaultForceVar
+	}
+	if mir.SkipContentTypes == nil {
+		mir.SkipContentTypes = defaultSkipContentTypes
+	}
+	if mir.FinalizeTimeout == 0 {
+		mir.FinalizeTimeout = defaultFinalizeTimeout
+	}
+	mir.finalizes = new(finalizeTracker)
+	mir.partialSweeps = new(partialSweeper)
+	if swr := mir.StaleWhileRevalidate; swr != nil {
+		mir.refresher = newRefresher(mir, swr.MaxConcurrent)
+	}
+	if mir.Refresh != nil {
+		popularity, err := newPopularity(mir)
+		if err != nil {
+			return fmt.Errorf("refresh: %w", err)
+		}
+		mir.popularity = popularity
+		mir.popularity.run()
+	}
+	for _, policy := range mir.ReadThrough {
+		if err := policy.Paths.Provision(ctx); err != nil {
+			return fmt.Errorf("read_through paths: %w", err)
+		}
+	}
+	if mir.MaxAge > 0 {
+		mir.maxAgePolicy = &ReadThrough{TTL: mir.MaxAge}
+	}
+	if len(mir.Replicas) > 0 {
+		mir.replicator = newReplicator(mir)
+		mir.replicator.run()
+		if !hasPlaceholders(mir.Root) {
+			go mir.replicator.reconcile(mir.Root)
+		}
+	}
+	if mir.Immutable {
+		ok, err := canSetImmutable()
+		if err != nil {
+			return fmt.Errorf("checking for immutable support: %w", err)
+		}
+		if !ok {
+			return errors.New("immutable requires the CAP_LINUX_IMMUTABLE capability")
+		}
+	}
+	if q := mir.Quarantine; q != nil && !hasPlaceholders(mir.Root) {
+		if rel, err := filepath.Rel(mir.Root, q.Dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("quarantine directory %s must be outside of the root", q.Dir)
+		}
+	}
+	if w := mir.Warc; w != nil {
+		if rel, err := filepath.Rel(mir.Root, w.Dir); !hasPlaceholders(mir.Root) && err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("WARC directory %s must be outside of the root", w.Dir)
+		}
+		mir.warc = newWarcWriter(w, mir.logger)
+	}
+	if mir.SinksRaw != nil {
+		mods, err := ctx.LoadModule(mir, "SinksRaw")
+		if err != nil {
+			return fmt.Errorf("loading sinks: %w", err)
+		}
+		mir.sinks = newSinkDispatcher(ctx, mir.logger)
+		for _, mod := range mods.([]any) {
+			mir.sinks.add(string(mod.(caddy.Module).CaddyModule().ID), mod.(Sink), mir.SinkWorkers)
+		}
+	}
+	if mir.ValidatorsRaw != nil {
+		mods, err := ctx.LoadModule(mir, "ValidatorsRaw")
+		if err != nil {
+			return fmt.Errorf("loading validators: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			name := mod.(caddy.Module).CaddyModule().ID.Name()
+			mir.validators = append(mir.validators, namedValidator{name: name, Validator: mod.(Validator)})
+		}
+	}
+	if mir.TransformersRaw != nil {
+		mods, err := ctx.LoadModule(mir, "TransformersRaw")
+		if err != nil {
+			return fmt.Errorf("loading transformers: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			name := mod.(caddy.Module).CaddyModule().ID.Name()
+			mir.transformers = append(mir.transformers, namedTransformer{name: name, Transformer: mod.(Transformer)})
+		}
+	}
+	if mir.ExecAfter != nil {
+		if mir.sinks == nil {
+			mir.sinks = newSinkDispatcher(ctx, mir.logger)
+		}
+		mir.ExecAfter.logger = mir.logger
+		mir.sinks.add("exec_after", mir.ExecAfter, mir.ExecAfter.MaxConcurrent)
+	}
+	if len(mir.Precompress) > 0 {
+		if mir.sinks == nil {
+			mir.sinks = newSinkDispatcher(ctx, mir.logger)
+		}
+		mir.sinks.add("precompress", &precompressor{mir: mir, logger: mir.logger}, mir.SinkWorkers)
+	}
+	if mir.sinks != nil {
+		mir.sinks.run()
+	}
+	if mir.Staging != nil {
+		mir.stager = newStager(mir)
+		mir.stager.activate()
+		mir.stager.recover()
+	}
+	mir.completionLevel = zapcore.InfoLevel
+	if mir.CompletionLogLevel != "" {
+		level, err := zapcore.ParseLevel(mir.CompletionLogLevel)
+		if err != nil {
+			return fmt.Errorf("completion_log_level: %w", err)
+		}
+		mir.completionLevel = level
+	}
+	if len(mir.Policies) > 0 {
+		// Variants share the state set up so far
+		if err := mir.provisionPolicies(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup stops the background work of the mirror handler and waits for
+// in-flight finalizes
+func (mir *Mirror) Cleanup() error {
+	unregisterHandler(mir)
+	if mir.xattrHealth != nil {
+		mir.xattrHealth.Stop()
+	}
+	if mir.health != nil {
+		mir.health.Stop()
+	}
+	if mir.finalizes != nil {
+		mir.finalizes.wait(time.Duration(mir.FinalizeTimeout), mir.logger)
+	}
+	if mir.replicator != nil {
+		mir.replicator.stop()
+	}
+	if mir.stager != nil {
+		// Moves not started yet are handed over to the handler replacing
+		// this one, or left for recovery
+		mir.stager.deactivate()
+		mir.stager.moves.Wait()
+	}
+	if mir.warc != nil {
+		if err := mir.warc.Close(); err != nil {
+			mir.logger.Error("failed to close WARC file", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// finalizeTracker tracks the finalizes in flight, so that unloading the
+// handler can wait for them. Unlike a sync.WaitGroup, finalizes may still
+// be added while it is being waited for.
+type finalizeTracker struct {
+	mu    sync.Mutex
+	count int64
+	// idle is closed once count drops back to 0
+	idle chan struct{}
+}
+
+func (ft *finalizeTracker) add() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.count == 0 {
+		ft.idle = make(chan struct{})
+	}
+	ft.count++
+}
+
+func (ft *finalizeTracker) done() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.count--
+	if ft.count == 0 {
+		close(ft.idle)
+	}
+}
+
+// wait waits up to timeout for the finalizes in flight to complete, logging
+// any that are abandoned
+func (ft *finalizeTracker) wait(timeout time.Duration, logger *zap.Logger) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		ft.mu.Lock()
+		count, idle := ft.count, ft.idle
+		ft.mu.Unlock()
+		if count == 0 {
+			return
+		}
+		select {
+		case <-idle:
+			// More may have been added since
+		case <-timer.C:
+			ft.mu.Lock()
+			count = ft.count
+			ft.mu.Unlock()
+			logger.Warn("abandoned in-flight finalizes",
+				zap.Int64("count", count),
+				zap.Duration("timeout", timeout))
+			return
+		}
+	}
+}
+
+func (mir *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if pm := mir.policyFor(r); pm != mir {
+		mir = pm
+		caddyhttp.SetVar(r.Context(), policyVar, mir.policyName)
+	}
+	if mir.shouldPassThrough(r) {
+		if mir.Tracing {
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("mirror.decision", decisionSkip))
+		}
+		mir.setLogFields(r, logStatusPassThrough, 0, "")
+		return next.ServeHTTP(w, r)
+	}
+	if !path.IsAbs(r.URL.Path) {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("URL path %v not absolute", r.URL.Path))
+	}
+	id := requestID(r)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDCtxKey{}, id))
+	urlp, err := mir.storagePath(r)
+	if err != nil {
+		mir.logger.Debug("skip mirroring, no storage path",
+			zap.String("request_id", id),
+			zap.String("request_path", r.URL.Path),
+			zap.Error(err))
+		mir.setLogFields(r, decisionSkip, 0, "")
+		return next.ServeHTTP(w, r)
+	}
+
+	// Replace any Caddy placeholders in Root
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root := repl.ReplaceAll(mir.Root, ".")
+	logger := mir.logger.With(zap.String("request_id", id),
+		zap.String("site_root", root),
+		zap.String("request_path", r.URL.Path))
+	if r.Method != http.MethodGet {
+		return mir.mirrorUpload(w, r, next, root, urlp, logger)
+	}
+	if mir.popularity != nil {
+		mir.popularity.record(r, next, root, pathInsideRoot(root, urlp))
+	}
+	if mir.serveReadThrough(w, r, next, root, logger) {
+		return nil
+	}
+	if mir.isReadOnly() {
+		// Nothing is written, but local copies may still be served
+		_, err := mir.mirrorResponse(w, r, next, root, logger, nil)
+		return err
+	}
+	if mir.health != nil && !mir.health.healthy(root) {
+		logger.Debug("skip mirroring to unhealthy root")
+		mir.setLogFields(r, decisionSkip, 0, "")
+		return next.ServeHTTP(w, r)
+	}
+	if mir.rootChecks != nil && mir.rootChecks.check(root, logger) != nil {
+		mir.setLogFields(r, decisionSkip, 0, "")
+		return next.ServeHTTP(w, r)
+	}
+	mir.trackAccess(pathInsideRoot(root, urlp), time.Now(), logger)
+
+	resume := mir.resumable(r, pathInsideRoot(root, urlp), logger)
+	retry, err := mir.mirrorResponse(w, r, next, root, logger, resume)
+	if retry {
+		logger.Debug("upstream response unusable for resuming or revalidating, mirroring from scratch")
+		_, err = mir.mirrorResponse(w, r, next, root, logger, nil)
+	}
+	return err
+}
+
+// mirrorResponse passes r on to the next handler while mirroring the
+// response. If resume is set, only the bytes missing from its partial file
+// are requested. retry is set if upstream failed to resume, in which case
+// nothing has been written to w yet.
+func (mir *Mirror) mirrorResponse(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, root string, logger *zap.Logger, resume *partialResume) (retry bool, err error) {
+	urlp, err := mir.storagePath(r)
+	if err != nil {
+		return false, next.ServeHTTP(w, r)
+	}
+	rww := &responseWriterWrapper{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		config:                mir,
+		root:                  root,
+		path:                  urlp,
+		logger:                logger.With(zap.Namespace("rww")),
+		bytesExpected:         -1,
+		start:                 time.Now(),
+		decision:              decisionSkip,
+		resume:                resume,
+		url:                   requestURL(r),
+		requestID:             requestID(r),
+		host:                  r.Host,
+		forced:                varTrue(r, mir.ForceVar),
+		etagSuffix:            mir.etagSuffix(r),
+		acceptLanguage:        strings.Join(r.Header.Values("Accept-Language"), ","),
+	}
+	rww.repl, _ = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	rww.setMetadata(xattrOriginURL, mir.originURL(r))
+	if mir.Warc != nil && mir.Warc.Requests {
+		rww.warcRequest = warcRequest(r)
+	}
+	if referrer := mir.referrerURL(r); referrer != "" {
+		rww.setMetadata(xattrReferrerURL, referrer)
+	}
+	if mir.Tracing {
+		if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+			rww.span = span
+		}
+	}
+	defer rww.Cleanup()
+	defer rww.recordSpan()
+	// status and served override the outcome logged from rww, when a local
+	// copy is served instead
+	var status, served string
+	defer func() {
+		if retry {
+			return
+		}
+		if status != "" {
+			mir.setLogFields(r, status, 0, served)
+		} else {
+			mir.setLogFields(r, rww.decision, rww.bytesWritten, rww.filename)
+		}
+		switch {
+		case isBackground(w):
+		case status == logStatusFallback:
+			mir.stats.fallbackHits.Add(1)
+			mir.stats.hit()
+		case status != "":
+			mir.stats.hit()
+		default:
+			mir.stats.miss(rww.bytesFetched)
+		}
+	}()
+
+	// Upstream doesn't know the ETags of local copies the mirror made up
+	upstreamReq := withoutDigestEtags(r)
+	var header http.Header
+	var filename string
+	if resume != nil {
+		defer resume.file.Close()
+		upstreamReq = resume.request(upstreamReq)
+		header = w.Header().Clone()
+	} else if mir.Revalidate {
+		filename = mir.languageCopy(r, root, urlp)
+		if req := mir.revalidationRequest(upstreamReq, filename); req != nil {
+			upstreamReq = req
+			rww.revalidating = true
+			header = w.Header().Clone()
+		}
+	}
+	if mir.CompleteOnDisconnect != nil && !mir.isReadOnly() {
+		var stop func()
+		upstreamReq, stop = mir.CompleteOnDisconnect.detachContext(upstreamReq)
+		defer stop()
+	}
+	err = next.ServeHTTP(rww, upstreamReq)
+	rww.stopMaxDuration()
+	if rww.notModified && err == nil && (mir.UseXattr || mir.MetadataFileSuffix != "") {
+		// The local copy is fresh for as long as the 304 says, else it
+		// would be revalidated by every request from now on
+		if err := rww.refreshMetadata(filename); err != nil {
+			logger.Error("failed to refresh metadata of local copy not modified upstream",
+				zap.String("path", filename),
+				zap.Error(err))
+		}
+	}
+	if rww.swallowed() {
+		// Drop the header of the swallowed response
+		clear(w.Header())
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+	}
+	if rww.setupErr != nil {
+		return false, caddyhttp.Error(setupErrorStatus(rww.setupErr), rww.setupErr)
+	}
+	if rww.notModified && err == nil {
+		if mir.serveLocal(w, r, filename, logger) {
+			mir.stats.notModified.Add(1)
+			status, served = logStatusNotModified, filename
+			return false, nil
+		}
+		// The local copy is gone, so fetch it again
+		return true, nil
+	}
+	if rww.retry {
+		return true, nil
+	}
+	if err != nil {
+		// Whatever was written so far can't be trusted to be complete
+		if rww.file != nil && rww.bytesExpected >= 0 && rww.bytesWritten < rww.bytesExpected {
+			rww.truncated(rww.bytesExpected, err)
+		} else {
+			rww.abort(zapcore.WarnLevel, "upstream error", zap.Error(err))
+		}
+		if mir.Fallback && !rww.wroteHeader && shouldFallback(err) {
+			local := mir.fallbackCopy(r, root, urlp)
+			if mir.serveLocal(w, r, local, logger) {
+				logger.Debug("served local copy after upstream error", zap.Error(err))
+				status, served = logStatusFallback, local
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	rww.handlerDone(upstreamReq.Context())
+	return false, nil
+}
+
+// varTrue reports whether the request var name is true, as a bool or a
+// string such as "true" or "1"
+func varTrue(r *http.Request, name string) bool {
+	switch value := caddyhttp.GetVar(r.Context(), name).(type) {
+	case bool:
+		return value
+	case string:
+		b, _ := strconv.ParseBool(value)
+		return b
+	default:
+		return false
+	}
+}
+
+// requestURL returns the absolute URL of r
+func requestURL(r *http.Request) string {
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+func (mir *Mirror) shouldPassThrough(r *http.Request) bool {
+	if r.Method != http.MethodGet && !mir.mirrorsUpload(r) {
+		mir.trace(mir.logger, "Pass through non-GET request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path))
+		return true
+	}
+	if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+		// Pass through directory requests unmodified
+		mir.trace(mir.logger, "skip directory browse",
+			zap.String("request_path", r.URL.Path))
+		return true
+	}
+	if varTrue(r, mir.SkipVar) {
+		mir.trace(mir.logger, "skip mirroring per request var",
+			zap.String("var", mir.SkipVar),
+			zap.String("request_path", r.URL.Path))
+		return true
+	}
+	return false
+}
+
+// trace logs a noisy per-request message at debug level, if tracing is enabled
+func (mir *Mirror) trace(logger *zap.Logger, msg string, fields ...zap.Field) {
+	if mir.Trace {
+		logger.Debug(msg, fields...)
+	}
+}
+
+// skipContentType reports whether responses with the given Content-Type
+// header should not be mirrored
+func (mir *Mirror) skipContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, skip := range mir.SkipContentTypes {
+		skip = strings.ToLower(skip)
+		if prefix, ok := strings.CutSuffix(skip, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == skip {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrNotRegular = errors.New("file is not a regular file")
+
+func pathInsideRoot(root string, urlp string) string {
+	// Figure out the local path of the given URL path
+	filename := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, urlp), "/")
+	return filename
+}
+
+type responseWriterWrapper struct {
+	*caddyhttp.ResponseWriterWrapper
+	// mu is held while writing the pending mirror file as the next
+	// handler runs, as max_duration may abandon it meanwhile
+	mu sync.Mutex
+	// durationTimer abandons the pending mirror file after max_duration
+	durationTimer *time.Timer
+	file          *renameio.PendingFile
+	etagFile      *renameio.PendingFile
+	metaFile      *renameio.PendingFile
+	responseFile  *renameio.PendingFile
+	meta          map[string]string
+	config        *Mirror
+	root          string
+	path          string
+	filename      string
+	etag          string
+	requestID     string
+	// trailers are the final values of the response trailers, once the
+	// handler has returned
+	trailers http.Header
+	// detached is the error writing to the client failed with, once it
+	// went away and the response is mirrored without it, with
+	// complete_on_disconnect. detachedBytes is the number of bytes written
+	// by then.
+	detached      error
+	detachedAt    time.Time
+	detachedBytes int64
+	// oversized are the sizes of the metadata values too large for xattrs,
+	// by name
+	oversized map[string]int
+	// setupErr is why the mirror file couldn't be created, with
+	// strict_errors
+	setupErr      error
+	lastModified  time.Time
+	logger        *zap.Logger
+	bytesExpected int64
+	bytesWritten  int64
+	// bytesFetched is the number of bytes of the body passed on to the
+	// client, whether mirrored or not
+	bytesFetched int64
+	contentHash  hash.Hash
+	// hashSkipped is set when the response is too large to be hashed, with
+	// max_hash_size
+	hashSkipped bool
+	// streaming is set when the response has been flushed at least once
+	streaming bool
+	start     time.Time
+	// firstWrite is when the first bytes of the body were written to the
+	// pending file
+	firstWrite time.Time
+	// wroteHeader is set once the response header has been written
+	wroteHeader bool
+	// decision is the outcome of mirroring the response, one of the decision constants
+	decision string
+	span     trace.Span
+	// resume is the partial file being resumed, until it has been replayed
+	resume *partialResume
+	// retry is set when upstream failed to resume, the response is then
+	// swallowed
+	retry bool
+	// revalidating is set when upstream is asked whether the local copy
+	// is still valid, notModified when it answered that it is. The answer
+	// is then swallowed and the local copy served instead.
+	revalidating bool
+	notModified  bool
+	// newFile is set when the file is counted as new for max_files
+	newFile bool
+	// conflict is the way made for the file once complete, with
+	// path_conflicts, until which the pending files are written to the root
+	conflict *pathConflict
+	// pending is where the pending files are written, which is filename
+	// unless staged
+	pending string
+	// url is the URL of the request, recorded for quarantined files
+	url string
+	// repl is the replacer of the request
+	repl *caddy.Replacer
+	// staged is set when the pending files are written to the staging
+	// directory, where reserved bytes are reserved for them
+	staged   bool
+	reserved int64
+	// space is the space reserved on the filesystem of the root for the
+	// rest of the response, with min_free_space
+	space *spaceReservation
+	// spent is the time spent writing to the mirror file and hashing
+	spent time.Duration
+	// expectedType is the media type expected for the file with
+	// soft_not_found, sniffed the first bytes of the response kept to
+	// check it
+	expectedType string
+	sniffed      []byte
+	// inferType is set when the response has no useful Content-Type, so
+	// its first bytes are sniffed to infer one for the metadata
+	inferType bool
+	// head and tail are the first and last bytes written, when only those
+	// are verified by verify_writes
+	head []byte
+	tail []byte
+	// warcHeader is the HTTP header of the response as archived, with
+	// warc. warcHash hashes it along with the body, warcRequest is the
+	// request as archived, with the requests option.
+	warcHeader  []byte
+	warcHash    hash.Hash
+	warcRequest []byte
+	// writes is the number of writes to the mirror file, for min_rate
+	writes int
+	// direct writes the mirror file with O_DIRECT, for direct_io
+	direct *directWriter
+	// writer writes the mirror file from a goroutine, for write_timeout
+	writer *fileWriter
+	// host is the host of the request, labeled the counters of the
+	// response's metric labels, if any
+	host    string
+	labeled *labeledStats
+	// forced is set when the request var named by force_var is true
+	forced bool
+	// etagSuffix is the ETag file suffix with its placeholders replaced
+	etagSuffix string
+	// transform feeds the response through the transformers, which write
+	// the pending mirror file in its place
+	transform *transformPipe
+	// language is the language of the response, if it is a variant stored
+	// with languages, acceptLanguage the Accept-Language of the request
+	language       string
+	acceptLanguage string
+	// inflight is the progress of the pending mirror file, listed by the
+	// admin API
+	inflight *inflightWrite
+}
+
+// Mirroring outcomes recorded on trace spans
+const (
+	decisionStore   = "store"
+	decisionSkip    = "skip"
+	decisionDiscard = "discard"
+	// decisionOverBudget is when mirroring was skipped after exceeding the
+	// write budget
+	decisionOverBudget = "skip_budget"
+)
+
+// recordSpan records the outcome of mirroring on the trace span, if tracing is enabled
+func (rww *responseWriterWrapper) recordSpan() {
+	if rww.span == nil {
+		return
+	}
+	rww.span.SetAttributes(
+		attribute.String("mirror.decision", rww.decision),
+		attribute.Int64("mirror.bytes", rww.bytesWritten),
+		attribute.Int64("mirror.duration_ms", time.Since(rww.start).Milliseconds()),
+		attribute.String("mirror.path", rww.filename),
+	)
+}
+
+// spanEvent adds an event to the trace span, if tracing is enabled
+func (rww *responseWriterWrapper) spanEvent(name string, attrs ...attribute.KeyValue) {
+	if rww.span == nil {
+		return
+	}
+	rww.span.AddEvent(name, trace.WithAttributes(attrs...))
+}
+
+// spanFailure adds a failure event for err to the trace span, if tracing is enabled
+func (rww *responseWriterWrapper) spanFailure(msg string, err error) {
+	rww.spanEvent("mirror.failure",
+		attribute.String("message", msg),
+		attribute.String("error", err.Error()))
+}
+
+func (rww *responseWriterWrapper) Cleanup() error {
+	rww.stopTransform()
+	rww.transform = nil
+	rww.stopWriter()
+	if rww.file != nil {
+		rww.endInflight()
+	}
+	if rww.direct != nil {
+		rww.direct.release()
+		rww.direct = nil
+	}
+	if rww.reserved != 0 {
+		rww.config.stager.release(rww.reserved)
+		rww.reserved = 0
+	}
+	if rww.space != nil {
+		rww.space.release()
+		rww.space = nil
+	}
+	err := errors.Join(cleanupPending(rww.file), cleanupPending(rww.etagFile), cleanupPending(rww.metaFile), cleanupPending(rww.responseFile))
+	rww.file = nil
+	rww.etagFile = nil
+	rww.metaFile = nil
+	rww.responseFile = nil
+	return err
+}
+
+func (rww *responseWriterWrapper) writeDone(written int64) {
+	rww.bytesWritten += written
+	rww.config.stats.bytesWritten.Add(written)
+	if rww.labeled != nil {
+		rww.labeled.bytesWritten.Add(written)
+	}
+	if rww.inflight != nil {
+		rww.inflight.wrote(written, time.Now())
+	}
+	if rww.bytesExpected >= 0 && rww.bytesWritten == rww.bytesExpected {
+		rww.config.trace(rww.logger, "responseWriterWrapper fully written",
+			zap.Int64("bytes_written", rww.bytesWritten),
+			zap.Int64("bytes_expected", rww.bytesExpected),
+		)
+	}
+}
+
+// handlerDone is called when the next handler has returned without error.
+// Only then is the response known to be complete, so this is where the
+// pending files are finalized, in two phases: first the writes are completed
+// and what the response is expected to be like is gathered, then it is
+// verified against those expectations, and only if that passes are the
+// files renamed into place.
+func (rww *responseWriterWrapper) handlerDone(ctx context.Context) {
+	if rww.file == nil || !rww.endTransform() || !rww.flushDirect() {
+		return
+	}
+	exp := rww.expectations(ctx)
+	if !rww.verify(exp) {
+		return
+	}
+	rww.useTransformed()
+	if rww.bytesExpected < 0 {
+		rww.config.trace(rww.logger, "responseWriterWrapper done without Content-Length",
+			zap.Int64("bytes_written", rww.bytesWritten),
+			zap.Bool("streaming", rww.streaming),
+		)
+	}
+	if rww.detached != nil {
+		rww.config.stats.completedOnDisconnect.Add(1)
+		rww.logger.Debug("completed mirroring after client went away",
+			zap.Int64("bytes_after_disconnect", rww.bytesWritten-rww.detachedBytes),
+			zap.Duration("duration_after_disconnect", time.Since(rww.detachedAt)))
+	}
+	rww.finalize()
+}
+
+func (rww *responseWriterWrapper) finalize() {
+	if ft := rww.config.finalizes; ft != nil {
+		ft.add()
+		defer ft.done()
+	}
+	// The pending files are either renamed into place or discarded after this
+	defer rww.Cleanup()
+	finalizeStart := time.Now()
+	defer func() {
+		if rww.decision == decisionStore {
+			// An empty body takes no time to write
+			var write time.Duration
+			if !rww.firstWrite.IsZero() {
+				write = finalizeStart.Sub(rww.firstWrite)
+			}
+			rww.config.stats.histograms.observeFile(rww.bytesWritten, write, time.Since(finalizeStart))
+		}
+	}()
+	var sumText string
+	if rww.contentHash != nil {
+		sum := rww.contentHash.Sum(nil)
+		sumText = hex.EncodeToString(sum)
+		rww.config.trace(rww.logger, "hash done", zap.String("sum", sumText))
+		if rww.config.Sha256Xattr && !rww.useXattr() {
+			// Written to the metadata sidecar file instead, if any
+			rww.setMetadata(xattrSha256, sumText)
+		} else if rww.config.Sha256Xattr {
+			err := rww.setMetadataXattr(xattrSha256, sumText)
+			if err != nil {
+				rww.logger.Error("failed to set sha256 xattr",
+					zap.Binary("sha256", sum),
+					zap.Error(err))
+				rww.spanFailure("failed to set sha256 xattr", err)
+			}
+		}
+	}
+	if !rww.validate(sumText) {
+		return
+	}
+	rww.setMetadata(xattrDownloaded, time.Now().UTC().Format(time.RFC3339))
+	rww.recordContentType()
+	rww.writeMetadata()
+	rww.writeResponseMeta()
+	rww.writeXattrs()
+	rww.logOversized()
+	if rww.config.PreserveMtime && !rww.lastModified.IsZero() {
+		err := os.Chtimes(rww.file.Name(), time.Now(), rww.lastModified)
+		if err != nil {
+			rww.logger.Error("failed to preserve Last-Modified as mtime",
+				zap.Error(err))
+		}
+	}
+	if rww.config.warc != nil {
+		rww.archive(sumText)
+		if rww.config.Warc.Only {
+			// The pending files are discarded by the deferred cleanup
+			rww.decision = decisionStore
+			rww.logger.Log(rww.config.completionLevel, "archived response",
+				zap.String("url", rww.url),
+				zap.Int64("bytes_written", rww.bytesWritten),
+				zap.Duration("duration", time.Since(rww.start)),
+				zap.String("sha256", sumText))
+			return
+		}
+	}
+	if err := rww.config.checkContained(rww.root, rww.filename); err != nil {
+		rww.logger.Error("refusing to complete mirror file outside of the root",
+			zap.String("path", rww.filename),
+			zap.String("root", rww.root),
+			zap.Error(err))
+		rww.decision = decisionDiscard
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("mirror file outside of the root", err)
+		return
+	}
+	if rww.conflict != nil {
+		err := rww.config.makeWay(rww.root, rww.filename, rww.conflict, rww.logger)
+		if err != nil {
+			rww.logger.Warn("failed to make way for mirror file",
+				zap.String("path_conflicts", rww.config.PathConflicts),
+				zap.Error(err))
+			rww.decision = decisionDiscard
+			rww.config.stats.failures.Add(1)
+			rww.spanFailure("failed to make way for mirror file", err)
+			return
+		}
+	}
+	// Sidecars are replaced after the content, so the ones they replace
+	// are removed first, to never leave them next to content they don't
+	// describe
+	err := rww.removeSidecars()
+	if err != nil {
+		rww.logger.Error("failed to remove sidecar files before replacing mirror file",
+			zap.Error(err))
+		rww.decision = decisionDiscard
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("failed to remove sidecar files", err)
+		return
+	}
+	replace := func() error {
+		return rww.config.replacePending(rww.root, rww.file, rww.pending)
+	}
+	if rww.staged {
+		// The file is made immutable once moved to the root
+		err = replace()
+	} else {
+		err = rww.config.replaceImmutable(rww.filename, replace)
+	}
+	if err != nil {
+		rww.logger.Error("failed to complete mirror file",
+			zap.Error(err))
+		rww.decision = decisionDiscard
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("failed to complete mirror file", err)
+		return
+	}
+	if rww.config.VerifyWrites && !rww.verifyWrite(sumText) {
+		return
+	}
+	if rww.etagFile != nil {
+		err := rww.etagFile.CloseAtomicallyReplace()
+		if err != nil {
+			rww.logger.Error("failed to complete etagFile",
+				zap.Error(err))
+			rww.spanFailure("failed to complete etagFile", err)
+		}
+	}
+	if rww.metaFile != nil {
+		err := rww.metaFile.CloseAtomicallyReplace()
+		if err != nil {
+			rww.logger.Error("failed to complete metaFile",
+				zap.Error(err))
+			rww.spanFailure("failed to complete metaFile", err)
+		}
+	}
+	if rww.responseFile != nil {
+		err := rww.responseFile.CloseAtomicallyReplace()
+		if err != nil {
+			rww.logger.Error("failed to complete responseFile",
+				zap.Error(err))
+			rww.spanFailure("failed to complete responseFile", err)
+		}
+	}
+	if rww.config.KeepPartials != nil {
+		// A partial file left by an earlier attempt is obsolete now
+		if err := removePartial(rww.filename); err != nil {
+			rww.logger.Error("failed to remove obsolete partial file",
+				zap.Error(err))
+		}
+	}
+	info := FileInfo{
+		Path:      rww.filename,
+		Size:      rww.bytesWritten,
+		SHA256:    sumText,
+		ETag:      rww.etag,
+		Header:    rww.Header().Clone(),
+		RequestID: rww.requestID,
+		Language:  rww.language,
+	}
+	if rww.staged {
+		// The reservation is released once the file has been moved
+		rww.config.stager.used.Add(rww.bytesWritten - rww.reserved)
+		rww.config.stager.enqueue(rww.root, rww.pending, info)
+		rww.reserved = 0
+	} else {
+		rww.config.finalized(rww.root, info)
+	}
+	rww.decision = decisionStore
+	rww.config.stats.filesWritten.Add(1)
+	if rww.labeled != nil {
+		rww.labeled.filesWritten.Add(1)
+	}
+	if rww.newFile {
+		rww.config.fileAdded(rww.root)
+	}
+	rww.spanEvent("mirror.finalize",
+		attribute.String("sha256", sumText),
+		attribute.String("etag", rww.etag))
+	rww.logger.Log(rww.config.completionLevel, "mirrored file",
+		zap.String("path", rww.filename),
+		zap.Int64("bytes_written", rww.bytesWritten),
+		zap.Duration("duration", time.Since(rww.start)),
+		zap.String("sha256", sumText),
+		zap.String("etag", rww.etag))
+}
+
+// writeAll writes to w from data[], retrying until all of data[] has been consumed, unless an error other than ErrShortWrite occurs
+func writeAll(w io.Writer, data []byte) (int, error) {
+	written := 0
+	for {
+		// Keep going until we are not making any more progress
+		n, err := w.Write(data[written:])
+		written += n
+		if written > len(data) {
+			panic("wrote more than len(data)!!!")
+		}
+		if n == 0 {
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return written, fmt.Errorf("not making progress: %w", err)
+		}
+		if written == len(data) {
+			break
+		}
+	}
+	return written, nil
+}
+
+// abort discards the pending mirror files, logging the reason at the given
+// level. The rest of the response is passed through without being mirrored.
+func (rww *responseWriterWrapper) abort(level zapcore.Level, reason string, fields ...zap.Field) {
+	rww.discard(level, reason, true, fields...)
+}
+
+// discard discards the pending mirror files, logging the reason at the
+// given level. With keep, they are kept as a partial file where configured.
+func (rww *responseWriterWrapper) discard(level zapcore.Level, reason string, keep bool, fields ...zap.Field) {
+	if rww.file == nil {
+		return
+	}
+	rww.logger.Log(level, "mirror aborted: "+reason, append(fields,
+		zap.String("path", rww.filename),
+		zap.Int64("bytes_written", rww.bytesWritten),
+		zap.Duration("duration", time.Since(rww.start)))...)
+	rww.decision = decisionDiscard
+	rww.config.stats.discards.Add(1)
+	if rww.labeled != nil {
+		rww.labeled.discards.Add(1)
+	}
+	rww.spanEvent("mirror.discard", attribute.String("reason", reason))
+	if keep {
+		rww.keepPartial()
+	}
+	err := rww.Cleanup()
+	if err != nil {
+		rww.logger.Error("failed to clean up mirror temp files",
+			zap.Error(err))
+	}
+}
+
+// writeMirror writes data to the pending mirror file and content hash, if any
+func (rww *responseWriterWrapper) writeMirror(data []byte) (int, error) {
+	rww.mu.Lock()
+	defer rww.mu.Unlock()
+	return rww.writeMirrorLocked(data)
+}
 
-	Sha256Xattr   bool `json:"sha256_xattr,omitempty"`
-	HideTempFiles bool `json:"hide_temp_files,omitempty"`
+// writeMirrorLocked is writeMirror with mu held
+func (rww *responseWriterWrapper) writeMirrorLocked(data []byte) (int, error) {
+	if len(data) == 0 || rww.file == nil || rww.abandon() {
+		return len(data), nil
+	}
+	if rww.tooSlow() {
+		return len(data), nil
+	}
+	if !rww.spaceFor(int64(len(data))) {
+		return len(data), nil
+	}
+	start := time.Now()
+	if rww.firstWrite.IsZero() {
+		rww.firstWrite = start
+	}
+	rww.sniff(data)
+	if rww.transform == nil {
+		rww.keepSample(data)
+	}
+	if rww.contentHash != nil && rww.overHashSize(rww.bytesWritten+int64(len(data))) {
+		rww.skipHash()
+	}
+	if rww.contentHash != nil {
+		hashed, err := writeAll(rww.contentHash, data)
+		if err != nil {
+			rww.logger.Error("failed to hash data",
+				zap.Int("bytes_hashed", hashed),
+				zap.Error(err))
+			rww.contentHash = nil
+		}
+	}
+	if rww.warcHash != nil {
+		rww.warcHash.Write(data)
+	}
+	var written int
+	var err error
+	if rww.transform != nil {
+		written, err = rww.writeTransform(data)
+	} else {
+		written, err = rww.writeFile(data)
+	}
+	if errors.Is(err, errWriteTimeout) {
+		return len(data), nil
+	}
+	rww.writeDone(int64(written))
+	if err != nil {
+		rww.config.stats.failures.Add(1)
+		return written, err
+	}
+	rww.spent += time.Since(start)
+	if budget := time.Duration(rww.config.WriteBudget); budget > 0 && rww.spent > budget {
+		rww.overBudget(budget)
+	}
+	return written, nil
+}
 
-	logger *zap.Logger
+// overBudget discards the pending mirror files after mirroring the response
+// has cost more than budget. The rest of the response is passed through
+// without being mirrored.
+func (rww *responseWriterWrapper) overBudget(budget time.Duration) {
+	rww.logger.Debug("mirror skipped, write budget exceeded",
+		zap.String("path", rww.filename),
+		zap.Duration("write_budget", budget),
+		zap.Duration("spent", rww.spent),
+		zap.Int64("bytes_written", rww.bytesWritten))
+	rww.decision = decisionOverBudget
+	rww.config.stats.overBudget.Add(1)
+	rww.spanEvent("mirror.skip_budget", attribute.Int64("spent_ms", rww.spent.Milliseconds()))
+	if err := rww.Cleanup(); err != nil {
+		rww.logger.Error("failed to clean up mirror temp files",
+			zap.Error(err))
+	}
 }
 
-func (Mirror) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.handlers.mirror",
-		New: func() caddy.Module { return new(Mirror) },
+var errWriteTimeout = errors.New("mirror file write timed out")
+
+const (
+	defaultMinRateGrace = 10 * time.Second
+
+	// minRateInterval is the number of writes between checks of min_rate
+	minRateInterval = 16
+)
+
+// startMaxDuration has mirroring the response abandoned once max_duration
+// has passed, whether or not upstream is still sending it
+func (rww *responseWriterWrapper) startMaxDuration() {
+	maxDuration := time.Duration(rww.config.MaxDuration)
+	if maxDuration <= 0 {
+		return
 	}
+	var timer *time.Timer
+	timer = time.AfterFunc(maxDuration-time.Since(rww.start), func() {
+		rww.mu.Lock()
+		defer rww.mu.Unlock()
+		if rww.durationTimer != timer {
+			// Stopped meanwhile
+			return
+		}
+		rww.durationTimer = nil
+		rww.abort(zapcore.WarnLevel, "max duration exceeded",
+			zap.Duration("max_duration", maxDuration))
+	})
+	rww.mu.Lock()
+	rww.durationTimer = timer
+	rww.mu.Unlock()
 }
 
-// Provision sets up the mirror handler
-func (mir *Mirror) Provision(ctx caddy.Context) error {
-	mir.logger = ctx.Logger()
-	if mir.Root == "" {
-		mir.Root = "{http.vars.root}"
+// stopMaxDuration stops the max_duration timer, once the next handler is
+// done with the response. Mirroring it is no longer abandoned after this
+// returns.
+func (rww *responseWriterWrapper) stopMaxDuration() {
+	rww.mu.Lock()
+	defer rww.mu.Unlock()
+	if rww.durationTimer != nil {
+		rww.durationTimer.Stop()
+		rww.durationTimer = nil
 	}
-	return nil
 }
 
-func (mir *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if mir.shouldPassThrough(r) {
-		return next.ServeHTTP(w, r)
+// tooSlow discards the pending mirror files and reports true if the
+// response body arrives slower than min_rate. The rate is only checked
+// every minRateInterval writes.
+func (rww *responseWriterWrapper) tooSlow() bool {
+	minRate := rww.config.MinRate
+	if minRate == 0 {
+		return false
+	}
+	rww.writes++
+	if rww.writes%minRateInterval != 0 {
+		return false
+	}
+	grace := time.Duration(rww.config.MinRateGrace)
+	if grace <= 0 {
+		grace = defaultMinRateGrace
 	}
-	urlp := r.URL.Path
-	if !path.IsAbs(urlp) {
-		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("URL path %v not absolute", urlp))
+	elapsed := time.Since(rww.start)
+	if elapsed < grace || float64(rww.bytesWritten) >= float64(minRate)*elapsed.Seconds() {
+		return false
 	}
+	rww.config.stats.slowTransfers.Add(1)
+	rww.abort(zapcore.InfoLevel, "upstream too slow",
+		zap.Uint64("min_rate", minRate),
+		zap.Float64("rate", float64(rww.bytesWritten)/elapsed.Seconds()))
+	return true
+}
 
-	// Replace any Caddy placeholders in Root
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	root := repl.ReplaceAll(mir.Root, ".")
-	logger := mir.logger.With(zap.String("site_root", root),
-		zap.String("request_path", urlp))
+// fileWriter writes to a pending mirror file from a goroutine of its own,
+// for write_timeout, so that a write stuck on the filesystem can be given
+// up on while the response goes on. The goroutine writes a copy of the
+// data, which it may still be writing once given up on.
+type fileWriter struct {
+	chunks  chan []byte
+	results chan writeResult
+	timer   *time.Timer
+	buf     []byte
+}
 
-	rww := &responseWriterWrapper{
-		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
-		config:                mir,
-		root:                  root,
-		path:                  urlp,
-		logger:                logger.With(zap.Namespace("rww")),
+type writeResult struct {
+	written int
+	err     error
+}
+
+// newFileWriter starts the goroutine writing to w
+func newFileWriter(w io.Writer) *fileWriter {
+	fw := &fileWriter{chunks: make(chan []byte), results: make(chan writeResult, 1)}
+	go func() {
+		defer close(fw.results)
+		for chunk := range fw.chunks {
+			written, err := writeAll(w, chunk)
+			fw.results <- writeResult{written, err}
+		}
+	}()
+	return fw
+}
+
+// write writes data, reporting false if that doesn't complete within
+// timeout, in which case the write is left to the goroutine
+func (fw *fileWriter) write(data []byte, timeout time.Duration) (writeResult, bool) {
+	fw.buf = append(fw.buf[:0], data...)
+	fw.chunks <- fw.buf
+	if fw.timer == nil {
+		fw.timer = time.NewTimer(timeout)
+	} else {
+		fw.timer.Reset(timeout)
 	}
-	defer rww.Cleanup()
+	select {
+	case res := <-fw.results:
+		if !fw.timer.Stop() {
+			<-fw.timer.C
+		}
+		return res, true
+	case <-fw.timer.C:
+		return writeResult{}, false
+	}
+}
 
-	w = rww
+// stop ends the goroutine, returning a channel closed once it is done
+// with the write in progress, if any
+func (fw *fileWriter) stop() <-chan writeResult {
+	close(fw.chunks)
+	return fw.results
+}
 
-	return next.ServeHTTP(w, r)
+// stopWriter ends the goroutine writing to the pending mirror file, if any
+func (rww *responseWriterWrapper) stopWriter() {
+	if rww.writer != nil {
+		rww.writer.stop()
+		rww.writer = nil
+	}
 }
 
-func (mir *Mirror) shouldPassThrough(r *http.Request) bool {
-	if r.Method != http.MethodGet {
-		mir.logger.Debug("Pass through non-GET request",
-			zap.String("method", r.Method),
-			zap.String("path", r.URL.Path))
-		return true
+// writeFile writes data to the pending mirror file. If the write does not
+// complete within the configured write timeout, the pending files are
+// abandoned and errWriteTimeout is returned. They are cleaned up once the
+// stuck write returns.
+func (rww *responseWriterWrapper) writeFile(data []byte) (int, error) {
+	var w io.Writer = rww.file
+	if rww.direct != nil {
+		w = rww.direct
 	}
-	if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
-		// Pass through directory requests unmodified
-		mir.logger.Debug("skip directory browse",
-			zap.String("request_path", r.URL.Path))
-		return true
+	timeout := time.Duration(rww.config.WriteTimeout)
+	if timeout <= 0 {
+		return writeAll(w, data)
 	}
-	return false
-}
+	if rww.writer == nil {
+		rww.writer = newFileWriter(w)
+	}
+	if res, ok := rww.writer.write(data, timeout); ok {
+		return res.written, res.err
+	}
+	file := rww.file
+	direct := rww.direct
+	done := rww.writer.stop()
+	rww.writer = nil
 
-var ErrNotRegular = errors.New("file is not a regular file")
+	rww.logger.Error("mirror file write timed out, abandoning mirror",
+		zap.Duration("write_timeout", timeout),
+		zap.Int64("bytes_written", rww.bytesWritten))
+	rww.decision = decisionDiscard
+	rww.config.stats.failures.Add(1)
+	rww.endInflight()
+	rww.spanFailure("mirror file write timed out", errWriteTimeout)
+	etagFile := rww.etagFile
+	rww.file = nil
+	rww.etagFile = nil
+	rww.direct = nil
+	rww.contentHash = nil
+	go func() {
+		for range done {
+		}
+		if direct != nil {
+			direct.release()
+		}
+		err := errors.Join(file.Cleanup(), cleanupPending(etagFile))
+		if err != nil {
+			rww.logger.Error("failed to clean up abandoned mirror temp files",
+				zap.Error(err))
+		}
+	}()
+	return 0, errWriteTimeout
+}
 
-func pathInsideRoot(root string, urlp string) string {
-	// Figure out the local path of the given URL path
-	filename := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, urlp), "/")
-	return filename
+// removeSidecars removes the ETag and metadata sidecar files of the pending
+// file that are replaced or made stale by this response. Sidecars are only
+// renamed into place after the content, so a crash or failed rename in
+// between may leave a file without its sidecars, but never with sidecars of
+// an earlier version.
+func (rww *responseWriterWrapper) removeSidecars() error {
+	var sidecars []string
+	if rww.etagSuffix != "" {
+		sidecars = append(sidecars, rww.pending+rww.etagSuffix)
+	}
+	if suffix := rww.config.MetadataFileSuffix; suffix != "" {
+		sidecars = append(sidecars, rww.pending+suffix)
+	}
+	if rww.config.StoreResponseMeta != nil {
+		sidecars = append(sidecars, rww.pending+ResponseMetaSuffix)
+	}
+	if rww.config.tombstones() {
+		sidecars = append(sidecars, rww.pending+TombstoneSuffix)
+	}
+	for _, sidecar := range sidecars {
+		if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
 }
 
-type responseWriterWrapper struct {
-	*caddyhttp.ResponseWriterWrapper
-	file          *renameio.PendingFile
-	etagFile      *renameio.PendingFile
-	config        *Mirror
-	root          string
-	path          string
-	logger        *zap.Logger
-	bytesExpected int64
-	bytesWritten  int64
-	contentHash   hash.Hash
+// cleanupPending discards the pending file f, if any
+func cleanupPending(f *renameio.PendingFile) error {
+	if f == nil {
+		return nil
+	}
+	return f.Cleanup()
 }
 
-func (rww *responseWriterWrapper) Cleanup() error {
-	var fileErr error
-	var etagErr error
+func (rww *responseWriterWrapper) Write(data []byte) (int, error) {
+	if rww.setupErr != nil {
+		// Stop the upstream copy, the request fails regardless
+		return 0, rww.setupErr
+	}
+	if rww.swallowed() {
+		return len(data), nil
+	}
+	if rww.detached != nil {
+		return rww.writeDetached(data)
+	}
+	rww.wroteHeader = true
+	written, err := rww.writeMirror(data)
+	if err != nil {
+		return written, err
+	}
+	// Continue by passing the buffer on to the next ResponseWriter in the chain
+	written, err = rww.ResponseWriter.Write(data)
+	rww.bytesFetched += int64(written)
+	if err != nil && rww.completing() {
+		rww.detach(err)
+		return len(data), nil
+	}
+	return written, err
+}
 
+// ReadFrom implements io.ReaderFrom. The source is tee'd into the pending
+// mirror file while the copy itself is delegated to the next ResponseWriter in
+// the chain, so that it may use its own io.ReaderFrom (e.g. sendfile).
+func (rww *responseWriterWrapper) ReadFrom(r io.Reader) (int64, error) {
+	if rww.setupErr != nil {
+		return 0, rww.setupErr
+	}
+	if rww.swallowed() {
+		return io.Copy(io.Discard, r)
+	}
+	if rww.completing() {
+		// Writes to the client may fail without stopping the copy
+		return io.Copy(writerFunc(rww.Write), r)
+	}
 	if rww.file != nil {
-		fileErr = rww.file.Cleanup()
-		rww.file = nil
+		r = io.TeeReader(r, writerFunc(rww.writeMirror))
 	}
-	if rww.etagFile != nil {
-		etagErr = rww.etagFile.Cleanup()
-		rww.etagFile = nil
+	n, err := rww.ResponseWriterWrapper.ReadFrom(r)
+	rww.bytesFetched += n
+	return n, err
+}
+
+// Flush implements http.Flusher. The flush is forwarded down the chain and the
+// response is marked as streaming.
+func (rww *responseWriterWrapper) Flush() {
+	if rww.swallowed() || rww.detached != nil {
+		return
+	}
+	rww.streaming = true
+	err := http.NewResponseController(rww.ResponseWriter).Flush()
+	if err != nil {
+		rww.logger.Debug("failed to flush response", zap.Error(err))
 	}
-	return errors.Join(fileErr, etagErr)
 }
 
-func (rww *responseWriterWrapper) writeDone(written int64) {
-	rww.bytesWritten += written
-	if rww.bytesExpected > 0 && rww.bytesWritten == rww.bytesExpected {
-		rww.logger.Debug("responseWriterWrapper fully written",
-			zap.Int64("bytes_written", rww.bytesWritten),
-			zap.Int64("bytes_expected", rww.bytesExpected),
-		)
-		rww.finalize()
+// Hijack implements http.Hijacker. A hijacked connection is never mirrored,
+// so any pending mirror files are discarded right away instead of lingering
+// until the connection is closed.
+func (rww *responseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rww.mu.Lock()
+	rww.abort(zapcore.DebugLevel, "connection hijacked")
+	rww.mu.Unlock()
+	return http.NewResponseController(rww.ResponseWriter).Hijack()
+}
+
+// writerFunc adapts a function to the io.Writer interface
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// shouldMirror reports whether a response with the given status code and
+// the headers written so far should be mirrored
+func (rww *responseWriterWrapper) shouldMirror(statusCode int) bool {
+	if statusCode != http.StatusOK || rww.config.statusAction(statusCode) != actionStore || rww.config.isReadOnly() {
+		return false
+	}
+	if contentRange := rww.Header().Get("Content-Range"); contentRange != "" {
+		// A 200 with a Content-Range is nonsensical, and the body most
+		// likely only the requested range
+		rww.config.stats.rangeOn200.Add(1)
+		rww.logger.Warn("not mirroring 200 response with Content-Range",
+			zap.String("url", rww.url),
+			zap.String("content_range", contentRange))
+		return false
+	}
+	if rww.config.OnlyUpstream && !rww.fromUpstream() {
+		rww.config.trace(rww.logger, "skip mirroring response not from upstream")
+		return false
+	}
+	if contentType := rww.Header().Get("Content-Type"); !rww.forced && rww.config.skipContentType(contentType) {
+		rww.logger.Debug("skip mirroring content type",
+			zap.String("content_type", contentType))
+		return false
 	}
+	if !rww.admitLanguage() {
+		return false
+	}
+	if rww.config.SkipUnchanged && rww.unchanged() {
+		rww.config.trace(rww.logger, "skip mirroring unchanged content")
+		return false
+	}
+	return rww.admit()
 }
 
-func (rww *responseWriterWrapper) finalize() {
-	if rww.contentHash != nil {
-		sum := rww.contentHash.Sum(nil)
-		sumText := hex.EncodeToString(sum)
-		rww.logger.Debug("hash done", zap.String("sum", sumText))
-		if rww.config.Sha256Xattr {
-			err := xattr.FSet(rww.file.File, "user.xdg.origin.sha256", []byte(sumText))
-			if err != nil {
-				rww.logger.Error("failed to set sha256 xattr",
-					zap.Binary("sha256", sum),
-					zap.Error(err))
-			}
+// admit decides the file the response is mirrored to, following symlinks
+// and resolving conflicts, and reserves space for it. It reports false if
+// it can't be mirrored, such as with max_files reached.
+func (rww *responseWriterWrapper) admit() bool {
+	if rww.config.MaxFiles > 0 {
+		newFile, ok := rww.config.admitFile(rww.root, rww.config.locate(rww.root, pathInsideRoot(rww.root, rww.path)))
+		if !ok {
+			rww.logger.Debug("skip mirroring new file, max_files reached")
+			return false
 		}
+		rww.newFile = newFile
 	}
-	err := rww.file.CloseAtomicallyReplace()
-	if err != nil {
-		rww.logger.Error("failed to complete mirror file",
-			zap.Error(err))
-		return
-	} else if rww.etagFile != nil {
-		err := rww.etagFile.CloseAtomicallyReplace()
-		if err != nil {
-			rww.logger.Error("failed to complete etagFile",
+	filename, ok := rww.config.resolveSymlink(rww.root, pathInsideRoot(rww.root, rww.path), rww.logger)
+	if ok && rww.config.parentChecks != nil {
+		if err := rww.config.parentChecks.check(rww.root, filename); err != nil {
+			rww.logger.Error("not mirroring through a parent directory outside of the root",
+				zap.String("path", filename),
 				zap.Error(err))
+			ok = false
 		}
 	}
+	// Space is reserved before making way for the file, which isn't undone
+	// should there not be enough
+	if !ok || !rww.reserveResponse() {
+		return false
+	}
+	filename, rww.conflict, ok = rww.config.resolveConflicts(rww.root, filename, rww.logger)
+	if !ok {
+		return false
+	}
+	rww.filename = filename
+	return true
 }
 
-// writeAll writes to w from data[], retrying until all of data[] has been consumed, unless an error other than ErrShortWrite occurs
-func writeAll(w io.Writer, data []byte) (int, error) {
-	written := 0
-	for {
-		// Keep going until we are not making any more progress
-		n, err := w.Write(data[written:])
-		written += n
-		if written > len(data) {
-			panic("wrote more than len(data)!!!")
-		}
-		if n == 0 {
-			if err == nil {
-				err = io.ErrShortWrite
+// fromUpstream reports whether the response was produced by an upstream
+func (rww *responseWriterWrapper) fromUpstream() bool {
+	if rww.config.UpstreamHeader != "" {
+		return rww.Header().Get(rww.config.UpstreamHeader) != ""
+	}
+	if rww.repl == nil {
+		return false
+	}
+	host, _ := rww.repl.GetString("http.reverse_proxy.upstream.host")
+	return host != ""
+}
+
+// unchanged reports whether the response's ETag matches that of the local copy
+func (rww *responseWriterWrapper) unchanged() bool {
+	etag := rww.Header().Get("ETag")
+	if etag == "" {
+		return false
+	}
+	filename := rww.config.locate(rww.root, pathInsideRoot(rww.root, rww.path))
+	if _, err := os.Stat(filename); err != nil {
+		return false
+	}
+	stored := rww.config.storedEtag(filename, rww.etagSuffix, rww.config.readMetadata(filename))
+	return etagsMatch(stored, etag, rww.config.WeakEtags)
+}
+
+// parseContentLength returns the length given by the Content-Length header
+// values, or -1 if there are none. Values may be repeated, in separate
+// headers or as a comma-separated list, but must then agree. Anything but
+// decimal digits is invalid.
+func parseContentLength(values []string) (int64, error) {
+	length := int64(-1)
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.Trim(v, " \t")
+			if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+				return -1, fmt.Errorf("invalid Content-Length %q", v)
 			}
-			return written, fmt.Errorf("not making progress: %w", err)
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return -1, fmt.Errorf("invalid Content-Length %q: %w", v, err)
+			}
+			if length >= 0 && n != length {
+				return -1, fmt.Errorf("conflicting Content-Length values %d and %d", length, n)
+			}
+			length = n
 		}
-		if written == len(data) {
-			break
+	}
+	return length, nil
+}
+
+// setupErrorStatus returns the status of requests failed with
+// strict_errors as the mirror file couldn't be created with err: 507
+// Insufficient Storage where the disk or quota is full, 500 otherwise
+func setupErrorStatus(err error) int {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// swallowed reports whether the response is kept from the client
+func (rww *responseWriterWrapper) swallowed() bool {
+	return rww.retry || rww.notModified || rww.setupErr != nil
+}
+
+func (rww *responseWriterWrapper) WriteHeader(statusCode int) {
+	if rww.resume != nil {
+		statusCode = rww.resumeHeader(statusCode)
+	}
+	if rww.revalidating && statusCode == http.StatusNotModified {
+		rww.config.trace(rww.logger, "local copy not modified upstream")
+		rww.notModified = true
+	}
+	if !rww.retry {
+		rww.applyStatusAction(statusCode)
+	}
+	if rww.swallowed() {
+		return
+	}
+	rww.wroteHeader = true
+	rww.config.trace(rww.logger, "WriteHeader", zap.Int("status_code", statusCode))
+	if rww.shouldMirror(statusCode) {
+		rww.startMirror()
+		if rww.setupErr != nil {
+			return
 		}
 	}
-	return written, nil
+	rww.ResponseWriter.WriteHeader(statusCode)
+	if rww.resume != nil {
+		rww.replayPartial()
+	}
 }
 
-func (rww *responseWriterWrapper) Write(data []byte) (int, error) {
-	if len(data) > 0 && rww.file != nil {
-		if rww.contentHash != nil {
-			hashed, err := writeAll(rww.contentHash, data)
-			if err != nil {
-				rww.logger.Error("failed to hash data",
-					zap.Int("bytes_hashed", hashed),
-					zap.Error(err))
-				rww.contentHash = nil
+// startMirror creates the pending files the response is mirrored to, once
+// admitted, and sets up what mirroring it takes from its header. With
+// strict_errors, setupErr is set if the mirror file can't be created.
+func (rww *responseWriterWrapper) startMirror() {
+	// Get the Content-Length header to figure out how much data to expect
+	cl, err := parseContentLength(rww.Header().Values("Content-Length"))
+	if err != nil {
+		rww.logger.Warn("invalid Content-Length, treating length as unknown",
+			zap.Strings("content_length", rww.Header().Values("Content-Length")),
+			zap.Error(err))
+	}
+	rww.bytesExpected = cl
+	etag := rww.Header().Get("ETag")
+	if etag != "" {
+		canonical, ok := canonicalEtag(etag)
+		if !ok {
+			rww.logger.Warn("invalid ETag, continuing without storing it",
+				zap.String("etag", etag))
+		}
+		etag = canonical
+	}
+	filename := rww.filename
+	rww.pending = filename
+	if !rww.forced {
+		rww.expectedType = rww.config.expectedType(filename)
+	}
+	rww.inferType = !usefulContentType(rww.Header().Get("Content-Type"))
+	rww.labeled = rww.config.labeled(rww.host, rww.Header().Get("Content-Type"))
+	if lastModified, err := http.ParseTime(rww.Header().Get("Last-Modified")); err == nil {
+		rww.lastModified = lastModified
+		rww.setMetadata(xattrLastModified, lastModified.UTC().Format(http.TimeFormat))
+	}
+	if rww.file == nil {
+		if st := rww.config.stager; st != nil && rww.conflict == nil {
+			if staged, ok := st.stage(rww.root, filename, rww.bytesExpected); ok {
+				rww.pending = staged
+				rww.staged = true
+				rww.reserved = max(rww.bytesExpected, 0)
 			}
 		}
-		written, err := writeAll(rww.file, data)
-		rww.writeDone(int64(written))
+		rww.config.trace(rww.logger, "creating temp file")
+		rww.file, err = rww.createPending(rww.pending)
 		if err != nil {
-			return written, err
+			rww.logger.Error("failed to create mirror temp file",
+				zap.Error(err))
+			if errors.Is(err, syscall.EROFS) && !rww.staged {
+				rww.config.enterReadOnly(err)
+			}
+			rww.config.stats.failures.Add(1)
+			rww.spanFailure("failed to create mirror temp file", err)
+			rww.file = nil
+			if rww.config.StrictErrors {
+				// The response is swallowed, and the request fails
+				rww.setupErr = err
+				return
+			}
+		} else {
+			rww.startInflight()
+			rww.startDirect()
 		}
 	}
-	// Continue by passing the buffer on to the next ResponseWriter in the chain
-	return rww.ResponseWriter.Write(data)
+	if etag != "" {
+		rww.storeEtag(etag)
+	}
+	if rww.config.Sha256Xattr || rww.config.VerifyWrites || rww.config.sinks != nil || rww.config.warc != nil || declaresDigestTrailer(rww.Header()) {
+		if rww.overHashSize(rww.bytesExpected) {
+			rww.skipHash()
+		} else {
+			rww.contentHash = newContentHash()
+		}
+	}
+	if rww.file != nil {
+		rww.startWarc()
+		rww.startTransform()
+		rww.startMaxDuration()
+	}
+	if expires, ok := freshUntil(rww.Header(), time.Now(), rww.config.HeuristicFreshness); ok {
+		rww.setMetadata(xattrExpires, expires.UTC().Format(time.RFC3339))
+	}
 }
 
-func (rww *responseWriterWrapper) WriteHeader(statusCode int) {
-	rww.logger.Debug("WriteHeader", zap.Int("status_code", statusCode))
-	if statusCode == http.StatusOK {
-		// Get the Content-Length header to figure out how much data to expect
-		cl, err := strconv.ParseInt(rww.Header().Get("Content-Length"), 10, 64)
-		if err == nil {
-			rww.bytesExpected = cl
-		}
-		etag := rww.Header().Get("ETag")
-		filename := pathInsideRoot(rww.root, rww.path)
-		if rww.file == nil {
-			rww.logger.Debug("creating temp file")
-			rww.file, err = createTempFile(filename)
+// storeEtag stores etag, which must be valid, alongside the mirrored file
+func (rww *responseWriterWrapper) storeEtag(etag string) {
+	if rww.file == nil {
+		return
+	}
+	rww.etag = etag
+	// Store ETag as xattr
+	if rww.config.UseXattr {
+		if !rww.useXattr() || !rww.fitsXattr(xattrEtag, etag) {
+			// Written to the metadata sidecar file instead, if any
+			rww.setMetadata(xattrEtag, etag)
+		} else if err := rww.setMetadataXattr(xattrEtag, etag); err != nil {
+			rww.logger.Error("failed to write ETag to xattr",
+				zap.Error(err))
+		}
+	}
+	// Store ETag as separate file
+	if formatted, ok := formatEtag(etag, rww.config.EtagFileFormat); ok && rww.etagSuffix != "" {
+		etagFilename := rww.pending + rww.etagSuffix
+		etagFile, err := rww.createPending(etagFilename)
+		if err != nil {
+			rww.logger.Error("failed to create ETag temp file, continuing without writing ETag sidecar file",
+				zap.Error(err))
+		} else {
+			rww.etagFile = etagFile
+			_, err := io.Copy(rww.etagFile, strings.NewReader(formatted))
 			if err != nil {
-				rww.logger.Error("failed to create mirror temp file",
+				rww.logger.Error("failed to write temp ETag file",
 					zap.Error(err))
-				if errors.Is(err, fs.ErrPermission) {
-					statusCode = http.StatusForbidden
-				} else {
-					statusCode = http.StatusInternalServerError
-				}
-				rww.file = nil
-			}
-		}
-		if etag != "" {
-			// Store ETag as xattr
-			if rww.config.UseXattr {
-				err := xattr.FSet(rww.file.File, "user.xdg.origin.etag", []byte(etag))
-				if err != nil {
-					rww.logger.Error("failed to write ETag to xattr",
-						zap.Error(err))
-				}
-			}
-			// Store ETag as separate file
-			if rww.config.EtagFileSuffix != "" {
-				etagFilename := filename + rww.config.EtagFileSuffix
-				etagFile, err := createTempFile(etagFilename)
-				if err != nil {
-					rww.logger.Error("failed to create ETag temp file, continuing without writing ETag sidecar file",
-						zap.Error(err))
-				} else {
-					rww.etagFile = etagFile
-					_, err := io.Copy(rww.etagFile, strings.NewReader(etag))
-					if err != nil {
-						rww.logger.Error("failed to write temp ETag file",
-							zap.Error(err))
-					}
-				}
 			}
 		}
-		if rww.config.Sha256Xattr {
-			rww.contentHash = sha256.New()
-		}
 	}
-	rww.ResponseWriter.WriteHeader(statusCode)
 }
 
-func createTempFile(path string) (*renameio.PendingFile, error) {
+// createPending creates a pending file to replace path. Until the way is
+// made for the mirror file, it is created in the root rather than next to
+// path, whose directory may not exist yet.
+func (rww *responseWriterWrapper) createPending(path string) (*renameio.PendingFile, error) {
+	if rww.conflict == nil {
+		return rww.config.createTempFile(rww.root, path)
+	}
+	return rww.config.newPendingFile(path, rww.root)
+}
+
+// createTempFile creates a pending file to replace path, which is within
+// root. With file_mode, the pending file gets that mode.
+func (mir *Mirror) createTempFile(root string, path string) (*renameio.PendingFile, error) {
 	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, mkdirPerms); err != nil {
+	if err := mir.mkdirAll(root, dir); err != nil {
 		return nil, &fs.PathError{
 			Op:   "createTempFile",
 			Path: path,
@@ -304,7 +2349,7 @@ func createTempFile(path string) (*renameio.PendingFile, error) {
 			Err:  err,
 		}
 	}
-	if stat != nil && !stat.Mode().IsRegular() {
+	if stat != nil && !stat.Mode().IsRegular() && !(stat.Mode()&fs.ModeSymlink != 0 && mir.Symlinks == symlinksReplace) {
 		return nil, &fs.PathError{
 			Op:   "createTempFile",
 			Path: path,
@@ -313,10 +2358,34 @@ func createTempFile(path string) (*renameio.PendingFile, error) {
 	}
 
 	// Create a temporary file in the same directory as the destination named ".<name><random numbers>"
-	temp, err := renameio.NewPendingFile(path,
+	return mir.newPendingFile(path, dir, renameio.WithExistingPermissions())
+}
+
+// writeFile atomically replaces filename with data, with file_mode if set,
+// as for sidecar and metadata files
+func (mir *Mirror) writeFile(filename string, data []byte) error {
+	file, err := mir.newPendingFile(filename, filepath.Dir(filename), renameio.WithExistingPermissions())
+	if err != nil {
+		return err
+	}
+	defer file.Cleanup()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.CloseAtomicallyReplace()
+}
+
+// newPendingFile creates a pending file to replace path, whose temp file
+// is in dir
+func (mir *Mirror) newPendingFile(path string, dir string, opts ...renameio.Option) (*renameio.PendingFile, error) {
+	temp, err := renameio.NewPendingFile(path, append([]renameio.Option{
 		renameio.WithTempDir(dir),
-		renameio.WithPermissions(filePerms),
-		renameio.WithExistingPermissions())
+		renameio.WithPermissions(filePerms)}, opts...)...)
+	if err == nil && mir.fileMode != 0 {
+		if err = chmodIfNeeded(temp.Name(), mir.fileMode); err != nil {
+			temp.Cleanup()
+		}
+	}
 	if err != nil {
 		return nil, &fs.PathError{
 			Op:   "createTempFile",
@@ -336,5 +2405,9 @@ const (
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Mirror)(nil)
+	_ caddy.CleanerUpper          = (*Mirror)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Mirror)(nil)
+	_ io.ReaderFrom               = (*responseWriterWrapper)(nil)
+	_ http.Flusher                = (*responseWriterWrapper)(nil)
+	_ http.Hijacker               = (*responseWriterWrapper)(nil)
 )
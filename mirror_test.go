@@ -1,9 +1,33 @@
 package mirror
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestShouldPassThrough(t *testing.T) {
@@ -53,3 +77,989 @@ func TestShouldPassThrough(t *testing.T) {
 		}
 	}
 }
+
+// discardResponseWriter is a http.ResponseWriter that discards everything
+// written to it, like a client on a fast network would
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+func (d *discardResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(io.Discard, r)
+}
+
+// provisionTestMirror provisions mir like Caddy would, keeping its logger if set
+func provisionTestMirror(t testing.TB, mir *Mirror) *Mirror {
+	t.Helper()
+	logger := mir.logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := mir.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mir.Cleanup() })
+	mir.logger = logger
+	return mir
+}
+
+func newTestWrapper(t testing.TB, root string, urlp string, w http.ResponseWriter) *responseWriterWrapper {
+	return &responseWriterWrapper{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		config:                provisionTestMirror(t, &Mirror{Root: root}),
+		root:                  root,
+		path:                  urlp,
+		logger:                zap.NewNop(),
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	root := t.TempDir()
+	body := bytes.Repeat([]byte("mirror"), 10000)
+	rec := httptest.NewRecorder()
+	rww := newTestWrapper(t, root, "/some/file.bin", rec)
+	defer rww.Cleanup()
+
+	rww.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rww.WriteHeader(http.StatusOK)
+	n, err := rww.ReadFrom(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if n != int64(len(body)) {
+		t.Errorf("expected %d bytes copied, got %d", len(body), n)
+	}
+	rww.handlerDone(context.Background())
+	if !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("client received %d bytes, expected %d", rec.Body.Len(), len(body))
+	}
+	mirrored, err := os.ReadFile(filepath.Join(root, "some", "file.bin"))
+	if err != nil {
+		t.Fatalf("mirror file not written: %v", err)
+	}
+	if !bytes.Equal(mirrored, body) {
+		t.Errorf("mirror file has %d bytes, expected %d", len(mirrored), len(body))
+	}
+}
+
+func benchmarkCopy(b *testing.B, copyFn func(rww *responseWriterWrapper, r io.Reader) error) {
+	root := b.TempDir()
+	body := bytes.Repeat([]byte{0x5a}, 64<<20)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rww := newTestWrapper(b, root, "/large.bin", &discardResponseWriter{})
+		rww.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		rww.WriteHeader(http.StatusOK)
+		if err := copyFn(rww, bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+		rww.Cleanup()
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkCopy(b, func(rww *responseWriterWrapper, r io.Reader) error {
+		// Hide ReadFrom so io.Copy goes through Write
+		_, err := io.Copy(struct{ io.Writer }{rww}, r)
+		return err
+	})
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	benchmarkCopy(b, func(rww *responseWriterWrapper, r io.Reader) error {
+		_, err := io.Copy(rww, r)
+		return err
+	})
+}
+
+// serveMirror runs a request for urlp through mir with next as the next handler
+func serveMirror(mir *Mirror, urlp string, next caddyhttp.HandlerFunc) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+urlp, nil)
+	repl := caddy.NewReplacer()
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	rec := httptest.NewRecorder()
+	err := mir.ServeHTTP(rec, req, next)
+	return rec, err
+}
+
+func TestFlushStreamedResponse(t *testing.T) {
+	chunks := []string{"data: one\n", "data: two\n", "data: three\n"}
+	testCases := []struct {
+		name     string
+		err      error
+		mirrored bool
+	}{
+		{name: "complete", err: nil, mirrored: true},
+		{name: "aborted", err: errors.New("upstream went away"), mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root})
+			rec, err := serveMirror(mir, "/stream.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				for _, chunk := range chunks {
+					if _, err := io.WriteString(w, chunk); err != nil {
+						return err
+					}
+					if err := http.NewResponseController(w).Flush(); err != nil {
+						return err
+					}
+				}
+				return test.err
+			})
+			if err != test.err {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+			if !rec.Flushed {
+				t.Error("flush was not forwarded to the client")
+			}
+			mirrored, err := os.ReadFile(filepath.Join(root, "stream.txt"))
+			if test.mirrored {
+				if err != nil {
+					t.Fatalf("streamed response not mirrored: %v", err)
+				}
+				if string(mirrored) != strings.Join(chunks, "") {
+					t.Errorf("unexpected mirror content %q", mirrored)
+				}
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("aborted response should not be mirrored, stat error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+	}{
+		{name: "zero Content-Length", header: "0"},
+		{name: "no Content-Length", header: ""},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root})
+			_, err := serveMirror(mir, "/empty.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if test.header != "" {
+					w.Header().Set("Content-Length", test.header)
+				}
+				w.WriteHeader(http.StatusOK)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := os.Stat(filepath.Join(root, "empty.txt"))
+			if err != nil {
+				t.Fatalf("empty response was not mirrored: %v", err)
+			}
+			if stat.Size() != 0 {
+				t.Errorf("expected an empty file, got %d bytes", stat.Size())
+			}
+			entries, _ := os.ReadDir(root)
+			if len(entries) != 1 {
+				t.Errorf("expected only the mirrored file, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestRequireComplete(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	testCases := []struct {
+		name            string
+		contentLength   bool
+		trailer         string
+		digest          string
+		disconnected    bool
+		requireComplete bool
+		mirrored        bool
+	}{
+		{name: "chunked", mirrored: true},
+		{name: "chunked strict", requireComplete: true, mirrored: true},
+		{name: "content length after disconnect strict", contentLength: true, disconnected: true, requireComplete: true, mirrored: true},
+		{name: "chunked after disconnect", disconnected: true, mirrored: true},
+		{name: "chunked after disconnect strict", disconnected: true, requireComplete: true, mirrored: false},
+		{name: "verified after disconnect strict", trailer: "Repr-Digest", digest: digest, disconnected: true, requireComplete: true, mirrored: true},
+		{name: "missing digest", trailer: "Repr-Digest", mirrored: true},
+		{name: "missing digest strict", trailer: "Repr-Digest", requireComplete: true, mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, RequireComplete: test.requireComplete})
+			discards := mir.stats.discards.Value()
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			defer cancel()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil).WithContext(ctx)
+			err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if test.contentLength {
+					w.Header().Set("Content-Length", "7")
+				}
+				if test.trailer != "" {
+					w.Header().Set("Trailer", test.trailer)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				if test.digest != "" {
+					w.Header().Set(test.trailer, test.digest)
+				}
+				if test.disconnected {
+					cancel()
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.txt"))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if !test.mirrored && mir.stats.discards.Value() == discards {
+				t.Error("discarded response not counted")
+			}
+		})
+	}
+}
+
+func TestSkipContentType(t *testing.T) {
+	mir := Mirror{SkipContentTypes: append(defaultSkipContentTypes, "video/*")}
+	testCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "", expected: false},
+		{contentType: "application/octet-stream", expected: false},
+		{contentType: "text/event-stream", expected: true},
+		{contentType: "Text/Event-Stream; charset=utf-8", expected: true},
+		{contentType: "multipart/x-mixed-replace; boundary=frame", expected: true},
+		{contentType: "video/mp4", expected: true},
+		{contentType: "text/plain", expected: false},
+		{contentType: "not a media type", expected: false},
+	}
+	for i, test := range testCases {
+		actual := mir.skipContentType(test.contentType)
+		if actual != test.expected {
+			t.Errorf("Test %d (Content-Type: %q) - expected %v, got %v",
+				i, test.contentType, test.expected, actual)
+		}
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, MaxDuration: caddy.Duration(time.Millisecond)})
+	rec, err := serveMirror(mir, "/slow.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "first")
+		time.Sleep(5 * time.Millisecond)
+		_, err := io.WriteString(w, "second")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "firstsecond" {
+		t.Errorf("client received %q", rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "slow.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("response exceeding max duration should not be mirrored, stat error: %v", err)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+func TestMaxDurationStalled(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, MaxDuration: caddy.Duration(10 * time.Millisecond)})
+	_, err := serveMirror(mir, "/stalled.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "first")
+		// Upstream sends nothing more for a while
+		time.Sleep(100 * time.Millisecond)
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			t.Errorf("temp files linger past max duration while upstream stalls: %v", entries)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "stalled.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("response exceeding max duration should not be mirrored, stat error: %v", err)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// The connection is still open here, the temp file must already be gone
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			t.Errorf("temp files linger after hijack: %v", entries)
+		}
+		brw.WriteString("upgraded")
+		return brw.Flush()
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := mir.ServeHTTP(w, r, next); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(received, []byte("upgraded")) {
+		t.Errorf("unexpected response %q", received)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("hijacked response should not be mirrored: %v", entries)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	root := t.TempDir()
+	rec := httptest.NewRecorder()
+	rww := newTestWrapper(t, root, "/stalled.bin", rec)
+	rww.config.WriteTimeout = caddy.Duration(10 * time.Millisecond)
+	defer rww.Cleanup()
+
+	rww.Header().Set("Content-Length", "1048576")
+	rww.WriteHeader(http.StatusOK)
+	// Swap the temp file for a pipe nobody reads from to simulate a hung disk
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	pr := os.NewFile(uintptr(fds[0]), "pipe")
+	rww.file.File.Close()
+	rww.file.File = os.NewFile(uintptr(fds[1]), rww.file.Name())
+
+	body := bytes.Repeat([]byte{0x5a}, 1<<20)
+	n, err := rww.Write(body)
+	if err != nil || n != len(body) {
+		t.Fatalf("client write failed after %d bytes: %v", n, err)
+	}
+	if rww.file != nil {
+		t.Error("stalled mirror file was not abandoned")
+	}
+	if rec.Body.Len() != len(body) {
+		t.Errorf("client received %d bytes, expected %d", rec.Body.Len(), len(body))
+	}
+
+	// The caller's buffer is reused once the write has returned, the stuck
+	// write keeps writing the data it was given
+	for i := range body {
+		body[i] = 0
+	}
+	// Unblock the stuck write, the abandoned temp file is then cleaned up
+	written, err := io.ReadAll(pr)
+	if err != nil || !bytes.Equal(written, bytes.Repeat([]byte{0x5a}, len(body))) {
+		t.Errorf("stuck write wrote %d bytes other than the data it was given, error: %v", len(written), err)
+	}
+	pr.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries, _ := os.ReadDir(root)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned temp files not cleaned up: %v", entries)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandlerErrorDiscardsMirror(t *testing.T) {
+	upstreamErr := errors.New("upstream died")
+	testCases := []struct {
+		name     string
+		body     string
+		err      error
+		mirrored bool
+	}{
+		{name: "complete", body: "0123456789", mirrored: true},
+		{name: "complete with error", body: "0123456789", err: upstreamErr, mirrored: false},
+		{name: "truncated with error", body: "01234", err: upstreamErr, mirrored: false},
+		{name: "truncated without error", body: "01234", mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root})
+			_, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Length", "10")
+				w.WriteHeader(http.StatusOK)
+				io.WriteString(w, test.body)
+				return test.err
+			})
+			if err != test.err {
+				t.Errorf("expected error %v to propagate unchanged, got %v", test.err, err)
+			}
+			entries, _ := os.ReadDir(root)
+			if test.mirrored != (len(entries) == 1 && entries[0].Name() == "file.bin") {
+				t.Errorf("expected mirrored=%v, root contains %v", test.mirrored, entries)
+			}
+		})
+	}
+}
+
+func TestCompletionLog(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, logger: zap.New(core)})
+	next := func(body string) caddyhttp.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("ETag", `"abc"`)
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, body)
+			return nil
+		}
+	}
+
+	serveMirror(mir, "/done.bin", next("0123456789"))
+	completed := logs.FilterMessage("mirrored file").AllUntimed()
+	if len(completed) != 1 || completed[0].Level != zapcore.InfoLevel {
+		t.Fatalf("expected one Info completion log, got %v", completed)
+	}
+	fields := completed[0].ContextMap()["rww"].(map[string]any)
+	if fields["path"] != filepath.Join(root, "done.bin") || fields["bytes_written"] != int64(10) || fields["etag"] != `"abc"` {
+		t.Errorf("unexpected completion log fields %v", fields)
+	}
+
+	serveMirror(mir, "/truncated.bin", next("01234"))
+	discarded := logs.FilterMessage("mirror aborted: incomplete response").AllUntimed()
+	if len(discarded) != 1 || discarded[0].Level != zapcore.WarnLevel {
+		t.Errorf("expected one Warn discard log, got %v", discarded)
+	}
+}
+
+func TestCleanupWaitsForFinalizes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		finishIn  time.Duration
+		abandoned bool
+	}{
+		{name: "completed", finishIn: 10 * time.Millisecond, abandoned: false},
+		{name: "abandoned", finishIn: 300 * time.Millisecond, abandoned: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			mir := provisionTestMirror(t, &Mirror{
+				Root:            t.TempDir(),
+				FinalizeTimeout: caddy.Duration(100 * time.Millisecond),
+				logger:          zap.New(core),
+			})
+			mir.finalizes.add()
+			finished := make(chan struct{})
+			go func() {
+				time.Sleep(test.finishIn)
+				close(finished)
+				mir.finalizes.done()
+			}()
+			mir.Cleanup()
+			select {
+			case <-finished:
+				if test.abandoned {
+					t.Error("Cleanup waited beyond finalize_timeout")
+				}
+			default:
+				if !test.abandoned {
+					t.Error("Cleanup returned before finalize completed")
+				}
+			}
+			if abandoned := logs.FilterMessage("abandoned in-flight finalizes").Len(); (abandoned != 0) != test.abandoned {
+				t.Errorf("expected abandoned finalizes logged %v, got %d logs", test.abandoned, abandoned)
+			}
+			<-finished
+		})
+	}
+}
+
+func TestFinalizesAddedWhileWaiting(t *testing.T) {
+	ft := new(finalizeTracker)
+	var wg sync.WaitGroup
+	// Finalizes start and complete, from none in flight, as they are
+	// waited for
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				ft.add()
+				ft.done()
+			}
+		}()
+	}
+	for range 100 {
+		ft.wait(time.Second, zap.NewNop())
+	}
+	wg.Wait()
+	waited := make(chan struct{})
+	go func() {
+		ft.wait(time.Second, zap.NewNop())
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("wait didn't return once the finalizes completed")
+	}
+}
+
+// recordingSpan is a trace.Span that remembers its attributes and events
+type recordingSpan struct {
+	trace.Span
+	attrs  map[attribute.Key]attribute.Value
+	events []string
+}
+
+func (s *recordingSpan) IsRecording() bool {
+	return true
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) AddEvent(name string, _ ...trace.EventOption) {
+	s.events = append(s.events, name)
+}
+
+func TestTracing(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		body     string
+		decision string
+		events   []string
+	}{
+		{name: "store", status: http.StatusOK, body: "0123456789", decision: decisionStore, events: []string{"mirror.finalize"}},
+		{name: "skip", status: http.StatusNotFound, body: "not found!", decision: decisionSkip},
+		{name: "discard", status: http.StatusOK, body: "01234", decision: decisionDiscard, events: []string{"mirror.discard"}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Tracing: true})
+			span := &recordingSpan{Span: noop.Span{}, attrs: make(map[attribute.Key]attribute.Value)}
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/file.bin", nil)
+			ctx := context.WithValue(trace.ContextWithSpan(req.Context(), span), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			err := mir.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx), caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Length", "10")
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision := span.attrs["mirror.decision"].AsString(); decision != test.decision {
+				t.Errorf("expected mirror.decision %q, got %q", test.decision, decision)
+			}
+			if bytes := span.attrs["mirror.bytes"].AsInt64(); test.decision != decisionSkip && bytes != int64(len(test.body)) {
+				t.Errorf("expected mirror.bytes %d, got %d", len(test.body), bytes)
+			}
+			if strings.Join(span.events, ",") != strings.Join(test.events, ",") {
+				t.Errorf("expected events %v, got %v", test.events, span.events)
+			}
+		})
+	}
+}
+
+func TestWriteBudget(t *testing.T) {
+	testCases := []struct {
+		name     string
+		budget   time.Duration
+		mirrored bool
+	}{
+		{name: "within budget", budget: time.Hour, mirrored: true},
+		{name: "over budget", budget: time.Nanosecond},
+		{name: "no budget", mirrored: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, WriteBudget: caddy.Duration(test.budget)})
+			overBudget := mir.stats.overBudget.Value()
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("first"))
+				w.Write([]byte(" second"))
+				return nil
+			})
+			if err != nil || rec.Body.String() != "first second" {
+				t.Fatalf("unexpected response %q, error: %v", rec.Body.String(), err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.txt"))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if test.mirrored {
+				return
+			}
+			if skipped := mir.stats.overBudget.Value() - overBudget; skipped != 1 {
+				t.Errorf("expected 1 response over budget, got %d", skipped)
+			}
+			if entries, _ := os.ReadDir(root); len(entries) != 0 {
+				t.Errorf("pending files left behind: %v", entries)
+			}
+		})
+	}
+}
+
+func TestMinRate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		minRate  uint64
+		grace    time.Duration
+		mirrored bool
+	}{
+		{name: "fast enough", minRate: 1, grace: time.Nanosecond, mirrored: true},
+		{name: "too slow", minRate: 1 << 50, grace: time.Nanosecond},
+		{name: "within grace period", minRate: 1 << 50, grace: time.Hour, mirrored: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, MinRate: test.minRate, MinRateGrace: caddy.Duration(test.grace)})
+			slow := mir.stats.slowTransfers.Value()
+			chunk := strings.Repeat("x", 10)
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				for range 2 * minRateInterval {
+					w.Write([]byte(chunk))
+				}
+				return nil
+			})
+			if err != nil || rec.Body.Len() != 2*minRateInterval*len(chunk) {
+				t.Fatalf("response not passed through, got %d bytes, error: %v", rec.Body.Len(), err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.txt"))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if !test.mirrored && mir.stats.slowTransfers.Value()-slow != 1 {
+				t.Errorf("slow transfer not counted")
+			}
+		})
+	}
+}
+
+func TestSidecarOrdering(t *testing.T) {
+	testCases := []struct {
+		name string
+		// setup prepares the root, which has file.txt with its sidecars
+		setup    func(t *testing.T, root string)
+		etag     string
+		expected map[string]string
+	}{
+		{
+			name:     "replaced",
+			etag:     `"v2"`,
+			expected: map[string]string{"file.txt": "new", "file.txt.etag": `"v2"`},
+		},
+		{
+			name:     "stale sidecar removed",
+			expected: map[string]string{"file.txt": "new"},
+		},
+		{
+			name: "sidecar not removable",
+			setup: func(t *testing.T, root string) {
+				sidecar := filepath.Join(root, "file.txt.etag")
+				os.Remove(sidecar)
+				if err := os.MkdirAll(filepath.Join(sidecar, "dir"), mkdirPerms); err != nil {
+					t.Fatal(err)
+				}
+			},
+			etag: `"v2"`,
+			// The content isn't replaced either
+			expected: map[string]string{"file.txt": "old", "file.txt.etag/dir": ""},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range map[string]string{"file.txt": "old", "file.txt.etag": `"v1"`} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(content), filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.setup != nil {
+				test.setup(t, root)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag"})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if test.etag != "" {
+					w.Header().Set("ETag", test.etag)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("new"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[string]string)
+			filepath.WalkDir(root, func(filename string, d fs.DirEntry, err error) error {
+				if err != nil || filename == root {
+					return err
+				}
+				rel, _ := filepath.Rel(root, filename)
+				if d.IsDir() {
+					if entries, _ := os.ReadDir(filename); len(entries) == 0 {
+						found[rel] = ""
+					}
+					return nil
+				}
+				content, _ := os.ReadFile(filename)
+				found[rel] = string(content)
+				return nil
+			})
+			if !reflect.DeepEqual(found, test.expected) {
+				t.Errorf("expected %v in root, got %v", test.expected, found)
+			}
+		})
+	}
+}
+
+func TestParseContentLength(t *testing.T) {
+	testCases := []struct {
+		name     string
+		values   []string
+		expected int64
+		invalid  bool
+	}{
+		{name: "missing", expected: -1},
+		{name: "single", values: []string{"42"}, expected: 42},
+		{name: "zero", values: []string{"0"}, expected: 0},
+		{name: "leading zeros", values: []string{"0042"}, expected: 42},
+		{name: "surrounding whitespace", values: []string{" 42\t"}, expected: 42},
+		{name: "duplicate headers", values: []string{"42", "42"}, expected: 42},
+		{name: "duplicate list", values: []string{"42, 42"}, expected: 42},
+		{name: "conflicting headers", values: []string{"42", "43"}, expected: -1, invalid: true},
+		{name: "conflicting list", values: []string{"42,43"}, expected: -1, invalid: true},
+		{name: "empty", values: []string{""}, expected: -1, invalid: true},
+		{name: "empty list element", values: []string{"42,"}, expected: -1, invalid: true},
+		{name: "negative", values: []string{"-1"}, expected: -1, invalid: true},
+		{name: "plus sign", values: []string{"+42"}, expected: -1, invalid: true},
+		{name: "garbage", values: []string{"42abc"}, expected: -1, invalid: true},
+		{name: "inner whitespace", values: []string{"4 2"}, expected: -1, invalid: true},
+		{name: "hex", values: []string{"0x2a"}, expected: -1, invalid: true},
+		{name: "overflow", values: []string{"99999999999999999999"}, expected: -1, invalid: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			length, err := parseContentLength(test.values)
+			if length != test.expected || test.invalid != (err != nil) {
+				t.Errorf("expected %d (invalid %v), got %d, error: %v", test.expected, test.invalid, length, err)
+			}
+		})
+	}
+}
+
+func TestContentRangeOn200(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root})
+	rec, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Range", "bytes 0-3/100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("part"))
+		return nil
+	})
+	if err != nil || rec.Body.String() != "part" {
+		t.Fatalf("response not passed through: %q, error: %v", rec.Body.String(), err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "file.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("200 response with Content-Range mirrored, stat error: %v", err)
+	}
+	if count := mir.stats.rangeOn200.Value(); count != 1 {
+		t.Errorf("expected 1 response with Content-Range counted, got %d", count)
+	}
+}
+
+func TestOnlyUpstream(t *testing.T) {
+	testCases := []struct {
+		name           string
+		upstreamHeader string
+		proxied        bool
+		header         string
+		mirrored       bool
+	}{
+		{name: "proxied", proxied: true, mirrored: true},
+		{name: "local hit"},
+		{name: "header", upstreamHeader: "X-Upstream", header: "X-Upstream", mirrored: true},
+		{name: "header missing", upstreamHeader: "X-Upstream", proxied: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, OnlyUpstream: true, UpstreamHeader: test.upstreamHeader})
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if test.proxied {
+					repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+					repl.Set("http.reverse_proxy.upstream.host", "upstream.example.com")
+				}
+				if test.header != "" {
+					w.Header().Set(test.header, "1")
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil || rec.Body.String() != "content" {
+				t.Fatalf("unexpected response %q, error: %v", rec.Body.String(), err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.txt"))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if !test.mirrored {
+				if entries, _ := os.ReadDir(root); len(entries) != 0 {
+					t.Errorf("files written for response not from upstream: %v", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestVars(t *testing.T) {
+	testCases := []struct {
+		name        string
+		vars        map[string]any
+		contentType string
+		mirrored    bool
+	}{
+		{name: "no vars", contentType: "application/octet-stream", mirrored: true},
+		{name: "skipped", vars: map[string]any{"mirror.skip": "true"}, contentType: "application/octet-stream"},
+		{name: "skip var false", vars: map[string]any{"mirror.skip": false}, contentType: "application/octet-stream", mirrored: true},
+		{name: "skipped content type", contentType: "text/event-stream"},
+		{name: "forced", vars: map[string]any{"mirror.force": true}, contentType: "text/event-stream", mirrored: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root})
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/file.bin", nil)
+			ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			req = req.WithContext(context.WithValue(ctx, caddyhttp.VarsCtxKey, test.vars))
+			err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.bin"))
+			if test.mirrored != (err == nil) {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+		})
+	}
+}
+
+func TestSetupErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		strict bool
+		status int
+	}{
+		{name: "pass through", status: http.StatusOK},
+		{name: "strict", strict: true, status: http.StatusInternalServerError},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			// The mirror file can't be created in place of the symlink
+			if err := os.Symlink("elsewhere", filepath.Join(root, "file.txt")); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, StrictErrors: test.strict})
+			var writeErr error
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("X-Upstream", "1")
+				w.WriteHeader(http.StatusOK)
+				_, writeErr = w.Write([]byte("content"))
+				return nil
+			})
+			var handlerErr caddyhttp.HandlerError
+			switch {
+			case test.strict && writeErr == nil:
+				t.Error("expected the upstream copy to be stopped at the first write")
+			case !test.strict:
+				if err != nil || rec.Code != http.StatusOK || rec.Body.String() != "content" {
+					t.Errorf("expected response passed through, got %d %q, error: %v", rec.Code, rec.Body.String(), err)
+				}
+			case !errors.As(err, &handlerErr) || handlerErr.StatusCode != test.status:
+				t.Errorf("expected error with status %d, got %v", test.status, err)
+			case rec.Body.Len() > 0 || rec.Header().Get("X-Upstream") != "":
+				t.Errorf("expected response swallowed, got %q, header %v", rec.Body.String(), rec.Header())
+			}
+		})
+	}
+
+	for err, status := range map[error]int{
+		&fs.PathError{Op: "write", Path: "file", Err: syscall.ENOSPC}: http.StatusInsufficientStorage,
+		&fs.PathError{Op: "open", Path: "file", Err: syscall.EACCES}:  http.StatusInternalServerError,
+		ErrNotRegular: http.StatusInternalServerError,
+	} {
+		if actual := setupErrorStatus(err); actual != status {
+			t.Errorf("expected status %d for %v, got %d", status, err, actual)
+		}
+	}
+}
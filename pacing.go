@@ -0,0 +1,145 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DeletionPacing limits the rate at which files are deleted in the
+// background, by eviction and expiry sweeps, so that deleting many files at
+// once doesn't starve live traffic of disk IOPS.
+type DeletionPacing struct {
+	// Maximum number of files to delete per second. Default is 50.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Maximum number of files to delete per sweep. Whatever is left is
+	// deleted by the next sweep. Default is 10000.
+	MaxBatch int `json:"max_batch,omitempty"`
+}
+
+const (
+	defaultDeletionRate     = 50
+	defaultDeletionMaxBatch = 10000
+
+	// evictionProgressFile records the files an interrupted eviction has yet
+	// to delete, relative to the root
+	evictionProgressFile = ".mirror-eviction.json"
+)
+
+// deletionPacer paces the deletions of a single sweep
+type deletionPacer struct {
+	interval time.Duration
+	maxBatch int
+	done     <-chan struct{}
+	deleted  int
+	next     time.Time
+	start    time.Time
+}
+
+// deletionPacer returns a pacer for a new sweep, which is interrupted when
+// the handler is unloaded
+func (mir *Mirror) deletionPacer() *deletionPacer {
+	rate, maxBatch := float64(defaultDeletionRate), defaultDeletionMaxBatch
+	if dp := mir.DeletionPacing; dp != nil {
+		if dp.Rate > 0 {
+			rate = dp.Rate
+		}
+		if dp.MaxBatch > 0 {
+			maxBatch = dp.MaxBatch
+		}
+	}
+	now := time.Now()
+	return &deletionPacer{
+		interval: time.Duration(float64(time.Second) / rate),
+		maxBatch: maxBatch,
+		done:     mir.done,
+		next:     now,
+		start:    now,
+	}
+}
+
+// wait blocks until the next deletion is due. It reports false if the sweep
+// must stop instead, because its batch is full or the handler is unloaded.
+func (dp *deletionPacer) wait() bool {
+	if dp.deleted >= dp.maxBatch {
+		return false
+	}
+	if delay := time.Until(dp.next); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-dp.done:
+			return false
+		}
+	} else {
+		select {
+		case <-dp.done:
+			return false
+		default:
+		}
+	}
+	dp.next = time.Now().Add(dp.interval)
+	return true
+}
+
+// finish records the sweep in the stats of mir
+func (dp *deletionPacer) finish(mir *Mirror, sweep string) {
+	duration := time.Since(dp.start)
+	mir.stats.deleted.Add(int64(dp.deleted))
+	mir.stats.lastSweepDeleted.Set(int64(dp.deleted))
+	mir.stats.lastSweepDurationMs.Set(duration.Milliseconds())
+	mir.logger.Debug("sweep done",
+		zap.String("sweep", sweep),
+		zap.Int("deleted", dp.deleted),
+		zap.Duration("duration", duration))
+}
+
+// loadEvictionProgress returns the files an interrupted eviction in root has
+// yet to delete, or nil if there are none
+func (mir *Mirror) loadEvictionProgress(root string) []string {
+	data, err := os.ReadFile(filepath.Join(root, evictionProgressFile))
+	if err != nil {
+		return nil
+	}
+	var pending []string
+	if err := json.Unmarshal(data, &pending); err != nil {
+		mir.logger.Error("invalid eviction progress file", zap.Error(err))
+		return nil
+	}
+	files := make([]string, 0, len(pending))
+	for _, name := range pending {
+		files = append(files, filepath.Join(root, filepath.FromSlash(name)))
+	}
+	return files
+}
+
+// saveEvictionProgress records the files an eviction in root has yet to
+// delete, so that the next eviction resumes with them
+func (mir *Mirror) saveEvictionProgress(root string, files []string) {
+	filename := filepath.Join(root, evictionProgressFile)
+	if len(files) == 0 {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			mir.logger.Error("failed to remove eviction progress file", zap.Error(err))
+		}
+		return
+	}
+	pending := make([]string, 0, len(files))
+	for _, file := range files {
+		if name, err := filepath.Rel(root, file); err == nil {
+			pending = append(pending, filepath.ToSlash(name))
+		}
+	}
+	data, err := json.Marshal(pending)
+	if err == nil {
+		err = mir.writeFile(filename, data)
+	}
+	if err != nil {
+		mir.logger.Error("failed to save eviction progress", zap.Error(err))
+	}
+}
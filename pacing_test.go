@@ -0,0 +1,79 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeletionPacer(t *testing.T) {
+	mir := &Mirror{DeletionPacing: &DeletionPacing{Rate: 100, MaxBatch: 3}}
+	pacer := mir.deletionPacer()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !pacer.wait() {
+			t.Fatalf("deletion %d not allowed", i)
+		}
+		pacer.deleted++
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected 3 deletions at 100/s to take at least 20ms, took %v", elapsed)
+	}
+	if pacer.wait() {
+		t.Error("deletion allowed beyond max_batch")
+	}
+
+	done := make(chan struct{})
+	close(done)
+	mir.done = done
+	if mir.deletionPacer().wait() {
+		t.Error("deletion allowed after the handler was unloaded")
+	}
+}
+
+func TestEvictionProgress(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		filename := filepath.Join(root, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(filename, nil, filePerms); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Evicting down to one fewer than 3 files means evicting 3 of 5, two per sweep
+	mir := provisionTestMirror(t, &Mirror{Root: root, MaxFiles: 3, DeletionPacing: &DeletionPacing{MaxBatch: 2}})
+	rf := &rootFiles{counting: true, counted: true, count: 5}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, name))
+		return err == nil
+	}
+
+	mir.evictFiles(root, rf)
+	if exists("file0.txt") || exists("file1.txt") || !exists("file2.txt") || !exists(evictionProgressFile) {
+		t.Fatal("expected first sweep to evict file0.txt and file1.txt only and record progress")
+	}
+	if pending := mir.loadEvictionProgress(root); len(pending) != 1 || pending[0] != filepath.Join(root, "file2.txt") {
+		t.Errorf("unexpected eviction progress %v", pending)
+	}
+
+	// Touching file2.txt doesn't save it, the sweep resumes where it left off
+	if err := os.Chtimes(filepath.Join(root, "file2.txt"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mir.evictFiles(root, rf)
+	if exists("file2.txt") || !exists("file3.txt") || exists(evictionProgressFile) {
+		t.Error("expected resumed sweep to evict file2.txt and complete")
+	}
+	if rf.count != 2 {
+		t.Errorf("expected 2 files left, counted %d", rf.count)
+	}
+	if deleted := mir.stats.lastSweepDeleted.Value(); deleted != 1 {
+		t.Errorf("expected 1 file deleted by last sweep, got %d", deleted)
+	}
+}
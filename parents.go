@@ -0,0 +1,136 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// parentCheckTTL is how long the verdict on a directory is cached, as
+	// symlinks may be changed by other tooling
+	parentCheckTTL = time.Minute
+
+	// maxParentChecks is the number of cached verdicts above which they
+	// are all dropped
+	maxParentChecks = 10000
+)
+
+// parentChecks caches whether directories resolve to inside their root,
+// for the parents of mirrored files
+type parentChecks struct {
+	mu       sync.Mutex
+	verdicts map[string]parentVerdict
+}
+
+type parentVerdict struct {
+	err     error
+	checked time.Time
+}
+
+// check returns an error if the deepest existing parent directory of
+// filename resolves to outside of root, as it would if it or one of its
+// parents is a symlink pointing out of root. Directories still to be
+// created are created below that one, so they don't matter.
+func (pc *parentChecks) check(root string, filename string) error {
+	dir := filepath.Dir(filename)
+	pc.mu.Lock()
+	verdict, ok := pc.verdicts[dir]
+	pc.mu.Unlock()
+	if ok && time.Since(verdict.checked) < parentCheckTTL {
+		return verdict.err
+	}
+	exists, err := checkParent(root, dir)
+	if !exists {
+		// The directory is yet to be created, which may change the verdict
+		return err
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.verdicts == nil || len(pc.verdicts) >= maxParentChecks {
+		pc.verdicts = make(map[string]parentVerdict)
+	}
+	pc.verdicts[dir] = parentVerdict{err: err, checked: time.Now()}
+	return err
+}
+
+// checkContained returns an error unless filename is inside root, as a
+// last line of defense against mistakes in mapping paths to files. It may
+// be so as written, or once symlinks in both are resolved, as when the
+// root is reached through a symlink and filename is the target of one
+// followed. Unless skip_parent_check is set, this holds once symlinks are
+// resolved too.
+func (mir *Mirror) checkContained(root string, filename string) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if !withinRoot(absRoot, absFilename) {
+		realRoot, err := filepath.EvalSymlinks(absRoot)
+		if err != nil {
+			return err
+		}
+		realFilename, err := resolveExisting(absFilename)
+		if err != nil {
+			return err
+		}
+		if !withinRoot(realRoot, realFilename) {
+			return fmt.Errorf("%s is outside of the root %s", absFilename, absRoot)
+		}
+		absRoot, absFilename = realRoot, realFilename
+	}
+	if mir.SkipParentCheck {
+		return nil
+	}
+	_, err = checkParent(absRoot, filepath.Dir(absFilename))
+	return err
+}
+
+// resolveExisting returns filename with the symlinks in its deepest
+// existing parent directory resolved
+func resolveExisting(filename string) (string, error) {
+	dir, rest := filepath.Dir(filename), filepath.Base(filename)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+		dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// checkParent checks the deepest existing directory of dir and its parents
+// within root. exists reports whether that was dir itself.
+func checkParent(root string, dir string) (exists bool, err error) {
+	for existing := dir; ; existing = filepath.Dir(existing) {
+		if existing != root && !withinRoot(root, existing) {
+			// Nothing within root exists yet
+			return false, nil
+		}
+		resolved, err := filepath.EvalSymlinks(existing)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return existing == dir, err
+		}
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return existing == dir, err
+		}
+		if resolved != realRoot && !withinRoot(realRoot, resolved) {
+			return existing == dir, fmt.Errorf("%s resolves to %s, outside of the root %s", existing, resolved, realRoot)
+		}
+		return existing == dir, nil
+	}
+}
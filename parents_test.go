@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParentCheck(t *testing.T) {
+	testCases := []struct {
+		name     string
+		skip     bool
+		urlp     string
+		mirrored string
+	}{
+		{name: "inside root", urlp: "/latest/file", mirrored: "root/1.2.3/file"},
+		{name: "outside root", urlp: "/evil/file"},
+		{name: "outside root nested", urlp: "/evil/dir/file"},
+		{name: "skipped", skip: true, urlp: "/evil/file", mirrored: "outside/file"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "root")
+			for _, name := range []string{"root/1.2.3", "outside"} {
+				if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(name)), mkdirPerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("1.2.3", filepath.Join(root, "latest")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "evil")); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, SkipParentCheck: test.skip})
+			rec, err := serveMirror(mir, test.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil || rec.Code != http.StatusOK || rec.Body.String() != "content" {
+				t.Fatalf("expected response passed through, got %d %q, error: %v", rec.Code, rec.Body.String(), err)
+			}
+			if test.mirrored != "" {
+				content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(test.mirrored)))
+				if err != nil || string(content) != "content" {
+					t.Errorf("expected response mirrored to %s, got %q, error: %v", test.mirrored, content, err)
+				}
+				return
+			}
+			entries, err := os.ReadDir(filepath.Join(dir, "outside"))
+			if err != nil || len(entries) != 0 {
+				t.Errorf("expected nothing written outside of the root, got %v, error: %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestCheckContained(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "dir"), mkdirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(root, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name      string
+		filename  string
+		skip      bool
+		contained bool
+	}{
+		{name: "inside", filename: filepath.Join(root, "dir", "file"), contained: true},
+		{name: "not yet created", filename: filepath.Join(root, "new", "dir", "file"), contained: true},
+		{name: "root itself", filename: root},
+		{name: "escaping", filename: filepath.Join(root, "..", "file")},
+		{name: "absolute elsewhere", filename: filepath.Join(dir, "other", "file")},
+		{name: "through symlink", filename: filepath.Join(root, "evil", "file")},
+		{name: "through symlink skipped", filename: filepath.Join(root, "evil", "file"), skip: true, contained: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mir := &Mirror{SkipParentCheck: test.skip}
+			if err := mir.checkContained(root, test.filename); (err == nil) != test.contained {
+				t.Errorf("expected contained %v, got error: %v", test.contained, err)
+			}
+		})
+	}
+}
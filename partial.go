@@ -0,0 +1,206 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeepPartials configures keeping the content of substantial responses
+// whose mirroring was aborted, so that it can be salvaged. Content that
+// can't be resumed from, longer than expected or failing a digest check,
+// isn't kept. The content is
+// kept as `<path>.partial`, next to a `<path>.partial.json` file recording
+// the bytes received, the expected length and the ETag. Partial files are
+// never served as local copies.
+//
+// When the file is requested again, mirroring resumes from the partial file
+// if it has a strong ETag and a known length: only the missing bytes are
+// requested from upstream, with a Range and an If-Range header, and the
+// partial file is replayed to the client ahead of them.
+type KeepPartials struct {
+	// Minimum number of bytes received for the content to be kept.
+	// Default is 1MiB.
+	MinSize int64 `json:"min_size,omitempty"`
+
+	// How long to keep partial files. Expired partial files in a directory
+	// are removed whenever another one is kept there. Default is 24h.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+const (
+	partialSuffix     = ".partial"
+	partialInfoSuffix = ".partial.json"
+
+	defaultPartialMinSize = 1 << 20
+	defaultPartialTTL     = 24 * time.Hour
+)
+
+// partialInfo is the content of partial info files
+type partialInfo struct {
+	BytesReceived int64 `json:"bytes_received"`
+	// BytesExpected is the Content-Length of the response, or -1 if unknown
+	BytesExpected int64  `json:"bytes_expected"`
+	Etag          string `json:"etag,omitempty"`
+}
+
+func (kp *KeepPartials) minSize() int64 {
+	if kp.MinSize > 0 {
+		return kp.MinSize
+	}
+	return defaultPartialMinSize
+}
+
+func (kp *KeepPartials) ttl() time.Duration {
+	if kp.TTL > 0 {
+		return time.Duration(kp.TTL)
+	}
+	return defaultPartialTTL
+}
+
+// isPartialFile reports whether filename is a partial file or its info file
+func isPartialFile(filename string) bool {
+	return strings.HasSuffix(filename, partialSuffix) || strings.HasSuffix(filename, partialInfoSuffix)
+}
+
+// keepPartial moves the pending mirror file to its partial file, if enough
+// has been received. It reports whether it did, in which case the pending
+// file is gone.
+func (rww *responseWriterWrapper) keepPartial() bool {
+	kp := rww.config.KeepPartials
+	if kp == nil || rww.file == nil || rww.bytesWritten < kp.minSize() {
+		return false
+	}
+	partial := rww.filename + partialSuffix
+	info, err := json.Marshal(partialInfo{
+		BytesReceived: rww.bytesWritten,
+		BytesExpected: rww.bytesExpected,
+		Etag:          rww.etag,
+	})
+	if err == nil && rww.direct != nil {
+		err = rww.direct.flush()
+	}
+	if err == nil {
+		err = rww.file.Sync()
+	}
+	if err == nil {
+		err = rww.config.moveFile(rww.root, rww.file.Name(), partial)
+	}
+	if err == nil {
+		err = rww.config.writeFile(rww.filename+partialInfoSuffix, info)
+		if err != nil {
+			os.Remove(partial)
+		}
+	}
+	if err != nil {
+		rww.logger.Error("failed to keep partial file",
+			zap.String("partial", partial),
+			zap.Error(err))
+		return false
+	}
+	// The pending file has been renamed, so only its descriptor is left
+	rww.stopWriter()
+	rww.file.Close()
+	rww.file = nil
+	rww.endInflight()
+	rww.logger.Info("kept partial file",
+		zap.String("partial", partial),
+		zap.Int64("bytes_written", rww.bytesWritten),
+		zap.Int64("bytes_expected", rww.bytesExpected))
+	rww.config.partialSweeps.schedule(rww.config, filepath.Dir(partial), kp.ttl())
+	return true
+}
+
+// partialSweeper sweeps the directories partial files were kept in, from a
+// single goroutine, each once however many partial files were kept in it
+// meanwhile
+type partialSweeper struct {
+	mu      sync.Mutex
+	dirs    map[string]struct{}
+	running bool
+}
+
+// schedule has dir swept of the partial files older than ttl
+func (ps *partialSweeper) schedule(mir *Mirror, dir string, ttl time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.dirs == nil {
+		ps.dirs = make(map[string]struct{})
+	}
+	ps.dirs[dir] = struct{}{}
+	if ps.running {
+		return
+	}
+	ps.running = true
+	go func() {
+		for {
+			ps.mu.Lock()
+			var next string
+			for dir := range ps.dirs {
+				next = dir
+				break
+			}
+			if next == "" {
+				ps.running = false
+				ps.mu.Unlock()
+				return
+			}
+			delete(ps.dirs, next)
+			ps.mu.Unlock()
+			mir.sweepPartials(next, ttl)
+		}
+	}()
+}
+
+// sweepPartials removes the partial files in dir that haven't been written
+// to for longer than ttl, along with their info files. Deletions are paced.
+func (mir *Mirror) sweepPartials(dir string, ttl time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		mir.logger.Error("failed to sweep partial files", zap.Error(err))
+		return
+	}
+	pacer := mir.deletionPacer()
+	defer pacer.finish(mir, "partials")
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), partialSuffix) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil || time.Since(stat.ModTime()) < ttl {
+			continue
+		}
+		if !pacer.wait() {
+			return
+		}
+		partial := filepath.Join(dir, entry.Name())
+		if err := removePartial(strings.TrimSuffix(partial, partialSuffix)); err != nil {
+			mir.logger.Error("failed to remove expired partial file",
+				zap.String("partial", partial),
+				zap.Error(err))
+			continue
+		}
+		pacer.deleted++
+	}
+}
+
+// removePartial removes the partial file of filename and its info file, if
+// they exist
+func removePartial(filename string) error {
+	err := os.Remove(filename + partialSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.Remove(filename + partialInfoSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepPartials(t *testing.T) {
+	testCases := []struct {
+		name     string
+		received int
+		kept     bool
+	}{
+		{name: "substantial", received: 100, kept: true},
+		{name: "too small", received: 10, kept: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, KeepPartials: &KeepPartials{MinSize: 50}})
+			upstreamErr := errors.New("upstream went away")
+			_, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Length", "1000")
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(strings.Repeat("x", test.received)))
+				return upstreamErr
+			})
+			if err != upstreamErr {
+				t.Fatalf("expected error %v, got %v", upstreamErr, err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "file.bin")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("aborted response should not be mirrored, stat error: %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(root, "file.bin"+partialSuffix))
+			if !test.kept {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("partial file should not be kept, stat error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(content) != test.received {
+				t.Errorf("expected %d bytes in partial file, got %d", test.received, len(content))
+			}
+			infoJSON, err := os.ReadFile(filepath.Join(root, "file.bin"+partialInfoSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var info partialInfo
+			if err := json.Unmarshal(infoJSON, &info); err != nil {
+				t.Fatal(err)
+			}
+			expected := partialInfo{BytesReceived: int64(test.received), BytesExpected: 1000, Etag: `"v1"`}
+			if info != expected {
+				t.Errorf("expected partial info %+v, got %+v", expected, info)
+			}
+
+			// Once the file has been mirrored completely, the partial file is obsolete
+			_, err = serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("complete"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "file.bin"+partialSuffix)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("obsolete partial file not removed, stat error: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeepPartialsOverlong(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, KeepPartials: &KeepPartials{MinSize: 50}})
+	serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Length", "60")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(strings.Repeat("x", 100)))
+		return nil
+	})
+	for _, name := range []string{"file.bin", "file.bin" + partialSuffix} {
+		if _, err := os.Stat(filepath.Join(root, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected no %s for a response longer than its Content-Length, stat error: %v", name, err)
+		}
+	}
+}
+
+func TestSweepPartials(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"old", "new"} {
+		for _, suffix := range []string{partialSuffix, partialInfoSuffix} {
+			if err := os.WriteFile(filepath.Join(dir, name+suffix), nil, filePerms); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old"+partialSuffix), old, old); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{DeletionPacing: &DeletionPacing{Rate: 1000}})
+	mir.sweepPartials(dir, time.Hour)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := "new" + partialSuffix + " new" + partialInfoSuffix
+	if strings.Join(names, " ") != expected {
+		t.Errorf("expected %s to remain, got %v", expected, names)
+	}
+}
+
+func TestPartialSweeper(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "old"+partialSuffix), nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old"+partialSuffix), old, old); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{})
+	ps := mir.partialSweeps
+	// While a sweep is running, a directory is queued once
+	ps.running = true
+	for range 50 {
+		ps.schedule(mir, dir, time.Hour)
+	}
+	if len(ps.dirs) != 1 {
+		t.Errorf("expected the directory queued once, got %d", len(ps.dirs))
+	}
+	ps.running = false
+	ps.schedule(mir, dir, time.Hour)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ps.mu.Lock()
+		running := ps.running
+		ps.mu.Unlock()
+		if !running {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old"+partialSuffix)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected expired partial file swept, stat error: %v", err)
+	}
+}
+
+func TestFallbackIgnoresPartials(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.bin"+partialSuffix), []byte("part"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, Fallback: true, KeepPartials: &KeepPartials{}})
+	upstreamErr := caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	_, err := serveMirror(mir, "/file.bin"+partialSuffix, func(w http.ResponseWriter, r *http.Request) error {
+		return upstreamErr
+	})
+	if err != upstreamErr {
+		t.Errorf("partial file served as local copy, error: %v", err)
+	}
+}
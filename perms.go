@@ -0,0 +1,54 @@
+package mirror
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseMode parses an octal permission mode, e.g. "0755"
+func parseMode(mode string) (fs.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > uint64(fs.ModePerm) {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions such as 0755", mode)
+	}
+	return fs.FileMode(perm), nil
+}
+
+// mkdirAll creates dir along with any missing parents. With dir_mode, the
+// directories below root down to dir get that mode if they don't have it,
+// whether they were just created or left by an earlier version with
+// another umask.
+func (mir *Mirror) mkdirAll(root string, dir string) error {
+	if err := os.MkdirAll(dir, mkdirPerms); err != nil {
+		return err
+	}
+	if mir.dirMode == 0 {
+		return nil
+	}
+	for ; ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+		if err := chmodIfNeeded(dir, mir.dirMode); err != nil {
+			return err
+		}
+	}
+}
+
+// chmodIfNeeded sets the permissions of filename to perm, unless it
+// already has them
+func chmodIfNeeded(filename string, perm fs.FileMode) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm() == perm {
+		return nil
+	}
+	return os.Chmod(filename, perm)
+}
@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestModes(t *testing.T) {
+	oldUmask := syscall.Umask(0o077)
+	defer syscall.Umask(oldUmask)
+
+	root := t.TempDir()
+	// Left by an earlier version with a restrictive umask
+	if err := os.Mkdir(filepath.Join(root, "old"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", DirMode: "0755", FileMode: "0644"})
+	_, err := serveMirror(mir, "/old/new/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]fs.FileMode{
+		"old":                   0o755,
+		"old/new":               0o755,
+		"old/new/file.txt":      0o644,
+		"old/new/file.txt.etag": 0o644,
+	} {
+		stat, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != expected {
+			t.Errorf("expected %s to have mode %v, got %v", name, expected, stat.Mode().Perm())
+		}
+	}
+}
+
+func TestModesSidecars(t *testing.T) {
+	oldUmask := syscall.Umask(0o077)
+	defer syscall.Umask(oldUmask)
+
+	root := t.TempDir()
+	filename := filepath.Join(root, "file.txt")
+	if err := os.WriteFile(filename, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", FileMode: "0644"})
+	// Written outside of mirroring a response, as when refreshing metadata
+	if err := mir.updateMetadata(filename, xattrExpires, "2030-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filename + ".meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0o644 {
+		t.Errorf("expected metadata file to have mode %v, got %v", fs.FileMode(0o644), stat.Mode().Perm())
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for mode, valid := range map[string]bool{
+		"0755": true,
+		"644":  true,
+		"0999": false,
+		"7777": false,
+		"rwx":  false,
+	} {
+		if _, err := parseMode(mode); (err == nil) != valid {
+			t.Errorf("expected %q valid %v, got error: %v", mode, valid, err)
+		}
+	}
+}
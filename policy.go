@@ -0,0 +1,260 @@
+package mirror
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+// policyVar is the request var set to the name of the policy applying to a
+// request, available as the {http.vars.mirror_policy} placeholder
+const policyVar = "mirror_policy"
+
+// Policy overrides storage options of the handler for the requests whose
+// path it matches, so that one handler can mirror different parts of a
+// site differently. Options left unset keep the value of the handler. The
+// sidecar file suffixes can't be overridden, as they tell the files of the
+// whole root apart when it is walked.
+type Policy struct {
+	// Name of the policy, reported in logs and the mirror_policy request
+	// var. Default is the index of the policy.
+	Name string `json:"name,omitempty"`
+
+	// Paths the policy applies to, with the syntax of the path matcher.
+	Paths caddyhttp.MatchPath `json:"paths,omitempty"`
+
+	// Record the SHA-256 of mirrored files in xattrs, or not. Requires
+	// xattrs enabled on the handler.
+	Sha256Xattr *bool `json:"sha256_xattr,omitempty"`
+
+	// Size in bytes of the largest response hashed.
+	MaxHashSize *uint64 `json:"max_hash_size,omitempty"`
+
+	// Read back mirrored files to verify them, or not.
+	VerifyWrites *bool `json:"verify_writes,omitempty"`
+
+	// Size in bytes of the largest file read back with verify_writes.
+	VerifyMaxSize *uint64 `json:"verify_max_size,omitempty"`
+
+	// Content types of responses not mirrored.
+	SkipContentTypes []string `json:"skip_content_types,omitempty"`
+
+	// Read-through policies, replacing those of the handler.
+	ReadThrough []*ReadThrough `json:"read_through,omitempty"`
+
+	// Age under which local copies are served directly.
+	MaxAge *caddy.Duration `json:"max_age,omitempty"`
+
+	// Ask upstream whether local copies are still valid, or not.
+	Revalidate *bool `json:"revalidate,omitempty"`
+
+	// Serve local copies when upstream fails, or not.
+	Fallback *bool `json:"fallback,omitempty"`
+}
+
+// provisionPolicies sets up the handler variant of each policy, which are
+// validated like the handler itself
+func (mir *Mirror) provisionPolicies(ctx caddy.Context) error {
+	names := make(map[string]bool)
+	mir.policies = make([]*Mirror, len(mir.Policies))
+	for i, policy := range mir.Policies {
+		if policy.Name == "" {
+			policy.Name = strconv.Itoa(i)
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("duplicate policy name %q", policy.Name)
+		}
+		names[policy.Name] = true
+		if len(policy.Paths) == 0 {
+			return fmt.Errorf("policy %s: no paths", policy.Name)
+		}
+		if err := policy.Paths.Provision(ctx); err != nil {
+			return fmt.Errorf("policy %s paths: %w", policy.Name, err)
+		}
+		for _, readThrough := range policy.ReadThrough {
+			if err := readThrough.Paths.Provision(ctx); err != nil {
+				return fmt.Errorf("policy %s read_through paths: %w", policy.Name, err)
+			}
+		}
+		pm := mir.withPolicy(policy)
+		if err := pm.Validate(); err != nil {
+			return fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+		mir.policies[i] = pm
+	}
+	return nil
+}
+
+// withPolicy returns a copy of the provisioned handler with the options of
+// policy, sharing its state
+func (mir *Mirror) withPolicy(policy *Policy) *Mirror {
+	pm := *mir
+	pm.Policies, pm.policies = nil, nil
+	pm.policyName = policy.Name
+	pm.logger = mir.logger.With(zap.String("policy", policy.Name))
+	if policy.Sha256Xattr != nil {
+		pm.Sha256Xattr = *policy.Sha256Xattr
+	}
+	if policy.MaxHashSize != nil {
+		pm.MaxHashSize = *policy.MaxHashSize
+	}
+	if policy.VerifyWrites != nil {
+		pm.VerifyWrites = *policy.VerifyWrites
+	}
+	if policy.VerifyMaxSize != nil {
+		pm.VerifyMaxSize = *policy.VerifyMaxSize
+	}
+	if policy.SkipContentTypes != nil {
+		pm.SkipContentTypes = policy.SkipContentTypes
+	}
+	if policy.ReadThrough != nil {
+		pm.ReadThrough = policy.ReadThrough
+	}
+	if policy.MaxAge != nil {
+		pm.MaxAge = *policy.MaxAge
+		pm.maxAgePolicy = nil
+		if pm.MaxAge > 0 {
+			pm.maxAgePolicy = &ReadThrough{TTL: pm.MaxAge}
+		}
+	}
+	if policy.Revalidate != nil {
+		pm.Revalidate = *policy.Revalidate
+	}
+	if policy.Fallback != nil {
+		pm.Fallback = *policy.Fallback
+	}
+	return &pm
+}
+
+// policyFor returns the handler variant of the first policy applying to r,
+// or else the handler itself
+func (mir *Mirror) policyFor(r *http.Request) *Mirror {
+	for i, policy := range mir.Policies {
+		if policy.Paths.Match(r) {
+			return mir.policies[i]
+		}
+	}
+	return mir
+}
+
+// unmarshalCaddyfile parses the block of a policy, with this syntax:
+//
+//	policy <name> <paths...> {
+//	    sha256             xattr|off
+//	    max_hash_size      <size>
+//	    verify_writes      [<max_size>]|off
+//	    skip_content_types <types...>
+//	    read_through       always|expires|<ttl> [<paths...>]
+//	    max_age            <duration>
+//	    revalidate         [on|off]
+//	    fallback           [on|off]
+//	}
+func (policy *Policy) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&policy.Name) {
+		return d.ArgErr()
+	}
+	policy.Paths = d.RemainingArgs()
+	if len(policy.Paths) == 0 {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "sha256":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			switch val {
+			case "xattr", "off":
+				on := val == "xattr"
+				policy.Sha256Xattr = &on
+			default:
+				return d.Err("sha256 only supports xattr at the moment")
+			}
+		case "max_hash_size":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(val)
+			if err != nil {
+				return d.Errf("parsing max_hash_size: %v", err)
+			}
+			policy.MaxHashSize = &size
+		case "verify_writes":
+			args := d.RemainingArgs()
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			on := len(args) == 0 || args[0] != "off"
+			policy.VerifyWrites = &on
+			if on && len(args) > 0 {
+				size, err := humanize.ParseBytes(args[0])
+				if err != nil {
+					return d.Errf("parsing verify_writes max size: %v", err)
+				}
+				policy.VerifyMaxSize = &size
+			}
+		case "skip_content_types":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			policy.SkipContentTypes = args
+		case "read_through":
+			readThrough, err := parseReadThrough(d)
+			if err != nil {
+				return err
+			}
+			policy.ReadThrough = append(policy.ReadThrough, readThrough)
+		case "max_age":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing max_age: %v", err)
+			}
+			maxAge := caddy.Duration(dur)
+			policy.MaxAge = &maxAge
+		case "revalidate":
+			on, err := parseSwitch(d)
+			if err != nil {
+				return err
+			}
+			policy.Revalidate = on
+		case "fallback":
+			on, err := parseSwitch(d)
+			if err != nil {
+				return err
+			}
+			policy.Fallback = on
+		case "etag_file_suffix", "metadata_file_suffix":
+			return d.Errf("%s applies to the whole root and can't be overridden by a policy", d.Val())
+		default:
+			return d.Errf("unknown policy subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseSwitch parses the optional on|off argument of a policy option, which
+// is on if omitted
+func parseSwitch(d *caddyfile.Dispenser) (*bool, error) {
+	args := d.RemainingArgs()
+	switch {
+	case len(args) == 0:
+		on := true
+		return &on, nil
+	case len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		on := args[0] == "on"
+		return &on, nil
+	}
+	return nil, d.ArgErr()
+}
@@ -0,0 +1,145 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	on := true
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{
+		Root:           root,
+		EtagFileSuffix: ".etag",
+		Policies: []*Policy{
+			{Name: "raw", Paths: caddyhttp.MatchPath{"/raw/*"}, VerifyWrites: &on},
+			{Name: "images", Paths: caddyhttp.MatchPath{"/img/*", "*.png"}, SkipContentTypes: []string{"image/*"}},
+			{Name: "shadowed", Paths: caddyhttp.MatchPath{"/raw/*"}, SkipContentTypes: []string{"*/*"}},
+		},
+	})
+
+	testCases := []struct {
+		path     string
+		policy   string
+		mirrored bool
+		etag     bool
+	}{
+		{path: "/raw/file.bin", policy: "raw", mirrored: true, etag: true},
+		{path: "/img/photo.jpg", policy: "images"},
+		{path: "/other/photo.png", policy: "images"},
+		{path: "/other/file.bin", mirrored: true, etag: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil)
+			ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, make(map[string]any))
+			req = req.WithContext(ctx)
+			err := mir.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if strings.HasSuffix(r.URL.Path, ".bin") {
+					w.Header().Set("Content-Type", "application/octet-stream")
+				} else {
+					w.Header().Set("Content-Type", "image/png")
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy, _ := caddyhttp.GetVar(req.Context(), policyVar).(string); policy != test.policy {
+				t.Errorf("expected policy %q, got %q", test.policy, policy)
+			}
+			filename := filepath.Join(root, filepath.FromSlash(test.path))
+			if _, err := os.Stat(filename); (err == nil) != test.mirrored {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if _, err := os.Stat(filename + ".etag"); (err == nil) != test.etag {
+				t.Errorf("expected ETag sidecar %v, got %v", test.etag, err)
+			}
+		})
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	on := true
+	testCases := []struct {
+		name     string
+		policies []*Policy
+		errorMsg string
+	}{
+		{name: "invalid override", policies: []*Policy{{Name: "hashed", Paths: caddyhttp.MatchPath{"/*"}, Sha256Xattr: &on}}, errorMsg: "policy hashed: sha256 xattr requires xattr enabled"},
+		{name: "no paths", policies: []*Policy{{Name: "empty"}}, errorMsg: "policy empty: no paths"},
+		{name: "duplicate names", policies: []*Policy{{Paths: caddyhttp.MatchPath{"/a/*"}}, {Name: "0", Paths: caddyhttp.MatchPath{"/b/*"}}}, errorMsg: `duplicate policy name "0"`},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			mir := &Mirror{Root: t.TempDir(), Policies: test.policies}
+			err := mir.Provision(ctx)
+			defer mir.Cleanup()
+			if err == nil || err.Error() != test.errorMsg {
+				t.Errorf("expected error %q, got %v", test.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalPolicy(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		etag_file_suffix .etag
+		policy packages /packages/* *.deb {
+			sha256 off
+			max_hash_size 1GiB
+			read_through always
+			revalidate off
+			fallback
+		}
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(mir.Policies) != 1 {
+		t.Fatalf("expected one policy, got %+v", mir.Policies)
+	}
+	policy := mir.Policies[0]
+	if policy.Name != "packages" || len(policy.Paths) != 2 || policy.Paths[1] != "*.deb" {
+		t.Errorf("unexpected policy matcher %+v", policy)
+	}
+	if policy.Sha256Xattr == nil || *policy.Sha256Xattr {
+		t.Errorf("unexpected policy storage options %+v", policy)
+	}
+	if policy.MaxHashSize == nil || *policy.MaxHashSize != 1<<30 || len(policy.ReadThrough) != 1 || !policy.ReadThrough[0].Always {
+		t.Errorf("unexpected policy limits %+v", policy)
+	}
+	if policy.Revalidate == nil || *policy.Revalidate || policy.Fallback == nil || !*policy.Fallback || policy.VerifyWrites != nil {
+		t.Errorf("unexpected policy switches %+v", policy)
+	}
+}
+
+func TestUnmarshalPolicySuffix(t *testing.T) {
+	// The sidecars of the whole root must be named alike
+	for _, option := range []string{"etag_file_suffix", "metadata_file_suffix"} {
+		d := caddyfile.NewTestDispenser(`mirror {
+			policy raw /raw/* {
+				` + option + ` .other
+			}
+		}`)
+		err := new(Mirror).UnmarshalCaddyfile(d)
+		if err == nil || !strings.Contains(err.Error(), "can't be overridden by a policy") {
+			t.Errorf("expected %s rejected in a policy, got %v", option, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/renameio/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// precompressSuffixes are the file name suffixes of the precompressed
+// variants of each encoding, as looked up by file_server's precompressed
+var precompressSuffixes = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// precompressor is the sink writing the precompressed variants of
+// finalized files
+type precompressor struct {
+	mir    *Mirror
+	logger *zap.Logger
+}
+
+// Finalized writes the variants of info.Path in each encoding
+func (pc *precompressor) Finalized(ctx context.Context, info FileInfo) error {
+	var errs []error
+	for _, encoding := range pc.mir.Precompress {
+		if err := pc.compress(info.Path, encoding); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", encoding, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compress writes the variant of filename in encoding, unless it isn't
+// smaller. With an ETag file suffix, the variant's sidecar is written
+// first, with a strong ETag derived from the digest of the variant, so that
+// the variant never exists without it.
+func (pc *precompressor) compress(filename string, encoding string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	variant := filename + precompressSuffixes[encoding]
+	out, err := pc.mir.createTempFile(filepath.Dir(filename), variant)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hash)}
+	var encoder io.WriteCloser
+	switch encoding {
+	case "gzip":
+		encoder = gzip.NewWriter(counter)
+	case "zstd":
+		encoder, err = zstd.NewWriter(counter)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(encoder, in); err != nil {
+		encoder.Close()
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if counter.n >= stat.Size() {
+		pc.mir.trace(pc.logger, "precompressed variant not smaller, skipping",
+			zap.String("path", filename),
+			zap.String("encoding", encoding))
+		return nil
+	}
+	if err := os.Chtimes(out.Name(), stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+	// The file may have been replaced meanwhile, making the variant stale
+	if current, err := os.Stat(filename); err != nil || !os.SameFile(current, stat) {
+		return nil
+	}
+	if err := pc.mir.markVariant(out, variant, encoding); err != nil {
+		return err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	formatted, _ := formatEtag(etag, pc.mir.EtagFileFormat)
+	// The variant gets a sidecar for each of those of the file, named alike
+	for _, sidecar := range pc.mir.etagSidecars(filename) {
+		suffix := strings.TrimPrefix(sidecar, filename)
+		if err := pc.mir.writeFile(variant+suffix, []byte(formatted)); err != nil {
+			return err
+		}
+	}
+	return out.CloseAtomicallyReplace()
+}
+
+// markVariant marks the pending variant as written by the precompressor,
+// with an xattr, or in the metadata sidecar of the variant where xattrs
+// aren't supported and there are metadata sidecars
+func (mir *Mirror) markVariant(out *renameio.PendingFile, variant string, encoding string) error {
+	err := xattr.FSet(out.File, xattrPrecompressed, []byte(encoding))
+	if err == nil || mir.MetadataFileSuffix == "" {
+		return err
+	}
+	data, err := json.Marshal(map[string]string{xattrPrecompressed: encoding})
+	if err != nil {
+		return err
+	}
+	return mir.writeFile(variant+mir.MetadataFileSuffix, append(data, '\n'))
+}
+
+// isVariant reports whether filename is a precompressed variant, as marked
+// by the precompressor. Mirrored files that happen to have the suffix of a
+// variant, such as archive.tar.gz, aren't.
+func (mir *Mirror) isVariant(filename string) bool {
+	for _, encoding := range mir.Precompress {
+		if strings.HasSuffix(filename, precompressSuffixes[encoding]) {
+			return mir.variantEncoding(filename) == encoding
+		}
+	}
+	return false
+}
+
+// variantEncoding returns the encoding the precompressed variant filename
+// is marked with, "" if it isn't marked
+func (mir *Mirror) variantEncoding(filename string) string {
+	if value, err := xattr.Get(filename, xattrPrecompressed); err == nil {
+		return string(value)
+	}
+	if mir.MetadataFileSuffix == "" {
+		return ""
+	}
+	return mir.readMetadata(filename)[xattrPrecompressed]
+}
+
+// removeVariants removes the precompressed variants of filename, which no
+// longer match its content, followed by their sidecars. Files not marked
+// as variants are left alone.
+func (mir *Mirror) removeVariants(filename string) error {
+	var errs []error
+	for _, encoding := range mir.Precompress {
+		variant := filename + precompressSuffixes[encoding]
+		if !mir.isVariant(variant) {
+			continue
+		}
+		names := append([]string{variant}, mir.etagSidecars(variant)...)
+		if mir.MetadataFileSuffix != "" {
+			names = append(names, variant+mir.MetadataFileSuffix)
+		}
+		for _, name := range names {
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
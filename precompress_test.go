@@ -0,0 +1,132 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrecompress(t *testing.T) {
+	body := strings.Repeat("compressible content ", 100)
+	testCases := []struct {
+		encoding   string
+		extension  string
+		decompress func(io.Reader) (io.Reader, error)
+	}{
+		{encoding: "gzip", extension: ".gz", decompress: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}},
+		{encoding: "zstd", extension: ".zst", decompress: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		}},
+	}
+	for _, test := range testCases {
+		t.Run(test.encoding, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Precompress: []string{test.encoding}})
+			filename := filepath.Join(root, "file.txt")
+			if err := os.WriteFile(filename, []byte(body), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			pc := &precompressor{mir: mir, logger: mir.logger}
+			if err := pc.Finalized(context.Background(), FileInfo{Path: filename}); err != nil {
+				t.Fatal(err)
+			}
+			variant := filename + test.extension
+			compressed, err := os.ReadFile(variant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := test.decompress(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, err := io.ReadAll(r); err != nil || string(content) != body {
+				t.Errorf("variant doesn't decompress to the content, error: %v", err)
+			}
+			sum := sha256.Sum256(compressed)
+			if etag, err := os.ReadFile(variant + ".etag"); err != nil || string(etag) != `"`+hex.EncodeToString(sum[:])+`"` {
+				t.Errorf("expected variant ETag derived from its SHA-256, got %q, error: %v", etag, err)
+			}
+
+			// Mirroring new content removes the stale variant and its sidecar
+			_, err = serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("new"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{variant, variant + ".etag"} {
+				if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("stale %s not removed, stat error: %v", filepath.Base(name), err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrecompressNotSmaller(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Precompress: []string{"gzip"}})
+	filename := filepath.Join(root, "file.txt")
+	if err := os.WriteFile(filename, []byte("x"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	pc := &precompressor{mir: mir, logger: mir.logger}
+	if err := pc.Finalized(context.Background(), FileInfo{Path: filename}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file.txt.gz", "file.txt.gz.etag"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s written for a variant that isn't smaller, stat error: %v", name, err)
+		}
+	}
+}
+
+func TestPrecompressUnmarked(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Precompress: []string{"gzip"}})
+	// An upstream archive with the suffix of a variant isn't one
+	for _, urlp := range []string{"/archive.tar.gz", "/archive.tar"} {
+		_, err := serveMirror(mir, urlp, func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content of " + urlp))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(root, "archive.tar.gz")
+	if content, err := os.ReadFile(archive); err != nil || string(content) != "content of /archive.tar.gz" {
+		t.Fatalf("mirrored archive.tar.gz removed as a variant, got %q, error: %v", content, err)
+	}
+	if !mir.isEntry(archive) {
+		t.Error("mirrored archive.tar.gz not an entry")
+	}
+
+	filename := filepath.Join(root, "file.txt")
+	if err := os.WriteFile(filename, []byte(strings.Repeat("compressible content ", 100)), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	pc := &precompressor{mir: mir, logger: mir.logger}
+	if err := pc.Finalized(context.Background(), FileInfo{Path: filename}); err != nil {
+		t.Fatal(err)
+	}
+	if mir.isEntry(filename + ".gz") {
+		t.Error("precompressed variant is an entry")
+	}
+}
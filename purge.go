@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// purgeOptions select the mirrored files to purge
+type purgeOptions struct {
+	// prefix is the URL path prefix of the files
+	prefix string
+	// pattern is the glob pattern the files match, see matchPath
+	pattern string
+	// olderThan is the minimum time since the files were last modified
+	olderThan time.Duration
+	dryRun    bool
+}
+
+// purgeSummary sums up a purge
+type purgeSummary struct {
+	Files  int
+	Bytes  int64
+	Failed int
+}
+
+func purgeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge --root <path> [--prefix <path>] [--glob <pattern>] [--older-than <duration>] [--dry-run] [--force]",
+		Short: "Deletes mirrored files along with their sidecar files",
+		Long: `
+Deletes the mirrored files of a root that match all of the given
+conditions, along with their sidecar files and precompressed variants,
+and prints a summary. With --dry-run, the files that would be deleted are
+listed instead.`,
+		Example: "caddy mirror purge --root /srv/mirror --prefix /pool/ --older-than 720h --dry-run",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return cmdPurge(caddycmd.Flags{FlagSet: cmd.Flags()}, cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	layoutFlags(cmd)
+	cmd.Flags().String("prefix", "/", "Only purge files under this URL path prefix")
+	cmd.Flags().String("glob", "", "Only purge files matching this pattern, matched against the file name, or the URL path if it has a slash")
+	cmd.Flags().String("older-than", "", "Only purge files last modified longer ago than this, e.g. 720h or 30d")
+	cmd.Flags().Bool("dry-run", false, "List the files that would be purged without deleting them")
+	return cmd
+}
+
+func cmdPurge(flags caddycmd.Flags, stdout io.Writer, stderr io.Writer) error {
+	mir, err := mirrorFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	opts := purgeOptions{
+		prefix:  prefixFlag(flags),
+		pattern: flags.String("glob"),
+		dryRun:  flags.Bool("dry-run"),
+	}
+	if _, err := path.Match(opts.pattern, ""); err != nil {
+		return fmt.Errorf("invalid --glob pattern: %v", err)
+	}
+	if olderThan := flags.String("older-than"); olderThan != "" {
+		if opts.olderThan, err = caddy.ParseDuration(olderThan); err != nil {
+			return fmt.Errorf("invalid --older-than duration: %v", err)
+		}
+	}
+	summary := mir.purge(mir.Root, opts, func(urlp string, size int64, err error) {
+		switch {
+		case err != nil:
+			fmt.Fprintf(stderr, "failed to purge %s: %v\n", urlp, err)
+		case opts.dryRun:
+			fmt.Fprintf(stdout, "%s (%s)\n", urlp, humanize.IBytes(uint64(size)))
+		}
+	})
+	verb := "purged"
+	if opts.dryRun {
+		verb = "would purge"
+	}
+	fmt.Fprintf(stdout, "%s %d files, %s\n", verb, summary.Files, humanize.IBytes(uint64(summary.Bytes)))
+	if summary.Failed > 0 {
+		return fmt.Errorf("failed to purge %d files", summary.Failed)
+	}
+	return nil
+}
+
+// purge removes the mirrored files in root selected by opts, along with
+// their sidecar files and precompressed variants. report is called with
+// the URL path of each, and the error removing it failed with.
+func (mir *Mirror) purge(root string, opts purgeOptions, report func(urlp string, size int64, err error)) purgeSummary {
+	var summary purgeSummary
+	cutoff := time.Now().Add(-opts.olderThan)
+	mir.walkEntries(prefixDir(root, opts.prefix), func(filename string, d fs.DirEntry) {
+		urlp, err := relativeURLPath(root, filename)
+		if err != nil || !matchPath(urlp, opts.prefix, opts.pattern) {
+			return
+		}
+		info, err := d.Info()
+		if err != nil || (opts.olderThan > 0 && info.ModTime().After(cutoff)) {
+			return
+		}
+		if !opts.dryRun {
+			if err := mir.removeEntry(filename); err != nil {
+				summary.Failed++
+				report(urlp, info.Size(), err)
+				return
+			}
+		}
+		summary.Files++
+		summary.Bytes += info.Size()
+		report(urlp, info.Size(), nil)
+	})
+	return summary
+}
@@ -0,0 +1,120 @@
+package mirror
+
+import (
+	"bytes"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCommand runs the mirror subcommand cmd with args, returning its output
+func runCommand(cmd *cobra.Command, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd.SetArgs(args)
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SilenceUsage = true
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestPurge(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	files := map[string]time.Time{
+		"pool/a.deb":  old,
+		"pool/b.iso":  old,
+		"pool/c.deb":  time.Now(),
+		"other/d.deb": old,
+	}
+	testCases := []struct {
+		name     string
+		args     []string
+		output   []string
+		purged   []string
+		errorMsg string
+	}{
+		{
+			name:   "dry run",
+			args:   []string{"--prefix", "/pool/", "--older-than", "24h", "--dry-run"},
+			output: []string{"/pool/a.deb", "/pool/b.iso", "would purge 2 files"},
+		},
+		{
+			name:   "glob",
+			args:   []string{"--glob", "*.deb", "--older-than", "1d"},
+			output: []string{"purged 2 files"},
+			purged: []string{"pool/a.deb", "other/d.deb"},
+		},
+		{
+			name:   "path glob",
+			args:   []string{"--glob", "/pool/*"},
+			output: []string{"purged 3 files"},
+			purged: []string{"pool/a.deb", "pool/b.iso", "pool/c.deb"},
+		},
+		{
+			name:     "no mirror structure",
+			args:     []string{"--etag-suffix", ""},
+			errorMsg: "use --force",
+		},
+		{
+			name: "forced",
+			args: []string{"--etag-suffix", "", "--force", "--prefix", "/other"},
+			// Without the suffix, ETag files are purged as mirrored files
+			output: []string{"purged 2 files"},
+			purged: []string{"other/d.deb"},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, mtime := range files {
+				filename := filepath.Join(root, name)
+				os.MkdirAll(filepath.Dir(filename), 0o755)
+				for _, file := range []string{filename, filename + ".etag"} {
+					if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+						t.Fatal(err)
+					}
+					os.Chtimes(file, mtime, mtime)
+				}
+			}
+			args := append([]string{"--root", root, "--etag-suffix", ".etag"}, test.args...)
+			output, err := runCommand(purgeCommand(), args...)
+			if test.errorMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+					t.Fatalf("expected error %q, got %v", test.errorMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range test.output {
+				if !strings.Contains(output, expected) {
+					t.Errorf("expected %q in output:\n%s", expected, output)
+				}
+			}
+			purged := make(map[string]bool)
+			for _, name := range test.purged {
+				purged[name] = true
+			}
+			for name := range files {
+				filename := filepath.Join(root, name)
+				for _, file := range []string{filename, filename + ".etag"} {
+					_, err := os.Stat(file)
+					if purged[name] != os.IsNotExist(err) {
+						t.Errorf("expected %s purged %v, got %v", file, purged[name], err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeRefusesFilesystemRoot(t *testing.T) {
+	_, err := runCommand(purgeCommand(), "--root", "/", "--dry-run")
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("expected purging / refused, got %v", err)
+	}
+}
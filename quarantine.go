@@ -0,0 +1,164 @@
+package mirror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quarantine configures keeping the bodies of responses that failed digest
+// verification or were rejected by a validator, as evidence, instead of
+// discarding them. Each body is moved to the quarantine directory, next to a
+// `.json` file recording the URL, the expected and actual digests or the
+// validator and its reason, the time and the response header.
+// Quarantined files are never served.
+type Quarantine struct {
+	// Directory to move quarantined bodies to. It must be outside of the
+	// root.
+	Dir string `json:"dir,omitempty"`
+
+	// How long to keep quarantined files. Default is 7 days.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Maximum number of quarantined files to keep, the oldest are removed
+	// first. Default is 1000.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+const (
+	quarantineInfoSuffix = ".json"
+
+	defaultQuarantineMaxAge   = 7 * 24 * time.Hour
+	defaultQuarantineMaxFiles = 1000
+)
+
+// quarantineInfo is the content of quarantine info files
+type quarantineInfo struct {
+	URL      string `json:"url"`
+	Path     string `json:"path"`
+	Digest   string `json:"digest,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Validator and Reason are set for files rejected by a validator
+	Validator string      `json:"validator,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	Time      time.Time   `json:"time"`
+	Header    http.Header `json:"header"`
+}
+
+func (q *Quarantine) maxAge() time.Duration {
+	if q.MaxAge > 0 {
+		return time.Duration(q.MaxAge)
+	}
+	return defaultQuarantineMaxAge
+}
+
+func (q *Quarantine) maxFiles() int {
+	if q.MaxFiles > 0 {
+		return q.MaxFiles
+	}
+	return defaultQuarantineMaxFiles
+}
+
+// quarantine moves the pending mirror file to the quarantine directory,
+// after the digest named digest turned out to be actual instead of
+// expected. It reports whether it did, in which case the pending file is
+// gone.
+func (rww *responseWriterWrapper) quarantine(digest string, expected []byte, actual []byte) bool {
+	return rww.quarantineWith(quarantineInfo{
+		Digest:   digest,
+		Expected: hex.EncodeToString(expected),
+		Actual:   hex.EncodeToString(actual),
+	}, zap.String("digest", digest))
+}
+
+// quarantineWith moves the pending mirror file to the quarantine directory,
+// recording why in its info file and fields in the log. It reports whether
+// it did, in which case the pending file is gone.
+func (rww *responseWriterWrapper) quarantineWith(why quarantineInfo, fields ...zap.Field) bool {
+	q := rww.config.Quarantine
+	if q == nil || rww.file == nil {
+		return false
+	}
+	var random [4]byte
+	rand.Read(random[:])
+	now := time.Now().UTC()
+	quarantined := filepath.Join(q.Dir, now.Format("20060102T150405Z")+"-"+hex.EncodeToString(random[:])+"-"+filepath.Base(rww.filename))
+	why.URL, why.Path, why.Time, why.Header = rww.url, rww.filename, now, rww.Header().Clone()
+	info, err := json.MarshalIndent(why, "", "\t")
+	if err == nil {
+		err = rww.config.moveFile(q.Dir, rww.file.Name(), quarantined)
+	}
+	if err == nil {
+		err = rww.config.writeFile(quarantined+quarantineInfoSuffix, info)
+		if err != nil {
+			os.Remove(quarantined)
+		}
+	}
+	if err != nil {
+		rww.logger.Error("failed to quarantine file",
+			zap.String("quarantined", quarantined),
+			zap.Error(err))
+		return false
+	}
+	// The pending file has been moved, so only its descriptor is left
+	rww.stopWriter()
+	rww.file.Close()
+	rww.file = nil
+	rww.endInflight()
+	rww.config.stats.quarantined.Add(1)
+	rww.logger.Info("quarantined file",
+		append([]zap.Field{zap.String("url", rww.url), zap.String("quarantined", quarantined)}, fields...)...)
+	go rww.config.sweepQuarantine()
+	return true
+}
+
+// sweepQuarantine removes the quarantined files that are too old or too many
+func (mir *Mirror) sweepQuarantine() {
+	q := mir.Quarantine
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		mir.logger.Error("failed to sweep quarantine directory", zap.Error(err))
+		return
+	}
+	var quarantined []os.DirEntry
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") && !strings.HasSuffix(entry.Name(), quarantineInfoSuffix) {
+			quarantined = append(quarantined, entry)
+		}
+	}
+	// Names start with the time of quarantine, so the oldest come first
+	sort.Slice(quarantined, func(i, j int) bool {
+		return quarantined[i].Name() < quarantined[j].Name()
+	})
+	pacer := mir.deletionPacer()
+	defer pacer.finish(mir, "quarantine")
+	for i, entry := range quarantined {
+		if len(quarantined)-i <= q.maxFiles() {
+			stat, err := entry.Info()
+			if err != nil || time.Since(stat.ModTime()) < q.maxAge() {
+				continue
+			}
+		}
+		if !pacer.wait() {
+			return
+		}
+		filename := filepath.Join(q.Dir, entry.Name())
+		for _, name := range []string{filename, filename + quarantineInfoSuffix} {
+			if err := os.Remove(name); err != nil {
+				mir.logger.Error("failed to remove quarantined file",
+					zap.String("quarantined", name),
+					zap.Error(err))
+			}
+		}
+		pacer.deleted++
+	}
+}
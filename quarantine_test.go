@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, Quarantine: &Quarantine{Dir: dir}})
+	wrong := make([]byte, sha256.Size)
+	_, err := serveMirror(mir, "/dir/file.txt?v=1", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Repr-Digest")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(wrong)+":")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir", "file.txt")); err == nil {
+		t.Error("file failing digest verification mirrored")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !strings.HasSuffix(entries[0].Name(), "-file.txt") {
+		t.Fatalf("expected quarantined file and its info, got %v", entries)
+	}
+	quarantined := filepath.Join(dir, entries[0].Name())
+	if content, err := os.ReadFile(quarantined); err != nil || string(content) != "content" {
+		t.Errorf("unexpected quarantined content %q, error: %v", content, err)
+	}
+	infoJSON, err := os.ReadFile(quarantined + quarantineInfoSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info quarantineInfo
+	if err := json.Unmarshal(infoJSON, &info); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("content"))
+	if info.URL != "http://example.com/dir/file.txt?v=1" || info.Digest != "Repr-Digest" ||
+		info.Expected != hex.EncodeToString(wrong) || info.Actual != hex.EncodeToString(sum[:]) ||
+		info.Header.Get("Trailer") != "Repr-Digest" || time.Since(info.Time) > time.Minute {
+		t.Errorf("unexpected quarantine info %+v", info)
+	}
+}
+
+func TestSweepQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"1-old", "2-new", "3-new", "4-new"} {
+		for _, suffix := range []string{"", quarantineInfoSuffix} {
+			filename := filepath.Join(dir, name+suffix)
+			if err := os.WriteFile(filename, nil, filePerms); err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasSuffix(name, "old") {
+				if err := os.Chtimes(filename, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	mir := provisionTestMirror(t, &Mirror{Quarantine: &Quarantine{Dir: dir, MaxAge: caddy.Duration(time.Hour), MaxFiles: 2}, DeletionPacing: &DeletionPacing{Rate: 1000}})
+	mir.sweepQuarantine()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := "3-new 3-new.json 4-new 4-new.json"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("expected %s to remain, got %v", expected, names)
+	}
+}
@@ -0,0 +1,258 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootFiles tracks the number of mirrored files in a root, for max_files.
+// Counts are shared by all handlers mirroring to the root and survive config
+// reloads.
+type rootFiles struct {
+	mu sync.Mutex
+	// counting is set once the initial walk has been started, counted once
+	// it is done and count can be relied on
+	counting bool
+	counted  bool
+	count    int64
+	evicting bool
+}
+
+var (
+	rootFileCounts   = make(map[string]*rootFiles)
+	rootFileCountsMu sync.Mutex
+)
+
+// filesIn returns the file count of root
+func filesIn(root string) *rootFiles {
+	rootFileCountsMu.Lock()
+	defer rootFileCountsMu.Unlock()
+	rf, ok := rootFileCounts[root]
+	if !ok {
+		rf = new(rootFiles)
+		rootFileCounts[root] = rf
+	}
+	return rf
+}
+
+// isEntry reports whether the file filename is a mirrored file, as opposed
+// to a sidecar, partial, temp file or precompressed variant. Hidden files,
+// which include temp files, are not counted.
+func (mir *Mirror) isEntry(filename string) bool {
+	name := filepath.Base(filename)
+	if strings.HasPrefix(name, ".") || isPartialFile(name) {
+		return false
+	}
+	if mir.isVariant(filename) {
+		return false
+	}
+	if _, ok := mir.trimEtagSuffix(name); ok {
+		return false
+	}
+	if suffix := mir.MetadataFileSuffix; suffix != "" && strings.HasSuffix(name, suffix) {
+		return false
+	}
+	if mir.StoreResponseMeta != nil && strings.HasSuffix(name, ResponseMetaSuffix) {
+		return false
+	}
+	if mir.tombstones() && strings.HasSuffix(name, TombstoneSuffix) {
+		return false
+	}
+	return true
+}
+
+// isCounted reports whether the file filename counts toward max_files: a
+// mirrored file, or a tombstone
+func (mir *Mirror) isCounted(filename string) bool {
+	name := filepath.Base(filename)
+	if mir.tombstones() && strings.HasSuffix(name, TombstoneSuffix) && !strings.HasPrefix(name, ".") {
+		return true
+	}
+	return mir.isEntry(filename)
+}
+
+// walkEntries calls fn for every mirrored file in root
+func (mir *Mirror) walkEntries(root string, fn func(filename string, d fs.DirEntry)) error {
+	return walkFiles(root, mir.isEntry, fn)
+}
+
+// walkCounted calls fn for every file in root that counts toward max_files
+func (mir *Mirror) walkCounted(root string, fn func(filename string, d fs.DirEntry)) error {
+	return walkFiles(root, mir.isCounted, fn)
+}
+
+// walkFiles calls fn for every regular file in root that include reports
+// true for
+func walkFiles(root string, include func(filename string) bool, fn func(filename string, d fs.DirEntry)) error {
+	return filepath.WalkDir(root, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if filename == root {
+				return err
+			}
+			// Skip what can't be read rather than giving up
+			return nil
+		}
+		if d.Type().IsRegular() && include(filename) {
+			fn(filename, d)
+		}
+		return nil
+	})
+}
+
+// admitFile decides whether a response may be mirrored to filename under
+// max_files. Replacing an existing file is always admitted. When root is at
+// the limit, least recently used files are evicted in the background to
+// make room, and new files other than the one that triggered it are not
+// admitted until that is done. Until the files in root have been
+// counted, which starts when it is first seen, new files are admitted.
+// newFile reports whether the file would be a new one.
+func (mir *Mirror) admitFile(root string, filename string) (newFile bool, ok bool) {
+	if _, err := os.Lstat(filename); err == nil {
+		return false, true
+	}
+	rf := filesIn(root)
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if !rf.counting {
+		rf.counting = true
+		go mir.countFiles(root, rf)
+		return true, true
+	}
+	if rf.counted && rf.count >= mir.MaxFiles {
+		if rf.evicting {
+			return true, false
+		}
+		// The file that triggers eviction takes the slot it frees
+		rf.evicting = true
+		go mir.evictFiles(root, rf)
+	}
+	return true, true
+}
+
+// fileAdded counts a new file mirrored, or tombstone recorded, to root
+func (mir *Mirror) fileAdded(root string) {
+	rf := filesIn(root)
+	rf.mu.Lock()
+	rf.count++
+	rf.mu.Unlock()
+	mir.stats.files.Add(1)
+}
+
+// countFiles counts the files in root initially
+func (mir *Mirror) countFiles(root string, rf *rootFiles) {
+	var count int64
+	err := mir.walkCounted(root, func(string, fs.DirEntry) {
+		count++
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		mir.logger.Error("failed to count mirrored files",
+			zap.String("root", root),
+			zap.Error(err))
+	}
+	rf.mu.Lock()
+	// Files added while walking may or may not have been counted
+	delta := count - rf.count
+	rf.count = count
+	rf.counted = true
+	if _, err := os.Stat(filepath.Join(root, evictionProgressFile)); err == nil && !rf.evicting {
+		// Resume an interrupted eviction
+		rf.evicting = true
+		go mir.evictFiles(root, rf)
+	}
+	rf.mu.Unlock()
+	mir.stats.files.Add(delta)
+	mir.logger.Debug("counted mirrored files",
+		zap.String("root", root),
+		zap.Int64("files", count))
+}
+
+// evictFiles removes the least recently used files and tombstones in root,
+// with their sidecar files, until there are 10% fewer than max_files, and at least one
+// fewer. Deletions are
+// paced, an eviction that is interrupted or exceeds its batch is resumed by
+// the next one.
+func (mir *Mirror) evictFiles(root string, rf *rootFiles) {
+	pacer := mir.deletionPacer()
+	walked := int64(-1)
+	pending := mir.loadEvictionProgress(root)
+	if pending == nil {
+		type entry struct {
+			filename   string
+			lastAccess time.Time
+		}
+		var entries []entry
+		err := mir.walkCounted(root, func(filename string, d fs.DirEntry) {
+			stat, err := d.Info()
+			if err != nil {
+				return
+			}
+			entries = append(entries, entry{filename, mir.lastAccess(filename, stat)})
+		})
+		if err != nil {
+			mir.logger.Error("failed to walk mirrored files for eviction",
+				zap.String("root", root),
+				zap.Error(err))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].lastAccess.Before(entries[j].lastAccess)
+		})
+		walked = int64(len(entries))
+		target := min(mir.MaxFiles-1, mir.MaxFiles-mir.MaxFiles/10)
+		for i := int64(0); i < walked-target; i++ {
+			pending = append(pending, entries[i].filename)
+		}
+	}
+	for len(pending) > 0 && pacer.wait() {
+		if err := mir.removeEntry(pending[0]); err != nil {
+			mir.logger.Error("failed to evict mirrored file",
+				zap.String("path", pending[0]),
+				zap.Error(err))
+		} else {
+			pacer.deleted++
+		}
+		pending = pending[1:]
+	}
+	mir.saveEvictionProgress(root, pending)
+	evicted := int64(pacer.deleted)
+	rf.mu.Lock()
+	count := rf.count - evicted
+	if walked >= 0 {
+		count = walked - evicted
+	}
+	delta := count - rf.count
+	rf.count = count
+	rf.evicting = false
+	rf.mu.Unlock()
+	mir.stats.files.Add(delta)
+	pacer.finish(mir, "eviction")
+	mir.logger.Info("evicted least recently used files",
+		zap.String("root", root),
+		zap.Int64("evicted", evicted),
+		zap.Int("pending", len(pending)),
+		zap.Int64("files", count))
+}
+
+// removeEntry removes the mirrored file filename along with its sidecar files
+// and precompressed variants
+func (mir *Mirror) removeEntry(filename string) error {
+	if err := mir.clearImmutable(filename); err != nil {
+		return err
+	}
+	err := os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, suffix := range mir.sidecarSuffixes(filename) {
+		if err := os.Remove(filename + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return mir.removeVariants(filename)
+}
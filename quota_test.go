@@ -0,0 +1,148 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIsEntry(t *testing.T) {
+	mir := Mirror{EtagFileSuffix: ".etag", MetadataFileSuffix: ".meta"}
+	testCases := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "file.txt", expected: true},
+		{name: "file.txt.etag", expected: false},
+		{name: "file.txt.meta", expected: false},
+		{name: "file.txt" + partialSuffix, expected: false},
+		{name: "file.txt" + partialInfoSuffix, expected: false},
+		{name: ".file.txt123456", expected: false},
+	}
+	for i, test := range testCases {
+		actual := mir.isEntry(test.name)
+		if actual != test.expected {
+			t.Errorf("Test %d (%s) - expected %v, got %v", i, test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		filename := filepath.Join(root, "dir", fmt.Sprintf("file%d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{filename, filename + ".etag"} {
+			if err := os.WriteFile(name, nil, filePerms); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// file0.txt is the least recently used
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MaxFiles: 10})
+	rf := filesIn(root)
+	mir.countFiles(root, rf)
+	rf.counting = true
+	if rf.count != 10 {
+		t.Fatalf("expected 10 files counted, got %d", rf.count)
+	}
+
+	newFile, ok := mir.admitFile(root, filepath.Join(root, "dir", "file0.txt"))
+	if newFile || !ok {
+		t.Errorf("replacing a file should be admitted, got new %v, ok %v", newFile, ok)
+	}
+	rf.mu.Lock()
+	rf.evicting = true // evict synchronously below
+	rf.mu.Unlock()
+	_, err := serveMirror(mir, "/dir/new.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir", "new.txt")); err == nil {
+		t.Error("new file mirrored beyond max_files")
+	}
+
+	mir.evictFiles(root, rf)
+	entries, err := os.ReadDir(filepath.Join(root, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 18 || names[0] != "file1.txt" {
+		t.Errorf("expected file0.txt and its sidecar to be evicted, got %v", names)
+	}
+	if rf.count != 9 || rf.evicting {
+		t.Errorf("unexpected count %d after eviction, evicting %v", rf.count, rf.evicting)
+	}
+	newFile, ok = mir.admitFile(root, filepath.Join(root, "dir", "new.txt"))
+	if !newFile || !ok {
+		t.Errorf("new file should be admitted after eviction, got new %v, ok %v", newFile, ok)
+	}
+}
+
+func TestMaxFilesSmall(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		filename := filepath.Join(root, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(filename, nil, filePerms); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MaxFiles: 3})
+	rf := filesIn(root)
+	mir.countFiles(root, rf)
+	rf.counting = true
+
+	// The new file triggering eviction is admitted, in the slot freed
+	newFile, ok := mir.admitFile(root, filepath.Join(root, "new.txt"))
+	if !newFile || !ok {
+		t.Errorf("new file triggering eviction should be admitted, got new %v, ok %v", newFile, ok)
+	}
+	if _, ok := mir.admitFile(root, filepath.Join(root, "other.txt")); ok {
+		t.Error("new file admitted while evicting")
+	}
+	for i := 0; i < 100; i++ {
+		rf.mu.Lock()
+		evicting := rf.evicting
+		rf.mu.Unlock()
+		if !evicting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(root, "file0.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the least recently used file evicted, stat error: %v", err)
+	}
+	rf.mu.Lock()
+	count := rf.count
+	rf.mu.Unlock()
+	if count != 2 {
+		t.Errorf("expected 2 files left after eviction, got %d", count)
+	}
+}
@@ -0,0 +1,120 @@
+package mirror
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ReadThrough is a freshness policy for serving local copies directly,
+// without calling the next handler. A local copy is fresh if the policy is
+// Always, if it was mirrored less than TTL ago, or else if the expiry time
+// recorded from the response's caching headers hasn't passed yet.
+type ReadThrough struct {
+	// Paths the policy applies to, with the syntax of the path matcher.
+	// Default is all paths.
+	Paths caddyhttp.MatchPath `json:"paths,omitempty"`
+
+	// Consider local copies always fresh, e.g. for immutable files such as
+	// packages whose names include their version.
+	Always bool `json:"always,omitempty"`
+
+	// Consider local copies fresh for this long after they were mirrored.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// readThroughPolicy returns the first read-through policy applying to r,
+// else that of max_age, or nil if there is none
+func (mir *Mirror) readThroughPolicy(r *http.Request) *ReadThrough {
+	for _, policy := range mir.ReadThrough {
+		if len(policy.Paths) == 0 || policy.Paths.Match(r) {
+			return policy
+		}
+	}
+	return mir.maxAgePolicy
+}
+
+// serveReadThrough serves the local copy of the file requested by r
+// without waiting for the next handler, if it is fresh, or if it is stale
+// with stale_while_revalidate, in which case it is refreshed in the
+// background. ok is false if nothing has been written to w.
+func (mir *Mirror) serveReadThrough(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, root string, logger *zap.Logger) (ok bool) {
+	policy := mir.readThroughPolicy(r)
+	swr := mir.StaleWhileRevalidate
+	if policy == nil && swr == nil {
+		return false
+	}
+	if policy == nil {
+		policy = new(ReadThrough)
+	}
+	urlp, err := mir.storagePath(r)
+	if err != nil {
+		return false
+	}
+	filename := mir.languageCopy(r, root, urlp)
+	now := time.Now()
+	exists, fresh, downloaded := mir.freshness(filename, policy, now)
+	if !exists || !fresh && swr == nil {
+		return false
+	}
+	if !fresh {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Mirror-Stale", "true")
+	}
+	if !mir.serveLocal(w, r, filename, logger) {
+		// The response is up to the next handler after all
+		w.Header().Del("Warning")
+		w.Header().Del("X-Mirror-Stale")
+		return false
+	}
+	if fresh {
+		mir.stats.readThroughHits.Add(1)
+		mir.setLogFields(r, logStatusReadThrough, 0, filename)
+	} else {
+		mir.stats.staleHits.Add(1)
+		mir.setLogFields(r, logStatusStale, 0, filename)
+	}
+	mir.stats.hit()
+	if mir.isReadOnly() {
+		return true
+	}
+	mir.trackAccess(filename, now, logger)
+	if !fresh && now.Sub(downloaded) >= time.Duration(swr.MinAge) {
+		if mir.refresher.refresh(r, next, root, filename, logger) {
+			mir.stats.staleRefreshes.Add(1)
+		}
+	}
+	return true
+}
+
+// freshness reports whether filename is a local copy that can be served,
+// whether it is fresh at now according to policy, and when it was
+// mirrored, if known
+func (mir *Mirror) freshness(filename string, policy *ReadThrough, now time.Time) (exists bool, fresh bool, downloaded time.Time) {
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		return false, false, downloaded
+	}
+	if mir.KeepPartials != nil && isPartialFile(filename) {
+		return false, false, downloaded
+	}
+	meta := mir.readMetadata(filename)
+	downloaded, err = time.Parse(time.RFC3339, meta[xattrDownloaded])
+	if err != nil && !mir.PreserveMtime {
+		// Without a preserved Last-Modified, mtime is the time of download
+		downloaded = stat.ModTime()
+	}
+	switch {
+	case policy.Always:
+		fresh = true
+	case policy.TTL > 0:
+		fresh = !downloaded.IsZero() && now.Before(downloaded.Add(time.Duration(policy.TTL)))
+	default:
+		expires, err := time.Parse(time.RFC3339, meta[xattrExpires])
+		fresh = err == nil && now.Before(expires)
+	}
+	return true, fresh, downloaded
+}
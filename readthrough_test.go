@@ -0,0 +1,131 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadThrough(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       ReadThrough
+		cacheControl string
+		downloaded   time.Time
+		served       bool
+	}{
+		{name: "always", policy: ReadThrough{Always: true}, cacheControl: "no-cache", served: true},
+		{name: "other path", policy: ReadThrough{Paths: caddyhttp.MatchPath{"/other/*"}, Always: true}},
+		{name: "matching path", policy: ReadThrough{Paths: caddyhttp.MatchPath{"/dir/*"}, Always: true}, served: true},
+		{name: "expires fresh", cacheControl: "max-age=60", served: true},
+		{name: "expires stale", cacheControl: "max-age=0"},
+		{name: "expires unknown"},
+		{name: "ttl fresh", policy: ReadThrough{TTL: caddy.Duration(time.Hour)}, served: true},
+		{name: "ttl stale", policy: ReadThrough{TTL: caddy.Duration(time.Minute)}, downloaded: time.Now().Add(-time.Hour)},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			policy := test.policy
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MetadataFileSuffix: ".meta", ReadThrough: []*ReadThrough{&policy}})
+			_, err := serveMirror(mir, "/dir/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("ETag", `"v1"`)
+				if test.cacheControl != "" {
+					w.Header().Set("Cache-Control", test.cacheControl)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.downloaded.IsZero() {
+				err := mir.updateMetadata(filepath.Join(root, "dir", "file.txt"), xattrDownloaded, test.downloaded.UTC().Format(time.RFC3339))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			called := false
+			rec, err := serveMirror(mir, "/dir/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				called = true
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("upstream"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if called == test.served {
+				t.Errorf("expected served from local copy %v, next handler called %v", test.served, called)
+			}
+			if test.served && (rec.Body.String() != "content" || rec.Header().Get("ETag") != `"v1"`) {
+				t.Errorf("unexpected local copy %q with ETag %q", rec.Body.String(), rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	testCases := []struct {
+		name        string
+		downloaded  time.Time
+		fallback    bool
+		upstreamErr error
+		body        string
+		called      bool
+	}{
+		{name: "fresh", downloaded: time.Now().Add(-time.Hour), body: "local copy"},
+		{name: "stale", downloaded: time.Now().Add(-48 * time.Hour), body: "upstream", called: true},
+		{name: "stale upstream down", downloaded: time.Now().Add(-48 * time.Hour), fallback: true, upstreamErr: caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed")), body: "local copy", called: true},
+		{name: "unknown age", body: "local copy"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			filename := filepath.Join(root, "file.txt")
+			if err := os.WriteFile(filename, []byte("local copy"), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			meta := map[string]string{}
+			if !test.downloaded.IsZero() {
+				meta[xattrDownloaded] = test.downloaded.UTC().Format(time.RFC3339)
+			}
+			data, _ := json.Marshal(meta)
+			if err := os.WriteFile(filename+".meta", data, filePerms); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", MaxAge: caddy.Duration(24 * time.Hour), Fallback: test.fallback})
+
+			called := false
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				called = true
+				if test.upstreamErr != nil {
+					return test.upstreamErr
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("upstream"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if called != test.called {
+				t.Errorf("expected next handler called %v, got %v", test.called, called)
+			}
+			if rec.Body.String() != test.body {
+				t.Errorf("expected %q, got %q", test.body, rec.Body.String())
+			}
+			if content, _ := os.ReadFile(filename); string(content) != test.body {
+				t.Errorf("expected %q mirrored, got %q", test.body, content)
+			}
+		})
+	}
+}
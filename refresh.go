@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Refresh configures refetching the most requested local copies in the
+// background before they go stale, so that they stay warm. Requests are
+// counted per path, and the counts are halved at each check, so that files
+// that stopped being requested cool down and are never refreshed. Requests
+// with an Authorization or Cookie header aren't counted.
+type Refresh struct {
+	// Number of most requested files considered at each check. Default is
+	// 100.
+	Top int `json:"top,omitempty"`
+
+	// Minimum request count for a file to be refreshed. Default is 2.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Interval between checks. Default is 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Refresh files that go stale within this time. Default is 5m.
+	Ahead caddy.Duration `json:"ahead,omitempty"`
+
+	// Daily window in local time during which files are refreshed, e.g.
+	// `01:00-05:00`. Default is any time.
+	Window string `json:"window,omitempty"`
+
+	// Maximum number of refreshes at the same time. Default is 2.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+const (
+	defaultRefreshTop           = 100
+	defaultRefreshMinRequests   = 2
+	defaultRefreshInterval      = time.Minute
+	defaultRefreshAhead         = 5 * time.Minute
+	defaultRefreshMaxConcurrent = 2
+
+	// popularPathsPerTop is the number of paths counted for each of the
+	// top paths. Further paths aren't counted until others cool down.
+	popularPathsPerTop = 10
+)
+
+// popularPath is a requested path, with what is needed to fetch it again
+type popularPath struct {
+	count    float64
+	req      *http.Request
+	next     caddyhttp.Handler
+	root     string
+	filename string
+}
+
+// popularity counts requests per path and refreshes the most requested
+// local copies before they go stale
+type popularity struct {
+	mir       *Mirror
+	config    *Refresh
+	logger    *zap.Logger
+	refresher *refresher
+	// window is the daily refresh window, as offsets from midnight
+	window      [2]time.Duration
+	hasWindow   bool
+	mu          sync.Mutex
+	paths       map[string]*popularPath
+	maxPaths    int
+	minRequests float64
+}
+
+func newPopularity(mir *Mirror) (*popularity, error) {
+	config := mir.Refresh
+	concurrency := config.MaxConcurrent
+	if concurrency <= 0 {
+		concurrency = defaultRefreshMaxConcurrent
+	}
+	p := &popularity{
+		mir:         mir,
+		config:      config,
+		logger:      mir.logger,
+		refresher:   newRefresher(mir, concurrency),
+		paths:       make(map[string]*popularPath),
+		maxPaths:    popularPathsPerTop * defaultRefreshTop,
+		minRequests: defaultRefreshMinRequests,
+	}
+	if config.Top > 0 {
+		p.maxPaths = popularPathsPerTop * config.Top
+	}
+	if config.MinRequests > 0 {
+		p.minRequests = float64(config.MinRequests)
+	}
+	if config.Window != "" {
+		window, err := parseWindow(config.Window)
+		if err != nil {
+			return nil, err
+		}
+		p.window, p.hasWindow = window, true
+	}
+	return p, nil
+}
+
+// parseWindow parses a daily window such as "01:00-05:00" into offsets from
+// midnight
+func parseWindow(window string) (offsets [2]time.Duration, err error) {
+	var hours, minutes [2]int
+	_, err = fmt.Sscanf(window, "%d:%d-%d:%d", &hours[0], &minutes[0], &hours[1], &minutes[1])
+	if err != nil {
+		return offsets, fmt.Errorf("invalid window %q, expected e.g. 01:00-05:00", window)
+	}
+	for i := range offsets {
+		if hours[i] < 0 || hours[i] > 24 || minutes[i] < 0 || minutes[i] > 59 {
+			return offsets, fmt.Errorf("invalid window %q, expected e.g. 01:00-05:00", window)
+		}
+		offsets[i] = time.Duration(hours[i])*time.Hour + time.Duration(minutes[i])*time.Minute
+	}
+	return offsets, nil
+}
+
+// inWindow reports whether files may be refreshed at now
+func (p *popularity) inWindow(now time.Time) bool {
+	if !p.hasWindow {
+		return true
+	}
+	hour, minute, second := now.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+	start, end := p.window[0], p.window[1]
+	if start <= end {
+		return offset >= start && offset < end
+	}
+	// The window spans midnight
+	return offset >= start || offset < end
+}
+
+// record counts a request r for filename within root, which is fetched
+// through next. Requests with credentials aren't, as refreshing with them
+// would fetch the file on behalf of one client for all of them.
+func (p *popularity) record(r *http.Request, next caddyhttp.Handler, root string, filename string) {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if path, ok := p.paths[filename]; ok {
+		path.count++
+		return
+	}
+	if len(p.paths) >= p.maxPaths {
+		return
+	}
+	p.paths[filename] = &popularPath{
+		count:    1,
+		req:      snapshotRequest(r),
+		next:     next,
+		root:     root,
+		filename: filename,
+	}
+}
+
+// snapshotHeaders are the request headers kept by snapshotRequest, which
+// select the variant of the file fetched
+var snapshotHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// snapshotRequest returns a request for the same file as r that can be kept
+// after r is done, to fetch it again later with backgroundRequest. Only the
+// server and vars of the context of r are kept, and only snapshotHeaders
+// of its header.
+func snapshotRequest(r *http.Request) *http.Request {
+	ctx := context.Background()
+	if server, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+		ctx = context.WithValue(ctx, caddyhttp.ServerCtxKey, server)
+	}
+	if vars, ok := r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any); ok {
+		ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, maps.Clone(vars))
+	}
+	u := *r.URL
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        &u,
+		Proto:      r.Proto,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+		Header:     make(http.Header),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+	}
+	for _, name := range snapshotHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Header[name] = slices.Clone(values)
+		}
+	}
+	return req.WithContext(ctx)
+}
+
+// run checks for files to refresh at each interval, until the handler is
+// unloaded
+func (p *popularity) run() {
+	interval := time.Duration(p.config.Interval)
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				p.check(now)
+			case <-p.mir.done:
+				return
+			}
+		}
+	}()
+}
+
+// check refreshes the most requested files that go stale soon, if within
+// the window, and cools down all request counts
+func (p *popularity) check(now time.Time) {
+	var top []*popularPath
+	p.mu.Lock()
+	for filename, path := range p.paths {
+		if path.count >= p.minRequests {
+			top = append(top, path)
+		}
+		path.count /= 2
+		if path.count < 0.5 {
+			delete(p.paths, filename)
+		}
+	}
+	p.mu.Unlock()
+	if !p.inWindow(now) || p.mir.isReadOnly() {
+		return
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].count > top[j].count
+	})
+	if limit := p.maxPaths / popularPathsPerTop; len(top) > limit {
+		top = top[:limit]
+	}
+	ahead := time.Duration(p.config.Ahead)
+	if ahead <= 0 {
+		ahead = defaultRefreshAhead
+	}
+	for _, path := range top {
+		mir := p.mir.policyFor(path.req)
+		policy := mir.readThroughPolicy(path.req)
+		if policy == nil {
+			policy = new(ReadThrough)
+		}
+		filename := mir.locate(path.root, path.filename)
+		if exists, fresh, _ := mir.freshness(filename, policy, now.Add(ahead)); !exists || fresh {
+			continue
+		}
+		logger := p.logger.With(zap.String("site_root", path.root),
+			zap.String("request_path", path.req.URL.Path))
+		if p.refresher.refresh(path.req, path.next, path.root, path.filename, logger) {
+			p.mir.stats.refreshes.Add(1)
+		} else {
+			p.mir.stats.refreshesSkipped.Add(1)
+		}
+	}
+}
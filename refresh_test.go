@@ -0,0 +1,130 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshPopular(t *testing.T) {
+	testCases := []struct {
+		name      string
+		requests  int
+		maxAge    string
+		refreshed bool
+	}{
+		{name: "popular expiring", requests: 3, maxAge: "60", refreshed: true},
+		{name: "cold", requests: 1, maxAge: "60"},
+		{name: "popular fresh", requests: 3, maxAge: "3600"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{
+				Root:               root,
+				MetadataFileSuffix: ".meta",
+				Refresh:            &Refresh{Interval: caddy.Duration(time.Hour)},
+				ReadThrough:        []*ReadThrough{{}},
+			})
+			var calls atomic.Int32
+			next := func(w http.ResponseWriter, r *http.Request) error {
+				calls.Add(1)
+				w.Header().Set("Cache-Control", "max-age="+test.maxAge)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			}
+			for range test.requests {
+				if _, err := serveMirror(mir, "/file.txt", next); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Fresh local copies are served without calling next
+			if calls.Load() != 1 {
+				t.Fatalf("expected 1 call to next, got %d", calls.Load())
+			}
+
+			mir.popularity.check(time.Now())
+			mir.popularity.refresher.wg.Wait()
+			expected := int32(1)
+			if test.refreshed {
+				expected = 2
+			}
+			if calls.Load() != expected {
+				t.Errorf("expected %d calls to next, got %d", expected, calls.Load())
+			}
+			if test.refreshed && mir.stats.refreshes.Value() == 0 {
+				t.Error("refresh not counted")
+			}
+		})
+	}
+}
+
+func TestRefreshWindow(t *testing.T) {
+	testCases := []struct {
+		window   string
+		clock    string
+		inWindow bool
+	}{
+		{window: "01:00-05:00", clock: "03:30", inWindow: true},
+		{window: "01:00-05:00", clock: "05:00"},
+		{window: "01:00-05:00", clock: "00:59"},
+		{window: "22:00-02:00", clock: "23:00", inWindow: true},
+		{window: "22:00-02:00", clock: "01:00", inWindow: true},
+		{window: "22:00-02:00", clock: "12:00"},
+	}
+	for _, test := range testCases {
+		window, err := parseWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &popularity{window: window, hasWindow: true}
+		now, err := time.ParseInLocation("15:04", test.clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.inWindow(now) != test.inWindow {
+			t.Errorf("expected %s in window %s %v", test.clock, test.window, test.inWindow)
+		}
+	}
+	for _, window := range []string{"1-5", "25:00-01:00", "01:60-02:00"} {
+		if _, err := parseWindow(window); err == nil {
+			t.Errorf("expected error for window %q", window)
+		}
+	}
+}
+
+func TestSnapshotRequest(t *testing.T) {
+	type ctxKey struct{}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt?v=1", nil)
+	r.Header.Set("Accept-Language", "de")
+	r.Header.Set("Cookie", "session=secret")
+	r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, "request scoped"))
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{"root": "/srv"}))
+
+	req := snapshotRequest(r)
+	if req.URL.String() != r.URL.String() || req.Host != "example.com" || req.Method != http.MethodGet {
+		t.Errorf("unexpected snapshot of %s %s: %s %s, host %s", r.Method, r.URL, req.Method, req.URL, req.Host)
+	}
+	if req.Header.Get("Accept-Language") != "de" || req.Header.Get("Cookie") != "" {
+		t.Errorf("unexpected snapshot header %v", req.Header)
+	}
+	if req.Context().Value(ctxKey{}) != nil {
+		t.Error("request scoped context value kept in snapshot")
+	}
+	if vars, _ := req.Context().Value(caddyhttp.VarsCtxKey).(map[string]any); vars["root"] != "/srv" {
+		t.Errorf("expected vars kept in snapshot, got %v", vars)
+	}
+
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Refresh: &Refresh{Interval: caddy.Duration(time.Hour)}})
+	mir.popularity.record(r, nil, mir.Root, filepath.Join(mir.Root, "file.txt"))
+	if len(mir.popularity.paths) != 0 {
+		t.Error("request with credentials recorded for refresh")
+	}
+}
@@ -0,0 +1,261 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/xattr"
+	"github.com/spf13/cobra"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// digestAlgorithm is a digest the hash command records, under the metadata
+// name xattr, as hex like the handler does for SHA-256
+type digestAlgorithm struct {
+	xattr string
+	new   func() hash.Hash
+}
+
+var digestAlgorithms = map[string]digestAlgorithm{
+	"sha256": {xattrSha256, sha256.New},
+	"sha512": {xattrSha512, sha512.New},
+}
+
+// hashOptions configure recording the digests of mirrored files
+type hashOptions struct {
+	prefix     string
+	algorithms []string
+	xattr      bool
+	sidecar    bool
+	// force rehashes files whose digests are up to date
+	force   bool
+	workers int
+}
+
+// hashSummary sums up recording the digests of mirrored files
+type hashSummary struct {
+	Files   int
+	Bytes   int64
+	Skipped int
+	Failed  int
+}
+
+func hashCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hash --root <path> [--prefix <path>] [--algorithms sha256,sha512] [--xattr] [--sidecar] [--workers <count>] [--rehash]",
+		Short: "Records the digests of mirrored files that lack them",
+		Long: `
+Computes the digests of the mirrored files of a root and records them the
+way the handler does with sha256_xattr: as hex in the user.xdg.origin.<alg>
+xattr, and with --sidecar in the metadata sidecar file of --metadata-suffix.
+
+Files are skipped if they have all the digests already, and haven't been
+modified since they were mirrored or hashed, so an interrupted run can be
+resumed by running it again. A file modified while it is hashed is left
+as it is.`,
+		Example: "caddy mirror hash --root /srv/mirror --algorithms sha256,sha512 --workers 8",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return cmdHash(caddycmd.Flags{FlagSet: cmd.Flags()}, cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	layoutFlags(cmd)
+	cmd.Flags().String("prefix", "/", "Only hash files under this URL path prefix")
+	cmd.Flags().StringSlice("algorithms", []string{"sha256"}, "The digests to record: sha256, sha512")
+	cmd.Flags().Bool("xattr", true, "Record the digests in xattrs")
+	cmd.Flags().Bool("sidecar", false, "Record the digests in the metadata sidecar files")
+	cmd.Flags().Int("workers", runtime.NumCPU(), "Number of files hashed concurrently")
+	cmd.Flags().Bool("rehash", false, "Hash files even if their digests are up to date")
+	return cmd
+}
+
+func cmdHash(flags caddycmd.Flags, stdout io.Writer, stderr io.Writer) error {
+	mir, err := mirrorFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	mir.UseXattr = true
+	opts := hashOptions{
+		prefix:  prefixFlag(flags),
+		xattr:   flags.Bool("xattr"),
+		sidecar: flags.Bool("sidecar"),
+		force:   flags.Bool("rehash"),
+		workers: flags.Int("workers"),
+	}
+	opts.algorithms, _ = flags.GetStringSlice("algorithms")
+	for _, algorithm := range opts.algorithms {
+		if _, ok := digestAlgorithms[algorithm]; !ok {
+			return fmt.Errorf("unknown digest algorithm %q", algorithm)
+		}
+	}
+	if len(opts.algorithms) == 0 {
+		return errors.New("--algorithms can't be empty")
+	}
+	if !opts.xattr && !opts.sidecar {
+		return errors.New("digests must be recorded in xattrs or with --sidecar")
+	}
+	if opts.sidecar && mir.MetadataFileSuffix == "" {
+		return errors.New("--sidecar requires --metadata-suffix")
+	}
+	summary := mir.hashTree(mir.Root, opts, func(filename string, err error) {
+		fmt.Fprintf(stderr, "failed to hash %s: %v\n", filename, err)
+	})
+	fmt.Fprintf(stdout, "hashed %d files, %s, %d up to date\n", summary.Files, humanize.IBytes(uint64(summary.Bytes)), summary.Skipped)
+	if summary.Failed > 0 {
+		return fmt.Errorf("failed to hash %d files", summary.Failed)
+	}
+	return nil
+}
+
+// hashTree records the digests of the mirrored files in root selected by
+// opts, with opts.workers files hashed concurrently. failed is called with
+// the files that couldn't be hashed.
+func (mir *Mirror) hashTree(root string, opts hashOptions, failed func(filename string, err error)) hashSummary {
+	var (
+		summary hashSummary
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	filenames := make(chan string)
+	for i := 0; i < max(opts.workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range filenames {
+				size, hashed, err := mir.recordDigests(filename, opts)
+				mu.Lock()
+				switch {
+				case err != nil:
+					summary.Failed++
+					failed(filename, err)
+				case hashed:
+					summary.Files++
+					summary.Bytes += size
+				default:
+					summary.Skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	mir.walkEntries(prefixDir(root, opts.prefix), func(filename string, _ fs.DirEntry) {
+		if urlp, err := relativeURLPath(root, filename); err == nil && matchPath(urlp, opts.prefix, "") {
+			filenames <- filename
+		}
+	})
+	close(filenames)
+	wg.Wait()
+	return summary
+}
+
+// recordDigests records the digests of the mirrored file filename, unless
+// they are up to date. It returns the size of the file and whether it was
+// hashed.
+func (mir *Mirror) recordDigests(filename string, opts hashOptions) (int64, bool, error) {
+	before, err := os.Stat(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	if !opts.force && digestsUpToDate(mir.readMetadata(filename), opts.algorithms, before.ModTime()) {
+		return before.Size(), false, nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	hashes := make([]hash.Hash, len(opts.algorithms))
+	writers := make([]io.Writer, len(opts.algorithms))
+	for i, algorithm := range opts.algorithms {
+		hashes[i] = digestAlgorithms[algorithm].new()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return 0, false, err
+	}
+	after, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		return 0, false, errors.New("modified while hashing")
+	}
+	// The hashed time goes last, so that the digests are only up to date
+	// once all are recorded
+	names := make([]string, 0, len(opts.algorithms)+1)
+	values := make(map[string]string, len(opts.algorithms)+1)
+	for i, algorithm := range opts.algorithms {
+		name := digestAlgorithms[algorithm].xattr
+		names = append(names, name)
+		values[name] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	names = append(names, xattrHashed)
+	values[xattrHashed] = before.ModTime().UTC().Format(time.RFC3339Nano)
+	if opts.xattr {
+		err := updateImmutable(filename, func() error {
+			for _, name := range names {
+				if err := xattr.FSet(file, name, []byte(values[name])); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if opts.sidecar {
+		if err := mir.mergeMetadataFile(filename, values); err != nil {
+			return 0, false, err
+		}
+	}
+	return before.Size(), true, nil
+}
+
+// digestsUpToDate reports whether the metadata meta has all the digests of
+// algorithms, recorded since the file was last modified at mtime: by the
+// hash command, or by the handler when it mirrored the file
+func digestsUpToDate(meta map[string]string, algorithms []string, mtime time.Time) bool {
+	for _, algorithm := range algorithms {
+		if meta[digestAlgorithms[algorithm].xattr] == "" {
+			return false
+		}
+	}
+	if hashed, ok := meta[xattrHashed]; ok {
+		return hashed == mtime.UTC().Format(time.RFC3339Nano)
+	}
+	downloaded, err := time.Parse(time.RFC3339, meta[xattrDownloaded])
+	// The downloaded time is recorded with second precision
+	return err == nil && !mtime.After(downloaded.Add(time.Second))
+}
+
+// mergeMetadataFile sets the metadata values in the metadata sidecar file
+// of filename, keeping the others, and replaces it atomically
+func (mir *Mirror) mergeMetadataFile(filename string, values map[string]string) error {
+	meta := make(map[string]string)
+	data, err := os.ReadFile(filename + mir.MetadataFileSuffix)
+	if err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("reading metadata sidecar file: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	maps.Copy(meta, values)
+	data, err = json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return mir.writeFile(filename+mir.MetadataFileSuffix, append(data, '\n'))
+}
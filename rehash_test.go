@@ -0,0 +1,108 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashCommand(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("content")
+	sha256Sum := sha256.Sum256(content)
+	sha512Sum := sha512.Sum512(content)
+	// a.bin was mirrored without digest, b.bin with one
+	sidecars := map[string]map[string]string{
+		"a.bin": {xattrDownloaded: "2000-01-01T00:00:00Z"},
+		"b.bin": {
+			xattrDownloaded: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			xattrSha256:     "recorded",
+		},
+	}
+	for name, meta := range sidecars {
+		filename := filepath.Join(root, "dir", name)
+		os.MkdirAll(filepath.Dir(filename), 0o755)
+		data, _ := json.Marshal(meta)
+		if err := os.WriteFile(filename, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename+".meta", data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readSidecar := func(name string) map[string]string {
+		var meta map[string]string
+		data, _ := os.ReadFile(filepath.Join(root, "dir", name+".meta"))
+		json.Unmarshal(data, &meta)
+		return meta
+	}
+
+	steps := []struct {
+		name   string
+		before func()
+		args   []string
+		output string
+	}{
+		{name: "missing digests", output: "hashed 1 files, 7 B, 1 up to date"},
+		{name: "resumed", output: "hashed 0 files, 0 B, 2 up to date"},
+		{
+			name: "modified",
+			before: func() {
+				mtime := time.Now().Add(2 * time.Hour)
+				os.Chtimes(filepath.Join(root, "dir", "a.bin"), mtime, mtime)
+			},
+			output: "hashed 1 files, 7 B, 1 up to date",
+		},
+		{name: "more algorithms", args: []string{"--algorithms", "sha256,sha512", "--workers", "2"}, output: "hashed 2 files"},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		args := append([]string{"--root", root, "--metadata-suffix", ".meta", "--xattr=false", "--sidecar"}, step.args...)
+		output, err := runCommand(hashCommand(), args...)
+		if err != nil {
+			t.Fatalf("%s: %v:\n%s", step.name, err, output)
+		}
+		if !strings.Contains(output, step.output) {
+			t.Errorf("%s: expected %q in output, got %q", step.name, step.output, output)
+		}
+	}
+
+	for name := range sidecars {
+		meta := readSidecar(name)
+		if meta[xattrSha256] != hex.EncodeToString(sha256Sum[:]) || meta[xattrSha512] != hex.EncodeToString(sha512Sum[:]) {
+			t.Errorf("expected digests of %s recorded, got %v", name, meta)
+		}
+		if meta[xattrDownloaded] != sidecars[name][xattrDownloaded] {
+			t.Errorf("expected other metadata of %s kept, got %v", name, meta)
+		}
+	}
+}
+
+func TestHashCommandOptions(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.bin"), []byte("content"), 0o644)
+	os.WriteFile(filepath.Join(root, "file.bin.meta"), []byte("{}"), 0o644)
+	testCases := []struct {
+		args     []string
+		errorMsg string
+	}{
+		{args: []string{"--algorithms", "md5"}, errorMsg: "unknown digest algorithm"},
+		{args: []string{"--xattr=false"}, errorMsg: "--sidecar"},
+		{args: []string{"--sidecar", "--metadata-suffix", "", "--force"}, errorMsg: "requires --metadata-suffix"},
+	}
+	for _, test := range testCases {
+		args := append([]string{"--root", root, "--metadata-suffix", ".meta"}, test.args...)
+		_, err := runCommand(hashCommand(), args...)
+		if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+			t.Errorf("%v: expected error %q, got %v", test.args, test.errorMsg, err)
+		}
+	}
+}
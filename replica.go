@@ -0,0 +1,281 @@
+package mirror
+
+import (
+	"errors"
+	"expvar"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicaWorkers = 2
+
+	// replicaQueueSize is the number of copy jobs that may be waiting. When
+	// the queue is full, jobs are dropped and left to reconciliation.
+	replicaQueueSize = 1024
+
+	replicaAttempts       = 5
+	replicaInitialBackoff = time.Second
+	replicaMaxBackoff     = time.Minute
+)
+
+// replicaJob copies a mirrored file to a replica
+type replicaJob struct {
+	replica  string
+	root     string
+	filename string
+	queued   time.Time
+}
+
+// replicator copies mirrored files to the replicas in the background. It
+// is best-effort, failures never affect the primary copy.
+type replicator struct {
+	mir    *Mirror
+	logger *zap.Logger
+	jobs   chan replicaJob
+	stats  map[string]*replicaStats
+	// mu is held for reading while queueing jobs, and for writing to set
+	// stopped, after which no more jobs are queued
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// replicaStats are the counters of a replica, published with expvar as part
+// of the "mirror_replicas" map, keyed by the handler's name and the replica
+type replicaStats struct {
+	// pending is the number of files waiting to be copied
+	pending expvar.Int
+	copied  expvar.Int
+	// failures is the number of files that couldn't be copied
+	failures expvar.Int
+	// lagMs is the time between queueing and copying the last file
+	lagMs expvar.Int
+}
+
+var (
+	expvarReplicaStats  = expvar.NewMap("mirror_replicas")
+	handlerReplicaStats = make(map[[2]string]*replicaStats)
+	replicaStatsMu      sync.Mutex
+)
+
+// replicaStatsFor returns the stats published for replica under name,
+// creating them if needed
+func replicaStatsFor(name string, replica string) *replicaStats {
+	replicaStatsMu.Lock()
+	defer replicaStatsMu.Unlock()
+	if s, ok := handlerReplicaStats[[2]string{name, replica}]; ok {
+		return s
+	}
+	handler, ok := expvarReplicaStats.Get(name).(*expvar.Map)
+	if !ok {
+		handler = new(expvar.Map).Init()
+		expvarReplicaStats.Set(name, handler)
+	}
+	s := new(replicaStats)
+	m := new(expvar.Map).Init()
+	m.Set("pending", &s.pending)
+	m.Set("copied", &s.copied)
+	m.Set("failures", &s.failures)
+	m.Set("lag_ms", &s.lagMs)
+	handler.Set(replica, m)
+	handlerReplicaStats[[2]string{name, replica}] = s
+	return s
+}
+
+func newReplicator(mir *Mirror) *replicator {
+	rep := &replicator{
+		mir:    mir,
+		logger: mir.logger,
+		jobs:   make(chan replicaJob, replicaQueueSize),
+		stats:  make(map[string]*replicaStats),
+	}
+	for _, replica := range mir.Replicas {
+		rep.stats[replica] = replicaStatsFor(mir.Name, replica)
+	}
+	return rep
+}
+
+// run starts the workers, which stop when the handler is unloaded
+func (rep *replicator) run() {
+	workers := rep.mir.ReplicaWorkers
+	if workers <= 0 {
+		workers = defaultReplicaWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-rep.jobs:
+					rep.copy(job)
+				case <-rep.mir.done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// replicate queues copying filename within root to the replicas
+func (mir *Mirror) replicate(root string, filename string) {
+	if mir.replicator == nil {
+		return
+	}
+	for _, replica := range mir.Replicas {
+		mir.replicator.enqueue(replicaJob{replica: replica, root: root, filename: filename, queued: time.Now()}, false)
+	}
+}
+
+// enqueue queues job. Unless wait is set, the job is dropped if the queue is
+// full. The job is pending from here until it is done, whether it is copied,
+// dropped, or left in the queue when the handler is unloaded.
+func (rep *replicator) enqueue(job replicaJob, wait bool) bool {
+	rep.stats[job.replica].pending.Add(1)
+	queued := rep.send(job, wait)
+	if !queued {
+		rep.done(job)
+	}
+	return queued
+}
+
+// send sends job to the workers, unless stopped
+func (rep *replicator) send(job replicaJob, wait bool) bool {
+	rep.mu.RLock()
+	defer rep.mu.RUnlock()
+	if rep.stopped {
+		return false
+	}
+	if wait {
+		select {
+		case rep.jobs <- job:
+			return true
+		case <-rep.mir.done:
+			return false
+		}
+	}
+	select {
+	case rep.jobs <- job:
+		return true
+	default:
+		rep.logger.Warn("replication queue full, dropping file",
+			zap.String("replica", job.replica),
+			zap.String("path", job.filename))
+		return false
+	}
+}
+
+// done ends job being pending
+func (rep *replicator) done(job replicaJob) {
+	rep.stats[job.replica].pending.Add(-1)
+}
+
+// stop stops queueing jobs and ends those still queued, which are left to
+// reconciliation, so that the pending counts that outlive the handler don't
+// drift
+func (rep *replicator) stop() {
+	rep.mu.Lock()
+	rep.stopped = true
+	rep.mu.Unlock()
+	for {
+		select {
+		case job := <-rep.jobs:
+			rep.done(job)
+		default:
+			return
+		}
+	}
+}
+
+// copy copies the file of job to its replica, retrying with backoff
+func (rep *replicator) copy(job replicaJob) {
+	defer rep.done(job)
+	stats := rep.stats[job.replica]
+	rel, err := filepath.Rel(job.root, job.filename)
+	if err != nil {
+		rep.logger.Error("failed to replicate file", zap.String("path", job.filename), zap.Error(err))
+		stats.failures.Add(1)
+		return
+	}
+	target := filepath.Join(job.replica, rel)
+	backoff := replicaInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = rep.copyFiles(job.replica, job.filename, target)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			// A file that is gone, e.g. evicted, doesn't need to be copied
+			break
+		}
+		if attempt == replicaAttempts {
+			rep.logger.Error("failed to replicate file, giving up",
+				zap.String("replica", job.replica),
+				zap.String("path", job.filename),
+				zap.Int("attempts", attempt),
+				zap.Error(err))
+			stats.failures.Add(1)
+			return
+		}
+		rep.logger.Warn("failed to replicate file, retrying",
+			zap.String("replica", job.replica),
+			zap.String("path", job.filename),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-rep.mir.done:
+			return
+		}
+		backoff = min(2*backoff, replicaMaxBackoff)
+	}
+	if err == nil {
+		stats.copied.Add(1)
+		stats.lagMs.Set(time.Since(job.queued).Milliseconds())
+		rep.mir.trace(rep.logger, "replicated file",
+			zap.String("replica", job.replica),
+			zap.String("path", job.filename))
+	}
+}
+
+// copyFiles copies filename to target within replica, followed by its
+// sidecar files
+func (rep *replicator) copyFiles(replica string, filename string, target string) error {
+	if err := rep.mir.copyFile(replica, filename, target); err != nil {
+		return err
+	}
+	for _, suffix := range rep.mir.sidecarSuffixes(filename) {
+		if err := rep.mir.copyFile(replica, filename+suffix, target+suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile queues copying the files of root missing from the replicas
+func (rep *replicator) reconcile(root string) {
+	queued := 0
+	err := rep.mir.walkEntries(root, func(filename string, d fs.DirEntry) {
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return
+		}
+		for _, replica := range rep.mir.Replicas {
+			if _, err := os.Lstat(filepath.Join(replica, rel)); !errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if !rep.enqueue(replicaJob{replica: replica, root: root, filename: filename, queued: time.Now()}, true) {
+				return
+			}
+			queued++
+		}
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		rep.logger.Error("failed to reconcile replicas", zap.String("root", root), zap.Error(err))
+		return
+	}
+	if queued > 0 {
+		rep.logger.Info("copying files missing from replicas",
+			zap.String("root", root),
+			zap.Int("files", queued))
+	}
+}
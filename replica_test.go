@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitReplicated waits until copied files have been copied to replica
+func waitReplicated(t *testing.T, mir *Mirror, replica string, copied int64) {
+	t.Helper()
+	stats := mir.replicator.stats[replica]
+	deadline := time.Now().Add(time.Second)
+	for stats.copied.Value() < copied || stats.pending.Value() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d files copied to %s, got %d", copied, replica, stats.copied.Value())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	root := t.TempDir()
+	replicas := []string{t.TempDir(), t.TempDir()}
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", PreserveMtime: true, Replicas: replicas})
+	lastModified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_, err := serveMirror(mir, "/dir/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, replica := range replicas {
+		waitReplicated(t, mir, replica, 1)
+		for name, expected := range map[string]string{"file.txt": "content", "file.txt.etag": `"v1"`} {
+			content, err := os.ReadFile(filepath.Join(replica, "dir", name))
+			if err != nil || string(content) != expected {
+				t.Errorf("expected %s to be replicated with %q, got %q, error: %v", name, expected, content, err)
+			}
+		}
+		if stat, err := os.Stat(filepath.Join(replica, "dir", "file.txt")); err != nil || !stat.ModTime().Equal(lastModified) {
+			t.Errorf("mtime not preserved in replica, stat: %v, error: %v", stat, err)
+		}
+	}
+}
+
+func TestReplicaFailure(t *testing.T) {
+	root := t.TempDir()
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, Replicas: []string{filepath.Join(notADir, "replica")}})
+	_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(content) != "content" {
+		t.Errorf("failing replica affected primary copy %q, error: %v", content, err)
+	}
+}
+
+func TestReplicaReconcile(t *testing.T) {
+	root := t.TempDir()
+	replica := t.TempDir()
+	for name, content := range map[string]string{"missing.txt": "primary", "present.txt": "primary", ".hidden": "primary"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), filePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(replica, "present.txt"), []byte("replica"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, Replicas: []string{replica}})
+	waitReplicated(t, mir, replica, 1)
+	for name, expected := range map[string]string{"missing.txt": "primary", "present.txt": "replica"} {
+		if content, err := os.ReadFile(filepath.Join(replica, name)); err != nil || string(content) != expected {
+			t.Errorf("expected %s in replica to be %q, got %q, error: %v", name, expected, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(replica, ".hidden")); err == nil {
+		t.Error("hidden file replicated")
+	}
+}
+
+func TestReplicaPendingOnUnload(t *testing.T) {
+	replica := t.TempDir()
+	mir := &Mirror{Name: "replica_pending_test", Replicas: []string{replica}, logger: zap.NewNop(), done: make(chan struct{})}
+	// The workers aren't run, so that the jobs stay queued
+	rep := newReplicator(mir)
+	for i := 0; i < 3; i++ {
+		rep.enqueue(replicaJob{replica: replica, root: t.TempDir(), filename: "file.txt", queued: time.Now()}, false)
+	}
+	if pending := rep.stats[replica].pending.Value(); pending != 3 {
+		t.Fatalf("expected 3 pending files, got %d", pending)
+	}
+	rep.stop()
+	if rep.enqueue(replicaJob{replica: replica, filename: "late.txt", queued: time.Now()}, false) {
+		t.Error("job queued after stopping")
+	}
+	if pending := rep.stats[replica].pending.Value(); pending != 0 {
+		t.Errorf("expected no pending files once unloaded, got %d", pending)
+	}
+}
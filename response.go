@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ResponseMeta configures storing what it takes to replay the response of
+// a mirrored file, in a JSON sidecar file with the suffix `.response.json`:
+// its status, selected headers and its trailers. ReadResponse reconstructs
+// the response from the file and its sidecar.
+type ResponseMeta struct {
+	// Response headers to store. Cookie and authentication headers are
+	// never stored. Default is the headers describing the content, such
+	// as Content-Type, Cache-Control and Last-Modified.
+	Headers []string `json:"headers,omitempty"`
+}
+
+const (
+	// ResponseMetaSuffix is the file name suffix of response sidecar files
+	ResponseMetaSuffix = ".response.json"
+
+	// responseMetaVersion is the version of the format of response sidecar
+	// files
+	responseMetaVersion = 1
+)
+
+var defaultResponseMetaHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Digest",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Link",
+	"Vary",
+}
+
+// privateHeaders are never stored, whatever headers are configured
+var privateHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Set-Cookie":          true,
+	"Www-Authenticate":    true,
+}
+
+// responseMeta is the content of response sidecar files
+type responseMeta struct {
+	Version int         `json:"version"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Trailer http.Header `json:"trailer,omitempty"`
+}
+
+func (rm *ResponseMeta) headers() []string {
+	if rm.Headers != nil {
+		return rm.Headers
+	}
+	return defaultResponseMetaHeaders
+}
+
+// responseMeta returns the replayable parts of the response
+func (rww *responseWriterWrapper) responseMeta() responseMeta {
+	header := rww.Header()
+	meta := responseMeta{
+		Version: responseMetaVersion,
+		// Only 200 responses are mirrored
+		Status: http.StatusOK,
+		Header: make(http.Header),
+	}
+	declared := make(map[string]bool)
+	for _, name := range declaredTrailers(header) {
+		declared[name] = true
+	}
+	for _, name := range rww.config.StoreResponseMeta.headers() {
+		name = http.CanonicalHeaderKey(name)
+		if values := header.Values(name); len(values) > 0 && !declared[name] && !privateHeaders[name] {
+			meta.Header[name] = values
+		}
+	}
+	for name, values := range rww.trailers {
+		if !privateHeaders[name] {
+			if meta.Trailer == nil {
+				meta.Trailer = make(http.Header)
+			}
+			meta.Trailer[name] = values
+		}
+	}
+	return meta
+}
+
+// writeResponseMeta writes the response to a pending response sidecar file,
+// if configured
+func (rww *responseWriterWrapper) writeResponseMeta() {
+	if rww.config.StoreResponseMeta == nil {
+		return
+	}
+	file, err := rww.createPending(rww.pending + ResponseMetaSuffix)
+	if err != nil {
+		rww.logger.Error("failed to create response meta temp file, continuing without writing response sidecar file",
+			zap.Error(err))
+		rww.spanFailure("failed to create response meta temp file", err)
+		return
+	}
+	err = json.NewEncoder(file).Encode(rww.responseMeta())
+	if err != nil {
+		rww.logger.Error("failed to write temp response meta file",
+			zap.Error(err))
+		rww.spanFailure("failed to write temp response meta file", err)
+		file.Cleanup()
+		return
+	}
+	rww.responseFile = file
+}
+
+// ReadResponse reconstructs the response a file was mirrored from, out of
+// the file, its body, and its response sidecar file, written with
+// store_response_meta. The body must be closed by the caller.
+func ReadResponse(filename string) (*http.Response, error) {
+	data, err := os.ReadFile(filename + ResponseMetaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var meta responseMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("parsing response sidecar file: %w", err)
+	}
+	if meta.Version != responseMetaVersion {
+		return nil, fmt.Errorf("unsupported response sidecar file version %d", meta.Version)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, ErrNotRegular
+	}
+	header := meta.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	return &http.Response{
+		Status:        strconv.Itoa(meta.Status) + " " + http.StatusText(meta.Status),
+		StatusCode:    meta.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Trailer:       meta.Trailer,
+		Body:          file,
+		ContentLength: stat.Size(),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadResponse(t *testing.T) {
+	testCases := []struct {
+		name            string
+		headers         []string
+		expectedHeader  http.Header
+		expectedTrailer http.Header
+	}{
+		{
+			name: "default headers",
+			expectedHeader: http.Header{
+				"Content-Type":   {"text/plain"},
+				"Cache-Control":  {"max-age=60"},
+				"Content-Length": {"7"},
+			},
+			expectedTrailer: http.Header{"Content-Digest": {"sha-256=:7XACtDnprIRfIjV9giusFERzD722AW0+yUMil7nsn3M=:"}},
+		},
+		{
+			name:    "allowlist",
+			headers: []string{"X-Custom", "Set-Cookie", "content-type"},
+			expectedHeader: http.Header{
+				"Content-Type":   {"text/plain"},
+				"X-Custom":       {"a", "b"},
+				"Content-Length": {"7"},
+			},
+			expectedTrailer: http.Header{"Content-Digest": {"sha-256=:7XACtDnprIRfIjV9giusFERzD722AW0+yUMil7nsn3M=:"}},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, StoreResponseMeta: &ResponseMeta{Headers: test.headers}})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Add("X-Custom", "a")
+				w.Header().Add("X-Custom", "b")
+				w.Header().Set("Set-Cookie", "session=secret")
+				w.Header().Set("Trailer", "Content-Digest")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				w.Header().Set("Content-Digest", "sha-256=:7XACtDnprIRfIjV9giusFERzD722AW0+yUMil7nsn3M=:")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := ReadResponse(filepath.Join(root, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || string(body) != "content" {
+				t.Errorf("expected body %q, got %q, error: %v", "content", body, err)
+			}
+			if resp.StatusCode != http.StatusOK || resp.ContentLength != 7 {
+				t.Errorf("expected status 200 and length 7, got %d and %d", resp.StatusCode, resp.ContentLength)
+			}
+			if !reflect.DeepEqual(resp.Header, test.expectedHeader) {
+				t.Errorf("expected header %v, got %v", test.expectedHeader, resp.Header)
+			}
+			if !reflect.DeepEqual(resp.Trailer, test.expectedTrailer) {
+				t.Errorf("expected trailer %v, got %v", test.expectedTrailer, resp.Trailer)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// partialResume is an attempt to resume mirroring a file from its partial
+// file, by only requesting the missing bytes from upstream
+type partialResume struct {
+	file *os.File
+	info partialInfo
+}
+
+// resumable returns the partial file of filename to resume mirroring from,
+// or nil if there is none that can be resumed. Resuming requires a strong
+// ETag for If-Range and a known length, and is only attempted for clients
+// requesting the whole file.
+func (mir *Mirror) resumable(r *http.Request, filename string, logger *zap.Logger) *partialResume {
+	if mir.KeepPartials == nil || r.Header.Get("Range") != "" {
+		return nil
+	}
+	infoJSON, err := os.ReadFile(filename + partialInfoSuffix)
+	if err != nil {
+		return nil
+	}
+	var info partialInfo
+	if err := json.Unmarshal(infoJSON, &info); err != nil {
+		logger.Error("invalid partial info file", zap.Error(err))
+		return nil
+	}
+	if info.Etag == "" || isWeakEtag(info.Etag) ||
+		info.BytesReceived <= 0 || info.BytesExpected <= info.BytesReceived {
+		return nil
+	}
+	file, err := os.Open(filename + partialSuffix)
+	if err != nil {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != info.BytesReceived {
+		// Can't be trusted to be what the info file says
+		file.Close()
+		return nil
+	}
+	return &partialResume{file: file, info: info}
+}
+
+// request returns a copy of r that asks upstream for the missing bytes only
+func (pr *partialResume) request(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-", pr.info.BytesReceived))
+	r.Header.Set("If-Range", pr.info.Etag)
+	return r
+}
+
+// parseContentRange parses a Content-Range header of a single byte range
+// with a known complete length, e.g. `bytes 100-999/1000`
+func parseContentRange(value string) (first, last, length int64, ok bool) {
+	unit, rangeResp, found := strings.Cut(strings.TrimSpace(value), " ")
+	if !found || !strings.EqualFold(unit, "bytes") {
+		return 0, 0, 0, false
+	}
+	byteRange, lengthText, found := strings.Cut(rangeResp, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	firstText, lastText, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if first, err = strconv.ParseInt(firstText, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if last, err = strconv.ParseInt(lastText, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if length, err = strconv.ParseInt(lengthText, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if first < 0 || last < first || length <= last {
+		return 0, 0, 0, false
+	}
+	return first, last, length, true
+}
+
+// resumeHeader handles the response to a resumed request before its header
+// is written, and returns the status code to write instead. A 206 that
+// continues the partial file exactly is turned into a 200 for the whole
+// file, which the partial file is replayed into once the header has been
+// written. A 200 means upstream sent the whole file, e.g. because it has
+// changed, so the partial file is dropped. Otherwise, the response can't be
+// used and the request has to be retried without resuming.
+func (rww *responseWriterWrapper) resumeHeader(statusCode int) int {
+	info := rww.resume.info
+	switch statusCode {
+	case http.StatusPartialContent:
+		header := rww.Header()
+		first, last, length, ok := parseContentRange(header.Get("Content-Range"))
+		etag := header.Get("ETag")
+		if !ok || first != info.BytesReceived || last != length-1 || length != info.BytesExpected ||
+			(etag != "" && !etagsMatch(etag, info.Etag, false)) {
+			rww.logger.Debug("partial content doesn't continue partial file",
+				zap.String("content_range", header.Get("Content-Range")),
+				zap.String("etag", etag))
+			rww.dropResume(true)
+			return statusCode
+		}
+		rww.config.trace(rww.logger, "resuming from partial file",
+			zap.Int64("bytes_received", info.BytesReceived))
+		header.Del("Content-Range")
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+		return http.StatusOK
+	case http.StatusOK:
+		rww.dropResume(false)
+	case http.StatusRequestedRangeNotSatisfiable:
+		rww.dropResume(true)
+	default:
+		// Keep the partial file around for another attempt
+		rww.resume = nil
+	}
+	return statusCode
+}
+
+// dropResume gives up on resuming, removing the partial file. If retry is
+// set, the response is swallowed so that the request can be retried.
+func (rww *responseWriterWrapper) dropResume(retry bool) {
+	rww.resume = nil
+	rww.retry = retry
+	if err := removePartial(pathInsideRoot(rww.root, rww.path)); err != nil {
+		rww.logger.Error("failed to remove partial file", zap.Error(err))
+	}
+}
+
+// replayPartial writes the content of the partial file being resumed, to
+// both the client and the mirror file
+func (rww *responseWriterWrapper) replayPartial() {
+	pr := rww.resume
+	rww.resume = nil
+	n, err := io.Copy(writerFunc(rww.Write), io.NewSectionReader(pr.file, 0, pr.info.BytesReceived))
+	if err == nil && n != pr.info.BytesReceived {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		rww.logger.Error("failed to replay partial file", zap.Error(err))
+	}
+}
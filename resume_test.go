@@ -0,0 +1,202 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	testCases := []struct {
+		value               string
+		first, last, length int64
+		ok                  bool
+	}{
+		{value: "bytes 100-999/1000", first: 100, last: 999, length: 1000, ok: true},
+		{value: "bytes 0-0/1", first: 0, last: 0, length: 1, ok: true},
+		{value: "bytes 100-999/*", ok: false},
+		{value: "bytes */1000", ok: false},
+		{value: "bytes 100-1000/1000", ok: false},
+		{value: "bytes 999-100/1000", ok: false},
+		{value: "items 100-999/1000", ok: false},
+		{value: "", ok: false},
+	}
+	for i, test := range testCases {
+		first, last, length, ok := parseContentRange(test.value)
+		if ok != test.ok || (ok && (first != test.first || last != test.last || length != test.length)) {
+			t.Errorf("Test %d (%s) - expected %d-%d/%d (ok: %v), got %d-%d/%d (ok: %v)",
+				i, test.value, test.first, test.last, test.length, test.ok, first, last, length, ok)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	const content = "hello world"
+	const received = 6
+	testCases := []struct {
+		name string
+		// respond is the upstream response to a request for the given range,
+		// empty for the whole file
+		respond func(w http.ResponseWriter, rangeHeader string)
+		// mirrored is the expected content of the mirrored file, empty if none
+		mirrored string
+		// partial is the expected number of bytes in the partial file
+		// afterwards, 0 if there is none
+		partial  int64
+		requests int
+	}{
+		{
+			name: "resumed",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Range", "bytes 6-10/11")
+				w.Header().Set("Content-Length", "5")
+				// Only matches if the hash includes the replayed partial file
+				w.Header().Set("Trailer", "Repr-Digest")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content[received:]))
+				sum := sha256.Sum256([]byte(content))
+				w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+			},
+			mirrored: content,
+			requests: 1,
+		},
+		{
+			name: "changed",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				w.Header().Set("ETag", `"v2"`)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("new content"))
+			},
+			mirrored: "new content",
+			requests: 1,
+		},
+		{
+			name: "short read",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Range", "bytes 6-10/11")
+				w.Header().Set("Content-Length", "5")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content[received : received+2]))
+			},
+			partial:  received + 2,
+			requests: 1,
+		},
+		{
+			name: "wrong offset",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				w.Header().Set("ETag", `"v1"`)
+				if rangeHeader == "" {
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(content))
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 5-10/11")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content[5:]))
+			},
+			mirrored: content,
+			requests: 2,
+		},
+		{
+			name: "etag changed",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				if rangeHeader == "" {
+					w.Header().Set("ETag", `"v2"`)
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte("new content"))
+					return
+				}
+				w.Header().Set("ETag", `"v2"`)
+				w.Header().Set("Content-Range", "bytes 6-10/11")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("ntent"))
+			},
+			mirrored: "new content",
+			requests: 2,
+		},
+		{
+			name: "range not satisfiable",
+			respond: func(w http.ResponseWriter, rangeHeader string) {
+				if rangeHeader == "" {
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(content))
+					return
+				}
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			mirrored: content,
+			requests: 2,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			filename := filepath.Join(root, "file.txt")
+			if err := os.WriteFile(filename+partialSuffix, []byte(content[:received]), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			info, _ := json.Marshal(partialInfo{BytesReceived: received, BytesExpected: int64(len(content)), Etag: `"v1"`})
+			if err := os.WriteFile(filename+partialInfoSuffix, info, filePerms); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, KeepPartials: &KeepPartials{MinSize: 1}})
+			requests := 0
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				requests++
+				rangeHeader := r.Header.Get("Range")
+				if requests == 1 && (rangeHeader != "bytes=6-" || r.Header.Get("If-Range") != `"v1"`) {
+					t.Errorf("expected upstream request to resume, got Range %q, If-Range %q",
+						rangeHeader, r.Header.Get("If-Range"))
+				}
+				if requests > 1 && rangeHeader != "" {
+					t.Errorf("expected retry without Range, got %q", rangeHeader)
+				}
+				test.respond(w, rangeHeader)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if requests != test.requests {
+				t.Errorf("expected %d upstream requests, got %d", test.requests, requests)
+			}
+			if test.mirrored != "" {
+				if rec.Code != http.StatusOK || rec.Body.String() != test.mirrored {
+					t.Errorf("expected client to receive 200 %q, got %d %q", test.mirrored, rec.Code, rec.Body.String())
+				}
+				if cl := rec.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(test.mirrored)) {
+					t.Errorf("unexpected Content-Length %s", cl)
+				}
+				if cr := rec.Header().Get("Content-Range"); cr != "" {
+					t.Errorf("unexpected Content-Range %s", cr)
+				}
+				mirrored, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(mirrored) != test.mirrored {
+					t.Errorf("expected mirrored content %q, got %q", test.mirrored, mirrored)
+				}
+			} else if _, err := os.Stat(filename); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected no mirrored file, stat error: %v", err)
+			}
+			stat, err := os.Stat(filename + partialSuffix)
+			if test.partial == 0 {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected partial file to be removed, stat error: %v", err)
+				}
+			} else if err != nil || stat.Size() != test.partial {
+				t.Errorf("expected partial file of %d bytes, got %v %v", test.partial, stat, err)
+			}
+		})
+	}
+}
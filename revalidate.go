@@ -0,0 +1,167 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StaleWhileRevalidate configures serving stale local copies immediately,
+// while fetching a fresh copy through the next handler in the background,
+// so that later requests get fresh content. Whether a local copy is fresh
+// is decided by the read_through policy applying to the request, or else
+// by the expiry time recorded from the response's caching headers.
+type StaleWhileRevalidate struct {
+	// Don't refresh local copies mirrored less than this long ago, only
+	// serve them.
+	MinAge caddy.Duration `json:"min_age,omitempty"`
+
+	// Maximum number of background refreshes at the same time. Stale local
+	// copies are served without being refreshed beyond that. Default is 4.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+const defaultRefreshConcurrency = 4
+
+// refresher runs background refreshes, at most one per file at a time
+type refresher struct {
+	mir      *Mirror
+	sem      chan struct{}
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+	wg       sync.WaitGroup
+}
+
+func newRefresher(mir *Mirror, concurrency int) *refresher {
+	if concurrency <= 0 {
+		concurrency = defaultRefreshConcurrency
+	}
+	return &refresher{
+		mir:      mir,
+		sem:      make(chan struct{}, concurrency),
+		inFlight: make(map[string]struct{}),
+	}
+}
+
+// refresh fetches r again through next in the background, mirroring the
+// response to filename within root. It reports whether the refresh was
+// started, which it isn't if one is already running for filename or too
+// many are running.
+func (rf *refresher) refresh(r *http.Request, next caddyhttp.Handler, root string, filename string, logger *zap.Logger) bool {
+	select {
+	case rf.sem <- struct{}{}:
+	default:
+		logger.Debug("too many background refreshes, skipping")
+		return false
+	}
+	rf.mu.Lock()
+	if _, ok := rf.inFlight[filename]; ok {
+		rf.mu.Unlock()
+		<-rf.sem
+		return false
+	}
+	rf.inFlight[filename] = struct{}{}
+	rf.mu.Unlock()
+
+	w := newBackgroundResponseWriter()
+	req, cancel := rf.mir.backgroundRequest(r, w)
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		defer func() {
+			cancel()
+			rf.mu.Lock()
+			delete(rf.inFlight, filename)
+			rf.mu.Unlock()
+			<-rf.sem
+		}()
+		start := time.Now()
+		_, err := rf.mir.policyFor(req).mirrorResponse(w, req, next, root, logger, nil)
+		if err == nil && w.status != http.StatusOK {
+			logger.Warn("background refresh failed",
+				zap.Int("status", w.status),
+				zap.Duration("duration", time.Since(start)))
+			return
+		}
+		if err != nil {
+			logger.Warn("background refresh failed",
+				zap.Duration("duration", time.Since(start)),
+				zap.Error(err))
+			return
+		}
+		logger.Debug("refreshed local copy in background",
+			zap.Duration("duration", time.Since(start)))
+	}()
+	return true
+}
+
+// backgroundRequest returns a copy of r for fetching the same file through
+// the handler chain in the background, writing to w. It isn't canceled
+// along with r, but when the handler is unloaded or cancel is called, and
+// it has its own replacer and vars, so that it doesn't race with r.
+// Conditional and range headers of the client are removed, so that the
+// full file is fetched.
+func (mir *Mirror) backgroundRequest(r *http.Request, w http.ResponseWriter) (req *http.Request, cancel context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	if mir.done != nil {
+		done := mir.done
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	req = r.Clone(ctx)
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+	vars, _ := r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)
+	server, _ := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), w, server)
+	for key, value := range vars {
+		caddyhttp.SetVar(req.Context(), key, value)
+	}
+	return req, cancel
+}
+
+// backgroundResponseWriter is the response writer of background requests,
+// which discards the response, only recording its status code
+type backgroundResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func newBackgroundResponseWriter() *backgroundResponseWriter {
+	return &backgroundResponseWriter{header: make(http.Header)}
+}
+
+func (dw *backgroundResponseWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *backgroundResponseWriter) Write(p []byte) (int, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (dw *backgroundResponseWriter) WriteHeader(statusCode int) {
+	if dw.status == 0 {
+		dw.status = statusCode
+	}
+}
+
+func (dw *backgroundResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	return io.Copy(io.Discard, r)
+}
@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		minAge    time.Duration
+		refreshed bool
+	}{
+		{name: "refresh", refreshed: true},
+		{name: "within min_age", minAge: time.Hour},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{
+				Root:                 root,
+				MetadataFileSuffix:   ".meta",
+				StaleWhileRevalidate: &StaleWhileRevalidate{MinAge: caddy.Duration(test.minAge)},
+			})
+			var calls atomic.Int32
+			release := make(chan struct{})
+			next := func(w http.ResponseWriter, r *http.Request) error {
+				n := calls.Add(1)
+				if n > 1 {
+					// Refreshes only complete once the stale copies are served
+					<-release
+				}
+				w.Header().Set("Cache-Control", "max-age=0")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, "v%d", n)
+				return nil
+			}
+			if _, err := serveMirror(mir, "/file.txt", next); err != nil {
+				t.Fatal(err)
+			}
+
+			// Concurrent requests for the same stale file start a single refresh
+			for range 2 {
+				rec, err := serveMirror(mir, "/file.txt", next)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rec.Body.String() != "v1" || rec.Header().Get("X-Mirror-Stale") != "true" {
+					t.Errorf("expected stale copy v1, got %q, X-Mirror-Stale %q", rec.Body.String(), rec.Header().Get("X-Mirror-Stale"))
+				}
+			}
+			close(release)
+			mir.refresher.wg.Wait()
+
+			content, err := os.ReadFile(filepath.Join(root, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, expectedCalls := "v1", int32(1)
+			if test.refreshed {
+				expected, expectedCalls = "v2", 2
+			}
+			if string(content) != expected || calls.Load() != expectedCalls {
+				t.Errorf("expected %q after %d calls, got %q after %d", expected, expectedCalls, content, calls.Load())
+			}
+		})
+	}
+}
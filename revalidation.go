@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"net/http"
+	"os"
+)
+
+// conditionalHeaders are the request headers that make a request
+// conditional or partial
+var conditionalHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// revalidationRequest returns a copy of r asking upstream to only send the
+// file if it differs from the local copy filename: with If-None-Match from
+// its stored ETag, and If-Modified-Since from its recorded Last-Modified
+// time, or else its mtime kept by preserve_mtime when no metadata was
+// recorded. The time of download is never used for If-Modified-Since, as a
+// clock ahead of upstream's would make changed files look unmodified. It
+// returns nil if the local copy has no validator, or if r is conditional
+// itself, in which case upstream's answer is meant for the client.
+func (mir *Mirror) revalidationRequest(r *http.Request, filename string) *http.Request {
+	for _, name := range conditionalHeaders {
+		if r.Header.Get(name) != "" {
+			return nil
+		}
+	}
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+	if mir.KeepPartials != nil && isPartialFile(filename) {
+		return nil
+	}
+	meta := mir.readMetadata(filename)
+	etag := mir.storedEtag(filename, mir.etagSuffix(r), meta)
+	lastModified := meta[xattrLastModified]
+	if lastModified == "" && mir.PreserveMtime && meta[xattrDownloaded] == "" {
+		// Metadata recorded without Last-Modified would mean that mtime
+		// is the time of download
+		lastModified = stat.ModTime().UTC().Format(http.TimeFormat)
+	}
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	r = r.Clone(r.Context())
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return r
+}
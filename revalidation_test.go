@@ -0,0 +1,191 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevalidate(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	testCases := []struct {
+		name          string
+		etag          string
+		lastModified  string
+		ignoreHeaders bool
+		// expected validators sent upstream
+		ifNoneMatch     string
+		ifModifiedSince string
+		expected        string
+	}{
+		{name: "etag", etag: `"v1"`, ifNoneMatch: `"v1"`, expected: "v1"},
+		{name: "last modified", lastModified: lastModified, ifModifiedSince: lastModified, expected: "v1"},
+		{name: "both", etag: `"v1"`, lastModified: lastModified, ifNoneMatch: `"v1"`, ifModifiedSince: lastModified, expected: "v1"},
+		{name: "no validators", expected: "v2"},
+		{name: "upstream ignores validators", etag: `"v1"`, ignoreHeaders: true, ifNoneMatch: `"v1"`, expected: "v2"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MetadataFileSuffix: ".meta", Revalidate: true})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if test.etag != "" {
+					w.Header().Set("ETag", test.etag)
+				}
+				if test.lastModified != "" {
+					w.Header().Set("Last-Modified", test.lastModified)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("v1"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if r.Header.Get("If-None-Match") != test.ifNoneMatch || r.Header.Get("If-Modified-Since") != test.ifModifiedSince {
+					t.Errorf("unexpected validators If-None-Match %q, If-Modified-Since %q",
+						r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"))
+				}
+				if (test.ifNoneMatch != "" || test.ifModifiedSince != "") && !test.ignoreHeaders {
+					w.Header().Set("X-Upstream", "304")
+					w.WriteHeader(http.StatusNotModified)
+					return nil
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("v2"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != test.expected {
+				t.Errorf("expected %q, got %d %q", test.expected, rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("X-Upstream") != "" {
+				t.Error("header of swallowed 304 response leaked")
+			}
+			if content, err := os.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(content) != test.expected {
+				t.Errorf("expected local copy %q, got %q, error: %v", test.expected, content, err)
+			}
+		})
+	}
+}
+
+func TestRevalidateConditionalClient(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Revalidate: true})
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("v1"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.txt.etag"), []byte(`"v1"`), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	req.Header.Set("If-None-Match", `"client"`)
+	rec := httptest.NewRecorder()
+	err := mir.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("If-None-Match") != `"client"` {
+			t.Errorf("client validator replaced with %q", r.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 passed on to client, got %d", rec.Code)
+	}
+}
+
+func TestRevalidateDigestEtag(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ifNoneMatch string
+		upstream    string
+	}{
+		{name: "only synthesized", ifNoneMatch: `"sha256-0123456789abcdef0123456789abcdef"`, upstream: `"v1"`},
+		{name: "mixed", ifNoneMatch: `"client", W/"sha256-0123456789abcdef0123456789abcdef"`, upstream: `"client"`},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Revalidate: true})
+			if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("v1"), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "file.txt.etag"), []byte(`"v1"`), filePerms); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+			rec := httptest.NewRecorder()
+			err := mir.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if got := r.Header.Get("If-None-Match"); got != test.upstream {
+					t.Errorf("expected If-None-Match %q upstream, got %q", test.upstream, got)
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Header.Get("If-None-Match") != test.ifNoneMatch {
+				t.Errorf("client request modified: %q", req.Header.Get("If-None-Match"))
+			}
+		})
+	}
+}
+
+func TestRevalidatePreservedMtime(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, PreserveMtime: true, Revalidate: true})
+	serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Last-Modified", lastModified)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("v1"))
+		return nil
+	})
+	rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("If-Modified-Since") != lastModified {
+			t.Errorf("expected If-Modified-Since %q from the preserved mtime, got %q", lastModified, r.Header.Get("If-Modified-Since"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	})
+	if err != nil || rec.Body.String() != "v1" {
+		t.Errorf("expected local copy served, got %q, error: %v", rec.Body.String(), err)
+	}
+}
+
+func TestRevalidateRefreshesExpiry(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MetadataFileSuffix: ".meta", Revalidate: true})
+	serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("v1"))
+		return nil
+	})
+	serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	})
+	expires, err := time.Parse(time.RFC3339, mir.readMetadata(filepath.Join(root, "file.txt"))[xattrExpires])
+	if err != nil || expires.Before(time.Now().Add(time.Hour-time.Minute)) {
+		t.Errorf("expected expiry refreshed from the 304, got %v, error: %v", expires, err)
+	}
+}
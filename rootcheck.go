@@ -0,0 +1,104 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rootChecks caches whether the roots expanded from a Root with placeholders
+// are writable, as they can only be checked on first use
+type rootChecks struct {
+	mir     *Mirror
+	mu      sync.Mutex
+	results map[string]*rootCheck
+}
+
+// rootCheck is the result of checking a root
+type rootCheck struct {
+	// done is closed once the check has completed
+	done chan struct{}
+	err  error
+	at   time.Time
+}
+
+// rootCheckFailureTTL is how long a failed check of a root is cached for,
+// after which the root is checked again
+const rootCheckFailureTTL = time.Minute
+
+// errRootChecking is returned for a root while it is being checked by
+// another request
+var errRootChecking = errors.New("mirror root is being checked")
+
+// checkRoot verifies that root exists or can be created, and that files can
+// be written to and removed from it
+func checkRoot(root string) error {
+	if err := probeRoot(root); err != nil {
+		return fmt.Errorf("mirror root %s is not writable: %w", root, err)
+	}
+	return nil
+}
+
+// check returns the cached result of checking root, checking it first if it
+// hasn't been yet, or if it failed over rootCheckFailureTTL ago. The check
+// runs without holding the lock, so that a root with slow storage doesn't
+// hold up requests to others. Requests to the root meanwhile get
+// errRootChecking rather than waiting for it. Failures are logged once per
+// check.
+func (rc *rootChecks) check(root string, logger *zap.Logger) error {
+	rc.mu.Lock()
+	result, ok := rc.results[root]
+	if ok {
+		select {
+		case <-result.done:
+			if result.err == nil || time.Since(result.at) < rootCheckFailureTTL {
+				rc.mu.Unlock()
+				return result.err
+			}
+		default:
+			rc.mu.Unlock()
+			return errRootChecking
+		}
+	}
+	if rc.results == nil {
+		rc.results = make(map[string]*rootCheck)
+	}
+	result = &rootCheck{done: make(chan struct{})}
+	rc.results[root] = result
+	rc.mu.Unlock()
+
+	err := checkRoot(root)
+	if errors.Is(err, syscall.EROFS) {
+		rc.mir.enterReadOnly(err)
+	} else if err != nil {
+		logger.Error("not mirroring to root", zap.Error(err))
+	}
+	rc.mu.Lock()
+	result.err, result.at = err, time.Now()
+	close(result.done)
+	rc.mu.Unlock()
+	return err
+}
+
+// isReadOnly reports whether the handler must not write to the root
+func (mir *Mirror) isReadOnly() bool {
+	return mir.readOnly != nil && mir.readOnly.Load()
+}
+
+// enterReadOnly switches the handler to read-only mode after err showed the
+// root to be on a read-only filesystem
+func (mir *Mirror) enterReadOnly(err error) {
+	if mir.readOnly.CompareAndSwap(false, true) {
+		mir.logger.Warn("mirror root is on a read-only filesystem, passing responses through",
+			zap.Error(err))
+	}
+}
+
+// hasPlaceholders reports whether s contains Caddy placeholders
+func hasPlaceholders(s string) bool {
+	return strings.Contains(s, "{")
+}
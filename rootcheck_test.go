@@ -0,0 +1,149 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStartupCheck(t *testing.T) {
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		mir   Mirror
+		fails bool
+	}{
+		{name: "writable", mir: Mirror{Root: t.TempDir()}},
+		{name: "created", mir: Mirror{Root: filepath.Join(t.TempDir(), "new", "root")}},
+		{name: "not writable", mir: Mirror{Root: filepath.Join(notADir, "root")}, fails: true},
+		{name: "skipped", mir: Mirror{Root: filepath.Join(notADir, "root"), SkipStartupCheck: true}},
+		{name: "placeholders", mir: Mirror{Root: filepath.Join(notADir, "{env.ROOT}")}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := test.mir.Provision(ctx)
+			defer test.mir.Cleanup()
+			if test.fails {
+				if err == nil || !strings.Contains(err.Error(), test.mir.Root) {
+					t.Errorf("expected error naming the root, got %v", err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLazyRootCheck(t *testing.T) {
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MIRROR_TEST_ROOT", notADir)
+	mir := provisionTestMirror(t, &Mirror{Root: "{env.MIRROR_TEST_ROOT}/root"})
+	for i := 0; i < 2; i++ {
+		rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+			if _, ok := w.(*responseWriterWrapper); ok {
+				t.Error("response to unwritable root should not be mirrored")
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		})
+		if err != nil || rec.Body.String() != "content" {
+			t.Errorf("unexpected response %q, error: %v", rec.Body.String(), err)
+		}
+	}
+	if result, ok := mir.rootChecks.results[filepath.Join(notADir, "root")]; !ok || result.err == nil {
+		t.Errorf("expected cached failed check, got %v", mir.rootChecks.results)
+	}
+}
+
+func TestRootCheckRetry(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocker, nil, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(blocker, "root")
+	rc := &rootChecks{mir: &Mirror{}}
+	if err := rc.check(root, zap.NewNop()); err == nil {
+		t.Fatal("expected unwritable root to fail the check")
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.check(root, zap.NewNop()); err == nil {
+		t.Error("failed check not cached")
+	}
+	rc.results[root].at = time.Now().Add(-rootCheckFailureTTL)
+	if err := rc.check(root, zap.NewNop()); err != nil {
+		t.Errorf("root not checked again after the failure expired: %v", err)
+	}
+
+	// A check in progress, as if the storage of the root hung, doesn't
+	// hold up other roots
+	hungRoot := filepath.Join(dir, "hung")
+	rc.results[hungRoot] = &rootCheck{done: make(chan struct{})}
+	if err := rc.check(hungRoot, zap.NewNop()); !errors.Is(err, errRootChecking) {
+		t.Errorf("expected root being checked to be skipped, got %v", err)
+	}
+	if err := rc.check(filepath.Join(dir, "other"), zap.NewNop()); err != nil {
+		t.Errorf("other root not checked: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "local.txt"), []byte("local copy"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zapcore.DebugLevel)
+	mir := provisionTestMirror(t, &Mirror{Root: root, ReadOnly: true, Fallback: true, TrackAccess: caddy.Duration(time.Minute), MetadataFileSuffix: ".meta", logger: zap.New(core)})
+
+	rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil || rec.Body.String() != "content" {
+		t.Errorf("unexpected response %q, error: %v", rec.Body.String(), err)
+	}
+	rec, err = serveMirror(mir, "/local.txt", func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	})
+	if err != nil || rec.Body.String() != "local copy" {
+		t.Errorf("local copy not served in read-only mode: %q, error: %v", rec.Body.String(), err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no writes in read-only mode, root contains %v", entries)
+	}
+
+	// Switching modes is only logged once
+	mir.readOnly.Store(false)
+	mir.enterReadOnly(syscall.EROFS)
+	mir.enterReadOnly(syscall.EROFS)
+	if switched := logs.FilterMessageSnippet("read-only").Len(); switched != 1 || !mir.isReadOnly() {
+		t.Errorf("expected one log of switching to read-only mode, got %d", switched)
+	}
+}
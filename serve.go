@@ -0,0 +1,124 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// shouldFallback reports whether the local copy should be served in place of
+// the response of the next handler, which failed with err
+func shouldFallback(err error) bool {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 && handlerErr.StatusCode < 500 {
+		return false
+	}
+	return true
+}
+
+// storedEtag returns the ETag stored for the mirrored file filename, from
+// its metadata or its ETag sidecar file named with suffix
+func (mir *Mirror) storedEtag(filename string, suffix string, meta map[string]string) string {
+	if etag := meta[xattrEtag]; etag != "" {
+		return etag
+	}
+	if suffix == "" {
+		return ""
+	}
+	content, err := os.ReadFile(filename + suffix)
+	if err != nil {
+		return ""
+	}
+	// Sidecars may be in any format, e.g. unquoted
+	etag, _ := canonicalEtag(string(content))
+	return etag
+}
+
+// serveLocal serves the mirrored copy of a file. ok is false if there is no
+// such copy, in which case nothing has been written to w.
+func (mir *Mirror) serveLocal(w http.ResponseWriter, r *http.Request, filename string, logger *zap.Logger) (ok bool) {
+	if mir.KeepPartials != nil && isPartialFile(filename) {
+		return false
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("failed to open local copy", zap.Error(err))
+		}
+		return false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+
+	now := time.Now()
+	meta := mir.readMetadata(filename)
+	header := w.Header()
+	downloaded, err := time.Parse(time.RFC3339, meta[xattrDownloaded])
+	if err != nil && !mir.PreserveMtime {
+		// Without a preserved Last-Modified, mtime is the time of download
+		downloaded, err = stat.ModTime(), nil
+	}
+	if err == nil {
+		age := max(now.Sub(downloaded), 0)
+		header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	if expires, err := time.Parse(time.RFC3339, meta[xattrExpires]); err == nil && now.After(expires) {
+		header.Set("Warning", `110 - "Response is Stale"`)
+		header.Set("X-Mirror-Stale", "true")
+	}
+	// With the ETag set, ServeContent also evaluates If-Match, If-None-Match
+	// and If-Range, so that clients polling a mirror whose upstream is down
+	// get 304s. Per RFC 9110, If-None-Match takes precedence over
+	// If-Modified-Since, and is evaluated with weak comparison.
+	etag := mir.storedEtag(filename, mir.etagSuffix(r), meta)
+	if etag == "" {
+		etag = digestEtag(meta)
+	}
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	// Otherwise ServeContent guesses it from the extension or content
+	if contentType := storedContentType(meta); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if mir.Languages != nil {
+		// Which copy is served depends on the language the client accepts
+		if !varies(header, "Accept-Language") {
+			header.Add("Vary", "Accept-Language")
+		}
+		if lang := meta[xattrLanguage]; lang != "" {
+			header.Set("Content-Language", lang)
+		}
+	}
+	lastModified := stat.ModTime()
+	if stored, err := http.ParseTime(meta[xattrLastModified]); err == nil {
+		lastModified = stored
+	}
+
+	logger.Debug("serving local copy", zap.String("path", filename))
+	if isBackground(w) {
+		http.ServeContent(w, joinEtagLists(r), filename, lastModified, file)
+		return true
+	}
+	cw := &countingResponseWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	http.ServeContent(cw, joinEtagLists(r), filename, lastModified, file)
+	mir.stats.bytesServedLocally.Add(cw.written)
+	return true
+}
+
+// storedContentType returns the Content-Type recorded in the metadata meta
+// of a mirrored file, or else its inferred media type, if any
+func storedContentType(meta map[string]string) string {
+	if contentType := meta[xattrMimeType]; contentType != "" {
+		return contentType
+	}
+	return meta[xattrMimeTypeInferred]
+}
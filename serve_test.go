@@ -0,0 +1,316 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFallback(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.bin"), []byte("local copy"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := json.Marshal(map[string]string{
+		xattrDownloaded: time.Now().Add(-2 * time.Minute).UTC().Format(time.RFC3339),
+		xattrExpires:    time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	})
+	if err := os.WriteFile(filepath.Join(root, "file.bin.meta"), meta, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", Fallback: true})
+
+	testCases := []struct {
+		name     string
+		path     string
+		err      error
+		fallback bool
+	}{
+		{name: "upstream unreachable", path: "/file.bin", err: caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed")), fallback: true},
+		{name: "plain error", path: "/file.bin", err: errors.New("broken"), fallback: true},
+		{name: "client error", path: "/file.bin", err: caddyhttp.Error(http.StatusForbidden, errors.New("forbidden")), fallback: false},
+		{name: "no local copy", path: "/missing.bin", err: caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed")), fallback: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			rec, err := serveMirror(mir, test.path, func(w http.ResponseWriter, r *http.Request) error {
+				return test.err
+			})
+			if !test.fallback {
+				if err != test.err {
+					t.Errorf("expected error %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("local copy not served: %v", err)
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != "local copy" {
+				t.Errorf("unexpected fallback response %d %q", rec.Code, rec.Body.String())
+			}
+			if age, _ := strconv.Atoi(rec.Header().Get("Age")); age < 120 || age > 130 {
+				t.Errorf("expected Age of about 120, got %q", rec.Header().Get("Age"))
+			}
+			if rec.Header().Get("X-Mirror-Stale") != "true" || rec.Header().Get("Warning") == "" {
+				t.Errorf("expired copy not marked as stale: %v", rec.Header())
+			}
+		})
+	}
+}
+
+func TestFallbackValidators(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", PreserveMtime: true, Fallback: true})
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err := serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filepath.Join(root, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(lastModified) {
+		t.Errorf("expected mtime %v, got %v", lastModified, stat.ModTime())
+	}
+
+	testCases := []struct {
+		header http.Header
+		status int
+	}{
+		{header: http.Header{}, status: http.StatusOK},
+		{header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusNotModified},
+		{header: http.Header{"If-None-Match": {`"v0"`}}, status: http.StatusOK},
+		{header: http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, status: http.StatusNotModified},
+		{header: http.Header{"If-Unmodified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}}, status: http.StatusPreconditionFailed},
+	}
+	for i, test := range testCases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+		req.Header = test.header
+		if !mir.serveLocal(rec, req, filepath.Join(root, "file.bin"), zap.NewNop()) {
+			t.Fatal("local copy not served")
+		}
+		if rec.Code != test.status {
+			t.Errorf("Test %d (header: %v) - expected status %d, got %d", i, test.header, test.status, rec.Code)
+		}
+		if rec.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Test %d - stored ETag missing: %v", i, rec.Header())
+		}
+		if test.status == http.StatusOK && rec.Header().Get("Last-Modified") != lastModified.Format(http.TimeFormat) {
+			t.Errorf("Test %d - Last-Modified missing: %v", i, rec.Header())
+		}
+		if rec.Header().Get("Age") != "" {
+			t.Errorf("Test %d - Age derived from preserved mtime: %v", i, rec.Header())
+		}
+	}
+}
+
+func TestServeLocalRanges(t *testing.T) {
+	root := t.TempDir()
+	filename := filepath.Join(root, "file.dat")
+	if err := os.WriteFile(filename, []byte("0123456789"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	meta, _ := json.Marshal(map[string]string{
+		xattrEtag:         `"v1"`,
+		xattrLastModified: lastModified.Format(http.TimeFormat),
+		xattrMimeType:     "application/x-tile",
+	})
+	if err := os.WriteFile(filename+".meta", meta, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta"})
+
+	testCases := []struct {
+		name         string
+		method       string
+		header       http.Header
+		status       int
+		body         string
+		contentRange string
+	}{
+		{name: "full", header: http.Header{}, status: http.StatusOK, body: "0123456789"},
+		{name: "range", header: http.Header{"Range": {"bytes=2-5"}}, status: http.StatusPartialContent, body: "2345", contentRange: "bytes 2-5/10"},
+		{name: "suffix range", header: http.Header{"Range": {"bytes=-3"}}, status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+		{name: "unsatisfiable range", header: http.Header{"Range": {"bytes=20-"}}, status: http.StatusRequestedRangeNotSatisfiable, body: "invalid range: failed to overlap\n", contentRange: "bytes */10"},
+		{name: "if-range match", header: http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"v1"`}}, status: http.StatusPartialContent, body: "2345", contentRange: "bytes 2-5/10"},
+		{name: "if-range mismatch", header: http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"v0"`}}, status: http.StatusOK, body: "0123456789"},
+		{name: "if-range date", header: http.Header{"Range": {"bytes=2-5"}, "If-Range": {lastModified.Format(http.TimeFormat)}}, status: http.StatusPartialContent, body: "2345", contentRange: "bytes 2-5/10"},
+		{name: "head", method: http.MethodHead, header: http.Header{}, status: http.StatusOK},
+		{name: "head range", method: http.MethodHead, header: http.Header{"Range": {"bytes=2-5"}}, status: http.StatusPartialContent, contentRange: "bytes 2-5/10"},
+		{name: "if-none-match hit", header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusNotModified},
+		{name: "if-modified-since hit", header: http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, status: http.StatusNotModified},
+		{name: "if-modified-since miss", header: http.Header{"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}}, status: http.StatusOK, body: "0123456789"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/file.dat", nil)
+			req.Header = test.header
+			if !mir.serveLocal(rec, req, filename, zap.NewNop()) {
+				t.Fatal("local copy not served")
+			}
+			if rec.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, rec.Code)
+			}
+			if rec.Body.String() != test.body {
+				t.Errorf("expected body %q, got %q", test.body, rec.Body.String())
+			}
+			if contentRange := rec.Header().Get("Content-Range"); contentRange != test.contentRange {
+				t.Errorf("expected Content-Range %q, got %q", test.contentRange, contentRange)
+			}
+			if test.status == http.StatusOK || test.status == http.StatusPartialContent {
+				if contentType := rec.Header().Get("Content-Type"); contentType != "application/x-tile" {
+					t.Errorf("expected stored Content-Type, got %q", contentType)
+				}
+				if rec.Header().Get("Last-Modified") != lastModified.Format(http.TimeFormat) {
+					t.Errorf("expected stored Last-Modified, got %q", rec.Header().Get("Last-Modified"))
+				}
+				if rec.Header().Get("Accept-Ranges") != "bytes" {
+					t.Errorf("expected Accept-Ranges, got %v", rec.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestServeLocalDigestEtag(t *testing.T) {
+	root := t.TempDir()
+	filename := filepath.Join(root, "file.dat")
+	if err := os.WriteFile(filename, []byte("0123456789"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	sum := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+	meta, _ := json.Marshal(map[string]string{xattrSha256: sum})
+	if err := os.WriteFile(filename+".meta", meta, filePerms); err != nil {
+		t.Fatal(err)
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta"})
+	etag := `"sha256-` + sum[:32] + `"`
+
+	testCases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{name: "full", header: http.Header{}, status: http.StatusOK},
+		{name: "if-none-match hit", header: http.Header{"If-None-Match": {etag}}, status: http.StatusNotModified},
+		{name: "if-none-match miss", header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusOK},
+		{name: "if-range match", header: http.Header{"Range": {"bytes=2-5"}, "If-Range": {etag}}, status: http.StatusPartialContent},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/file.dat", nil)
+			req.Header = test.header
+			if !mir.serveLocal(rec, req, filename, zap.NewNop()) {
+				t.Fatal("local copy not served")
+			}
+			if rec.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, rec.Code)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("expected ETag %s, got %q", etag, got)
+			}
+		})
+	}
+
+	// A stored ETag takes precedence
+	if err := os.WriteFile(filename+".meta", []byte(`{"`+xattrEtag+`":"\"v1\"","`+xattrSha256+`":"`+sum+`"}`), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	mir.serveLocal(rec, httptest.NewRequest(http.MethodGet, "/file.dat", nil), filename, zap.NewNop())
+	if got := rec.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("expected stored ETag, got %q", got)
+	}
+}
+
+func TestFallbackConditional(t *testing.T) {
+	root := t.TempDir()
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	sum := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+	files := map[string]map[string]string{
+		"weak.bin":   {xattrEtag: `W/"v1"`, xattrLastModified: lastModified.Format(http.TimeFormat)},
+		"strong.bin": {xattrEtag: `"v1"`, xattrLastModified: lastModified.Format(http.TimeFormat)},
+		"digest.bin": {xattrSha256: sum},
+	}
+	for name, meta := range files {
+		data, _ := json.Marshal(meta)
+		if err := os.WriteFile(filepath.Join(root, name), []byte("0123456789"), filePerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name+".meta"), data, filePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mir := provisionTestMirror(t, &Mirror{Root: root, MetadataFileSuffix: ".meta", Fallback: true})
+	since := lastModified.Format(http.TimeFormat)
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+
+	testCases := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{name: "strong match", path: "/strong.bin", header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusNotModified},
+		{name: "weak stored etag", path: "/weak.bin", header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusNotModified},
+		{name: "weak client etag", path: "/strong.bin", header: http.Header{"If-None-Match": {`W/"v1"`}}, status: http.StatusNotModified},
+		{name: "mismatch", path: "/strong.bin", header: http.Header{"If-None-Match": {`"v0"`}}, status: http.StatusOK},
+		{name: "etag list", path: "/weak.bin", header: http.Header{"If-None-Match": {`"v0", W/"v1"`}}, status: http.StatusNotModified},
+		{name: "etag list split across fields", path: "/weak.bin", header: http.Header{"If-None-Match": {`"v0"`, `W/"v1"`}}, status: http.StatusNotModified},
+		{name: "etag list mismatch", path: "/weak.bin", header: http.Header{"If-None-Match": {`"v0"`, `"v2"`}}, status: http.StatusOK},
+		{name: "any", path: "/strong.bin", header: http.Header{"If-None-Match": {"*"}}, status: http.StatusNotModified},
+		{name: "if-modified-since", path: "/strong.bin", header: http.Header{"If-Modified-Since": {since}}, status: http.StatusNotModified},
+		{name: "modified since", path: "/strong.bin", header: http.Header{"If-Modified-Since": {before}}, status: http.StatusOK},
+		{name: "if-none-match wins over match", path: "/strong.bin", header: http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {since}}, status: http.StatusOK},
+		{name: "if-none-match wins over mismatch", path: "/strong.bin", header: http.Header{"If-None-Match": {`"v1"`}, "If-Modified-Since": {before}}, status: http.StatusNotModified},
+		{name: "synthesized etag", path: "/digest.bin", header: http.Header{"If-None-Match": {`"sha256-` + sum[:32] + `"`}}, status: http.StatusNotModified},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			req.Header = test.header
+			rec := httptest.NewRecorder()
+			err := mir.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+			}))
+			if err != nil {
+				t.Fatalf("local copy not served: %v", err)
+			}
+			if rec.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, rec.Code)
+			}
+			if body := rec.Body.String(); (test.status == http.StatusOK) != (body == "0123456789") {
+				t.Errorf("unexpected body %q", body)
+			}
+			if rec.Header().Get("ETag") == "" {
+				t.Errorf("expected ETag, got %v", rec.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package mirror
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Sink is implemented by the guest modules of the
+// http.handlers.mirror.sinks namespace, which receive each mirrored file
+// once it has been finalized, e.g. to push it to a CDN.
+type Sink interface {
+	// Finalized is called with each finalized file. ctx is canceled when
+	// the mirror handler is unloaded.
+	Finalized(ctx context.Context, info FileInfo) error
+}
+
+// FileInfo describes a finalized mirrored file
+type FileInfo struct {
+	// Path of the file
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Hex encoded SHA-256 of the content, if known
+	SHA256 string `json:"sha256,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+	// Header of the mirrored response, if known
+	Header http.Header `json:"header,omitempty"`
+	// ID of the request whose response was mirrored, as in the
+	// request_id field of the handler's logs
+	RequestID string `json:"request_id,omitempty"`
+	// Language of the file, if it is a variant stored with languages
+	Language string `json:"language,omitempty"`
+}
+
+const (
+	defaultSinkWorkers = 1
+
+	// sinkQueueSize is the number of files that may be waiting for each
+	// sink. When the queue is full, files are dropped.
+	sinkQueueSize = 1024
+)
+
+// sinkQueue feeds the finalized files to one sink
+type sinkQueue struct {
+	name    string
+	sink    Sink
+	files   chan FileInfo
+	workers int
+}
+
+// sinkDispatcher passes finalized files to the sinks in the background. Each
+// sink has its own queue and workers, so that a failing or slow sink
+// doesn't hold up the others.
+type sinkDispatcher struct {
+	ctx    context.Context
+	logger *zap.Logger
+	queues []*sinkQueue
+}
+
+func newSinkDispatcher(ctx context.Context, logger *zap.Logger) *sinkDispatcher {
+	return &sinkDispatcher{ctx: ctx, logger: logger}
+}
+
+// add adds sink under name, which receives up to workers files at the same
+// time. With a single worker, it receives files in the order they were
+// finalized.
+func (sd *sinkDispatcher) add(name string, sink Sink, workers int) {
+	if workers <= 0 {
+		workers = defaultSinkWorkers
+	}
+	sd.queues = append(sd.queues, &sinkQueue{
+		name:    name,
+		sink:    sink,
+		files:   make(chan FileInfo, sinkQueueSize),
+		workers: workers,
+	})
+}
+
+// run starts the workers of each sink, which stop when ctx is canceled
+func (sd *sinkDispatcher) run() {
+	for _, queue := range sd.queues {
+		for i := 0; i < queue.workers; i++ {
+			go func() {
+				for {
+					select {
+					case info := <-queue.files:
+						sd.deliver(queue, info)
+					case <-sd.ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+// notify queues info for each sink, without blocking
+func (sd *sinkDispatcher) notify(info FileInfo) {
+	for _, queue := range sd.queues {
+		select {
+		case queue.files <- info:
+		default:
+			sd.logger.Warn("sink queue full, dropping file",
+				zap.String("sink", queue.name),
+				zap.String("path", info.Path))
+		}
+	}
+}
+
+// deliver passes info to the sink of queue, logging failures
+func (sd *sinkDispatcher) deliver(queue *sinkQueue, info FileInfo) {
+	defer func() {
+		if r := recover(); r != nil {
+			sd.logger.Error("sink panicked",
+				zap.String("sink", queue.name),
+				zap.String("path", info.Path),
+				zap.Any("panic", r))
+		}
+	}()
+	if err := queue.sink.Finalized(sd.ctx, info); err != nil {
+		sd.logger.Error("sink failed",
+			zap.String("sink", queue.name),
+			zap.String("path", info.Path),
+			zap.Error(err))
+	}
+}
+
+// finalized hands a file that has landed in root on to replication and the
+// sinks. Precompressed variants of the previous content are removed first.
+func (mir *Mirror) finalized(root string, info FileInfo) {
+	if err := mir.removeVariants(info.Path); err != nil {
+		mir.logger.Error("failed to remove stale precompressed variants",
+			zap.String("path", info.Path),
+			zap.Error(err))
+	}
+	mir.replicate(root, info.Path)
+	mir.storeDefaultLanguage(root, info)
+	if mir.sinks != nil {
+		mir.sinks.notify(info)
+	}
+}
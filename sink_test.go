@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink records the paths it receives
+type recordingSink struct {
+	mu    sync.Mutex
+	paths []string
+	got   chan struct{}
+}
+
+func (rs *recordingSink) Finalized(ctx context.Context, info FileInfo) error {
+	rs.mu.Lock()
+	rs.paths = append(rs.paths, info.Path)
+	rs.mu.Unlock()
+	rs.got <- struct{}{}
+	return nil
+}
+
+// stuckSink fails after blocking until ctx is canceled
+type stuckSink struct{}
+
+func (stuckSink) Finalized(ctx context.Context, info FileInfo) error {
+	<-ctx.Done()
+	return errors.New("stuck")
+}
+
+// panickingSink panics on every file
+type panickingSink struct{}
+
+func (panickingSink) Finalized(ctx context.Context, info FileInfo) error {
+	panic("sink bug")
+}
+
+func TestSinkOrderAndIsolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &recordingSink{got: make(chan struct{}, 10)}
+	sd := newSinkDispatcher(ctx, zap.NewNop())
+	sd.add("stuck", stuckSink{}, 1)
+	sd.add("panicking", panickingSink{}, 1)
+	sd.add("recording", recorder, 1)
+	sd.run()
+	mir := &Mirror{sinks: sd}
+	expected := []string{"/root/a", "/root/b", "/root/c"}
+	for _, path := range expected {
+		mir.finalized("/root", FileInfo{Path: path})
+	}
+	for range expected {
+		select {
+		case <-recorder.got:
+		case <-time.After(time.Second):
+			t.Fatal("sink held up by failing sinks")
+		}
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	for i, path := range expected {
+		if i >= len(recorder.paths) || recorder.paths[i] != path {
+			t.Fatalf("expected files in order %v, got %v", expected, recorder.paths)
+		}
+	}
+}
+
+func TestSinkInfo(t *testing.T) {
+	root := t.TempDir()
+	recorder := &recordingSink{got: make(chan struct{}, 1)}
+	var info FileInfo
+	mir := provisionTestMirror(t, &Mirror{Root: root})
+	mir.sinks = newSinkDispatcher(context.Background(), zap.NewNop())
+	mir.sinks.add("recording", sinkFunc(func(ctx context.Context, i FileInfo) error {
+		info = i
+		return recorder.Finalized(ctx, i)
+	}), 1)
+	mir.sinks.run()
+	_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-recorder.got:
+	case <-time.After(time.Second):
+		t.Fatal("sink not notified")
+	}
+	// sha256 of "content"
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	if info.Path != root+"/file.txt" || info.Size != 7 || info.SHA256 != sum || info.ETag != `"v1"` || info.Header.Get("ETag") != `"v1"` {
+		t.Errorf("unexpected file info %+v", info)
+	}
+}
+
+// sinkFunc adapts a function to a Sink
+type sinkFunc func(ctx context.Context, info FileInfo) error
+
+func (f sinkFunc) Finalized(ctx context.Context, info FileInfo) error {
+	return f(ctx, info)
+}
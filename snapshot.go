@@ -0,0 +1,234 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotEntry is a line of a metadata snapshot, the metadata of a
+// mirrored file
+type snapshotEntry struct {
+	// Path of the file relative to the root, with slashes
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Xattrs of the file by name
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+	// Sidecars are the contents of the sidecar files of the file, such as
+	// its ETag and metadata sidecar files, by suffix
+	Sidecars map[string]string `json:"sidecars,omitempty"`
+}
+
+// snapshotMismatch is an entry of a metadata snapshot that wasn't imported
+type snapshotMismatch struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type snapshotImported struct {
+	Name       string             `json:"name"`
+	Root       string             `json:"root"`
+	Imported   int                `json:"imported"`
+	Mismatched []snapshotMismatch `json:"mismatched"`
+}
+
+// snapshot returns the metadata of the mirrored file filename in root
+func (mir *Mirror) snapshot(root string, filename string) (snapshotEntry, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return snapshotEntry{}, err
+	}
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return snapshotEntry{}, err
+	}
+	entry := snapshotEntry{Path: filepath.ToSlash(rel), Size: stat.Size(), ModTime: stat.ModTime().UTC()}
+	if names, err := xattr.List(filename); err == nil {
+		for _, name := range names {
+			value, err := xattr.Get(filename, name)
+			if err != nil {
+				return snapshotEntry{}, err
+			}
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string][]byte)
+			}
+			entry.Xattrs[name] = value
+		}
+	}
+	for _, suffix := range mir.sidecarSuffixes(filename) {
+		content, err := os.ReadFile(filename + suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return snapshotEntry{}, err
+		}
+		if entry.Sidecars == nil {
+			entry.Sidecars = make(map[string]string)
+		}
+		entry.Sidecars[suffix] = string(content)
+	}
+	return entry, nil
+}
+
+// restore re-creates the xattrs and sidecar files of entry in root, if its
+// file still has the same size and modification time. The reason it
+// didn't is returned otherwise.
+func (mir *Mirror) restore(root string, entry snapshotEntry) (reason string, err error) {
+	filename := caddyhttp.SanitizedPathJoin(root, "/"+entry.Path)
+	if rel, err := filepath.Rel(root, filename); err != nil || rel != filepath.FromSlash(entry.Path) {
+		return "invalid path", nil
+	}
+	stat, err := os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if stat.Size() != entry.Size {
+		return fmt.Sprintf("size is %d instead of %d", stat.Size(), entry.Size), nil
+	}
+	// Filesystems differ in the precision of modification times
+	if !stat.ModTime().Truncate(time.Second).Equal(entry.ModTime.Truncate(time.Second)) {
+		return fmt.Sprintf("modified %s instead of %s", stat.ModTime().UTC().Format(time.RFC3339), entry.ModTime.Format(time.RFC3339)), nil
+	}
+	for name, value := range entry.Xattrs {
+		if current, err := xattr.Get(filename, name); err == nil && bytes.Equal(current, value) {
+			continue
+		}
+		err := updateImmutable(filename, func() error {
+			return xattr.Set(filename, name, value)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	for suffix, content := range entry.Sidecars {
+		if !mir.isSidecarSuffix(filename, suffix) {
+			return "unknown sidecar suffix " + suffix, nil
+		}
+		if current, err := os.ReadFile(filename + suffix); err == nil && string(current) == content {
+			continue
+		}
+		if err := mir.writeFile(filename+suffix, []byte(content)); err != nil {
+			return "", err
+		}
+	}
+	// Writing xattrs and sidecars doesn't change the modification time of
+	// the file itself
+	return "", nil
+}
+
+// isSidecarSuffix reports whether filename+suffix is a sidecar file of
+// filename under the current configuration
+func (mir *Mirror) isSidecarSuffix(filename string, suffix string) bool {
+	if suffix == "" || strings.ContainsAny(suffix, `/\`) {
+		return false
+	}
+	if trimmed, ok := mir.trimEtagSuffix(filename + suffix); ok && trimmed == filename {
+		return true
+	}
+	return (mir.MetadataFileSuffix != "" && suffix == mir.MetadataFileSuffix) ||
+		(mir.StoreResponseMeta != nil && suffix == ResponseMetaSuffix) ||
+		(mir.tombstones() && suffix == TombstoneSuffix)
+}
+
+// handleMetadataExport streams a snapshot of the metadata of all files in
+// the root of the handler named by the name query parameter, which may be
+// left out if there is only one handler, as JSON lines: their xattrs and
+// sidecar files, keyed by path relative to the root.
+func (adminAPI) handleMetadataExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	mir, err := selectHandler(r.URL.Query().Get("name"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	enc := json.NewEncoder(w)
+	var failed error
+	err = mir.walkEntries(mir.Root, func(filename string, d fs.DirEntry) {
+		if failed != nil {
+			return
+		}
+		entry, err := mir.snapshot(mir.Root, filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed while walking
+			return
+		}
+		if err == nil {
+			err = enc.Encode(entry)
+		}
+		failed = err
+	})
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		mir.logger.Error("metadata export failed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// handleMetadataImport re-creates the xattrs and sidecar files of a
+// metadata snapshot in the request body in the root of the handler named by
+// the name query parameter, which may be left out if there is only one
+// handler. Files that are missing or whose size or modification time
+// changed since the snapshot are reported as mismatched.
+func (adminAPI) handleMetadataImport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	mir, err := selectHandler(r.URL.Query().Get("name"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	response := snapshotImported{Name: mir.Name, Root: mir.Root, Mismatched: []snapshotMismatch{}}
+	dec := json.NewDecoder(r.Body)
+	for {
+		var entry snapshotEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("parsing snapshot after %d entries: %v", response.Imported+len(response.Mismatched), err),
+			}
+		}
+		reason, err := mir.restore(mir.Root, entry)
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			response.Mismatched = append(response.Mismatched, snapshotMismatch{Path: entry.Path, Reason: reason})
+			continue
+		}
+		response.Imported++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
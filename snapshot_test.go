@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/xattr"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataSnapshot(t *testing.T) {
+	root := t.TempDir()
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range map[string]string{
+		"dir/file.txt":      "content",
+		"dir/file.txt.etag": `"v1"`,
+		"changed.txt":       "old",
+		"removed.txt":       "gone",
+	} {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), filePerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(root, "dir", "file.txt")
+	hasXattrs := xattr.Set(filename, xattrEtag, []byte(`"v1"`)) == nil
+	provisionTestMirror(t, &Mirror{Root: root, Name: "snapshot", EtagFileSuffix: ".etag"})
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleMetadataExport(rec, httptest.NewRequest(http.MethodGet, "/mirror/metadata/export?name=snapshot", nil)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := rec.Body.Bytes()
+	entries := make(map[string]snapshotEntry)
+	dec := json.NewDecoder(bytes.NewReader(snapshot))
+	for dec.More() {
+		var entry snapshotEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries[entry.Path] = entry
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	entry := entries["dir/file.txt"]
+	if entry.Size != 7 || !entry.ModTime.Equal(mtime) || entry.Sidecars[".etag"] != `"v1"` {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if hasXattrs && string(entry.Xattrs[xattrEtag]) != `"v1"` {
+		t.Errorf("expected ETag xattr in entry, got %v", entry.Xattrs)
+	}
+
+	// Restore onto a tree without the metadata, where a file changed and
+	// another was removed
+	os.Remove(filename + ".etag")
+	xattr.Remove(filename, xattrEtag)
+	os.WriteFile(filepath.Join(root, "changed.txt"), []byte("new content"), filePerms)
+	os.Remove(filepath.Join(root, "removed.txt"))
+	rec = httptest.NewRecorder()
+	err := (adminAPI{}).handleMetadataImport(rec, httptest.NewRequest(http.MethodPost, "/mirror/metadata/import?name=snapshot", bytes.NewReader(snapshot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported snapshotImported
+	if err := json.Unmarshal(rec.Body.Bytes(), &imported); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Imported != 1 || len(imported.Mismatched) != 2 {
+		t.Errorf("expected 1 entry imported and 2 mismatched, got %+v", imported)
+	}
+	for _, mismatch := range imported.Mismatched {
+		if mismatch.Path != "changed.txt" && mismatch.Path != "removed.txt" {
+			t.Errorf("unexpected mismatch %+v", mismatch)
+		}
+	}
+	if content, err := os.ReadFile(filename + ".etag"); err != nil || string(content) != `"v1"` {
+		t.Errorf("ETag sidecar not restored: %q, error: %v", content, err)
+	}
+	if value, err := xattr.Get(filename, xattrEtag); hasXattrs && (err != nil || string(value) != `"v1"`) {
+		t.Errorf("ETag xattr not restored: %q, error: %v", value, err)
+	}
+}
@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SoftNotFound configures the detection of "soft 404s", HTML error pages
+// that some upstreams send with a 200 status for missing files. A response
+// for a path whose extension implies a non-HTML type is discarded instead
+// of being finalized when its Content-Type is HTML, or its first bytes look
+// like HTML. This is a heuristic, so it is disabled by default.
+type SoftNotFound struct {
+	// Expected media types by lowercase file extension, including the dot.
+	// Default covers common package and archive extensions.
+	Types map[string]string `json:"types,omitempty"`
+}
+
+// sniffLen is the number of bytes http.DetectContentType considers
+const sniffLen = 512
+
+var defaultSoftNotFoundTypes = map[string]string{
+	".apk":  "application/vnd.android.package-archive",
+	".bz2":  "application/x-bzip2",
+	".deb":  "application/vnd.debian.binary-package",
+	".gz":   "application/gzip",
+	".iso":  "application/x-iso9660-image",
+	".jar":  "application/java-archive",
+	".rpm":  "application/x-rpm",
+	".tar":  "application/x-tar",
+	".tgz":  "application/gzip",
+	".whl":  "application/zip",
+	".xz":   "application/x-xz",
+	".zip":  "application/zip",
+	".zst":  "application/zstd",
+	".udeb": "application/vnd.debian.binary-package",
+}
+
+func (snf *SoftNotFound) types() map[string]string {
+	if snf.Types != nil {
+		return snf.Types
+	}
+	return defaultSoftNotFoundTypes
+}
+
+// expectedType returns the media type expected for filename, if it isn't
+// HTML and soft 404s are to be detected for it
+func (mir *Mirror) expectedType(filename string) string {
+	if mir.SoftNotFound == nil {
+		return ""
+	}
+	expected := mir.SoftNotFound.types()[strings.ToLower(filepath.Ext(filename))]
+	if isHTML(expected) {
+		return ""
+	}
+	return expected
+}
+
+// isHTML reports whether contentType is an HTML media type
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// sniff keeps the first bytes of the response while a soft 404 is to be
+// detected or its media type inferred
+func (rww *responseWriterWrapper) sniff(data []byte) {
+	if (rww.expectedType == "" && !rww.inferType) || len(rww.sniffed) >= sniffLen {
+		return
+	}
+	rww.sniffed = append(rww.sniffed, data[:min(len(data), sniffLen-len(rww.sniffed))]...)
+}
+
+// softNotFound discards the pending mirror files and reports true if the
+// response looks like an HTML error page rather than the expected type
+func (rww *responseWriterWrapper) softNotFound() bool {
+	if rww.expectedType == "" {
+		return false
+	}
+	contentType := rww.Header().Get("Content-Type")
+	if !isHTML(contentType) && (len(rww.sniffed) == 0 || !isHTML(http.DetectContentType(rww.sniffed))) {
+		return false
+	}
+	rww.config.stats.softNotFound.Add(1)
+	rww.discard(zapcore.ErrorLevel, "soft 404 suspected, HTML response for "+rww.expectedType, false,
+		zap.String("url", rww.url),
+		zap.String("content_type", contentType))
+	return true
+}
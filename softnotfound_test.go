@@ -0,0 +1,54 @@
+package mirror
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSoftNotFound(t *testing.T) {
+	testCases := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		mirrored    bool
+	}{
+		{name: "HTML Content-Type", path: "/pool/foo.deb", contentType: "text/html; charset=utf-8", body: "<p>Not found</p>"},
+		{name: "sniffed as HTML", path: "/pool/foo.deb", contentType: "application/octet-stream", body: "<!DOCTYPE html><html><body>Not found</body></html>"},
+		{name: "binary content", path: "/pool/foo.deb", contentType: "application/vnd.debian.binary-package", body: "!<arch>\ndebian-binary", mirrored: true},
+		{name: "extension without expected type", path: "/index.html", contentType: "text/html", body: "<html></html>", mirrored: true},
+		{name: "configured extension", path: "/data.BIN", contentType: "text/html", body: "<html></html>"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, SoftNotFound: &SoftNotFound{Types: map[string]string{
+				".deb": "application/vnd.debian.binary-package",
+				".bin": "application/octet-stream",
+			}}})
+			rec, err := serveMirror(mir, test.path, func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(test.body))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Body.String() != test.body {
+				t.Errorf("response not passed through, got %q", rec.Body.String())
+			}
+			_, err = os.Stat(filepath.Join(root, filepath.FromSlash(test.path)))
+			if test.mirrored && err != nil {
+				t.Errorf("response not mirrored: %v", err)
+			}
+			if !test.mirrored && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("soft 404 mirrored, stat error: %v", err)
+			}
+		})
+	}
+}
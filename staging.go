@@ -0,0 +1,380 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Staging configures a fast staging tier. Files are mirrored to the staging
+// directory first, and moved to the root in the background once finalized,
+// content first and sidecar files afterwards. Until then, local copies are
+// served from the staging directory. Files left in the staging directory,
+// e.g. by a crash, are moved when the handler is provisioned. On a config
+// reload, moves that haven't started are handed over to the new handler
+// rather than queued again by it. Where the
+// staging directory is on another filesystem than a root, which is checked
+// on first use of the root, files are copied to it rather than renamed.
+type Staging struct {
+	// Directory on fast storage to mirror files to first.
+	Dir string `json:"dir,omitempty"`
+
+	// Maximum total size of the files waiting to be moved. While exceeded,
+	// files are mirrored to the root directly, as are responses without
+	// Content-Length. Default is no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of files moved at the same time. Default is 2.
+	Workers int `json:"workers,omitempty"`
+}
+
+const (
+	defaultStagingWorkers = 2
+
+	// stagingRootFile records the root that the files in a staging
+	// subdirectory are destined for
+	stagingRootFile = ".mirror-root"
+)
+
+// stager moves files from the staging directory to their roots
+type stager struct {
+	mir    *Mirror
+	config *Staging
+	logger *zap.Logger
+	// sem bounds the number of concurrent moves
+	sem chan struct{}
+	// used is the total size of the files waiting to be moved
+	used  atomic.Int64
+	moves sync.WaitGroup
+	// acrossMu guards across, whether each root is on another filesystem
+	// than the staging directory, as checked on first use
+	acrossMu sync.Mutex
+	across   map[string]bool
+}
+
+var (
+	// activeStagers are the stagers of the loaded handlers by staging
+	// directory, the one provisioned last for handlers sharing one
+	activeStagers = make(map[string]*stager)
+	// stagedMoves are the staged files queued to be moved by any stager,
+	// which survive config reloads, so that recovery doesn't queue them
+	// again
+	stagedMoves   = make(map[string]int)
+	stagedMovesMu sync.Mutex
+)
+
+// activate makes st the stager that moves left over by unloaded handlers
+// are handed to
+func (st *stager) activate() {
+	stagedMovesMu.Lock()
+	defer stagedMovesMu.Unlock()
+	activeStagers[st.config.Dir] = st
+}
+
+// deactivate undoes activate, unless another stager has taken over since
+func (st *stager) deactivate() {
+	stagedMovesMu.Lock()
+	defer stagedMovesMu.Unlock()
+	if activeStagers[st.config.Dir] == st {
+		delete(activeStagers, st.config.Dir)
+	}
+}
+
+// trackMove records that staged is queued to be moved. With onlyNew, it
+// reports false, recording nothing, if it already is.
+func trackMove(staged string, onlyNew bool) bool {
+	stagedMovesMu.Lock()
+	defer stagedMovesMu.Unlock()
+	if onlyNew && stagedMoves[staged] > 0 {
+		return false
+	}
+	stagedMoves[staged]++
+	return true
+}
+
+// untrackMove undoes trackMove once staged has been moved, or abandoned,
+// and returns the stager to hand it over to in the latter case
+func untrackMove(staged string, dir string) *stager {
+	stagedMovesMu.Lock()
+	defer stagedMovesMu.Unlock()
+	if stagedMoves[staged]--; stagedMoves[staged] <= 0 {
+		delete(stagedMoves, staged)
+	}
+	return activeStagers[dir]
+}
+
+func newStager(mir *Mirror) *stager {
+	workers := mir.Staging.Workers
+	if workers <= 0 {
+		workers = defaultStagingWorkers
+	}
+	return &stager{
+		mir:    mir,
+		config: mir.Staging,
+		logger: mir.logger,
+		sem:    make(chan struct{}, workers),
+	}
+}
+
+// stagingDir returns the subdirectory of the staging directory for root
+func (st *stager) stagingDir(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(st.config.Dir, hex.EncodeToString(sum[:8]))
+}
+
+// stagedPath returns the path filename within root is staged at
+func (st *stager) stagedPath(root string, filename string) (string, error) {
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(st.stagingDir(root), rel), nil
+}
+
+// stage returns the path to mirror filename within root to, in the staging
+// directory. ok is false if staging the expected size would exceed max_size,
+// otherwise it is reserved until released. Files of unknown size, -1, are
+// only staged without max_size, as they could exceed it.
+func (st *stager) stage(root string, filename string, size int64) (staged string, ok bool) {
+	if size < 0 {
+		if st.config.MaxSize > 0 {
+			return "", false
+		}
+		size = 0
+	}
+	if used := st.used.Add(size); st.config.MaxSize > 0 && used > st.config.MaxSize {
+		st.used.Add(-size)
+		return "", false
+	}
+	staged, err := st.stagedPath(root, filename)
+	if err == nil {
+		err = st.recordRoot(root)
+	}
+	if err == nil {
+		st.acrossFilesystems(root)
+	}
+	if err != nil {
+		st.logger.Error("failed to stage file, mirroring to root directly",
+			zap.String("path", filename),
+			zap.Error(err))
+		st.used.Add(-size)
+		return "", false
+	}
+	return staged, true
+}
+
+// release releases size reserved in the staging directory
+func (st *stager) release(size int64) {
+	st.used.Add(-size)
+}
+
+// acrossFilesystems reports whether root is on another filesystem than the
+// staging directory, so that staged files are copied to root rather than
+// renamed, which is checked once per root and logged as a warning
+func (st *stager) acrossFilesystems(root string) bool {
+	st.acrossMu.Lock()
+	defer st.acrossMu.Unlock()
+	if across, ok := st.across[root]; ok {
+		return across
+	}
+	// The root may be yet to be created
+	rootDevice, ok := deviceID(existingAncestor(root))
+	stagingDevice, stagingOK := deviceID(st.config.Dir)
+	across := ok && stagingOK && rootDevice != stagingDevice
+	if across {
+		st.logger.Warn("staging directory is on another filesystem than the root, staged files are copied to the root",
+			zap.String("staging_dir", st.config.Dir),
+			zap.String("root", root))
+	}
+	if st.across == nil {
+		st.across = make(map[string]bool)
+	}
+	st.across[root] = across
+	return across
+}
+
+// moveFile moves src to dst within root, copying it if root is on another
+// filesystem than the staging directory
+func (st *stager) moveFile(root string, src string, dst string) error {
+	if !st.acrossFilesystems(root) {
+		return st.mir.moveFile(root, src, dst)
+	}
+	if err := st.mir.copyFile(root, src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// recordRoot records root in its staging subdirectory, for recovery
+func (st *stager) recordRoot(root string) error {
+	recorded := filepath.Join(st.stagingDir(root), stagingRootFile)
+	if _, err := os.Stat(recorded); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(recorded), mkdirPerms); err != nil {
+		return err
+	}
+	return os.WriteFile(recorded, []byte(root), filePerms)
+}
+
+// locate returns where the local copy of filename within root currently is,
+// in the staging directory or the root, and next to a directory in its
+// place with the suffix path_conflicts policy
+func (mir *Mirror) locate(root string, filename string) string {
+	if mir.PathConflicts == pathConflictsSuffix {
+		filename = conflictFilename(filename)
+	}
+	if mir.stager == nil {
+		return filename
+	}
+	if staged, err := mir.stager.stagedPath(root, filename); err == nil {
+		if _, err := os.Stat(staged); err == nil {
+			return staged
+		}
+	}
+	return filename
+}
+
+// enqueue moves the staged file to info.Path within root in the background,
+// releasing info.Size once it has been moved
+func (st *stager) enqueue(root string, staged string, info FileInfo) {
+	trackMove(staged, false)
+	st.start(root, staged, info)
+}
+
+// start moves the staged file, once tracked. If the handler is unloaded
+// before the move starts, it is handed over to the handler that replaced
+// it, if any, else left for recovery.
+func (st *stager) start(root string, staged string, info FileInfo) {
+	st.moves.Add(1)
+	go func() {
+		defer st.moves.Done()
+		select {
+		case st.sem <- struct{}{}:
+		case <-st.mir.done:
+			st.release(info.Size)
+			if next := untrackMove(staged, st.config.Dir); next != nil && next != st {
+				next.adopt(root, staged, info)
+			}
+			return
+		}
+		defer func() { <-st.sem }()
+		if st.move(root, staged, info.Path) {
+			st.mir.finalized(root, info)
+		}
+		st.release(info.Size)
+		untrackMove(staged, st.config.Dir)
+	}()
+}
+
+// adopt moves a staged file that was queued by another stager, or left in
+// the staging directory, unless it is queued already
+func (st *stager) adopt(root string, staged string, info FileInfo) bool {
+	if !trackMove(staged, true) {
+		return false
+	}
+	st.used.Add(info.Size)
+	st.start(root, staged, info)
+	return true
+}
+
+// move moves the staged file to filename within root, followed by its
+// sidecar files
+func (st *stager) move(root string, staged string, filename string) (ok bool) {
+	sidecarSuffixes := st.mir.sidecarSuffixes(staged)
+	// As when finalizing, the sidecars in the root are removed before the
+	// content is replaced, and replaced after it
+	for _, suffix := range sidecarSuffixes {
+		if err := os.Remove(filename + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			st.logger.Error("failed to remove sidecar file before moving staged file",
+				zap.String("path", filename+suffix),
+				zap.Error(err))
+			return false
+		}
+	}
+	suffixes := append([]string{""}, sidecarSuffixes...)
+	for _, suffix := range suffixes {
+		var err error
+		if suffix == "" {
+			err = st.mir.replaceImmutable(filename, func() error {
+				return st.moveFile(root, staged, filename)
+			})
+		} else {
+			err = st.moveFile(root, staged+suffix, filename+suffix)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			st.logger.Error("failed to move staged file",
+				zap.String("staged", staged+suffix),
+				zap.String("path", filename+suffix),
+				zap.Error(err))
+			return false
+		}
+	}
+	st.mir.trace(st.logger, "moved staged file", zap.String("path", filename))
+	return true
+}
+
+// recover moves the files left in the staging directory, other than those
+// still queued by the handler being replaced on a config reload
+func (st *stager) recover() {
+	subdirs, err := os.ReadDir(st.config.Dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			st.logger.Error("failed to read staging directory", zap.Error(err))
+		}
+		return
+	}
+	for _, subdir := range subdirs {
+		dir := filepath.Join(st.config.Dir, subdir.Name())
+		root, err := os.ReadFile(filepath.Join(dir, stagingRootFile))
+		if err != nil {
+			continue
+		}
+		// Sidecar files are moved along with their content, or on their own
+		// if the content has been moved already
+		staged := make(map[string]int64)
+		_ = filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			if trimmed, ok := st.mir.trimEtagSuffix(filename); ok {
+				filename = trimmed
+			} else if suffix := st.mir.MetadataFileSuffix; suffix != "" && strings.HasSuffix(filename, suffix) {
+				filename = strings.TrimSuffix(filename, suffix)
+			} else if st.mir.StoreResponseMeta != nil && strings.HasSuffix(filename, ResponseMetaSuffix) {
+				filename = strings.TrimSuffix(filename, ResponseMetaSuffix)
+			} else if st.mir.tombstones() && strings.HasSuffix(filename, TombstoneSuffix) {
+				filename = strings.TrimSuffix(filename, TombstoneSuffix)
+			}
+			if info, err := d.Info(); err == nil {
+				staged[filename] += info.Size()
+			}
+			return nil
+		})
+		adopted := 0
+		for filename, size := range staged {
+			rel, err := filepath.Rel(dir, filename)
+			if err != nil {
+				continue
+			}
+			if st.adopt(string(root), filename, FileInfo{Path: filepath.Join(string(root), rel), Size: size}) {
+				adopted++
+			}
+		}
+		if adopted > 0 {
+			st.logger.Info("moving files left in staging directory",
+				zap.String("root", string(root)),
+				zap.Int("files", adopted))
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaging(t *testing.T) {
+	root := t.TempDir()
+	stagingDir := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Fallback: true, Staging: &Staging{Dir: stagingDir, Workers: 1}})
+	// Hold the only worker, so that the file stays staged
+	mir.stager.sem <- struct{}{}
+
+	_, err := serveMirror(mir, "/dir/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(mir.stager.stagingDir(root), "dir", "file.txt")
+	if _, err := os.Stat(staged); err != nil {
+		t.Fatalf("file not staged: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir", "file.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file should not be in root before being moved, stat error: %v", err)
+	}
+	if used := mir.stager.used.Load(); used != int64(len("content")) {
+		t.Errorf("expected %d bytes staged, got %d", len("content"), used)
+	}
+
+	// The staged copy is served while it hasn't been moved
+	rec, err := serveMirror(mir, "/dir/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	})
+	if err != nil || rec.Body.String() != "content" || rec.Header().Get("ETag") != `"v1"` {
+		t.Errorf("staged copy not served: %q, ETag %q, error: %v", rec.Body.String(), rec.Header().Get("ETag"), err)
+	}
+
+	<-mir.stager.sem
+	mir.stager.moves.Wait()
+	for name, expected := range map[string]string{"file.txt": "content", "file.txt.etag": `"v1"`} {
+		content, err := os.ReadFile(filepath.Join(root, "dir", name))
+		if err != nil || string(content) != expected {
+			t.Errorf("expected %s to be moved to root with %q, got %q, error: %v", name, expected, content, err)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(staged), name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s left in staging directory, stat error: %v", name, err)
+		}
+	}
+	if used := mir.stager.used.Load(); used != 0 {
+		t.Errorf("expected nothing staged after move, got %d bytes", used)
+	}
+}
+
+func TestStagingMaxSize(t *testing.T) {
+	root := t.TempDir()
+	stagingDir := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, Staging: &Staging{Dir: stagingDir, MaxSize: 10}})
+	// A response without Content-Length could exceed max_size too
+	for name, length := range map[string]string{"large.bin": "100", "unknown.bin": ""} {
+		body := strings.Repeat("x", 100)
+		_, err := serveMirror(mir, "/"+name, func(w http.ResponseWriter, r *http.Request) error {
+			if length != "" {
+				w.Header().Set("Content-Length", length)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(content) != body {
+			t.Errorf("%s not mirrored to root directly, error: %v", name, err)
+		}
+		if used := mir.stager.used.Load(); used != 0 {
+			t.Errorf("expected nothing staged, got %d bytes", used)
+		}
+	}
+}
+
+func TestStagingRecovery(t *testing.T) {
+	root := t.TempDir()
+	stagingDir := t.TempDir()
+	st := newStager(&Mirror{Staging: &Staging{Dir: stagingDir}})
+	if err := st.recordRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(st.stagingDir(root), "dir", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(staged), mkdirPerms); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"file.txt": "content", "file.txt.etag": `"v1"`, "moved.txt.etag": `"v2"`} {
+		if err := os.WriteFile(filepath.Join(filepath.Dir(staged), name), []byte(content), filePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Staging: &Staging{Dir: stagingDir}})
+	mir.stager.moves.Wait()
+	for name, expected := range map[string]string{"file.txt": "content", "file.txt.etag": `"v1"`, "moved.txt.etag": `"v2"`} {
+		content, err := os.ReadFile(filepath.Join(root, "dir", name))
+		if err != nil || string(content) != expected {
+			t.Errorf("expected %s to be recovered with %q, got %q, error: %v", name, expected, content, err)
+		}
+	}
+}
+
+func TestStagingReload(t *testing.T) {
+	root := t.TempDir()
+	stagingDir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	old := &Mirror{Root: root, Staging: &Staging{Dir: stagingDir, Workers: 1}, logger: zap.NewNop()}
+	if err := old.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	staged, err := old.stager.stagedPath(root, filepath.Join(root, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.stager.recordRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staged, []byte("content"), filePerms); err != nil {
+		t.Fatal(err)
+	}
+	// The move is queued behind one that hangs
+	old.stager.sem <- struct{}{}
+	old.stager.used.Add(7)
+	old.stager.enqueue(root, staged, FileInfo{Path: filepath.Join(root, "file.txt"), Size: 7})
+
+	// Reloading the config doesn't queue the move again
+	mir := provisionTestMirror(t, &Mirror{Root: root, Staging: &Staging{Dir: stagingDir}})
+	if used := mir.stager.used.Load(); used != 0 {
+		t.Errorf("file still queued by the old handler recovered, %d bytes staged", used)
+	}
+	// It is handed over once the old handler is unloaded
+	cancel()
+	old.Cleanup()
+	<-old.stager.sem
+	mir.stager.moves.Wait()
+	if content, err := os.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(content) != "content" {
+		t.Errorf("staged file not moved after reload, got %q, error: %v", content, err)
+	}
+	if used := mir.stager.used.Load(); used != 0 {
+		t.Errorf("expected nothing left staged, got %d bytes", used)
+	}
+}
+
+func TestStagingAcrossFilesystems(t *testing.T) {
+	root := t.TempDir()
+	stagingDir, err := os.MkdirTemp("/dev/shm", "mirror-staging")
+	if err != nil {
+		t.Skip("no /dev/shm to stage to")
+	}
+	t.Cleanup(func() { os.RemoveAll(stagingDir) })
+	rootDevice, _ := deviceID(root)
+	stagingDevice, ok := deviceID(stagingDir)
+	if !ok || rootDevice == stagingDevice {
+		t.Skip("staging directory not on another filesystem than the root")
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", Staging: &Staging{Dir: stagingDir}})
+	mir.stager.logger = zap.New(core)
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		_, err := serveMirror(mir, name, func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mir.stager.moves.Wait()
+	for _, name := range []string{"a.txt", "a.txt.etag", "b.txt", "b.txt.etag"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %s copied to root: %v", name, err)
+		}
+	}
+	if warnings := logs.FilterMessageSnippet("another filesystem").Len(); warnings != 1 {
+		t.Errorf("expected one warning about the staging directory, got %d", warnings)
+	}
+}
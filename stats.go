@@ -0,0 +1,174 @@
+package mirror
+
+import (
+	"expvar"
+	"sync"
+)
+
+// stats are the counters of a mirror handler's activity. They are published
+// with expvar as part of the "mirror" map, keyed by the handler's name, and
+// survive config reloads.
+type stats struct {
+	filesWritten expvar.Int
+	bytesWritten expvar.Int
+	discards     expvar.Int
+	failures     expvar.Int
+	inFlight     expvar.Int
+	// unhealthyRoots is the number of roots failing their health check
+	unhealthyRoots expvar.Int
+	// files is the number of mirrored files counted for max_files
+	files expvar.Int
+	// deleted is the number of files deleted by background sweeps
+	deleted             expvar.Int
+	lastSweepDeleted    expvar.Int
+	lastSweepDurationMs expvar.Int
+	// quarantined is the number of files quarantined after failing digest
+	// verification
+	quarantined expvar.Int
+	// overBudget is the number of responses not mirrored after exceeding
+	// the write budget
+	overBudget expvar.Int
+	// reflinkBytesSaved is the number of bytes not copied thanks to reflinks
+	reflinkBytesSaved expvar.Int
+	// readThroughHits is the number of requests served from fresh local
+	// copies without calling the next handler
+	readThroughHits expvar.Int
+	// staleHits is the number of requests served from stale local copies
+	// with stale_while_revalidate
+	staleHits expvar.Int
+	// refreshes is the number of popular files refreshed before going
+	// stale, refreshesSkipped the number not refreshed as too many
+	// refreshes were running
+	refreshes        expvar.Int
+	refreshesSkipped expvar.Int
+	// notModified is the number of local copies served after upstream
+	// confirmed they are still valid
+	notModified expvar.Int
+	// softNotFound is the number of responses discarded as soft 404s
+	softNotFound expvar.Int
+	// slowTransfers is the number of responses not mirrored as they
+	// arrived slower than min_rate
+	slowTransfers expvar.Int
+	// rangeOn200 is the number of 200 responses not mirrored as they had a
+	// Content-Range header, so likely only part of the body
+	rangeOn200 expvar.Int
+	// verifyFailures is the number of mirrored files removed as they
+	// failed read-back verification
+	verifyFailures expvar.Int
+	// truncated is the number of responses discarded as they ended before
+	// their Content-Length
+	truncated expvar.Int
+	// completedOnDisconnect is the number of responses mirrored to
+	// completion after the client went away
+	completedOnDisconnect expvar.Int
+	// xattrFailures are the numbers of failures to set xattrs, by class of
+	// error. xattrDegradedRoots is the number of roots metadata xattrs are
+	// no longer set on after too many consecutive failures.
+	xattrFailures      map[string]*expvar.Int
+	xattrDegradedRoots expvar.Int
+	// reservedBytes is the number of bytes reserved for responses being
+	// mirrored with min_free_space, that are yet to be written. noSpace is
+	// the number of responses not mirrored for lack of free space.
+	reservedBytes expvar.Int
+	noSpace       expvar.Int
+	// warcRecords is the number of WARC records written
+	warcRecords expvar.Int
+	// hashSkipped is the number of responses not hashed with max_hash_size
+	hashSkipped expvar.Int
+	// uploads is the number of request bodies mirrored with mirror_methods
+	uploads expvar.Int
+	// rejected is the number of mirrored files rejected by a validator
+	rejected expvar.Int
+	// fallbackHits is the number of requests served from local copies as
+	// upstream failed, misses the number passed on to the next handler
+	// that could have been served from a local copy. staleRefreshes is the
+	// number of background refreshes of stale local copies served with
+	// stale_while_revalidate.
+	fallbackHits   expvar.Int
+	misses         expvar.Int
+	staleRefreshes expvar.Int
+	// bytesServedLocally is the number of bytes of bodies served from
+	// local copies, bytesFetched the number passed on from the next
+	// handler on misses
+	bytesServedLocally expvar.Int
+	bytesFetched       expvar.Int
+	// hitRatio is the rolling ratio of hits among the requests counted as
+	// hits or misses, reported by the admin API
+	hitRatio rollingRatio
+
+	histograms *histograms
+
+	// name is the key the stats are published under. labeled are the
+	// counters per set of metric labels, published under the same key of
+	// the "mirror_labeled" map once there are any, so that the "mirror"
+	// map keeps flat counters.
+	name        string
+	labeledMu   sync.Mutex
+	labeled     map[string]*labeledStats
+	labeledVars *expvar.Map
+}
+
+var (
+	expvarStats  = expvar.NewMap("mirror")
+	expvarLabels = expvar.NewMap("mirror_labeled")
+	handlerStats = make(map[string]*stats)
+	statsMu      sync.Mutex
+)
+
+// statsFor returns the stats published under name, creating them if needed.
+// Handlers with the same name share their stats.
+func statsFor(name string) *stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if s, ok := handlerStats[name]; ok {
+		return s
+	}
+	s := new(stats)
+	m := new(expvar.Map).Init()
+	s.name = name
+	m.Set("files_written", &s.filesWritten)
+	m.Set("bytes_written", &s.bytesWritten)
+	m.Set("discards", &s.discards)
+	m.Set("failures", &s.failures)
+	m.Set("in_flight", &s.inFlight)
+	m.Set("unhealthy_roots", &s.unhealthyRoots)
+	m.Set("files", &s.files)
+	m.Set("deleted", &s.deleted)
+	m.Set("last_sweep_deleted", &s.lastSweepDeleted)
+	m.Set("last_sweep_duration_ms", &s.lastSweepDurationMs)
+	m.Set("quarantined", &s.quarantined)
+	m.Set("over_budget", &s.overBudget)
+	m.Set("reflink_bytes_saved", &s.reflinkBytesSaved)
+	m.Set("read_through_hits", &s.readThroughHits)
+	m.Set("stale_hits", &s.staleHits)
+	m.Set("refreshes", &s.refreshes)
+	m.Set("refreshes_skipped", &s.refreshesSkipped)
+	m.Set("not_modified", &s.notModified)
+	m.Set("soft_not_found", &s.softNotFound)
+	m.Set("slow_transfers", &s.slowTransfers)
+	m.Set("content_range_on_200", &s.rangeOn200)
+	m.Set("verify_failures", &s.verifyFailures)
+	m.Set("truncated", &s.truncated)
+	m.Set("completed_on_disconnect", &s.completedOnDisconnect)
+	s.xattrFailures = make(map[string]*expvar.Int)
+	for _, class := range xattrErrorClasses {
+		s.xattrFailures[class] = new(expvar.Int)
+		m.Set("xattr_failures_"+class, s.xattrFailures[class])
+	}
+	m.Set("xattr_degraded_roots", &s.xattrDegradedRoots)
+	m.Set("reserved_bytes", &s.reservedBytes)
+	m.Set("no_space", &s.noSpace)
+	m.Set("warc_records", &s.warcRecords)
+	m.Set("hash_skipped", &s.hashSkipped)
+	m.Set("uploads", &s.uploads)
+	m.Set("rejected", &s.rejected)
+	m.Set("fallback_hits", &s.fallbackHits)
+	m.Set("misses", &s.misses)
+	m.Set("stale_refreshes", &s.staleRefreshes)
+	m.Set("bytes_served_locally", &s.bytesServedLocally)
+	m.Set("bytes_fetched", &s.bytesFetched)
+	expvarStats.Set(name, m)
+	s.histograms = newHistograms(name)
+	handlerStats[name] = s
+	return s
+}
@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpvarStats(t *testing.T) {
+	readStats := func() map[string]int64 {
+		rec := httptest.NewRecorder()
+		expvar.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+		var vars struct {
+			Mirror map[string]map[string]int64 `json:"mirror"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return vars.Mirror["expvar_test"]
+	}
+
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), Name: "expvar_test"})
+	next := func(body string) func(w http.ResponseWriter, r *http.Request) error {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, body)
+			return nil
+		}
+	}
+	serveMirror(mir, "/complete.bin", next("0123456789"))
+	serveMirror(mir, "/truncated.bin", next("01234"))
+
+	expected := map[string]int64{
+		"files_written": 1,
+		"bytes_written": 15,
+		"discards":      1,
+		"failures":      0,
+		"in_flight":     0,
+	}
+	actual := readStats()
+	for key, value := range expected {
+		if actual[key] != value {
+			t.Errorf("expected %s=%d, got %d", key, value, actual[key])
+		}
+	}
+
+	// Reprovisioning with the same name, as on a config reload, keeps the stats
+	provisionTestMirror(t, &Mirror{Root: t.TempDir(), Name: "expvar_test"})
+	if actual := readStats(); actual["files_written"] != 1 {
+		t.Errorf("stats lost after reprovisioning: %v", actual)
+	}
+}
@@ -0,0 +1,168 @@
+package mirror
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Policies for percent-encoded slashes in URL paths
+const (
+	encodedSlashesDecode = "decode"
+	encodedSlashesKeep   = "keep_encoded"
+	encodedSlashesReject = "reject"
+)
+
+// encodedSeparators are the percent-encoded path separators, a backslash
+// being one on Windows
+var encodedSeparators = func() []string {
+	if filepath.Separator == '\\' {
+		return []string{"%2F", "%5C"}
+	}
+	return []string{"%2F"}
+}()
+
+// decodePath returns the decoded path of r, applying the encoded_slashes
+// policy to the encoded separators in it
+func (mir *Mirror) decodePath(r *http.Request) (string, error) {
+	if mir.EncodedSlashes == "" || mir.EncodedSlashes == encodedSlashesDecode {
+		return r.URL.Path, nil
+	}
+	escaped := r.URL.EscapedPath()
+	if mir.EncodedSlashes == encodedSlashesReject {
+		upper := strings.ToUpper(escaped)
+		if slices.ContainsFunc(encodedSeparators, func(sep string) bool { return strings.Contains(upper, sep) }) {
+			return "", fmt.Errorf("path %s has encoded slashes", escaped)
+		}
+		return r.URL.Path, nil
+	}
+	// Decode everything but the encoded separators, which are kept as is.
+	// Percent signs are encoded again, so that e.g. %252F and %2F don't
+	// map to the same file.
+	var sb strings.Builder
+	for len(escaped) > 0 {
+		next, sep := len(escaped), ""
+		for _, s := range encodedSeparators {
+			if i := strings.Index(strings.ToUpper(escaped), s); i >= 0 && i < next {
+				next, sep = i, s
+			}
+		}
+		decoded, err := url.PathUnescape(escaped[:next])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(strings.ReplaceAll(decoded, "%", "%25"))
+		sb.WriteString(sep)
+		escaped = escaped[min(next+len(sep), len(escaped)):]
+	}
+	return sb.String(), nil
+}
+
+// storagePathPlaceholder stands for the URL path in path_template, after
+// strip_prefix and path_rewrites
+const storagePathPlaceholder = "{mirror.path}"
+
+// PathRewrite is a regular expression replacement applied to URL paths to
+// get the path of their files
+type PathRewrite struct {
+	// Regular expression to find, in RE2 syntax.
+	Find string `json:"find,omitempty"`
+
+	// Replacement of the matches, which may refer to submatches as `$1`
+	// or `${name}`.
+	Replace string `json:"replace,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Provision compiles the regular expression
+func (pr *PathRewrite) Provision() error {
+	re, err := regexp.Compile(pr.Find)
+	if err != nil {
+		return fmt.Errorf("compiling path rewrite %q: %w", pr.Find, err)
+	}
+	pr.re = re
+	return nil
+}
+
+// rewritePath applies the path rewrites to urlp in order, failing if the
+// result is empty or has `..` segments
+func (mir *Mirror) rewritePath(urlp string) (string, error) {
+	rewritten := path.Clean(urlp)
+	for _, pr := range mir.PathRewrites {
+		rewritten = pr.re.ReplaceAllString(rewritten, pr.Replace)
+	}
+	mir.logger.Debug("rewrote storage path",
+		zap.String("before", urlp),
+		zap.String("after", rewritten))
+	if rewritten == "" {
+		return "", fmt.Errorf("path %s rewritten to an empty path", urlp)
+	}
+	if slices.Contains(strings.Split(rewritten, "/"), "..") {
+		return "", fmt.Errorf("path %s rewritten to %s, which has .. segments", urlp, rewritten)
+	}
+	return rewritten, nil
+}
+
+// storagePath returns the path, relative to the root, of the file
+// mirroring the response to r, as mapped by strip_prefix, path_rewrites,
+// path_template and lowercase_paths, with encoded slashes handled as per
+// encoded_slashes. It is cleaned, with duplicate slashes
+// collapsed and dot segments resolved, so that equivalent URLs share a
+// file. It fails if the mapping, where there is one, doesn't yield a file
+// path.
+func (mir *Mirror) storagePath(r *http.Request) (string, error) {
+	urlp, err := mir.decodePath(r)
+	if err != nil {
+		return "", err
+	}
+	if mir.StripPrefix == "" && mir.PathTemplate == "" && len(mir.PathRewrites) == 0 && !mir.LowercasePaths {
+		return path.Clean(urlp), nil
+	}
+	if mir.StripPrefix != "" {
+		stripped, ok := strings.CutPrefix(urlp, mir.StripPrefix)
+		if !ok {
+			return "", fmt.Errorf("path doesn't start with %s", mir.StripPrefix)
+		}
+		urlp = "/" + strings.TrimPrefix(stripped, "/")
+	}
+	if len(mir.PathRewrites) > 0 {
+		rewritten, err := mir.rewritePath(urlp)
+		if err != nil {
+			return "", err
+		}
+		urlp = rewritten
+	}
+	if mir.PathTemplate != "" {
+		repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if repl == nil {
+			repl = caddy.NewReplacer()
+		}
+		// The URL path is inserted as is, so that anything looking like a
+		// placeholder in it isn't replaced
+		parts := strings.Split(mir.PathTemplate, storagePathPlaceholder)
+		for i, part := range parts {
+			parts[i] = repl.ReplaceAll(part, "")
+		}
+		urlp = strings.Join(parts, urlp)
+	}
+	if mir.LowercasePaths {
+		urlp = strings.ToLower(urlp)
+	}
+	switch {
+	case !path.IsAbs(urlp):
+		return "", fmt.Errorf("storage path %q is not absolute", urlp)
+	case strings.HasSuffix(urlp, "/") || path.Clean(urlp) == "/":
+		return "", fmt.Errorf("storage path %q is a directory", urlp)
+	case strings.ContainsRune(urlp, 0):
+		return "", fmt.Errorf("storage path %q contains a NUL byte", urlp)
+	}
+	return path.Clean(urlp), nil
+}
@@ -0,0 +1,217 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoragePath(t *testing.T) {
+	testCases := []struct {
+		name        string
+		stripPrefix string
+		template    string
+		lowercase   bool
+		urlp        string
+		stored      string
+	}{
+		{name: "default", urlp: "/dir/file.txt", stored: "dir/file.txt"},
+		{name: "prefix stripped", stripPrefix: "/artifactory/api/storage", urlp: "/artifactory/api/storage/dir/file.txt", stored: "dir/file.txt"},
+		{name: "other prefix", stripPrefix: "/artifactory/api/storage", urlp: "/other/file.txt"},
+		{name: "template", template: "/{env.MIRROR_TEST_TENANT}/cache{mirror.path}", urlp: "/file.txt", stored: "tenant/cache/file.txt"},
+		{name: "placeholder in URL not replaced", template: "{mirror.path}", urlp: "/{env.MIRROR_TEST_TENANT}.txt", stored: "{env.MIRROR_TEST_TENANT}.txt"},
+		{name: "empty expansion", template: "{http.request.header.X-Missing}", urlp: "/file.txt"},
+		{name: "directory", template: "/{http.request.header.X-Missing}/", urlp: "/file.txt"},
+		{name: "kept within root", template: "/../..{mirror.path}", urlp: "/file.txt", stored: "file.txt"},
+		{name: "lowercased", lowercase: true, urlp: "/Dir/FÏLE.TXT", stored: "dir/fïle.txt"},
+	}
+	t.Setenv("MIRROR_TEST_TENANT", "tenant")
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, StripPrefix: test.stripPrefix, PathTemplate: test.template, LowercasePaths: test.lowercase, Fallback: true})
+			rec, err := serveMirror(mir, test.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil || rec.Body.String() != "content" {
+				t.Fatalf("response not passed through, got %q, error: %v", rec.Body.String(), err)
+			}
+			if test.stored == "" {
+				if entries, _ := os.ReadDir(root); len(entries) != 0 {
+					t.Errorf("expected nothing mirrored, got %v", entries)
+				}
+				return
+			}
+			if content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(test.stored))); err != nil || string(content) != "content" {
+				t.Errorf("expected response mirrored to %s, got %q, error: %v", test.stored, content, err)
+			}
+
+			// The local copy is found with the same mapping
+			rec, err = serveMirror(mir, test.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+			})
+			if err != nil || rec.Body.String() != "content" {
+				t.Errorf("local copy not served, got %q, error: %v", rec.Body.String(), err)
+			}
+		})
+	}
+}
+
+func TestStoragePathTrailingSlash(t *testing.T) {
+	testCases := []struct {
+		name      string
+		lowercase bool
+		stored    string
+	}{
+		// Without a mapping, the path maps to a file as it always has
+		{name: "default", stored: "/dir"},
+		{name: "mapped", lowercase: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), LowercasePaths: test.lowercase})
+			urlp, err := mir.storagePath(httptest.NewRequest(http.MethodGet, "http://example.com/dir/", nil))
+			if test.stored == "" {
+				if err == nil {
+					t.Errorf("expected mapping to a directory to fail, got %q", urlp)
+				}
+				return
+			}
+			if err != nil || urlp != test.stored {
+				t.Errorf("expected %q, got %q, error: %v", test.stored, urlp, err)
+			}
+		})
+	}
+}
+
+func TestPathRewrites(t *testing.T) {
+	mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), PathRewrites: []*PathRewrite{
+		{Find: `^/releases/(latest|\d+\.\d+\.\d+)/`, Replace: "/releases/${1}-"},
+		{Find: `/build-\d+/`, Replace: "/"},
+		{Find: `^/secret/.*`, Replace: ""},
+		{Find: `^/up/`, Replace: "/../"},
+	}})
+	for urlp, expected := range map[string]string{
+		"/releases/1.2.3/tool.tar.gz":     "/releases/1.2.3-tool.tar.gz",
+		"/releases/latest/tool.tar.gz":    "/releases/latest-tool.tar.gz",
+		"/nightly/build-1234/tool.tar.gz": "/nightly/tool.tar.gz",
+		"/nightly//./tool.tar.gz":         "/nightly/tool.tar.gz",
+		"/secret/file":                    "",
+		"/up/file":                        "",
+	} {
+		rewritten, err := mir.rewritePath(urlp)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("expected %s to be skipped, got %s", urlp, rewritten)
+			}
+		} else if err != nil || rewritten != expected {
+			t.Errorf("expected %s rewritten to %s, got %s, error: %v", urlp, expected, rewritten, err)
+		}
+	}
+
+	invalid := &PathRewrite{Find: "("}
+	if err := invalid.Provision(); err == nil {
+		t.Error("expected invalid regular expression to be rejected")
+	}
+}
+
+func TestEquivalentURLs(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, Fallback: true})
+	shapes := []string{
+		"/a/b/c.txt",
+		"/a//b/c.txt",
+		"//a/b/c.txt",
+		"/a/b//c.txt",
+		"/a/./b/c.txt",
+		"/./a/b/c.txt",
+		"/a/b/./c.txt",
+		"/a/x/../b/c.txt",
+		"/a/b/c.txt/.",
+		"/a///b//.//c.txt",
+	}
+	for _, urlp := range shapes {
+		_, err := serveMirror(mir, urlp, func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(r.URL.Path))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var files []string
+	filepath.WalkDir(root, func(filename string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, filename)
+		}
+		return nil
+	})
+	if len(files) != 1 || files[0] != filepath.Join(root, "a", "b", "c.txt") {
+		t.Fatalf("expected all shapes mirrored to a/b/c.txt, got %v", files)
+	}
+	for _, urlp := range shapes {
+		rec, err := serveMirror(mir, urlp, func(w http.ResponseWriter, r *http.Request) error {
+			return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+		})
+		if err != nil || rec.Body.String() != shapes[len(shapes)-1] {
+			t.Errorf("local copy not served for %s, got %q, error: %v", urlp, rec.Body.String(), err)
+		}
+	}
+}
+
+func TestEncodedSlashes(t *testing.T) {
+	testCases := []struct {
+		policy string
+		urlp   string
+		stored string
+	}{
+		{policy: "", urlp: "/api/a%2Fb", stored: "api/a/b"},
+		{policy: encodedSlashesDecode, urlp: "/api/a%2fb", stored: "api/a/b"},
+		{policy: encodedSlashesDecode, urlp: "/api/a%252Fb", stored: "api/a%2Fb"},
+		{policy: encodedSlashesKeep, urlp: "/api/a%2Fb", stored: "api/a%2Fb"},
+		{policy: encodedSlashesKeep, urlp: "/api/a%2fb", stored: "api/a%2Fb"},
+		{policy: encodedSlashesKeep, urlp: "/api/a%252Fb", stored: "api/a%252Fb"},
+		{policy: encodedSlashesKeep, urlp: "/api/a%25252Fb", stored: "api/a%25252Fb"},
+		{policy: encodedSlashesKeep, urlp: "/api/%20x%2F%2Fy", stored: "api/ x%2F%2Fy"},
+		{policy: encodedSlashesKeep, urlp: "/api/plain", stored: "api/plain"},
+		{policy: encodedSlashesReject, urlp: "/api/a%2Fb"},
+		{policy: encodedSlashesReject, urlp: "/api/a%252Fb", stored: "api/a%2Fb"},
+	}
+	for _, test := range testCases {
+		t.Run(test.policy+" "+test.urlp, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EncodedSlashes: test.policy, Fallback: true})
+			_, err := serveMirror(mir, test.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.stored == "" {
+				if entries, _ := os.ReadDir(root); len(entries) != 0 {
+					t.Errorf("expected nothing mirrored, got %v", entries)
+				}
+				return
+			}
+			if content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(test.stored))); err != nil || string(content) != "content" {
+				t.Errorf("expected response mirrored to %s, error: %v", test.stored, err)
+			}
+			rec, err := serveMirror(mir, test.urlp, func(w http.ResponseWriter, r *http.Request) error {
+				return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+			})
+			if err != nil || rec.Body.String() != "content" {
+				t.Errorf("local copy not served, got %q, error: %v", rec.Body.String(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// validSuffix checks that suffix, once expanded, can only name a sibling
+// of the file it is appended to
+func validSuffix(suffix string) error {
+	if strings.ContainsAny(suffix, "/\\\x00") || strings.Contains(suffix, "..") {
+		return fmt.Errorf("suffix %q must not contain path separators or ..", suffix)
+	}
+	return nil
+}
+
+// validateSuffixes checks the suffixes of the config, with placeholders
+// standing for any valid expansion. A suffix starting with a placeholder is
+// rejected, as the sidecars of a file would then match those of any file
+// whose name it prefixes.
+func (mir *Mirror) validateSuffixes() error {
+	suffix := mir.EtagFileSuffix
+	if hasPlaceholders(suffix) {
+		if strings.HasPrefix(suffix, "{") {
+			return fmt.Errorf("etag_file_suffix: suffix %q must not start with a placeholder", suffix)
+		}
+		suffix = replacePlaceholders(suffix, func(string) string { return "x" })
+	}
+	if err := validSuffix(suffix); err != nil {
+		return fmt.Errorf("etag_file_suffix: %w", err)
+	}
+	return nil
+}
+
+// replacePlaceholders replaces the placeholders in s with what fn returns
+// for them
+func replacePlaceholders(s string, fn func(placeholder string) string) string {
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "{")
+		end := strings.Index(s[max(start, 0):], "}")
+		if start < 0 || end < 0 {
+			sb.WriteString(s)
+			return sb.String()
+		}
+		end += start
+		sb.WriteString(s[:start])
+		sb.WriteString(fn(s[start : end+1]))
+		s = s[end+1:]
+	}
+}
+
+// expandSuffix replaces the placeholders in suffix with repl. It returns ""
+// if the expansion isn't a valid suffix, e.g. as it contains a path
+// separator.
+func expandSuffix(suffix string, repl *caddy.Replacer) string {
+	if !hasPlaceholders(suffix) {
+		return suffix
+	}
+	if repl == nil {
+		return ""
+	}
+	expanded := repl.ReplaceAll(suffix, "")
+	if expanded == "" || validSuffix(expanded) != nil {
+		return ""
+	}
+	return expanded
+}
+
+// etagSuffix returns the ETag file suffix for r, if any
+func (mir *Mirror) etagSuffix(r *http.Request) string {
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return expandSuffix(mir.EtagFileSuffix, repl)
+}
+
+// etagSuffixPattern returns the glob pattern matching the expansions of
+// the ETag file suffix
+func (mir *Mirror) etagSuffixPattern() string {
+	var sb strings.Builder
+	for i, part := range strings.Split(replacePlaceholders(mir.EtagFileSuffix, func(string) string { return "\x00" }), "\x00") {
+		if i > 0 {
+			sb.WriteString("*")
+		}
+		sb.WriteString(escapeGlob(part))
+	}
+	return sb.String()
+}
+
+// escapeGlob escapes the characters of s that are special in glob patterns
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// etagSidecars returns the ETag sidecar files of filename. With
+// placeholders in etag_file_suffix, these are the existing files named
+// after filename with any expansion of the suffix.
+func (mir *Mirror) etagSidecars(filename string) []string {
+	suffix := mir.EtagFileSuffix
+	if suffix == "" {
+		return nil
+	}
+	if !hasPlaceholders(suffix) {
+		return []string{filename + suffix}
+	}
+	matches, _ := filepath.Glob(escapeGlob(filename) + mir.etagSuffixPattern())
+	return matches
+}
+
+// trimEtagSuffix returns the name of the file whose ETag sidecar is name,
+// if it is one
+func (mir *Mirror) trimEtagSuffix(name string) (string, bool) {
+	suffix := mir.EtagFileSuffix
+	if suffix == "" {
+		return name, false
+	}
+	if !hasPlaceholders(suffix) {
+		trimmed, ok := strings.CutSuffix(name, suffix)
+		return trimmed, ok && trimmed != ""
+	}
+	pattern := mir.etagSuffixPattern()
+	base := filepath.Base(name)
+	for i := 1; i < len(base); i++ {
+		if ok, _ := filepath.Match(pattern, base[i:]); ok {
+			return name[:len(name)-len(base)+i], true
+		}
+	}
+	return name, false
+}
+
+// sidecarSuffixes returns the suffixes of the sidecar files of filename:
+// those of its ETag sidecars followed by the metadata file suffix
+func (mir *Mirror) sidecarSuffixes(filename string) []string {
+	var suffixes []string
+	for _, sidecar := range mir.etagSidecars(filename) {
+		suffixes = append(suffixes, strings.TrimPrefix(sidecar, filename))
+	}
+	if mir.MetadataFileSuffix != "" {
+		suffixes = append(suffixes, mir.MetadataFileSuffix)
+	}
+	if mir.StoreResponseMeta != nil {
+		suffixes = append(suffixes, ResponseMetaSuffix)
+	}
+	if mir.tombstones() {
+		suffixes = append(suffixes, TombstoneSuffix)
+	}
+	return suffixes
+}
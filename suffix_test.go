@@ -0,0 +1,108 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEtagSuffixPlaceholders(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag-{http.vars.tenant}", Fallback: true})
+	serve := func(tenant string, next caddyhttp.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+		repl := caddy.NewReplacer()
+		ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+		ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{"tenant": tenant})
+		req = req.WithContext(ctx)
+		repl.Map(func(key string) (any, bool) {
+			if key == "http.vars.tenant" {
+				return tenant, true
+			}
+			return nil, false
+		})
+		rec := httptest.NewRecorder()
+		if err := mir.ServeHTTP(rec, req, next); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	upstream := func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	}
+	down := func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("dial failed"))
+	}
+
+	serve("a", upstream)
+	filename := filepath.Join(root, "file.txt")
+	if content, err := os.ReadFile(filename + ".etag-a"); err != nil || string(content) != `"v1"` {
+		t.Errorf("expected ETag file with expanded suffix, got %q, error: %v", content, err)
+	}
+	if rec := serve("a", down); rec.Header().Get("ETag") != `"v1"` {
+		t.Errorf("expected ETag from expanded sidecar, got %q", rec.Header().Get("ETag"))
+	}
+	if rec := serve("b", down); rec.Header().Get("ETag") != "" {
+		t.Errorf("expected no ETag for another expansion, got %q", rec.Header().Get("ETag"))
+	}
+
+	// Expansions that would escape the directory are not used
+	serve("/../../x", upstream)
+	if entries, _ := os.ReadDir(root); len(entries) != 2 {
+		t.Errorf("expected only the file and its first sidecar, got %v", entries)
+	}
+
+	if mir.isEntry("file.txt.etag-a") || !mir.isEntry("file.txt") {
+		t.Error("ETag file with expanded suffix counted as a mirrored file")
+	}
+	if err := mir.removeEntry(filename); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("sidecar files left behind: %v", entries)
+	}
+}
+
+func TestTrimEtagSuffix(t *testing.T) {
+	mir := &Mirror{EtagFileSuffix: ".etag-{http.request.host}"}
+	for name, expected := range map[string]string{
+		"dir/file.txt.etag-a.example": "dir/file.txt",
+		"dir/file.txt.etag-":          "dir/file.txt",
+		"dir/file.txt":                "",
+		"dir/.etag-a.example":         "",
+	} {
+		trimmed, ok := mir.trimEtagSuffix(name)
+		if !ok {
+			trimmed = ""
+		}
+		if trimmed != expected {
+			t.Errorf("expected %q trimmed to %q, got %q", name, expected, trimmed)
+		}
+	}
+}
+
+func TestValidateSuffixes(t *testing.T) {
+	for suffix, valid := range map[string]bool{
+		".etag":                     true,
+		".etag-{http.request.host}": true,
+		"/etag":                     false,
+		".etag/{http.request.host}": false,
+		"{http.request.host}/../x":  false,
+		"{http.request.host}.etag":  false,
+	} {
+		mir := &Mirror{EtagFileSuffix: suffix}
+		if err := mir.validateSuffixes(); (err == nil) != valid {
+			t.Errorf("expected %q valid %v, got %v", suffix, valid, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Policies for symlinks at the paths files are mirrored to
+const (
+	symlinksRefuse  = "refuse"
+	symlinksFollow  = "follow"
+	symlinksReplace = "replace"
+)
+
+// resolveSymlink returns where to mirror filename within root under the
+// symlinks policy, which is the target of filename if it is a symlink to
+// be followed, or false if it can't be mirrored. Symlinks that are refused
+// or replaced are left to createTempFile.
+func (mir *Mirror) resolveSymlink(root string, filename string, logger *zap.Logger) (string, bool) {
+	if mir.Symlinks != symlinksFollow {
+		return filename, true
+	}
+	stat, err := os.Lstat(filename)
+	if err != nil || stat.Mode()&fs.ModeSymlink == 0 {
+		return filename, true
+	}
+	target, err := resolveLink(filename)
+	if err == nil {
+		// The root may itself be reached through symlinks
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		logger.Warn("failed to resolve symlink, not mirroring",
+			zap.String("path", filename),
+			zap.Error(err))
+		return "", false
+	}
+	if !withinRoot(root, target) {
+		logger.Error("refusing to follow symlink out of the root",
+			zap.String("path", filename),
+			zap.String("target", target),
+			zap.String("root", root))
+		return "", false
+	}
+	return target, true
+}
+
+// resolveLink returns the file the symlink filename points to, which may
+// not exist yet
+func resolveLink(filename string) (string, error) {
+	target, err := filepath.EvalSymlinks(filename)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return target, err
+	}
+	link, err := os.Readlink(filename)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(filename), link)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(link))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(link)), nil
+}
+
+// withinRoot reports whether filename is below root. Both must be clean
+// and absolute, or relative to the same directory.
+func withinRoot(root string, filename string) bool {
+	rel, err := filepath.Rel(root, filename)
+	return err == nil && rel != "." && filepath.IsLocal(rel)
+}
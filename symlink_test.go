@@ -0,0 +1,84 @@
+package mirror
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinks(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+		// link is the target of the symlink mirrored to, relative to the
+		// root
+		link     string
+		mirrored bool
+		replaced bool
+		// symlinkedRoot is set for the root to be a symlink itself
+		symlinkedRoot bool
+	}{
+		{name: "refuse", link: "1.2.3/file"},
+		{name: "follow", policy: symlinksFollow, link: "1.2.3/file", mirrored: true},
+		{name: "follow symlinked root", policy: symlinksFollow, link: "1.2.3/file", mirrored: true, symlinkedRoot: true},
+		{name: "follow dangling", policy: symlinksFollow, link: "1.2.3/new", mirrored: true},
+		{name: "follow out of root", policy: symlinksFollow, link: "../outside/file"},
+		{name: "replace", policy: symlinksReplace, link: "1.2.3/file", replaced: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "root")
+			if test.symlinkedRoot {
+				if err := os.Symlink("real", root); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"root/1.2.3/file", "outside/file"} {
+				if test.symlinkedRoot {
+					name = strings.Replace(name, "root/", "real/", 1)
+				}
+				filename := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(filename), mkdirPerms); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, []byte("old"), filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			link := filepath.Join(root, "latest")
+			if err := os.Symlink(filepath.FromSlash(test.link), link); err != nil {
+				t.Fatal(err)
+			}
+			mir := provisionTestMirror(t, &Mirror{Root: root, Symlinks: test.policy})
+			serveMirror(mir, "/latest", func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+
+			target := filepath.Join(root, filepath.FromSlash(test.link))
+			content, _ := os.ReadFile(target)
+			if test.mirrored != (string(content) == "content") {
+				t.Errorf("expected target mirrored %v, got %q", test.mirrored, content)
+			}
+			stat, err := os.Lstat(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := stat.Mode().IsRegular(); replaced != test.replaced {
+				t.Errorf("expected symlink replaced %v, got mode %v", test.replaced, stat.Mode())
+			}
+			if test.replaced {
+				if content, err := os.ReadFile(link); err != nil || string(content) != "content" {
+					t.Errorf("expected symlink replaced by mirrored file, got %q, error: %v", content, err)
+				}
+				if content, _ := os.ReadFile(target); string(content) != "old" {
+					t.Errorf("expected symlink target untouched, got %q", content)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package mirror
+
+import (
+	"encoding/base64"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// Trailers carrying integrity information that can be verified against the
+// sha256 of the mirrored content
+var digestTrailers = []string{"Content-Digest", "Repr-Digest", "Digest"}
+
+// declaredTrailers returns the canonical names of the trailers announced in
+// the Trailer header
+func declaredTrailers(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// declaresDigestTrailer reports whether the response announces a trailer
+// with a digest of its content
+func declaresDigestTrailer(header http.Header) bool {
+	for _, name := range declaredTrailers(header) {
+		for _, digest := range digestTrailers {
+			if name == digest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// receivedDigestTrailer reports whether any digest trailer is among the
+// trailers received
+func receivedDigestTrailer(trailers http.Header) bool {
+	for _, name := range digestTrailers {
+		if trailers.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// trailers returns the final values of the trailers in header once the
+// handler has returned, announced or not, by their canonical names.
+// Trailers that were announced but never sent are left out.
+func trailers(header http.Header) http.Header {
+	var values http.Header
+	add := func(name string, value []string) {
+		if len(value) == 0 || value[0] == "" {
+			return
+		}
+		if values == nil {
+			values = make(http.Header)
+		}
+		values[http.CanonicalHeaderKey(name)] = value
+	}
+	for _, name := range declaredTrailers(header) {
+		add(name, header.Values(name))
+	}
+	for key, value := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			add(key[len(http.TrailerPrefix):], value)
+		}
+	}
+	return values
+}
+
+// parseSha256Digest returns the sha256 digest in value, which is either a
+// Content-Digest or Repr-Digest field (RFC 9530), e.g. `sha-256=:base64:`,
+// or a legacy Digest field (RFC 3230), e.g. `SHA-256=base64`. ok is false if
+// value has no sha256 digest.
+func parseSha256Digest(value string) (sum []byte, ok bool) {
+	for _, member := range strings.Split(value, ",") {
+		algorithm, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":"))
+		if err != nil {
+			continue
+		}
+		return sum, true
+	}
+	return nil, false
+}
+
+// trailerDigests returns the sha256 digests of the content delivered as
+// trailers
+func (rww *responseWriterWrapper) trailerDigests(trailers http.Header) []expectedDigest {
+	header := rww.Header()
+	if rww.contentHash == nil || len(trailers) == 0 {
+		return nil
+	}
+	var digests []expectedDigest
+	for _, name := range digestTrailers {
+		if name != "Content-Digest" && header.Get("Content-Encoding") != "" {
+			// The digest is of the decoded representation, which isn't what's stored
+			continue
+		}
+		if sum, ok := parseSha256Digest(trailers.Get(name)); ok {
+			digests = append(digests, expectedDigest{name: name, sum: sum})
+		}
+	}
+	return digests
+}
+
+// storeTrailerEtag stores the ETag delivered as a trailer, unless the
+// response had one in its header
+func (rww *responseWriterWrapper) storeTrailerEtag(trailers http.Header) {
+	if rww.etag != "" {
+		return
+	}
+	if etag := trailers.Get("ETag"); etag != "" {
+		if canonical, ok := canonicalEtag(etag); ok {
+			rww.storeEtag(canonical)
+		} else {
+			rww.logger.Warn("invalid ETag trailer, continuing without storing it",
+				zap.String("etag", etag))
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSha256Digest(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+	testCases := []struct {
+		value string
+		ok    bool
+	}{
+		{value: "sha-256=:" + encoded + ":", ok: true},
+		{value: "sha-512=:AAAA:, sha-256=:" + encoded + ":", ok: true},
+		{value: "SHA-256=" + encoded, ok: true},
+		{value: "md5=:AAAA:", ok: false},
+		{value: "sha-256=:not base64:", ok: false},
+		{value: "", ok: false},
+	}
+	for i, test := range testCases {
+		actual, ok := parseSha256Digest(test.value)
+		if ok != test.ok {
+			t.Errorf("Test %d (%s) - expected ok %v, got %v", i, test.value, test.ok, ok)
+		}
+		if ok && string(actual) != string(sum[:]) {
+			t.Errorf("Test %d (%s) - unexpected digest %x", i, test.value, actual)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	wrong := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)) + ":"
+	testCases := []struct {
+		name     string
+		declared string
+		trailers map[string]string
+		mirrored bool
+		etag     string
+	}{
+		{name: "etag", declared: "ETag", trailers: map[string]string{"ETag": `"v1"`}, mirrored: true, etag: `"v1"`},
+		{name: "undeclared etag", trailers: map[string]string{http.TrailerPrefix + "ETag": `"v1"`}, mirrored: true, etag: `"v1"`},
+		{name: "invalid etag", declared: "ETag", trailers: map[string]string{"ETag": `"a", "b"`}, mirrored: true},
+		{name: "digest", declared: "Repr-Digest", trailers: map[string]string{"Repr-Digest": digest}, mirrored: true},
+		{name: "digest mismatch", declared: "Repr-Digest", trailers: map[string]string{"Repr-Digest": wrong}, mirrored: false},
+		{name: "content digest mismatch", declared: "Content-Digest", trailers: map[string]string{"Content-Digest": wrong}, mirrored: false},
+		{name: "never sent", declared: "ETag, Repr-Digest", mirrored: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag"})
+			_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				if test.declared != "" {
+					w.Header().Set("Trailer", test.declared)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				for name, value := range test.trailers {
+					w.Header()[http.CanonicalHeaderKey(name)] = []string{value}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(filepath.Join(root, "file.txt"))
+			if test.mirrored != (err == nil) {
+				t.Fatalf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			etag, _ := os.ReadFile(filepath.Join(root, "file.txt.etag"))
+			if string(etag) != test.etag {
+				t.Errorf("expected stored ETag %q, got %q", test.etag, etag)
+			}
+		})
+	}
+}
+
+func TestForwardTrailers(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	expected := http.Header{"Repr-Digest": {digest}, "X-Checksum": {"abc"}}
+	testCases := []struct {
+		name     string
+		declared bool
+	}{
+		{name: "declared", declared: true},
+		{name: "undeclared", declared: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, StoreResponseMeta: &ResponseMeta{}})
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if test.declared {
+					w.Header().Set("Trailer", "Repr-Digest, X-Checksum")
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				// Undeclared trailers are only sent with chunked encoding
+				http.NewResponseController(w).Flush()
+				for name, values := range expected {
+					if !test.declared {
+						name = http.TrailerPrefix + name
+					}
+					w.Header()[name] = values
+				}
+				return nil
+			})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				if err := mir.ServeHTTP(w, r, next); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != "content" {
+				t.Fatalf("expected body %q, got %q, error: %v", "content", body, err)
+			}
+			if !reflect.DeepEqual(resp.Trailer, expected) {
+				t.Errorf("expected client trailers %v, got %v", expected, resp.Trailer)
+			}
+
+			stored, err := ReadResponse(filepath.Join(root, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored.Body.Close()
+			if !reflect.DeepEqual(stored.Trailer, expected) {
+				t.Errorf("expected stored trailers %v, got %v", expected, stored.Trailer)
+			}
+		})
+	}
+}
+
+func TestServeTrailerEtag(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MaxAge: caddy.Duration(time.Hour)})
+	_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "ETag")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		// Only known once the body has been streamed
+		w.Header().Set("ETag", `"computed"`)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+	req.Header.Set("If-None-Match", `"computed"`)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	rec := httptest.NewRecorder()
+	err = mir.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		t.Error("fresh local copy not served")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != `"computed"` {
+		t.Errorf("expected 304 with the ETag of the trailer, got %d %v", rec.Code, rec.Header())
+	}
+}
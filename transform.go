@@ -0,0 +1,374 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(JSONTransformer{})
+}
+
+// Transformer is implemented by the guest modules of the
+// http.handlers.mirror.transformers namespace, which rewrite the content of
+// responses before it is stored, e.g. to normalize it. What is sent to the
+// client is left as is.
+type Transformer interface {
+	// Transform returns the content to store in place of the response body
+	// read from r. header is that of the response, and must not be
+	// modified. An error, returned or from reading the returned reader,
+	// aborts mirroring the response.
+	Transform(r io.Reader, header http.Header) (io.Reader, error)
+}
+
+// namedTransformer is a transformer with the name of its module
+type namedTransformer struct {
+	name string
+	Transformer
+}
+
+// transformedReader annotates the errors of the content returned by a
+// transformer with its name
+type transformedReader struct {
+	name string
+	io.Reader
+}
+
+func (tr transformedReader) Read(p []byte) (int, error) {
+	n, err := tr.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: %w", tr.name, err)
+	}
+	return n, err
+}
+
+// errTransformAborted is what the transformers read once mirroring the
+// response has been aborted
+var errTransformAborted = errors.New("mirroring aborted")
+
+// transformPipe feeds the response body through the transformers, in a
+// goroutine of its own, which writes their output to the pending mirror
+// file. The goroutine owns the writes to the file, their hash and samples
+// until it is done.
+type transformPipe struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	// Set by the goroutine before done is closed: the error that stopped
+	// it, and the size and hash of the stored content
+	err  error
+	size int64
+	hash hash.Hash
+}
+
+// startTransform starts feeding the response through the transformers, if
+// any. The pending mirror file then receives their output, which is only
+// known to be complete at the end of the stream: its size is no longer
+// that of the Content-Length, which only applies to the response itself.
+func (rww *responseWriterWrapper) startTransform() {
+	transformers := rww.config.transformers
+	if len(transformers) == 0 || rww.file == nil {
+		return
+	}
+	pr, pw := io.Pipe()
+	tp := &transformPipe{pw: pw, done: make(chan struct{})}
+	if rww.contentHash != nil {
+		// The hash of the response keeps verifying digest trailers
+		tp.hash = newContentHash()
+	}
+	header := rww.Header().Clone()
+	file := rww.file
+	go func() {
+		defer close(tp.done)
+		var content io.Reader = pr
+		var err error
+		for _, transformer := range transformers {
+			content, err = transformer.Transform(content, header)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", transformer.name, err)
+				break
+			}
+			content = transformedReader{name: transformer.name, Reader: content}
+		}
+		if err == nil {
+			_, err = io.Copy(writerFunc(func(data []byte) (int, error) {
+				written, err := writeAll(file, data)
+				tp.size += int64(written)
+				if tp.hash != nil {
+					tp.hash.Write(data[:written])
+				}
+				if rww.sampled(-1) {
+					rww.appendSample(data[:written])
+				}
+				return written, err
+			}), content)
+		}
+		if err == nil {
+			// Transformers needn't read all of the response
+			_, err = io.Copy(io.Discard, pr)
+		}
+		tp.err = err
+		// Writes of the response fail from now on, if any are left
+		pr.CloseWithError(err)
+	}()
+	rww.transform = tp
+}
+
+// writeTransform feeds data to the transformers, aborting mirroring the
+// response if they failed. If they don't take it within write_timeout, as
+// when their output can't be written, the pending mirror files are
+// abandoned and errWriteTimeout is returned. The data is then fed from the
+// goroutine writing the mirror file, which the transformers read from.
+func (rww *responseWriterWrapper) writeTransform(data []byte) (int, error) {
+	tp := rww.transform
+	var err error
+	if timeout := time.Duration(rww.config.WriteTimeout); timeout <= 0 {
+		_, err = tp.pw.Write(data)
+	} else {
+		if rww.writer == nil {
+			rww.writer = newFileWriter(tp.pw)
+		}
+		res, ok := rww.writer.write(data, timeout)
+		if !ok {
+			rww.abandonTransform(timeout)
+			return 0, errWriteTimeout
+		}
+		err = res.err
+	}
+	if err != nil {
+		tp.pw.CloseWithError(err)
+		<-tp.done
+		rww.discardTransform(tp.err)
+	}
+	return len(data), nil
+}
+
+// awaitTransform waits for done, closed once the transformers have made
+// progress, for up to write_timeout. It reports false if that was exceeded,
+// having abandoned the pending mirror files.
+func (rww *responseWriterWrapper) awaitTransform(done <-chan struct{}) bool {
+	timeout := time.Duration(rww.config.WriteTimeout)
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+	rww.abandonTransform(timeout)
+	return false
+}
+
+// abandonTransform abandons the pending mirror files after the transformers
+// took longer than timeout. They are cleaned up once the transformers are
+// done with them.
+func (rww *responseWriterWrapper) abandonTransform(timeout time.Duration) {
+	rww.logger.Error("mirror file write timed out, abandoning mirror",
+		zap.Duration("write_timeout", timeout),
+		zap.Int64("bytes_written", rww.bytesWritten))
+	rww.decision = decisionDiscard
+	rww.config.stats.failures.Add(1)
+	rww.endInflight()
+	rww.spanFailure("mirror file write timed out", errWriteTimeout)
+	tp := rww.transform
+	file := rww.file
+	etagFile := rww.etagFile
+	rww.transform = nil
+	rww.file = nil
+	rww.etagFile = nil
+	rww.contentHash = nil
+	rww.stopWriter()
+	tp.pw.CloseWithError(errWriteTimeout)
+	go func() {
+		<-tp.done
+		err := errors.Join(file.Cleanup(), cleanupPending(etagFile))
+		if err != nil {
+			rww.logger.Error("failed to clean up abandoned mirror temp files",
+				zap.Error(err))
+		}
+	}()
+}
+
+// endTransform waits for the transformers to reach the end of the stream,
+// and then stores what they wrote in place of the response: its size and
+// its hash. It reports whether the pending mirror file is still pending,
+// having discarded it if they failed.
+func (rww *responseWriterWrapper) endTransform() bool {
+	tp := rww.transform
+	if tp == nil {
+		return true
+	}
+	tp.pw.Close()
+	if !rww.awaitTransform(tp.done) {
+		return false
+	}
+	if tp.err != nil {
+		rww.discardTransform(tp.err)
+		return false
+	}
+	return true
+}
+
+// useTransformed makes the transformed content that of the response, once
+// the response has been verified
+func (rww *responseWriterWrapper) useTransformed() {
+	tp := rww.transform
+	if tp == nil {
+		return
+	}
+	rww.bytesWritten = tp.size
+	if rww.contentHash != nil && !rww.overHashSize(tp.size) {
+		rww.contentHash = tp.hash
+	} else if rww.contentHash != nil {
+		rww.skipHash()
+	}
+}
+
+// discardTransform discards the pending mirror file after the transformers
+// failed with err
+func (rww *responseWriterWrapper) discardTransform(err error) {
+	rww.config.stats.failures.Add(1)
+	rww.spanFailure("transformer failed", err)
+	rww.discard(zapcore.WarnLevel, "transformer failed", false, zap.Error(err))
+}
+
+// stopTransform stops feeding the response through the transformers, and
+// waits for their goroutine to be done with the pending mirror file
+func (rww *responseWriterWrapper) stopTransform() {
+	if rww.transform == nil {
+		return
+	}
+	rww.transform.pw.CloseWithError(errTransformAborted)
+	<-rww.transform.done
+}
+
+// JSONTransformer stores JSON documents re-encoded compactly with their
+// object keys sorted, so that equivalent documents are stored identically
+// and deduplicate. Responses of other types are stored as is, and so are
+// documents larger than max_size, as a document is held in memory while
+// re-encoded.
+type JSONTransformer struct {
+	// Media types re-encoded. Default is application/json and types with
+	// the +json suffix.
+	Types []string `json:"types,omitempty"`
+
+	// Size in bytes of the largest document re-encoded, as told by its
+	// Content-Length, or else by reading it. Default is 10MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+const defaultJSONTransformMaxSize = 10 << 20
+
+// maxSize returns the size of the largest document re-encoded
+func (jt *JSONTransformer) maxSize() int64 {
+	if jt.MaxSize > 0 {
+		return jt.MaxSize
+	}
+	return defaultJSONTransformMaxSize
+}
+
+func (JSONTransformer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirror.transformers.json",
+		New: func() caddy.Module { return new(JSONTransformer) },
+	}
+}
+
+// transforms reports whether a response of contentType is re-encoded
+func (jt *JSONTransformer) transforms(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if len(jt.Types) > 0 {
+		return slices.Contains(jt.Types, mediaType)
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Transform re-encodes the JSON document read from r. Numbers are kept as
+// written.
+func (jt *JSONTransformer) Transform(r io.Reader, header http.Header) (io.Reader, error) {
+	if !jt.transforms(header.Get("Content-Type")) {
+		return r, nil
+	}
+	maxSize := jt.maxSize()
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && size > maxSize {
+		return r, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		// Stored as is, what was read followed by the rest
+		return io.MultiReader(bytes.NewReader(data), r), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("decoding JSON: data after the document")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("encoding JSON: %w", err)
+	}
+	return bytes.NewReader(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// UnmarshalCaddyfile parses the json transformer with this syntax:
+//
+//	transformer json [<types...>] {
+//	    max_size <size>
+//	}
+func (jt *JSONTransformer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume transformer name
+	jt.Types = d.RemainingArgs()
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "max_size":
+			var val string
+			if !d.Args(&val) || d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(val)
+			if err != nil {
+				return d.Errf("parsing json transformer max_size: %v", err)
+			}
+			jt.MaxSize = int64(size)
+		default:
+			return d.Errf("unknown json transformer subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ Transformer           = (*JSONTransformer)(nil)
+	_ caddyfile.Unmarshaler = (*JSONTransformer)(nil)
+)
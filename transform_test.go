@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// transformerFunc adapts a function to the Transformer interface
+type transformerFunc func(r io.Reader, header http.Header) (io.Reader, error)
+
+func (f transformerFunc) Transform(r io.Reader, header http.Header) (io.Reader, error) {
+	return f(r, header)
+}
+
+func TestTransformers(t *testing.T) {
+	document := `{"b": [1.50, "<a>"], "a": {"d": null, "c": true}}`
+	canonical := `{"a":{"c":true,"d":null},"b":[1.50,"<a>"]}`
+	failing := transformerFunc(func(r io.Reader, header http.Header) (io.Reader, error) {
+		return io.MultiReader(io.LimitReader(r, 2), iotest.ErrReader(errors.New("boom"))), nil
+	})
+	head := transformerFunc(func(r io.Reader, header http.Header) (io.Reader, error) {
+		return io.LimitReader(r, 4), nil
+	})
+	testCases := []struct {
+		name         string
+		transformers []namedTransformer
+		contentType  string
+		content      string
+		digest       bool
+		stored       string
+		mirrored     bool
+	}{
+		{name: "json", transformers: []namedTransformer{{"json", &JSONTransformer{}}}, contentType: "application/json", content: document, stored: canonical, mirrored: true},
+		{name: "json with digest trailer", transformers: []namedTransformer{{"json", &JSONTransformer{}}}, contentType: "application/json", content: document, digest: true, stored: canonical, mirrored: true},
+		{name: "other type", transformers: []namedTransformer{{"json", &JSONTransformer{}}}, contentType: "text/plain", content: document, stored: document, mirrored: true},
+		{name: "invalid json", transformers: []namedTransformer{{"json", &JSONTransformer{}}}, contentType: "application/json", content: `{"a":`, mirrored: false},
+		{name: "chained", transformers: []namedTransformer{{"json", &JSONTransformer{}}, {"head", head}}, contentType: "application/json", content: document, stored: canonical[:4], mirrored: true},
+		{name: "failing mid-stream", transformers: []namedTransformer{{"failing", failing}}, contentType: "text/plain", content: document, mirrored: false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, VerifyWrites: true})
+			mir.transformers = test.transformers
+			rec, err := serveMirror(mir, "/doc.json", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", test.contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(test.content)))
+				if test.digest {
+					w.Header().Set("Trailer", "Repr-Digest")
+				}
+				w.WriteHeader(http.StatusOK)
+				// Written in pieces, as the transformers read the stream
+				w.Write([]byte(test.content[:5]))
+				w.Write([]byte(test.content[5:]))
+				if test.digest {
+					sum := sha256.Sum256([]byte(test.content))
+					w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Body.String() != test.content {
+				t.Errorf("expected response passed on as is, got %q", rec.Body.String())
+			}
+			stored, err := os.ReadFile(filepath.Join(root, "doc.json"))
+			if (err == nil) != test.mirrored {
+				t.Fatalf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if test.mirrored && string(stored) != test.stored {
+				t.Errorf("expected %q stored, got %q", test.stored, stored)
+			}
+			if entries, _ := os.ReadDir(root); len(entries) > 1 || !test.mirrored && len(entries) > 0 {
+				t.Errorf("pending files left behind: %v", entries)
+			}
+		})
+	}
+}
+
+func TestTransformerWriteTimeout(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, WriteTimeout: caddy.Duration(50 * time.Millisecond)})
+	// A transformer stuck writing its output takes no more of the response
+	release := make(chan struct{})
+	stuck := transformerFunc(func(r io.Reader, header http.Header) (io.Reader, error) {
+		<-release
+		return r, nil
+	})
+	mir.transformers = []namedTransformer{{"stuck", stuck}}
+	content := strings.Repeat("x", 100)
+	rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content[:50]))
+		w.Write([]byte(content[50:]))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != content {
+		t.Errorf("expected response passed on as is, got %q", rec.Body.String())
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if entries, _ := os.ReadDir(root); len(entries) == 0 {
+			return
+		}
+	}
+	entries, _ := os.ReadDir(root)
+	t.Errorf("abandoned files left behind: %v", entries)
+}
+
+func TestJSONTransformer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		types         []string
+		maxSize       int64
+		contentType   string
+		contentLength string
+		content       string
+		expected      string
+		valid         bool
+	}{
+		{name: "sorted", contentType: "application/json; charset=utf-8", content: "{\"z\":1,\n \"y\": 2e3}\n", expected: `{"y":2e3,"z":1}`, valid: true},
+		{name: "suffix", contentType: "application/ld+json", content: `[ {"b":1,"a":2} ]`, expected: `[{"a":2,"b":1}]`, valid: true},
+		{name: "not json", contentType: "text/html", content: `{ "a" : 1 }`, expected: `{ "a" : 1 }`, valid: true},
+		{name: "type not listed", types: []string{"application/vnd.api+json"}, contentType: "application/json", content: `{ }`, expected: `{ }`, valid: true},
+		{name: "trailing data", contentType: "application/json", content: `{} {}`, valid: false},
+		{name: "truncated", contentType: "application/json", content: `{"a": [`, valid: false},
+		{name: "larger than max_size", maxSize: 8, contentType: "application/json", content: `{ "a" : 1 }`, expected: `{ "a" : 1 }`, valid: true},
+		{name: "length larger than max_size", maxSize: 8, contentType: "application/json", contentLength: "11", content: `{ "a" : 1 }`, expected: `{ "a" : 1 }`, valid: true},
+		{name: "max_size", maxSize: 11, contentType: "application/json", content: `{ "a" : 1 }`, expected: `{"a":1}`, valid: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			jt := &JSONTransformer{Types: test.types, MaxSize: test.maxSize}
+			header := http.Header{"Content-Type": {test.contentType}}
+			if test.contentLength != "" {
+				header.Set("Content-Length", test.contentLength)
+			}
+			r, err := jt.Transform(strings.NewReader(test.content), header)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if err != nil {
+				return
+			}
+			transformed, _ := io.ReadAll(r)
+			if string(transformed) != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, transformed)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTransformer(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		transformer json application/json {
+			max_size 1MiB
+		}
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(mir.TransformersRaw) != 1 || string(mir.TransformersRaw[0]) != `{"max_size":1048576,"transformer":"json","types":["application/json"]}` {
+		t.Errorf("unexpected transformers %s", mir.TransformersRaw)
+	}
+	mir.Warc = &Warc{Dir: "/warc"}
+	if err := mir.Validate(); err == nil {
+		t.Error("expected transformers with warc refused")
+	}
+}
@@ -0,0 +1,179 @@
+package mirror
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uploadMethods are the methods whose request bodies can be mirrored with
+// mirror_methods
+var uploadMethods = []string{http.MethodPut, http.MethodPost}
+
+// mirrorsUpload reports whether the body of r is mirrored
+func (mir *Mirror) mirrorsUpload(r *http.Request) bool {
+	return slices.Contains(mir.MirrorMethods, r.Method)
+}
+
+// uploadHeader is the response writer of the wrapper mirroring an upload.
+// The upload is written to it as if it were a response, of which it only
+// keeps the header, that of the request body.
+type uploadHeader http.Header
+
+func (h uploadHeader) Header() http.Header {
+	return http.Header(h)
+}
+
+func (h uploadHeader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (h uploadHeader) WriteHeader(int) {}
+
+// uploadStatus records the status of the response to an upload
+type uploadStatus struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+}
+
+func (us *uploadStatus) WriteHeader(statusCode int) {
+	// Informational responses such as 100 Continue aren't final
+	if us.status == 0 && statusCode >= 200 {
+		us.status = statusCode
+	}
+	us.ResponseWriterWrapper.WriteHeader(statusCode)
+}
+
+// final returns the status of the response, which is 200 unless written
+func (us *uploadStatus) final() int {
+	if us.status == 0 {
+		return http.StatusOK
+	}
+	return us.status
+}
+
+// uploadBody is a request body that is mirrored as the next handler reads
+// it. Reads after finish, such as by a transport still sending the body
+// after the response came, are no longer mirrored.
+type uploadBody struct {
+	io.ReadCloser
+	rww *responseWriterWrapper
+
+	mu       sync.Mutex
+	eof      bool
+	finished bool
+}
+
+func (ub *uploadBody) Read(p []byte) (int, error) {
+	n, err := ub.ReadCloser.Read(p)
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	if ub.finished {
+		return n, err
+	}
+	if n > 0 {
+		if _, err := ub.rww.writeMirror(p[:n]); err != nil {
+			ub.rww.discard(zapcore.ErrorLevel, "failed to write upload", false, zap.Error(err))
+		}
+	}
+	if err == io.EOF {
+		ub.eof = true
+	}
+	return n, err
+}
+
+// finish stops mirroring the body, reporting whether all of it was read
+func (ub *uploadBody) finish() bool {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	ub.finished = true
+	return ub.eof
+}
+
+// mirrorUpload passes the upload r on to the next handler while mirroring
+// its body to the file a GET of the same URL is mirrored to. The file is
+// only finalized if the next handler read all of the body and responded
+// with a 2xx status.
+func (mir *Mirror) mirrorUpload(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, root string, urlp string, logger *zap.Logger) error {
+	if mir.isReadOnly() || (mir.health != nil && !mir.health.healthy(root)) || (mir.rootChecks != nil && mir.rootChecks.check(root, logger) != nil) {
+		mir.setLogFields(r, decisionSkip, 0, "")
+		return next.ServeHTTP(w, r)
+	}
+	header := make(http.Header)
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if r.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	rww := &responseWriterWrapper{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: uploadHeader(header)},
+		config:                mir,
+		root:                  root,
+		path:                  urlp,
+		logger:                logger.With(zap.Namespace("rww"), zap.String("method", r.Method)),
+		bytesExpected:         -1,
+		start:                 time.Now(),
+		decision:              decisionSkip,
+		url:                   requestURL(r),
+		requestID:             requestID(r),
+		host:                  r.Host,
+		etagSuffix:            mir.etagSuffix(r),
+	}
+	rww.repl, _ = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	rww.setMetadata(xattrOriginURL, mir.originURL(r))
+	defer rww.Cleanup()
+	defer func() {
+		mir.setLogFields(r, rww.decision, rww.bytesWritten, rww.filename)
+	}()
+
+	if contentType := header.Get("Content-Type"); mir.skipContentType(contentType) {
+		logger.Debug("skip mirroring upload content type",
+			zap.String("content_type", contentType))
+	} else if rww.admit() {
+		rww.startMirror()
+		if rww.setupErr != nil {
+			return caddyhttp.Error(setupErrorStatus(rww.setupErr), rww.setupErr)
+		}
+	}
+	if rww.file == nil {
+		return next.ServeHTTP(w, r)
+	}
+	body := &uploadBody{ReadCloser: r.Body, rww: rww}
+	upstreamReq := r.WithContext(r.Context())
+	upstreamReq.Body = body
+	status := &uploadStatus{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	err := next.ServeHTTP(status, upstreamReq)
+	rww.stopMaxDuration()
+	// An empty body needn't be read
+	complete := body.finish() || r.ContentLength == 0
+	switch {
+	case err != nil:
+		rww.discard(zapcore.WarnLevel, "upstream error", false, zap.Error(err))
+		return err
+	case status.final()/100 != 2:
+		rww.discard(zapcore.DebugLevel, "upload rejected", false, zap.Int("status", status.final()))
+		return nil
+	case !complete:
+		rww.discard(zapcore.WarnLevel, "upload not read to the end", false)
+		return nil
+	}
+	if r.Method == http.MethodPut {
+		// The ETag of the response to a PUT is that of the uploaded content
+		if etag, ok := canonicalEtag(w.Header().Get("ETag")); ok && etag != "" {
+			rww.storeEtag(etag)
+		}
+	}
+	rww.handlerDone(r.Context())
+	if rww.decision == decisionStore {
+		mir.stats.uploads.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package mirror
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorUpload(t *testing.T) {
+	content := "uploaded content"
+	readAll := func(status int) caddyhttp.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return err
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(status)
+			return nil
+		}
+	}
+	testCases := []struct {
+		name           string
+		method         string
+		methods        []string
+		chunked        bool
+		expectContinue bool
+		next           caddyhttp.HandlerFunc
+		status         int
+		mirrored       bool
+	}{
+		{name: "put", method: http.MethodPut, methods: []string{"PUT"}, next: readAll(http.StatusCreated), status: http.StatusCreated, mirrored: true},
+		{name: "post", method: http.MethodPost, methods: []string{"PUT", "POST"}, next: readAll(http.StatusOK), status: http.StatusOK, mirrored: true},
+		{name: "method not mirrored", method: http.MethodPost, methods: []string{"PUT"}, next: readAll(http.StatusOK), status: http.StatusOK, mirrored: false},
+		{name: "chunked", method: http.MethodPut, methods: []string{"PUT"}, chunked: true, next: readAll(http.StatusCreated), status: http.StatusCreated, mirrored: true},
+		{name: "100-continue", method: http.MethodPut, methods: []string{"PUT"}, expectContinue: true, next: readAll(http.StatusCreated), status: http.StatusCreated, mirrored: true},
+		{
+			name:           "100-continue rejected",
+			method:         http.MethodPut,
+			methods:        []string{"PUT"},
+			expectContinue: true,
+			next: func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusForbidden)
+				return nil
+			},
+			status:   http.StatusForbidden,
+			mirrored: false,
+		},
+		{name: "rejected after reading", method: http.MethodPut, methods: []string{"PUT"}, next: readAll(http.StatusInternalServerError), status: http.StatusInternalServerError, mirrored: false},
+		{
+			name:    "rejected after partial read",
+			method:  http.MethodPut,
+			methods: []string{"PUT"},
+			next: func(w http.ResponseWriter, r *http.Request) error {
+				io.ReadFull(r.Body, make([]byte, 4))
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return nil
+			},
+			status:   http.StatusRequestEntityTooLarge,
+			mirrored: false,
+		},
+		{
+			name:    "accepted after partial read",
+			method:  http.MethodPut,
+			methods: []string{"PUT"},
+			next: func(w http.ResponseWriter, r *http.Request) error {
+				io.ReadFull(r.Body, make([]byte, 4))
+				w.WriteHeader(http.StatusCreated)
+				return nil
+			},
+			status:   http.StatusCreated,
+			mirrored: false,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", MirrorMethods: test.methods})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				if err := mir.ServeHTTP(w, r, test.next); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer srv.Close()
+
+			var body io.Reader = strings.NewReader(content)
+			if test.chunked {
+				// Hide the length, so the body is sent chunked
+				body = io.MultiReader(body)
+			}
+			req, err := http.NewRequest(test.method, srv.URL+"/dir/file.bin", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := srv.Client()
+			if test.expectContinue {
+				req.Header.Set("Expect", "100-continue")
+				client.Transport.(*http.Transport).ExpectContinueTimeout = 10 * time.Second
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("expected status %d, got %d", test.status, resp.StatusCode)
+			}
+
+			filename := filepath.Join(root, "dir", "file.bin")
+			mirrored, err := os.ReadFile(filename)
+			if test.mirrored != (err == nil) {
+				t.Fatalf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			if !test.mirrored {
+				return
+			}
+			if string(mirrored) != content {
+				t.Errorf("expected %q mirrored, got %q", content, mirrored)
+			}
+			etag, _ := os.ReadFile(filename + ".etag")
+			if wantEtag := test.method == http.MethodPut; wantEtag != (string(etag) == `"v1"`) {
+				t.Errorf("expected ETag stored %v, got %q", wantEtag, etag)
+			}
+		})
+	}
+}
+
+func TestMirrorMethodsValidation(t *testing.T) {
+	for _, methods := range [][]string{{"PUT", "POST"}, {"DELETE"}} {
+		err := Mirror{MirrorMethods: methods}.Validate()
+		if valid := methods[0] != "DELETE"; valid != (err == nil) {
+			t.Errorf("%v: expected valid %v, got %v", methods, valid, err)
+		}
+	}
+}
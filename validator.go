@@ -0,0 +1,212 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(MagicValidator{})
+}
+
+// Validator is implemented by the guest modules of the
+// http.handlers.mirror.validators namespace, which approve each mirrored
+// file before it is renamed into place, e.g. to check signatures or to
+// scan it for malware.
+type Validator interface {
+	// Validate returns an error to reject file. ctx is canceled once
+	// validator_timeout has passed.
+	Validate(ctx context.Context, file PendingFile) error
+}
+
+// PendingFile describes a mirrored file awaiting validation
+type PendingFile struct {
+	// Path the file is renamed to once approved
+	Path string
+	// Content of the file, which is Size bytes long
+	Content io.ReaderAt
+	Size    int64
+	// Header of the mirrored response
+	Header http.Header
+	// Hex encoded digests of the content by algorithm, such as sha256, if
+	// computed
+	Digests map[string]string
+	// URL of the request whose response was mirrored
+	URL string
+}
+
+const defaultValidatorTimeout = 30 * time.Second
+
+// namedValidator is a validator with the name of its module
+type namedValidator struct {
+	name string
+	Validator
+}
+
+func (mir *Mirror) validatorTimeout() time.Duration {
+	if mir.ValidatorTimeout > 0 {
+		return time.Duration(mir.ValidatorTimeout)
+	}
+	return defaultValidatorTimeout
+}
+
+// validate runs the validators on the pending mirror file, whose SHA-256 is
+// sum if it was hashed. It reports whether all of them approved it, having
+// quarantined or discarded it otherwise.
+func (rww *responseWriterWrapper) validate(sum string) bool {
+	validators := rww.config.validators
+	if len(validators) == 0 {
+		return true
+	}
+	// Opened anew, as the pending file may be written with direct I/O
+	content, err := os.Open(rww.file.Name())
+	if err != nil {
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("failed to open mirror file for validation", err)
+		rww.discard(zapcore.ErrorLevel, "failed to open mirror file for validation", false, zap.Error(err))
+		return false
+	}
+	defer content.Close()
+	file := PendingFile{
+		Path:    rww.filename,
+		Content: content,
+		Size:    rww.bytesWritten,
+		Header:  rww.Header().Clone(),
+		URL:     rww.url,
+	}
+	if sum != "" {
+		file.Digests = map[string]string{"sha256": sum}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rww.config.validatorTimeout())
+	defer cancel()
+	for _, validator := range validators {
+		// Validators that don't heed ctx are left behind when it expires
+		result := make(chan error, 1)
+		go func() {
+			result <- validator.Validate(ctx, file)
+		}()
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			rww.config.stats.failures.Add(1)
+			rww.spanFailure("validation timed out", err)
+			rww.discard(zapcore.WarnLevel, "validation timed out", false,
+				zap.String("validator", validator.name),
+				zap.Duration("timeout", rww.config.validatorTimeout()))
+			return false
+		}
+		if err != nil {
+			rww.config.stats.rejected.Add(1)
+			rww.spanFailure("rejected by validator", err)
+			rww.quarantineWith(quarantineInfo{Validator: validator.name, Reason: err.Error()},
+				zap.String("validator", validator.name))
+			rww.discard(zapcore.WarnLevel, "rejected by validator", false,
+				zap.String("validator", validator.name),
+				zap.Error(err))
+			return false
+		}
+	}
+	return true
+}
+
+// MagicValidator rejects files whose content contradicts their
+// Content-Type, judging by the magic bytes it starts with, such as HTML
+// error pages served with a 200 status in place of images or archives.
+// Files of types without magic bytes pass, and so do files with a
+// Content-Encoding, whose content is encoded rather than of their type.
+type MagicValidator struct {
+	// Media types checked. Default is all of those with magic bytes: PNG,
+	// JPEG, GIF, WebP and BMP images, PDF, zip, gzip and RAR archives,
+	// WebAssembly and WOFF fonts.
+	Types []string `json:"types,omitempty"`
+}
+
+// magicTypes are the media types with magic bytes, and the types
+// http.DetectContentType sniffs from them
+var magicTypes = map[string]string{
+	"image/png":                    "image/png",
+	"image/jpeg":                   "image/jpeg",
+	"image/gif":                    "image/gif",
+	"image/webp":                   "image/webp",
+	"image/bmp":                    "image/bmp",
+	"application/pdf":              "application/pdf",
+	"application/zip":              "application/zip",
+	"application/gzip":             "application/x-gzip",
+	"application/x-gzip":           "application/x-gzip",
+	"application/vnd.rar":          "application/x-rar-compressed",
+	"application/x-rar-compressed": "application/x-rar-compressed",
+	"application/wasm":             "application/wasm",
+	"font/woff":                    "font/woff",
+	"font/woff2":                   "font/woff2",
+}
+
+func (MagicValidator) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirror.validators.magic",
+		New: func() caddy.Module { return new(MagicValidator) },
+	}
+}
+
+// Provision checks that the types have magic bytes
+func (mv *MagicValidator) Provision(caddy.Context) error {
+	for _, mediaType := range mv.Types {
+		if _, ok := magicTypes[mediaType]; !ok {
+			return fmt.Errorf("media type %s has no magic bytes", mediaType)
+		}
+	}
+	return nil
+}
+
+// Validate rejects file if its Content-Type is checked and its content
+// doesn't start with the magic bytes of that type
+func (mv *MagicValidator) Validate(_ context.Context, file PendingFile) error {
+	if encoding := file.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(file.Header.Get("Content-Type"))
+	sniffable, ok := magicTypes[mediaType]
+	if !ok || len(mv.Types) > 0 && !slices.Contains(mv.Types, mediaType) {
+		return nil
+	}
+	head := make([]byte, 512)
+	n, err := file.Content.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if sniffed != sniffable {
+		return fmt.Errorf("content sniffed as %s, not %s", sniffed, mediaType)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile parses the magic validator with this syntax:
+//
+//	validator magic [<types...>]
+func (mv *MagicValidator) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume validator name
+	mv.Types = d.RemainingArgs()
+	return nil
+}
+
+// Interface guards
+var (
+	_ Validator             = (*MagicValidator)(nil)
+	_ caddy.Provisioner     = (*MagicValidator)(nil)
+	_ caddyfile.Unmarshaler = (*MagicValidator)(nil)
+)
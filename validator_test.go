@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validatorFunc adapts a function to the Validator interface
+type validatorFunc func(ctx context.Context, file PendingFile) error
+
+func (f validatorFunc) Validate(ctx context.Context, file PendingFile) error {
+	return f(ctx, file)
+}
+
+func TestValidators(t *testing.T) {
+	accept := validatorFunc(func(ctx context.Context, file PendingFile) error {
+		content, err := io.ReadAll(io.NewSectionReader(file.Content, 0, file.Size))
+		if err != nil || string(content) != "content" || file.Path == "" || file.Header.Get("Content-Type") == "" {
+			return errors.New("unexpected pending file")
+		}
+		return nil
+	})
+	reject := validatorFunc(func(ctx context.Context, file PendingFile) error {
+		return errors.New("signature mismatch")
+	})
+	hang := validatorFunc(func(ctx context.Context, file PendingFile) error {
+		// Ignores ctx, like a stuck scanner
+		time.Sleep(time.Second)
+		return nil
+	})
+	testCases := []struct {
+		name        string
+		validators  []namedValidator
+		mirrored    bool
+		quarantined bool
+	}{
+		{name: "accepted", validators: []namedValidator{{"accept", accept}}, mirrored: true},
+		{name: "rejected", validators: []namedValidator{{"accept", accept}, {"reject", reject}}, quarantined: true},
+		{name: "timed out", validators: []namedValidator{{"hang", hang}}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{
+				Root:             root,
+				Quarantine:       &Quarantine{Dir: dir},
+				ValidatorTimeout: caddy.Duration(50 * time.Millisecond),
+			})
+			mir.validators = test.validators
+			rec, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Body.String() != "content" {
+				t.Errorf("expected response passed on, got %q", rec.Body.String())
+			}
+			if _, err := os.Stat(filepath.Join(root, "file.txt")); (err == nil) != test.mirrored {
+				t.Errorf("expected mirrored %v, got %v", test.mirrored, err)
+			}
+			entries, _ := os.ReadDir(dir)
+			if quarantined := len(entries) > 0; quarantined != test.quarantined {
+				t.Fatalf("expected quarantined %v, got %v", test.quarantined, entries)
+			}
+			if test.quarantined {
+				var info quarantineInfo
+				data, _ := os.ReadFile(filepath.Join(dir, entries[0].Name()+quarantineInfoSuffix))
+				if err := json.Unmarshal(data, &info); err != nil || info.Validator != "reject" || info.Reason != "signature mismatch" {
+					t.Errorf("unexpected quarantine info %+v: %v", info, err)
+				}
+			}
+			if leftovers, _ := os.ReadDir(root); len(leftovers) > 1 || !test.mirrored && len(leftovers) > 0 {
+				t.Errorf("pending files left behind: %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestMagicValidator(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	testCases := []struct {
+		name        string
+		types       []string
+		contentType string
+		encoding    string
+		content     []byte
+		valid       bool
+	}{
+		{name: "png", contentType: "image/png", content: png, valid: true},
+		{name: "html as png", contentType: "image/png", content: []byte("<!DOCTYPE html><html>error</html>"), valid: false},
+		{name: "empty png", contentType: "image/png", valid: false},
+		{name: "gzip", contentType: "application/gzip", content: []byte("\x1f\x8b\x08\x00"), valid: true},
+		{name: "type without magic", contentType: "text/css", content: []byte("<html>"), valid: true},
+		{name: "encoded png", contentType: "image/png", encoding: "gzip", content: []byte("\x1f\x8b\x08\x00"), valid: true},
+		{name: "identity encoded html as png", contentType: "image/png", encoding: "identity", content: []byte("<html>"), valid: false},
+		{name: "type not checked", types: []string{"application/pdf"}, contentType: "image/png; charset=binary", content: []byte("<html>"), valid: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mv := &MagicValidator{Types: test.types}
+			if err := mv.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+			header := http.Header{"Content-Type": {test.contentType}}
+			if test.encoding != "" {
+				header.Set("Content-Encoding", test.encoding)
+			}
+			err := mv.Validate(context.Background(), PendingFile{
+				Content: bytes.NewReader(test.content),
+				Size:    int64(len(test.content)),
+				Header:  header,
+			})
+			if (err == nil) != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+	if err := (&MagicValidator{Types: []string{"text/plain"}}).Provision(caddy.Context{}); err == nil {
+		t.Error("expected type without magic bytes refused")
+	}
+}
+
+func TestUnmarshalValidator(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		validator magic image/png application/zip
+		validator_timeout 5s
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(mir.ValidatorsRaw) != 1 || !strings.Contains(string(mir.ValidatorsRaw[0]), `"validator":"magic"`) ||
+		!strings.Contains(string(mir.ValidatorsRaw[0]), `"types":["image/png","application/zip"]`) {
+		t.Errorf("unexpected validators %s", mir.ValidatorsRaw)
+	}
+	if mir.ValidatorTimeout != caddy.Duration(5*time.Second) {
+		t.Errorf("unexpected validator_timeout %v", mir.ValidatorTimeout)
+	}
+}
@@ -0,0 +1,253 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/http"
+	"os"
+)
+
+// expectations are what a response is expected to be like, gathered once
+// all of it has been written, and verified before it is finalized
+type expectations struct {
+	// size is the Content-Length, or -1 if unknown
+	size int64
+	// trailers are the final values of the trailers the response came with
+	trailers http.Header
+	// digests are the digests of the content the response came with
+	digests []expectedDigest
+	// disconnected is the error of the request context, set if the client
+	// went away
+	disconnected error
+	// verified is set once a digest matched, confirming the response is
+	// complete
+	verified bool
+}
+
+// expectedDigest is a sha256 digest of the content, by the field it came in
+type expectedDigest struct {
+	name string
+	sum  []byte
+}
+
+// expectations gathers what the response is expected to be like, in the
+// first phase of finalizing, once all of it has been written
+func (rww *responseWriterWrapper) expectations(ctx context.Context) *expectations {
+	rww.trailers = trailers(rww.Header())
+	rww.storeTrailerEtag(rww.trailers)
+	return &expectations{
+		size:         rww.bytesExpected,
+		trailers:     rww.trailers,
+		digests:      rww.trailerDigests(rww.trailers),
+		disconnected: ctx.Err(),
+	}
+}
+
+// verifications are run in order in the second phase of finalizing. Each
+// reports whether the response may be mirrored, having aborted mirroring
+// it otherwise.
+var verifications = []func(rww *responseWriterWrapper, exp *expectations) bool{
+	(*responseWriterWrapper).verifySize,
+	(*responseWriterWrapper).verifyStreamed,
+	(*responseWriterWrapper).verifyDigests,
+	(*responseWriterWrapper).verifyNotSoft404,
+	(*responseWriterWrapper).verifyComplete,
+}
+
+// verify reports whether the response passes all verifications
+func (rww *responseWriterWrapper) verify(exp *expectations) bool {
+	for _, verification := range verifications {
+		if !verification(rww, exp) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifySize checks that the response has its Content-Length
+func (rww *responseWriterWrapper) verifySize(exp *expectations) bool {
+	if exp.size >= 0 && rww.bytesWritten < exp.size {
+		rww.truncated(exp.size, nil)
+		return false
+	}
+	if exp.size >= 0 && rww.bytesWritten != exp.size {
+		// Longer than its Content-Length, which resuming can't fix
+		rww.discard(zapcore.WarnLevel, "response longer than expected", false,
+			zap.Int64("bytes_expected", exp.size))
+		return false
+	}
+	return true
+}
+
+// truncated discards a response that ended before the expected bytes had
+// been received, with err if upstream failed
+func (rww *responseWriterWrapper) truncated(expected int64, err error) {
+	rww.config.stats.truncated.Add(1)
+	fields := []zap.Field{zap.Int64("bytes_expected", expected)}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	rww.abort(zapcore.WarnLevel, "incomplete response", fields...)
+}
+
+// verifyStreamed rejects streamed responses of unknown length after the
+// client went away, as they may have been cut short
+func (rww *responseWriterWrapper) verifyStreamed(exp *expectations) bool {
+	if exp.size < 0 && rww.streaming && exp.disconnected != nil {
+		rww.abort(zapcore.DebugLevel, "streamed response after client disconnect",
+			zap.Error(exp.disconnected))
+		return false
+	}
+	return true
+}
+
+// verifyDigests checks the digests the response came with against the
+// content, quarantining it if one doesn't match
+func (rww *responseWriterWrapper) verifyDigests(exp *expectations) bool {
+	if len(exp.digests) == 0 {
+		return true
+	}
+	sum := rww.contentHash.Sum(nil)
+	for _, digest := range exp.digests {
+		if !bytes.Equal(digest.sum, sum) {
+			rww.quarantine(digest.name, digest.sum, sum)
+			rww.discard(zapcore.WarnLevel, "digest mismatch", false,
+				zap.String("trailer", digest.name),
+				zap.Binary("expected", digest.sum),
+				zap.Binary("sha256", sum))
+			return false
+		}
+		exp.verified = true
+		rww.config.trace(rww.logger, "digest verified", zap.String("trailer", digest.name))
+	}
+	return true
+}
+
+// verifyNotSoft404 rejects responses that look like soft 404s
+func (rww *responseWriterWrapper) verifyNotSoft404(exp *expectations) bool {
+	return !rww.softNotFound()
+}
+
+// verifyComplete rejects responses whose completeness can't be confirmed,
+// with require_complete
+func (rww *responseWriterWrapper) verifyComplete(exp *expectations) bool {
+	if !rww.config.RequireComplete || exp.verified || exp.size >= 0 {
+		return true
+	}
+	if exp.disconnected != nil {
+		rww.abort(zapcore.WarnLevel, "completeness not confirmed after client disconnect",
+			zap.Error(exp.disconnected))
+		return false
+	}
+	if declaresDigestTrailer(rww.Header()) && !(rww.hashSkipped && receivedDigestTrailer(exp.trailers)) {
+		rww.abort(zapcore.WarnLevel, "completeness not confirmed, announced digest trailer is missing")
+		return false
+	}
+	return true
+}
+
+// verifySample is the number of bytes at either end of a file that are
+// verified when it is larger than verify_max_size
+const verifySample = 64 << 10
+
+// sampled reports whether only samples of the response are verified once
+// it is written
+func (rww *responseWriterWrapper) sampled(size int64) bool {
+	maxSize := rww.config.VerifyMaxSize
+	return rww.config.VerifyWrites && maxSize > 0 && (size < 0 || uint64(size) > maxSize)
+}
+
+// keepSample keeps the first and last bytes of the response, when only
+// those are verified
+func (rww *responseWriterWrapper) keepSample(data []byte) {
+	if rww.sampled(rww.bytesExpected) {
+		rww.appendSample(data)
+	}
+}
+
+// appendSample adds data to the first and last bytes kept
+func (rww *responseWriterWrapper) appendSample(data []byte) {
+	if len(rww.head) < verifySample {
+		rww.head = append(rww.head, data[:min(len(data), verifySample-len(rww.head))]...)
+	}
+	rww.tail = append(rww.tail, data...)
+	if len(rww.tail) > 2*verifySample {
+		rww.tail = append(rww.tail[:0], rww.tail[len(rww.tail)-verifySample:]...)
+	}
+}
+
+// verifyWrite reads the file just written back and compares it to what was
+// written, the whole of it to sum, the sha256 of the response, or only its
+// size and samples. A file that doesn't read back the same is removed, and
+// false returned.
+func (rww *responseWriterWrapper) verifyWrite(sum string) bool {
+	expected, actual, err := rww.readBack(rww.pending, sum)
+	if err == nil && expected == actual {
+		return true
+	}
+	rww.logger.Error("mirrored file failed read-back verification, removing it",
+		zap.String("path", rww.pending),
+		zap.String("expected", expected),
+		zap.String("actual", actual),
+		zap.Error(err))
+	rww.decision = decisionDiscard
+	rww.config.stats.failures.Add(1)
+	rww.config.stats.verifyFailures.Add(1)
+	if err == nil {
+		err = fmt.Errorf("read back %s instead of %s", actual, expected)
+	}
+	rww.spanFailure("mirrored file failed read-back verification", err)
+	if err := rww.config.removeEntry(rww.pending); err != nil {
+		rww.logger.Error("failed to remove mirrored file that failed verification",
+			zap.String("path", rww.pending),
+			zap.Error(err))
+	}
+	return false
+}
+
+// readBack returns what is expected of filename and what it actually has,
+// either its sha256 or, if they differ, its size
+func (rww *responseWriterWrapper) readBack(filename string, sum string) (expected string, actual string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if size := stat.Size(); size != rww.bytesWritten {
+		return fmt.Sprintf("%d bytes", rww.bytesWritten), fmt.Sprintf("%d bytes", size), nil
+	}
+	// Read from storage rather than what is still cached of the writes
+	if err := dropCache(file); err != nil {
+		rww.config.trace(rww.logger, "failed to drop file from page cache", zap.Error(err))
+	}
+	hash := sha256.New()
+	var r io.Reader = file
+	if sum == "" && !rww.sampled(rww.bytesWritten) {
+		// Not hashed with max_hash_size, so only the size can be verified
+		return "", "", nil
+	}
+	if rww.sampled(rww.bytesWritten) {
+		tail := rww.tail[max(0, len(rww.tail)-verifySample):]
+		hash.Write(rww.head)
+		hash.Write(tail)
+		sum = hex.EncodeToString(hash.Sum(nil))
+		hash.Reset()
+		r = io.MultiReader(
+			io.NewSectionReader(file, 0, int64(len(rww.head))),
+			io.NewSectionReader(file, stat.Size()-int64(len(tail)), int64(len(tail))))
+	}
+	if _, err := io.Copy(hash, r); err != nil {
+		return sum, "", err
+	}
+	return sum, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,177 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	content := []byte("content")
+	sum := sha256.Sum256(content)
+	testCases := []struct {
+		name            string
+		requireComplete bool
+		trailer         string
+		exp             expectations
+		ok              bool
+	}{
+		{name: "length matches", exp: expectations{size: 7}, ok: true},
+		{name: "length mismatch", exp: expectations{size: 8}},
+		{name: "unknown length", exp: expectations{size: -1}, ok: true},
+		{name: "digest matches", exp: expectations{size: -1, digests: []expectedDigest{{"Repr-Digest", sum[:]}}}, ok: true},
+		{name: "digest mismatch", exp: expectations{size: 7, digests: []expectedDigest{{"Repr-Digest", make([]byte, len(sum))}}}},
+		{name: "complete by length", requireComplete: true, exp: expectations{size: 7}, ok: true},
+		{name: "complete by digest", requireComplete: true, exp: expectations{size: -1, digests: []expectedDigest{{"Content-Digest", sum[:]}}}, ok: true},
+		{name: "completeness unknown", requireComplete: true, exp: expectations{size: -1}, ok: true},
+		{name: "digest trailer missing", requireComplete: true, trailer: "Repr-Digest", exp: expectations{size: -1}},
+		{name: "disconnected", requireComplete: true, exp: expectations{size: -1, disconnected: context.Canceled}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mir := provisionTestMirror(t, &Mirror{Root: t.TempDir(), RequireComplete: test.requireComplete})
+			rww := &responseWriterWrapper{
+				ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+				config:                mir,
+				logger:                mir.logger,
+				bytesWritten:          int64(len(content)),
+				contentHash:           sha256.New(),
+			}
+			rww.contentHash.Write(content)
+			if test.trailer != "" {
+				rww.Header().Set("Trailer", test.trailer)
+			}
+			if ok := rww.verify(&test.exp); ok != test.ok {
+				t.Errorf("expected ok %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestVerifyWrites(t *testing.T) {
+	root := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, VerifyWrites: true})
+	_, err := serveMirror(mir, "/file.txt", func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(content) != "content" {
+		t.Errorf("verified file not mirrored: %q, error: %v", content, err)
+	}
+}
+
+func TestVerifyWrite(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3*verifySample/16)
+	zeroed := func(b []byte, from int, to int) []byte {
+		b = bytes.Clone(b)
+		clear(b[from:to])
+		return b
+	}
+	testCases := []struct {
+		name     string
+		maxSize  uint64
+		readBack []byte
+		ok       bool
+	}{
+		{name: "intact", readBack: content, ok: true},
+		{name: "zeroed", readBack: zeroed(content, 0, len(content))},
+		{name: "zeroed middle", readBack: zeroed(content, verifySample, 2*verifySample)},
+		{name: "truncated", readBack: content[:len(content)-1]},
+		{name: "sampled intact", maxSize: verifySample, readBack: content, ok: true},
+		{name: "sampled zeroed head", maxSize: verifySample, readBack: zeroed(content, 0, 1)},
+		{name: "sampled zeroed tail", maxSize: verifySample, readBack: zeroed(content, len(content)-1, len(content))},
+		{name: "sampled truncated", maxSize: verifySample, readBack: content[:len(content)-1]},
+		// Only the ends of large files are checked
+		{name: "sampled zeroed middle", maxSize: verifySample, readBack: zeroed(content, verifySample, 2*verifySample), ok: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, EtagFileSuffix: ".etag", VerifyWrites: true, VerifyMaxSize: test.maxSize})
+			filename := filepath.Join(root, "file.bin")
+			for name, data := range map[string][]byte{filename: test.readBack, filename + ".etag": []byte(`"v1"`)} {
+				if err := os.WriteFile(name, data, filePerms); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rww := &responseWriterWrapper{config: mir, logger: mir.logger, pending: filename, bytesExpected: -1, etagSuffix: ".etag"}
+			// Written in chunks, as responses are
+			for i := 0; i < len(content); i += 10000 {
+				chunk := content[i:min(i+10000, len(content))]
+				rww.keepSample(chunk)
+				rww.bytesWritten += int64(len(chunk))
+			}
+			sum := sha256.Sum256(content)
+			failures := mir.stats.verifyFailures.Value()
+
+			if ok := rww.verifyWrite(hex.EncodeToString(sum[:])); ok != test.ok {
+				t.Fatalf("expected verification ok %v, got %v", test.ok, ok)
+			}
+			for _, name := range []string{filename, filename + ".etag"} {
+				if _, err := os.Stat(name); test.ok != !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected %s kept %v, stat error: %v", name, test.ok, err)
+				}
+			}
+			if failed := mir.stats.verifyFailures.Value() - failures; test.ok != (failed == 0) {
+				t.Errorf("expected ok %v, got %d verification failures", test.ok, failed)
+			}
+		})
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+	}{
+		{name: "short body"},
+		{name: "upstream error", err: errors.New("connection reset")},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			root := t.TempDir()
+			mir := provisionTestMirror(t, &Mirror{Root: root, Name: "truncated_test", logger: zap.New(core)})
+			before := mir.stats.truncated.Value()
+			serveMirror(mir, "/file.bin", func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Length", "10")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("01234"))
+				return test.err
+			})
+			if _, err := os.Stat(filepath.Join(root, "file.bin")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("truncated response mirrored, stat error: %v", err)
+			}
+			if truncated := mir.stats.truncated.Value() - before; truncated != 1 {
+				t.Errorf("expected 1 truncated response counted, got %d", truncated)
+			}
+			entries := logs.FilterMessage("mirror aborted: incomplete response").AllUntimed()
+			if len(entries) != 1 || entries[0].Level != zapcore.WarnLevel {
+				t.Fatalf("expected one Warn log, got %v", entries)
+			}
+			fields := entries[0].ContextMap()["rww"].(map[string]any)
+			if fields["path"] != filepath.Join(root, "file.bin") || fields["bytes_expected"] != int64(10) || fields["bytes_written"] != int64(5) {
+				t.Errorf("unexpected log fields %v", fields)
+			}
+			if test.err != nil && fields["error"] != test.err.Error() {
+				t.Errorf("expected upstream error logged, got %v", fields["error"])
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Warc configures archiving mirrored responses as WARC records (ISO 28500,
+// WARC 1.1), appended to gzipped WARC files that standard replay tools can
+// read. Each WARC file gets a CDX index file next to it, with the suffix
+// `.cdx`. Archiving may go along with mirroring to the root, or replace it.
+type Warc struct {
+	// Directory to write WARC files to. It must be outside of the root.
+	Dir string `json:"dir,omitempty"`
+
+	// Size in bytes after which a new WARC file is started. Default is
+	// 1GB.
+	MaxSize uint64 `json:"max_size,omitempty"`
+
+	// Also write a request record for each response.
+	Requests bool `json:"requests,omitempty"`
+
+	// Only archive responses, without mirroring them to the root.
+	Only bool `json:"only,omitempty"`
+}
+
+const (
+	defaultWarcMaxSize = 1 << 30
+
+	warcSuffix      = ".warc.gz"
+	warcIndexSuffix = ".cdx"
+
+	// warcIndexHeader is the first line of CDX index files, naming their
+	// fields: massaged URL, date, original URL, media type, status,
+	// payload digest, redirect, meta tags, compressed record length,
+	// offset and WARC file name
+	warcIndexHeader = " CDX N b a m s k r M S V g\n"
+)
+
+func (wc *Warc) maxSize() int64 {
+	if wc.MaxSize > 0 {
+		return int64(wc.MaxSize)
+	}
+	return defaultWarcMaxSize
+}
+
+// warcField is a named field of a WARC record header
+type warcField struct {
+	name  string
+	value string
+}
+
+// warcRecord is a WARC record, with its block read from block
+type warcRecord struct {
+	fields []warcField
+	block  io.Reader
+	length int64
+}
+
+// warcExchange is the records of a mirrored response to append, the
+// response record first, with what goes into the CDX index for it
+type warcExchange struct {
+	records     []warcRecord
+	url         string
+	date        time.Time
+	contentType string
+	digest      string
+}
+
+// warcWriter appends exchanges to the current WARC file, starting a new one
+// once it has reached its maximum size
+type warcWriter struct {
+	config *Warc
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	name  string
+	file  *os.File
+	index *os.File
+	size  int64
+}
+
+func newWarcWriter(config *Warc, logger *zap.Logger) *warcWriter {
+	return &warcWriter{config: config, logger: logger}
+}
+
+// write appends the records of ex to the current WARC file, and indexes
+// its response. It returns the name of the WARC file.
+func (ww *warcWriter) write(ex warcExchange) (string, error) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.file == nil || ww.size >= ww.config.maxSize() {
+		if err := ww.rotate(); err != nil {
+			return "", err
+		}
+	}
+	offset := ww.size
+	var responseOffset, responseLength int64
+	for i, record := range ex.records {
+		start := ww.size
+		if err := ww.writeRecord(record); err != nil {
+			// Don't leave a partial exchange behind, the next one is
+			// written in its place
+			ww.size = offset
+			if _, seekErr := ww.file.Seek(offset, io.SeekStart); seekErr != nil {
+				ww.logger.Error("failed to seek WARC file after failed write",
+					zap.String("warc", ww.name),
+					zap.Error(seekErr))
+				// The next exchange starts a new file
+				ww.size = ww.config.maxSize()
+			} else if truncErr := ww.file.Truncate(offset); truncErr != nil {
+				ww.logger.Error("failed to truncate WARC file after failed write",
+					zap.String("warc", ww.name),
+					zap.Error(truncErr))
+			}
+			return ww.name, err
+		}
+		if i == 0 {
+			responseOffset, responseLength = start, ww.size-start
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(ex.contentType)
+	line := strings.Join([]string{
+		surt(ex.url),
+		ex.date.UTC().Format("20060102150405"),
+		ex.url,
+		orDash(mediaType),
+		strconv.Itoa(http.StatusOK),
+		orDash(ex.digest),
+		"-",
+		"-",
+		strconv.FormatInt(responseLength, 10),
+		strconv.FormatInt(responseOffset, 10),
+		ww.name,
+	}, " ")
+	if _, err := io.WriteString(ww.index, line+"\n"); err != nil {
+		return ww.name, fmt.Errorf("writing CDX index: %w", err)
+	}
+	return ww.name, nil
+}
+
+// writeRecord appends record to the WARC file as a gzip member of its own
+func (ww *warcWriter) writeRecord(record warcRecord) error {
+	cw := &countingWriter{w: ww.file}
+	zw := gzip.NewWriter(cw)
+	var head bytes.Buffer
+	head.WriteString("WARC/1.1\r\n")
+	for _, field := range record.fields {
+		fmt.Fprintf(&head, "%s: %s\r\n", field.name, field.value)
+	}
+	fmt.Fprintf(&head, "Content-Length: %d\r\n\r\n", record.length)
+	if _, err := zw.Write(head.Bytes()); err != nil {
+		return err
+	}
+	n, err := io.Copy(zw, record.block)
+	if err != nil {
+		return err
+	}
+	if n != record.length {
+		return fmt.Errorf("WARC record block is %d bytes instead of %d", n, record.length)
+	}
+	if _, err := io.WriteString(zw, "\r\n\r\n"); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	ww.size += cw.n
+	return nil
+}
+
+// rotate closes the current WARC file, if any, and starts a new one with a
+// warcinfo record
+func (ww *warcWriter) rotate() error {
+	if err := ww.close(); err != nil {
+		ww.logger.Error("failed to close WARC file", zap.Error(err))
+	}
+	var random [4]byte
+	rand.Read(random[:])
+	name := "mirror-" + time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(random[:]) + warcSuffix
+	if err := os.MkdirAll(ww.config.Dir, mkdirPerms); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(ww.config.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerms)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(filepath.Join(ww.config.Dir, name+warcIndexSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerms)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	ww.name, ww.file, ww.index, ww.size = name, file, index, 0
+	if _, err := io.WriteString(index, warcIndexHeader); err != nil {
+		return err
+	}
+	info := []byte("software: caddy-mirror\r\nformat: WARC File Format 1.1\r\n")
+	return ww.writeRecord(warcRecord{
+		fields: []warcField{
+			{"WARC-Type", "warcinfo"},
+			{"WARC-Record-ID", newWarcRecordID()},
+			{"WARC-Date", warcDate(time.Now())},
+			{"WARC-Filename", name},
+			{"Content-Type", "application/warc-fields"},
+		},
+		block:  bytes.NewReader(info),
+		length: int64(len(info)),
+	})
+}
+
+// close closes the current WARC file and its index
+func (ww *warcWriter) close() error {
+	if ww.file == nil {
+		return nil
+	}
+	err := ww.file.Close()
+	if indexErr := ww.index.Close(); err == nil {
+		err = indexErr
+	}
+	ww.file, ww.index = nil, nil
+	return err
+}
+
+// Close closes the current WARC file, the next exchange starts a new one
+func (ww *warcWriter) Close() error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	return ww.close()
+}
+
+// startWarc records the HTTP header of the response, the start of the
+// block of its WARC record, which is hashed along with the body
+func (rww *responseWriterWrapper) startWarc() {
+	if rww.config.warc == nil {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", http.StatusOK, http.StatusText(http.StatusOK))
+	header := rww.Header().Clone()
+	// The body is stored decoded from the transfer coding
+	header.Del("Transfer-Encoding")
+	header.Del("Trailer")
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	rww.warcHeader = buf.Bytes()
+	rww.warcHash = sha256.New()
+	rww.warcHash.Write(rww.warcHeader)
+}
+
+// warcRequest returns the HTTP request of r as it goes into a WARC request
+// record, without cookie and authentication headers
+func warcRequest(r *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.Host)
+	r.Header.WriteSubset(&buf, privateHeaders)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// archive appends the response, and the request with the requests option,
+// to the current WARC file. sum is the hex encoded sha256 of the body, if
+// known.
+func (rww *responseWriterWrapper) archive(sum string) {
+	responseID := newWarcRecordID()
+	date := warcDate(rww.start)
+	response := warcRecord{
+		fields: []warcField{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", rww.url},
+			{"Content-Type", "application/http;msgtype=response"},
+			{"WARC-Block-Digest", warcDigest(rww.warcHash.Sum(nil))},
+		},
+		block: io.MultiReader(
+			bytes.NewReader(rww.warcHeader),
+			io.NewSectionReader(rww.file.File, 0, rww.bytesWritten)),
+		length: int64(len(rww.warcHeader)) + rww.bytesWritten,
+	}
+	var digest string
+	if raw, err := hex.DecodeString(sum); err == nil && sum != "" {
+		digest = warcDigest(raw)
+		response.fields = append(response.fields, warcField{"WARC-Payload-Digest", digest})
+	}
+	records := []warcRecord{response}
+	if rww.warcRequest != nil {
+		requestDigest := sha256.Sum256(rww.warcRequest)
+		records = append(records, warcRecord{
+			fields: []warcField{
+				{"WARC-Type", "request"},
+				{"WARC-Record-ID", newWarcRecordID()},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", rww.url},
+				{"WARC-Concurrent-To", responseID},
+				{"Content-Type", "application/http;msgtype=request"},
+				{"WARC-Block-Digest", warcDigest(requestDigest[:])},
+			},
+			block:  bytes.NewReader(rww.warcRequest),
+			length: int64(len(rww.warcRequest)),
+		})
+	}
+	name, err := rww.config.warc.write(warcExchange{
+		records:     records,
+		url:         rww.url,
+		date:        rww.start,
+		contentType: rww.Header().Get("Content-Type"),
+		digest:      digest,
+	})
+	if err != nil {
+		rww.logger.Error("failed to write WARC records",
+			zap.String("warc", name),
+			zap.Error(err))
+		rww.config.stats.failures.Add(1)
+		rww.spanFailure("failed to write WARC records", err)
+		return
+	}
+	rww.config.stats.warcRecords.Add(int64(len(records)))
+	rww.config.trace(rww.logger, "archived response", zap.String("warc", name))
+}
+
+// newWarcRecordID returns a new random WARC record ID
+func newWarcRecordID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	// Version 4, variant 1 UUID
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	h := hex.EncodeToString(u[:])
+	return "<urn:uuid:" + h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:] + ">"
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// warcDigest formats a sha256 digest as in WARC digest fields
+func warcDigest(sum []byte) string {
+	return "sha256:" + base32.StdEncoding.EncodeToString(sum)
+}
+
+// surt returns the Sort-friendly URI Reordering Transform of rawURL, as
+// used as the key of CDX indexes, e.g. `com,example)/path?a=1&b=2` for
+// `http://www.example.com/path?b=2&a=1`
+func surt(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	key := strings.Join(labels, ",")
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		key += ":" + port
+	}
+	key += ")" + strings.ToLower(u.EscapedPath())
+	if u.RawQuery != "" {
+		params := strings.Split(strings.ToLower(u.RawQuery), "&")
+		sort.Strings(params)
+		key += "?" + strings.Join(params, "&")
+	}
+	return key
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,240 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readWarcRecords reads the WARC records from r, checking their block digests
+func readWarcRecords(t *testing.T, r io.Reader) []textproto.MIMEHeader {
+	t.Helper()
+	br := bufio.NewReader(r)
+	var records []textproto.MIMEHeader
+	for {
+		version, err := br.ReadString('\n')
+		if err == io.EOF {
+			return records
+		}
+		if err != nil || version != "WARC/1.1\r\n" {
+			t.Fatalf("invalid WARC record version line %q, error: %v", version, err)
+		}
+		header, err := textproto.NewReader(br).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := make([]byte, length+4)
+		if _, err := io.ReadFull(br, block); err != nil || string(block[length:]) != "\r\n\r\n" {
+			t.Fatalf("invalid WARC record block, error: %v", err)
+		}
+		if digest := header.Get("WARC-Block-Digest"); digest != "" {
+			sum := sha256.Sum256(block[:length])
+			if digest != warcDigest(sum[:]) {
+				t.Errorf("block digest %s doesn't match block", digest)
+			}
+		}
+		header.Set("X-Test-Block", string(block[:length]))
+		records = append(records, header)
+	}
+}
+
+func TestWarc(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	mir := provisionTestMirror(t, &Mirror{Root: root, Warc: &Warc{Dir: dir, Requests: true}})
+	_, err := serveMirror(mir, "/dir/file.txt?v=1", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "dir", "file.txt")); err != nil || string(content) != "content" {
+		t.Errorf("file not mirrored along with archiving: %q, error: %v", content, err)
+	}
+	if err := mir.warc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	warcs, _ := filepath.Glob(filepath.Join(dir, "*"+warcSuffix))
+	if len(warcs) != 1 {
+		t.Fatalf("expected 1 WARC file, got %v", warcs)
+	}
+	file, err := os.Open(warcs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readWarcRecords(t, zr)
+	if len(records) != 3 {
+		t.Fatalf("expected warcinfo, response and request records, got %d records", len(records))
+	}
+	for i, expected := range []string{"warcinfo", "response", "request"} {
+		if warcType := records[i].Get("WARC-Type"); warcType != expected {
+			t.Errorf("expected record %d of type %s, got %s", i, expected, warcType)
+		}
+	}
+	response, request := records[1], records[2]
+	for _, record := range []textproto.MIMEHeader{response, request} {
+		if uri := record.Get("WARC-Target-URI"); uri != "http://example.com/dir/file.txt?v=1" {
+			t.Errorf("unexpected WARC-Target-URI %q", uri)
+		}
+	}
+	sum := sha256.Sum256([]byte("content"))
+	if digest := response.Get("WARC-Payload-Digest"); digest != warcDigest(sum[:]) {
+		t.Errorf("expected payload digest %s, got %s", warcDigest(sum[:]), digest)
+	}
+	if block := response.Get("X-Test-Block"); !strings.HasPrefix(block, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(block, "\r\n\r\ncontent") {
+		t.Errorf("unexpected response block %q", block)
+	}
+	if request.Get("WARC-Concurrent-To") != response.Get("WARC-Record-ID") {
+		t.Errorf("request record not linked to response record")
+	}
+	if block := request.Get("X-Test-Block"); !strings.HasPrefix(block, "GET /dir/file.txt?v=1 HTTP/1.1\r\nHost: example.com\r\n") {
+		t.Errorf("unexpected request block %q", block)
+	}
+
+	index, err := os.ReadFile(warcs[0] + warcIndexSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n")
+	if len(lines) != 2 || lines[0]+"\n" != warcIndexHeader {
+		t.Fatalf("unexpected CDX index %q", index)
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 11 || fields[0] != "com,example)/dir/file.txt?v=1" || fields[3] != "text/plain" || fields[10] != filepath.Base(warcs[0]) {
+		t.Fatalf("unexpected CDX line %q", lines[1])
+	}
+	// The offset and length in the index point at the response record
+	length, _ := strconv.ParseInt(fields[8], 10, 64)
+	offset, _ := strconv.ParseInt(fields[9], 10, 64)
+	zr, err = gzip.NewReader(io.NewSectionReader(file, offset, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr.Multistream(false)
+	if indexed := readWarcRecords(t, zr); len(indexed) != 1 || indexed[0].Get("WARC-Record-ID") != response.Get("WARC-Record-ID") {
+		t.Errorf("CDX index doesn't point at the response record")
+	}
+}
+
+func TestWarcFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	ww := newWarcWriter(&Warc{Dir: dir}, zap.NewNop())
+	defer ww.Close()
+	exchange := func(url string, block io.Reader, length int64) warcExchange {
+		return warcExchange{
+			records: []warcRecord{{
+				fields: []warcField{{"WARC-Type", "response"}, {"WARC-Record-ID", newWarcRecordID()}},
+				block:  block,
+				length: length,
+			}},
+			url:  url,
+			date: time.Now(),
+		}
+	}
+	// Enough for gzip to write some of the failed record out
+	failing := io.MultiReader(io.LimitReader(rand.Reader, 1<<20), iotest.ErrReader(errors.New("boom")))
+	if _, err := ww.write(exchange("http://example.com/failed", failing, 2<<20)); err == nil {
+		t.Fatal("expected failed block to fail the write")
+	}
+	name, err := ww.write(exchange("http://example.com/ok", strings.NewReader("content"), 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(filepath.Join(dir, name+warcIndexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected CDX index %q", index)
+	}
+	fields := strings.Fields(lines[1])
+	length, _ := strconv.ParseInt(fields[8], 10, 64)
+	offset, _ := strconv.ParseInt(fields[9], 10, 64)
+	if offset+length != int64(len(data)) {
+		t.Fatalf("expected the record at %d+%d to end the %d bytes WARC file", offset, length, len(data))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data[offset:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readWarcRecords(t, zr); len(records) != 1 || records[0].Get("X-Test-Block") != "content" {
+		t.Errorf("CDX index doesn't point at the record written after the failed one")
+	}
+}
+
+func TestWarcOnly(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	// Every response goes to a new WARC file
+	mir := provisionTestMirror(t, &Mirror{Root: root, Warc: &Warc{Dir: dir, Only: true, MaxSize: 1}})
+	for _, name := range []string{"/one.txt", "/two.txt"} {
+		_, err := serveMirror(mir, name, func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(root, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s mirrored to the root with only, stat error: %v", name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("expected nothing left in the root, got %d entries", len(entries))
+	}
+	warcs, _ := filepath.Glob(filepath.Join(dir, "*"+warcSuffix))
+	if len(warcs) != 2 {
+		t.Errorf("expected 2 WARC files, got %v", warcs)
+	}
+}
+
+func TestSurt(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"http://www.Example.com/Path?b=2&a=1", "com,example)/path?a=1&b=2"},
+		{"https://sub.example.org:8443/", "org,example,sub:8443)/"},
+		{"https://example.org:443/file", "org,example)/file"},
+	}
+	for _, test := range testCases {
+		if key := surt(test.url); key != test.expected {
+			t.Errorf("expected SURT of %s to be %s, got %s", test.url, test.expected, key)
+		}
+	}
+}
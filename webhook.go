@@ -0,0 +1,121 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"io"
+	"net/http"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(WebhookSink{})
+}
+
+// WebhookSink posts a JSON description of each finalized file to a URL
+type WebhookSink struct {
+	// URL to post to.
+	URL string `json:"url,omitempty"`
+
+	// Additional request headers.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Timeout for each request. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+}
+
+const defaultWebhookTimeout = caddy.Duration(10 * time.Second)
+
+func (WebhookSink) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirror.sinks.webhook",
+		New: func() caddy.Module { return new(WebhookSink) },
+	}
+}
+
+// Provision sets up the webhook sink
+func (ws *WebhookSink) Provision(ctx caddy.Context) error {
+	if ws.Timeout == 0 {
+		ws.Timeout = defaultWebhookTimeout
+	}
+	ws.client = &http.Client{Timeout: time.Duration(ws.Timeout)}
+	return nil
+}
+
+// Finalized posts info to the URL. Responses other than 2xx are errors.
+func (ws *WebhookSink) Finalized(ctx context.Context, info FileInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range ws.Headers {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile parses the webhook sink with this syntax:
+//
+//	sink webhook <url> {
+//	    header  <name> <value>
+//	    timeout <duration>
+//	}
+func (ws *WebhookSink) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume sink name
+	if !d.Args(&ws.URL) || d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "header":
+			var name, value string
+			if !d.Args(&name, &value) {
+				return d.ArgErr()
+			}
+			if ws.Headers == nil {
+				ws.Headers = make(http.Header)
+			}
+			ws.Headers.Add(name, value)
+		case "timeout":
+			var val string
+			if !d.Args(&val) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return d.Errf("parsing webhook timeout: %v", err)
+			}
+			ws.Timeout = caddy.Duration(dur)
+		default:
+			return d.Errf("unknown webhook subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ Sink                  = (*WebhookSink)(nil)
+	_ caddy.Provisioner     = (*WebhookSink)(nil)
+	_ caddyfile.Unmarshaler = (*WebhookSink)(nil)
+)
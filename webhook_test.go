@@ -0,0 +1,76 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var received FileInfo
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	info := FileInfo{Path: "/root/file.txt", Size: 7, ETag: `"v1"`}
+	testCases := []struct {
+		name  string
+		token string
+		fails bool
+	}{
+		{name: "accepted", token: "secret"},
+		{name: "rejected", token: "wrong", fails: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			received = FileInfo{}
+			ws := &WebhookSink{URL: server.URL, Headers: http.Header{"X-Token": {test.token}}}
+			if err := ws.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			err := ws.Finalized(ctx, info)
+			if test.fails {
+				if err == nil {
+					t.Error("expected error for rejected webhook")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if received.Path != info.Path || received.Size != info.Size || received.ETag != info.ETag {
+				t.Errorf("expected %+v to be posted, got %+v", info, received)
+			}
+		})
+	}
+}
+
+func TestUnmarshalWebhookSink(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror {
+		sink webhook http://localhost/hook {
+			header X-Token secret
+			timeout 5s
+		}
+	}`)
+	mir := new(Mirror)
+	if err := mir.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"headers":{"X-Token":["secret"]},"sink":"webhook","timeout":5000000000,"url":"http://localhost/hook"}`
+	if len(mir.SinksRaw) != 1 || string(mir.SinksRaw[0]) != expected {
+		t.Errorf("expected sink %s, got %s", expected, mir.SinksRaw)
+	}
+}
@@ -0,0 +1,166 @@
+package mirror
+
+import (
+	"errors"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultXattrFailures = 10
+
+// xattrRoot is the state of setting xattrs on the files of a single root
+type xattrRoot struct {
+	Root                string    `json:"root"`
+	Degraded            bool      `json:"degraded"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	DegradedSince       time.Time `json:"degraded_since,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// xattrHealth tracks failures to set metadata xattrs per root. Once a root
+// had too many consecutive failures, it is degraded: its metadata goes to
+// sidecar files if metadata_file_suffix is set, or else isn't stored, until
+// the handler is reloaded.
+type xattrHealth struct {
+	failures int
+	logger   *zap.Logger
+	stats    *stats
+
+	mu    sync.Mutex
+	roots map[string]*xattrRoot
+}
+
+func newXattrHealth(failures int, logger *zap.Logger, stats *stats) *xattrHealth {
+	if failures <= 0 {
+		failures = defaultXattrFailures
+	}
+	return &xattrHealth{
+		failures: failures,
+		logger:   logger,
+		stats:    stats,
+		roots:    make(map[string]*xattrRoot),
+	}
+}
+
+// enabled reports whether metadata xattrs are set on files in root
+func (xh *xattrHealth) enabled(root string) bool {
+	if xh == nil {
+		return true
+	}
+	xh.mu.Lock()
+	defer xh.mu.Unlock()
+	r, ok := xh.roots[root]
+	return !ok || !r.Degraded
+}
+
+// record records the outcome of setting a metadata xattr on a file in root,
+// degrading the root after too many consecutive failures
+func (xh *xattrHealth) record(root string, err error, sidecar bool) {
+	if xh == nil {
+		return
+	}
+	xh.mu.Lock()
+	defer xh.mu.Unlock()
+	r, ok := xh.roots[root]
+	if !ok {
+		if err == nil {
+			return
+		}
+		r = &xattrRoot{Root: root}
+		xh.roots[root] = r
+	}
+	if err == nil {
+		r.ConsecutiveFailures = 0
+		return
+	}
+	r.ConsecutiveFailures++
+	r.LastError = err.Error()
+	if r.Degraded || r.ConsecutiveFailures < xh.failures {
+		return
+	}
+	r.Degraded = true
+	r.DegradedSince = time.Now()
+	xh.stats.xattrDegradedRoots.Add(1)
+	if sidecar {
+		xh.logger.Warn("setting xattrs keeps failing, writing metadata to sidecar files instead",
+			zap.String("root", root),
+			zap.Int("consecutive_failures", r.ConsecutiveFailures),
+			zap.Error(err))
+	} else {
+		xh.logger.Warn("setting xattrs keeps failing, no longer storing metadata such as ETags and digests",
+			zap.String("root", root),
+			zap.Int("consecutive_failures", r.ConsecutiveFailures),
+			zap.Error(err))
+	}
+}
+
+// degraded returns the roots metadata xattrs are no longer set on
+func (xh *xattrHealth) degraded() []xattrRoot {
+	xh.mu.Lock()
+	defer xh.mu.Unlock()
+	var degraded []xattrRoot
+	for _, r := range xh.roots {
+		if r.Degraded {
+			degraded = append(degraded, *r)
+		}
+	}
+	return degraded
+}
+
+// Stop stops counting the degraded roots, as the state is lost with the
+// handler
+func (xh *xattrHealth) Stop() {
+	xh.mu.Lock()
+	defer xh.mu.Unlock()
+	for _, r := range xh.roots {
+		if r.Degraded {
+			xh.stats.xattrDegradedRoots.Add(-1)
+		}
+	}
+}
+
+// xattrErrorClasses are the classes of errors setting xattrs is counted by
+var xattrErrorClasses = []string{"no_space", "too_large", "not_supported", "permission", "io", "other"}
+
+// xattrErrorClass returns the class of the error setting an xattr failed
+// with, for the xattr_failures_<class> stats
+func xattrErrorClass(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return "no_space"
+	case errors.Is(err, syscall.E2BIG), errors.Is(err, syscall.ERANGE):
+		return "too_large"
+	case errors.Is(err, syscall.ENOTSUP), errors.Is(err, syscall.EOPNOTSUPP):
+		return "not_supported"
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return "permission"
+	case errors.Is(err, syscall.EIO):
+		return "io"
+	default:
+		return "other"
+	}
+}
+
+// countXattrFailure counts a failure to set an xattr by its class
+func (mir *Mirror) countXattrFailure(err error) {
+	mir.stats.xattrFailures[xattrErrorClass(err)].Add(1)
+}
+
+// useXattr reports whether metadata is set as xattrs of the mirrored file
+func (rww *responseWriterWrapper) useXattr() bool {
+	return rww.config.UseXattr && rww.config.xattrHealth.enabled(rww.root)
+}
+
+// setMetadataXattr sets the metadata xattr name of the pending file,
+// counting failures against the root
+func (rww *responseWriterWrapper) setMetadataXattr(name string, value string) error {
+	err := xattr.FSet(rww.file.File, name, []byte(value))
+	if err != nil {
+		rww.config.countXattrFailure(err)
+	}
+	rww.config.xattrHealth.record(rww.root, err, rww.config.MetadataFileSuffix != "")
+	return err
+}
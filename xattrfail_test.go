@@ -0,0 +1,87 @@
+package mirror
+
+import (
+	"encoding/json"
+	"github.com/pkg/xattr"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXattrFailures(t *testing.T) {
+	root := t.TempDir()
+	probe := filepath.Join(root, "probe")
+	if err := os.WriteFile(probe, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.Set(probe, "user.probe", []byte("1")); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	os.Remove(probe)
+	mir := provisionTestMirror(t, &Mirror{
+		Root:               root,
+		Name:               "xattr_failures_test",
+		UseXattr:           true,
+		MetadataFileSuffix: ".meta",
+		// Larger than any filesystem takes, so that setting the ETag fails
+		MaxXattrSize:  1 << 20,
+		XattrFailures: 1,
+	})
+	tooLarge := mir.stats.xattrFailures["too_large"]
+	failuresBefore, degradedBefore := tooLarge.Value(), mir.stats.xattrDegradedRoots.Value()
+
+	serve := func(urlp string, etag string) {
+		_, err := serveMirror(mir, urlp, func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	serve("/huge.txt", `"`+strings.Repeat("e", 100<<10)+`"`)
+	if failures := tooLarge.Value() - failuresBefore; failures < 1 {
+		t.Errorf("expected too_large xattr failures counted, got %d", failures)
+	}
+	if degraded := mir.stats.xattrDegradedRoots.Value() - degradedBefore; degraded != 1 {
+		t.Errorf("expected 1 degraded root, got %d", degraded)
+	}
+
+	// Metadata of the degraded root goes to the sidecar file
+	serve("/file.txt", `"v1"`)
+	filename := filepath.Join(root, "file.txt")
+	if _, err := xattr.Get(filename, xattrEtag); err == nil {
+		t.Error("ETag xattr set on degraded root")
+	}
+	data, err := os.ReadFile(filename + ".meta")
+	if err != nil {
+		t.Fatalf("metadata sidecar not written: %v", err)
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta[xattrEtag] != `"v1"` || meta[xattrOriginURL] == "" {
+		t.Errorf("expected ETag and origin URL in sidecar, got %v", meta)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleHealth(rec, httptest.NewRequest(http.MethodGet, "/mirror/health", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var response []handlerHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	for _, handler := range response {
+		if handler.Name == "xattr_failures_test" && len(handler.XattrDegraded) == 1 && handler.XattrDegraded[0].Root == root {
+			return
+		}
+	}
+	t.Errorf("degraded root not reported: %+v", response)
+}